@@ -42,6 +42,7 @@ func main() {
 		expiry       = flag.Duration("expiry", 24*time.Hour, "Token expiry duration (e.g., 1h, 24h, 7d)")
 		accessSecret = flag.String("secret", "", "Access secret for signing tokens (overrides ACCESS_SECRET env var)")
 		realm        = flag.String("realm", "", "Authentication realm (overrides REALM env var)")
+		issuer       = flag.String("issuer", "", "Token issuer (iss claim), must match EXPECTED_ISSUER when the server checks it")
 	)
 
 	flag.Usage = func() {
@@ -116,6 +117,7 @@ func main() {
 		Type:       *tokenType,
 		Realm:      config.Realm,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    *issuer,
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(*expiry)),
 		},
@@ -143,6 +145,9 @@ func main() {
 	fmt.Printf("  Role:        %s\n", claims.Role)
 	fmt.Printf("  Type:         %s\n", claims.Type)
 	fmt.Printf("  Realm:        %s\n", claims.Realm)
+	if claims.Issuer != "" {
+		fmt.Printf("  Issuer:       %s\n", claims.Issuer)
+	}
 	fmt.Printf("  Issued At:    %s\n", claims.IssuedAt.Time.Format(time.RFC3339))
 	fmt.Printf("  Expires At:   %s\n", claims.ExpiresAt.Time.Format(time.RFC3339))
 	fmt.Println()
@@ -0,0 +1,1231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pion/dtls/v3"
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v4"
+	"golang.org/x/net/websocket"
+)
+
+// Integration test for the full server: builds Saturn, boots it on ephemeral ports,
+// connects two pion clients, allocates a relay for each, sends data between the two
+// relays and verifies delivery and the metric increments.
+// Run it from the repository root: go run ./scripts/test-integration
+
+const (
+	realm          = "integration"
+	issuer         = "saturn-turn-server"
+	requiredRole   = "relay"
+	startupTimeout = 15 * time.Second
+	readTimeout    = 5 * time.Second
+
+	// maxAllocationLifetime is the MAX_ALLOCATION_LIFETIME of the guarded server
+	maxAllocationLifetime = 20 * time.Minute
+
+	// dtlsServerName is the name in the certificate of the DTLS listener
+	dtlsServerName = "saturn.test"
+
+	// allowAllDenyList is a deny list that matches no local address
+	allowAllDenyList = "# Documentation range only\n192.0.2.0/24\n"
+)
+
+// server is a Saturn process started for the test
+type server struct {
+	cmd         *exec.Cmd
+	dir         string
+	binary      string
+	port        int
+	addr        string
+	metricsAddr string
+	metricsAuth string       // Authorization header for the metrics endpoints, empty without METRICS_AUTH
+	httpClient  *http.Client // Client of the metrics endpoints, presenting the client certificate with mTLS
+	metricsTLS  bool         // Whether the metrics endpoints are served over HTTPS
+	settings    []string     // KEY=VALUE environment variables the server was started with
+	secret      string
+	logFile     string
+}
+
+// webhookSink is a webhook that answers 503 to its first deliveries and signals
+// the first one it accepts
+type webhookSink struct {
+	*http.Server
+	URL       string
+	failures  int
+	delivered chan struct{}
+	body      []byte // Body of the first accepted delivery, set before delivered is closed
+}
+
+// newWebhookSink starts a webhook sink that fails the given number of deliveries
+func newWebhookSink(failures int) (*webhookSink, error) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	sink := &webhookSink{
+		URL:       "http://" + listener.Addr().String(),
+		failures:  failures,
+		delivered: make(chan struct{}),
+	}
+	var requests atomic.Int32
+	var once sync.Once
+	sink.Server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(requests.Add(1)) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		once.Do(func() {
+			sink.body, _ = io.ReadAll(r.Body)
+			close(sink.delivered)
+		})
+	})}
+	go func() { _ = sink.Serve(listener) }()
+	return sink, nil
+}
+
+// freeUDPPort returns a UDP port that is currently unused
+func freeUDPPort() (int, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// freeTCPPort returns a TCP port that is currently unused
+func freeTCPPort() (int, error) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// startServer builds the server binary and starts it on ephemeral ports
+func startServer() (*server, error) {
+	dir, err := os.MkdirTemp("", "saturn-integration")
+	if err != nil {
+		return nil, err
+	}
+
+	binary := filepath.Join(dir, "saturn")
+	build := exec.Command("go", "build", "-o", binary, "./src")
+	build.Stdout = os.Stdout
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		return nil, fmt.Errorf("failed to build server: %w", err)
+	}
+
+	port, err := freeUDPPort()
+	if err != nil {
+		return nil, err
+	}
+
+	secretBytes := make([]byte, 16)
+	_, _ = rand.Read(secretBytes)
+	secret := hex.EncodeToString(secretBytes)
+
+	// Nothing the test connects from is denied until the test rewrites the file
+	if err := os.WriteFile(filepath.Join(dir, "deny.txt"), []byte(allowAllDenyList), 0o600); err != nil {
+		return nil, err
+	}
+
+	return launch(dir, binary, port, secret, "saturn.log")
+}
+
+// successor starts another server process on the same port, sharing the directory
+// and the handoff socket, as a supervisor does for a zero-downtime restart
+func (s *server) successor() (*server, error) {
+	return launch(s.dir, s.binary, s.port, s.secret, "saturn-successor.log",
+		"STARTUP_READY_FILE="+filepath.Join(s.dir, "saturn.ready"))
+}
+
+// readyFilePID returns the PID written to the startup ready file of the successor
+func (s *server) readyFilePID() (int, error) {
+	contents, err := os.ReadFile(filepath.Join(s.dir, "saturn.ready"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(contents)))
+}
+
+// launch starts the server binary on port with a fresh metrics port,
+// env overrides settings of the test configuration
+func launch(dir, binary string, port int, secret, logFile string, env ...string) (*server, error) {
+	metricsPort, err := freeTCPPort()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(binary)
+	// Run from the temp directory so a local .env does not leak into the test
+	cmd.Dir = dir
+	settings := []string{
+		"ENV_FILE=",
+		"PUBLIC_IP=127.0.0.1",
+		"BIND_ADDRESS=127.0.0.1",
+		"BIND_ADDRESSES=",
+		"ADVERTISED_IP=",
+		"RELAY_PUBLIC_IP=127.0.0.1",
+		"RELAY_BIND_ADDRESS=127.0.0.1",
+		"PORT=" + strconv.Itoa(port),
+		"REALM=" + realm,
+		"ACCESS_SECRET=" + secret,
+		"TOKEN_ALGORITHMS=HS256",
+		"EXPECTED_ISSUER=" + realm + "=" + issuer,
+		"MAX_ALLOCATIONS_PER_USER=1",
+		"REQUIRED_ROLE=" + requiredRole,
+		"REALM_CASE_INSENSITIVE=true",
+		"REDIS_URL=",
+		"THREAD_NUM=1",
+		"MODE=turn",
+		"LOG_LEVEL=warn",
+		"LOG_FORMAT=json",
+		"LOG_OUTPUT=file:" + filepath.Join(dir, logFile),
+		"ENABLE_METRICS=true",
+		"METRICS_PORT=" + strconv.Itoa(metricsPort),
+		"METRICS_BIND_IP=127.0.0.1",
+		"METRICS_AUTH=none",
+		"METRICS_IP_ALLOWLIST=",
+		"TRACK_PER_USER_TRAFFIC=true",
+		"ENABLE_TURN_CREDENTIALS=true",
+		"TURN_CREDENTIALS_TTL=600",
+		"TURN_CREDENTIALS_URIS=",
+		"TURN_CREDENTIALS_RATE_LIMIT=5",
+		"EVENT_SOCKET_PATH=" + filepath.Join(dir, "events.sock"),
+		"DENY_CIDRS_FILE=" + filepath.Join(dir, "deny.txt"),
+		"HANDOFF_SOCKET_PATH=" + filepath.Join(dir, "handoff.sock"),
+		"WEBHOOK_URL=",
+		"TRAFFIC_STATE_PATH=",
+	}
+	settings = append(settings, env...)
+	cmd.Env = append(os.Environ(), settings...)
+	var metricsAuth, metricsUsername, metricsPassword string
+	for _, setting := range env {
+		if token, ok := strings.CutPrefix(setting, "METRICS_BEARER_TOKEN="); ok {
+			metricsAuth = "Bearer " + token
+		}
+		if username, ok := strings.CutPrefix(setting, "METRICS_USERNAME="); ok {
+			metricsUsername = username
+		}
+		if password, ok := strings.CutPrefix(setting, "METRICS_PASSWORD="); ok {
+			metricsPassword = password
+		}
+	}
+	if metricsUsername != "" {
+		metricsAuth = basicAuthorization(metricsUsername, metricsPassword)
+	}
+	metricsClient, metricsTLS, err := metricsClientFor(env)
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start server: %w", err)
+	}
+
+	s := &server{
+		cmd:         cmd,
+		dir:         dir,
+		binary:      binary,
+		port:        port,
+		addr:        net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		metricsAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(metricsPort)),
+		metricsAuth: metricsAuth,
+		httpClient:  metricsClient,
+		metricsTLS:  metricsTLS,
+		settings:    settings,
+		secret:      secret,
+		logFile:     logFile,
+	}
+
+	// The metrics endpoint comes up before the TURN listeners, so wait for both
+	deadline := time.Now().Add(startupTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := s.metrics(); err == nil && (s.answersBinding() || s.answersAuthenticatedBinding("probe")) {
+			return s, nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	s.stop()
+	return nil, fmt.Errorf("server did not start within %s", startupTimeout)
+}
+
+// answersBinding reports whether the server answers a STUN binding request
+func (s *server) answersBinding() bool {
+	return s.bind("") == nil
+}
+
+// answersAuthenticatedBinding reports whether the server answers a STUN binding
+// request authenticated with a token of the user, as STUN_REQUIRE_AUTH requires
+func (s *server) answersAuthenticatedBinding(userID string) bool {
+	return s.bind(userID) == nil
+}
+
+// bind sends a binding request, authenticated with a token of the user unless the
+// user is empty
+func (s *server) bind(userID string) error {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: s.addr,
+		Conn:           conn,
+		RTO:            200 * time.Millisecond,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		return err
+	}
+	if userID == "" {
+		_, err = client.SendBindingRequest()
+		return err
+	}
+
+	token, err := generateToken(s.secret, userID, nil)
+	if err != nil {
+		return err
+	}
+	request, err := stun.Build(
+		stun.TransactionID,
+		stun.BindingRequest,
+		stun.NewUsername(token),
+		stun.NewRealm(realm),
+		stun.NewLongTermIntegrity(token, realm, userID),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	to, err := net.ResolveUDPAddr("udp4", s.addr)
+	if err != nil {
+		return err
+	}
+	_, err = client.PerformTransaction(request, to, false)
+	return err
+}
+
+// metrics fetches the Prometheus exposition from the server
+func (s *server) metrics() (string, error) {
+	resp, err := s.metricsGet("/metrics")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected metrics status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// allocateLifetime allocates a relay for the user asking for a lifetime with raw
+// STUN requests, since the pion client does not request one, and returns the
+// lifetime granted. The allocation is deleted again before returning.
+func (s *server) allocateLifetime(userID string, lifetime time.Duration) (time.Duration, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: s.addr,
+		Conn:           conn,
+		RTO:            200 * time.Millisecond,
+	})
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		return 0, err
+	}
+	to, err := net.ResolveUDPAddr("udp4", s.addr)
+	if err != nil {
+		return 0, err
+	}
+	token, err := generateToken(s.secret, userID, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	requestedTransport := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}
+	lifetimeAttribute := func(lifetime time.Duration) stun.RawAttribute {
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+		return stun.RawAttribute{Type: stun.AttrLifetime, Value: value}
+	}
+
+	// The first ALLOCATE is answered with a 401 carrying the nonce
+	request, err := stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		requestedTransport, stun.Fingerprint)
+	if err != nil {
+		return 0, err
+	}
+	result, err := client.PerformTransaction(request, to, false)
+	if err != nil {
+		return 0, err
+	}
+	var nonce stun.Nonce
+	if err := nonce.GetFrom(result.Msg); err != nil {
+		return 0, fmt.Errorf("no nonce in the response to the unauthenticated ALLOCATE: %w", err)
+	}
+
+	integrity := stun.NewLongTermIntegrity(token, realm, userID)
+	request, err = stun.Build(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		requestedTransport, lifetimeAttribute(lifetime), stun.NewUsername(token), stun.NewRealm(realm), nonce,
+		integrity, stun.Fingerprint)
+	if err != nil {
+		return 0, err
+	}
+	result, err = client.PerformTransaction(request, to, false)
+	if err != nil {
+		return 0, err
+	}
+	if result.Msg.Type.Class != stun.ClassSuccessResponse {
+		var code stun.ErrorCodeAttribute
+		_ = code.GetFrom(result.Msg)
+		return 0, fmt.Errorf("ALLOCATE failed: %s", code)
+	}
+	if err := integrity.Check(result.Msg); err != nil {
+		return 0, fmt.Errorf("ALLOCATE response failed the integrity check: %w", err)
+	}
+	granted, err := result.Msg.Get(stun.AttrLifetime)
+	if err != nil || len(granted) != 4 {
+		return 0, fmt.Errorf("no lifetime in the ALLOCATE response")
+	}
+
+	// A REFRESH with a zero lifetime deletes the allocation
+	request, err = stun.Build(stun.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassRequest),
+		lifetimeAttribute(0), stun.NewUsername(token), stun.NewRealm(realm), nonce, integrity, stun.Fingerprint)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := client.PerformTransaction(request, to, false); err != nil {
+		return 0, err
+	}
+	return time.Duration(binary.BigEndian.Uint32(granted)) * time.Second, nil
+}
+
+// metricsGet requests a path on the metrics port with the server's metrics credentials
+func (s *server) metricsGet(path string) (*http.Response, error) {
+	return s.metricsRequest(http.MethodGet, path, "")
+}
+
+// metricsRequest sends a request to the metrics port with the server's metrics credentials
+func (s *server) metricsRequest(method, path, body string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.metricsURL(path), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.metricsAuth != "" {
+		req.Header.Set("Authorization", s.metricsAuth)
+	}
+	return s.httpClient.Do(req)
+}
+
+// metricsURL returns the URL of a path on the metrics port
+func (s *server) metricsURL(path string) string {
+	if s.metricsTLS {
+		return "https://" + s.metricsAddr + path
+	}
+	return "http://" + s.metricsAddr + path
+}
+
+// metricsClientFor returns the client of the metrics endpoints of a server started
+// with env, trusting METRICS_TLS_CERT and presenting it as the client certificate
+// when METRICS_CLIENT_CA is set, since the test signs everything with one certificate
+func metricsClientFor(env []string) (*http.Client, bool, error) {
+	var certFile, keyFile string
+	mtls := false
+	for _, setting := range env {
+		if file, ok := strings.CutPrefix(setting, "METRICS_TLS_CERT="); ok {
+			certFile = file
+		}
+		if file, ok := strings.CutPrefix(setting, "METRICS_TLS_KEY="); ok {
+			keyFile = file
+		}
+		if file, ok := strings.CutPrefix(setting, "METRICS_CLIENT_CA="); ok {
+			mtls = file != ""
+		}
+	}
+	if certFile == "" {
+		return http.DefaultClient, false, nil
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, false, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certPEM) {
+		return nil, false, fmt.Errorf("%s contains no certificate", certFile)
+	}
+	tlsConfig := &tls.Config{RootCAs: roots, ServerName: dtlsServerName}
+	if mtls {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, false, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, true, nil
+}
+
+// effectiveSettings returns the effective settings reported by /admin/config
+func (s *server) effectiveSettings() (map[string]any, error) {
+	resp, err := s.metricsGet("/admin/config")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected admin config status %d", resp.StatusCode)
+	}
+	var config struct {
+		Settings map[string]any `json:"settings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, err
+	}
+	return config.Settings, nil
+}
+
+// configMatches checks that every setting the server was started with is reported
+// by /admin/config with the value it was given, i.e. reached the Config field of that name
+func (s *server) configMatches() error {
+	config, err := s.effectiveSettings()
+	if err != nil {
+		return err
+	}
+
+	// Settings keep their environment variable names, nothing is nested under dotted keys
+	for name := range config {
+		if strings.Contains(name, ".") {
+			return fmt.Errorf("/admin/config reports the dotted setting %s", name)
+		}
+	}
+
+	// Later settings override earlier ones like in the environment
+	expected := make(map[string]string)
+	for _, setting := range s.settings {
+		name, value, _ := strings.Cut(setting, "=")
+		expected[name] = value
+	}
+	for name, value := range expected {
+		reported, ok := config[name]
+		if !ok {
+			return fmt.Errorf("setting %s is not reported by /admin/config", name)
+		}
+		var got string
+		switch reported := reported.(type) {
+		case string:
+			got = reported
+		case float64:
+			got = strconv.FormatFloat(reported, 'f', -1, 64)
+		default:
+			got = fmt.Sprint(reported)
+		}
+		// Secrets are masked and an empty ENV_FILE falls back to .env
+		if got == "[REDACTED]" || (name == "ENV_FILE" && value == "") {
+			continue
+		}
+		if got != value {
+			return fmt.Errorf("setting %s=%q is reported by /admin/config as %q", name, value, got)
+		}
+	}
+	return nil
+}
+
+// reportsSettings checks that /admin/config reports every named setting, i.e. that
+// each is bound to a Config field
+func (s *server) reportsSettings(names []string) error {
+	config, err := s.effectiveSettings()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := config[name]; !ok {
+			return fmt.Errorf("documented setting %s is not bound to a Config field", name)
+		}
+	}
+	return nil
+}
+
+// documentedSettings returns the server settings documented in env.sample, the
+// testing configuration at its end is read by the shell scripts
+func documentedSettings() ([]string, error) {
+	data, err := os.ReadFile("env.sample")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "# Testing configuration" {
+			break
+		}
+		if name, _, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(line, "#") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// settingSources checks the sources /admin/config reports for settings
+func (s *server) settingSources(expected map[string]string) error {
+	resp, err := s.metricsGet("/admin/config")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected admin config status %d", resp.StatusCode)
+	}
+	var config struct {
+		Sources map[string]string `json:"sources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return err
+	}
+	for name, source := range expected {
+		if config.Sources[name] != source {
+			return fmt.Errorf("setting %s was taken from %q instead of %q", name, config.Sources[name], source)
+		}
+	}
+	return nil
+}
+
+// selfTest runs the server's self-test and returns its JSON result
+func (s *server) selfTest() (string, error) {
+	resp, err := s.metricsGet("/selftest")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("self-test failed with status %d: %s", resp.StatusCode, body)
+	}
+	return string(body), nil
+}
+
+// turnCredentials exchanges an app token for TURN credentials on /turn-credentials
+func (s *server) turnCredentials(token string) (*turnCredentials, error) {
+	req, err := http.NewRequest(http.MethodGet, s.metricsURL("/turn-credentials"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("turn-credentials failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	var credentials turnCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&credentials); err != nil {
+		return nil, err
+	}
+	return &credentials, nil
+}
+
+// turnCredentials is the /turn-credentials response
+type turnCredentials struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int      `json:"ttl"`
+	URIs     []string `json:"uris"`
+}
+
+// allocation is an entry of the server's /allocations listing
+type allocation struct {
+	UserID       string    `json:"user_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// allocations fetches the server's open relay allocations
+func (s *server) allocations() ([]allocation, error) {
+	resp, err := s.metricsGet("/allocations")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("allocations failed with status %d", resp.StatusCode)
+	}
+
+	var allocations []allocation
+	if err := json.NewDecoder(resp.Body).Decode(&allocations); err != nil {
+		return nil, err
+	}
+	return allocations, nil
+}
+
+// event is a line of the server's event socket
+type event struct {
+	Type   string `json:"type"`
+	UserID string `json:"user_id"`
+}
+
+// events connects to the event socket and streams the events the server publishes
+func (s *server) events() (<-chan event, error) {
+	conn, err := net.Dial("unix", filepath.Join(s.dir, "events.sock"))
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan event, 256)
+	go func() {
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for {
+			var e event
+			if err := decoder.Decode(&e); err != nil {
+				close(events)
+				return
+			}
+			events <- e
+		}
+	}()
+	return events, nil
+}
+
+// waitForEvent reads events until one of the type for the user arrives
+func waitForEvent(events <-chan event, eventType, userID string) error {
+	timeout := time.After(readTimeout)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return fmt.Errorf("event socket closed before a %s event for %s", eventType, userID)
+			}
+			if e.Type == eventType && e.UserID == userID {
+				return nil
+			}
+		case <-timeout:
+			return fmt.Errorf("no %s event for %s within %s", eventType, userID, readTimeout)
+		}
+	}
+}
+
+// drain starts draining the server through /admin/drain
+func (s *server) drain() error {
+	resp, err := http.Post("http://"+s.metricsAddr+"/admin/drain", "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("drain failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// setMaintenance enters or leaves maintenance through /admin/maintenance
+func (s *server) setMaintenance(body string) error {
+	resp, err := s.metricsRequest(http.MethodPost, "/admin/maintenance", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("maintenance failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ready reports whether /readyz answers 200
+func (s *server) ready() (bool, error) {
+	resp, err := s.httpClient.Get(s.metricsURL("/readyz"))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// exited waits for the server process to exit on its own
+func (s *server) exited(timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("server did not exit within %s", timeout)
+	}
+}
+
+// writeDenyList rewrites the server's deny list file in place
+func (s *server) writeDenyList(contents string) error {
+	return os.WriteFile(filepath.Join(s.dir, "deny.txt"), []byte(contents), 0o600)
+}
+
+// eventually retries check until it succeeds or the read timeout passes
+func eventually(check func() error) error {
+	deadline := time.Now().Add(readTimeout)
+	for {
+		err := check()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stop terminates the server, leaving the temp directory it shares with the others
+func (s *server) stop() {
+	_ = s.cmd.Process.Kill()
+	_ = s.cmd.Wait()
+}
+
+// printLog prints the server log to help debugging a failure
+func (s *server) printLog() {
+	file, err := os.Open(filepath.Join(s.dir, s.logFile))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	fmt.Printf("Server log %s:\n", s.logFile)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fmt.Println("  " + scanner.Text())
+	}
+}
+
+// basicAuthorization returns the Authorization header of HTTP basic auth
+func basicAuthorization(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// logContains reports whether the server logged message
+func (s *server) logContains(message string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, s.logFile))
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(data), message), nil
+}
+
+// command runs a subcommand of the server binary with the token settings of the servers
+func (s *server) command(args ...string) (string, error) {
+	cmd := exec.Command(s.binary, args...)
+	cmd.Dir = s.dir
+	cmd.Env = append(os.Environ(),
+		"REALM="+realm,
+		"ACCESS_SECRET="+s.secret,
+		"TOKEN_ALGORITHMS=HS256",
+		"EXPECTED_ISSUER="+realm+"="+issuer,
+		"REQUIRED_ROLE="+requiredRole,
+	)
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+// logLines returns the JSON log lines of the server with the message
+func (s *server) logLines(message string) ([]map[string]interface{}, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, s.logFile))
+	if err != nil {
+		return nil, err
+	}
+	var lines []map[string]interface{}
+	for _, text := range strings.Split(string(data), "\n") {
+		var line map[string]interface{}
+		if json.Unmarshal([]byte(text), &line) == nil && line["message"] == message {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// generateToken creates an access token for the user, overrides replace the
+// claims of a valid token and a nil override removes the claim
+func generateToken(secret, userID string, overrides jwt.MapClaims) (string, error) {
+	claims := jwt.MapClaims{
+		"user_id":     userID,
+		"email":       userID + "@test.com",
+		"username":    userID,
+		"is_verified": "true",
+		"role":        "user",
+		"type":        "ACCESS_TOKEN",
+		"realm":       realm,
+		"iss":         issuer,
+		"roles":       []string{requiredRole},
+		"exp":         time.Now().Add(time.Hour).Unix(),
+		"iat":         time.Now().Unix(),
+	}
+	for claim, value := range overrides {
+		if value == nil {
+			delete(claims, claim)
+			continue
+		}
+		claims[claim] = value
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+}
+
+// peer is a TURN client with an allocated relay
+type peer struct {
+	userID string
+	client *turn.Client
+	relay  net.PacketConn
+	closed bool
+}
+
+// allocate connects a TURN client for the user and allocates a relay,
+// overrides replace claims of the client's token
+func allocate(s *server, userID string, overrides jwt.MapClaims) (*peer, error) {
+	token, err := generateToken(s.secret, userID, overrides)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	return allocateWith(s, userID, token, userID) // Password must match the UserID from the token
+}
+
+// allocateWith connects a TURN client with the given credentials and allocates a relay
+func allocateWith(s *server, userID, username, password string) (*peer, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return allocateOver(conn, s.addr, userID, username, password)
+}
+
+// allocateDTLS connects a TURN client to the DTLS listener at addr, trusting the
+// certificate in certFile, and allocates a relay for the user
+func allocateDTLS(s *server, addr, certFile, userID string) (*peer, error) {
+	token, err := generateToken(s.secret, userID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certPEM) {
+		return nil, fmt.Errorf("%s contains no certificate", certFile)
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dtls.Dial("udp4", serverAddr, &dtls.Config{
+		RootCAs:              roots,
+		ServerName:           dtlsServerName,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("DTLS handshake failed: %w", err)
+	}
+	return allocateOver(turn.NewSTUNConn(conn), addr, userID, token, userID)
+}
+
+// allocateWebSocket connects a TURN client for the user tunneled over secure
+// WebSocket to port and allocates a relay. A PROXY protocol header is sent ahead
+// of the TLS handshake unless it is empty, like a load balancer would.
+func allocateWebSocket(s *server, port int, certFile, userID, proxyHeader string) (*peer, error) {
+	token, err := generateToken(s.secret, userID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certPEM) {
+		return nil, fmt.Errorf("%s contains no certificate", certFile)
+	}
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	config, err := websocket.NewConfig("wss://"+addr+"/turn", "https://"+dtlsServerName)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = &tls.Config{RootCAs: roots, ServerName: dtlsServerName}
+	tcpConn, err := net.DialTimeout("tcp", addr, readTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tcpConn.Write([]byte(proxyHeader)); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	conn, err := websocket.NewClient(config, tls.Client(tcpConn, config.TlsConfig))
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	conn.PayloadType = websocket.BinaryFrame
+	return allocateOver(turn.NewSTUNConn(conn), addr, userID, token, userID)
+}
+
+// writeDTLSCertificate writes a self-signed certificate for dtlsServerName and its
+// key to the directory, returning their paths
+func writeDTLSCertificate(dir string) (certFile, keyFile string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dtlsServerName},
+		DNSNames:     []string{dtlsServerName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		// Also a client certificate, so it can be presented to the metrics server it serves
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile = filepath.Join(dir, "dtls-cert.pem")
+	keyFile = filepath.Join(dir, "dtls-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// allocateOver connects a TURN client over conn to the server at addr and allocates a relay
+func allocateOver(conn net.PacketConn, addr, userID, username, password string) (*peer, error) {
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		Realm:          realm,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := client.Listen(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	relay, err := client.Allocate()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to allocate relay for %s: %w", userID, err)
+	}
+
+	return &peer{userID: userID, client: client, relay: relay}, nil
+}
+
+// close releases the relay and the client
+func (p *peer) close() {
+	if p.closed {
+		return
+	}
+	p.closed = true
+	_ = p.relay.Close()
+	p.client.Close()
+}
+
+// relayTo sends data from this peer's relay to the other peer's relay and
+// verifies the other peer receives it
+func (p *peer) relayTo(other *peer, data []byte) error {
+	if err := p.client.CreatePermission(other.relay.LocalAddr()); err != nil {
+		return fmt.Errorf("%s failed to create permission: %w", p.userID, err)
+	}
+	if err := other.client.CreatePermission(p.relay.LocalAddr()); err != nil {
+		return fmt.Errorf("%s failed to create permission: %w", other.userID, err)
+	}
+
+	if _, err := p.relay.WriteTo(data, other.relay.LocalAddr()); err != nil {
+		return fmt.Errorf("%s failed to send: %w", p.userID, err)
+	}
+
+	buf := make([]byte, 1500)
+	_ = other.relay.SetReadDeadline(time.Now().Add(readTimeout))
+	n, from, err := other.relay.ReadFrom(buf)
+	if err != nil {
+		return fmt.Errorf("%s did not receive the data: %w", other.userID, err)
+	}
+	if string(buf[:n]) != string(data) {
+		return fmt.Errorf("%s received %q, expected %q", other.userID, buf[:n], data)
+	}
+	if from.String() != p.relay.LocalAddr().String() {
+		return fmt.Errorf("%s received data from %s, expected %s", other.userID, from, p.relay.LocalAddr())
+	}
+	return nil
+}
+
+// metricValue returns the value of the sample with exactly the given labels
+func metricValue(exposition, name, labels string) (float64, bool) {
+	prefix := name + "{" + labels + "} "
+	if labels == "" {
+		prefix = name + " "
+	}
+	for _, line := range strings.Split(exposition, "\n") {
+		if value, found := strings.CutPrefix(line, prefix); found {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return parsed, err == nil
+		}
+	}
+	return 0, false
+}
+
+// expectMetric fails when the sample is missing or below min
+func expectMetric(exposition, name, labels string, min float64) error {
+	value, ok := metricValue(exposition, name, labels)
+	if !ok {
+		return fmt.Errorf("metric %s{%s} not found", name, labels)
+	}
+	if value < min {
+		return fmt.Errorf("metric %s{%s} is %v, expected at least %v", name, labels, value, min)
+	}
+	fmt.Printf("✅ %s{%s} = %v\n", name, labels, value)
+	return nil
+}
+
+// metricCheck is a sample expected at or above min
+type metricCheck struct {
+	name   string
+	labels string
+	min    float64
+}
+
+// expectMetrics scrapes the server's metrics and fails on the first check not met
+func (s *server) expectMetrics(checks ...metricCheck) error {
+	exposition, err := s.metrics()
+	if err != nil {
+		return err
+	}
+	for _, check := range checks {
+		if err := expectMetric(exposition, check.name, check.labels, check.min); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expectRefused fails when the user allocates a relay with a token carrying
+// overrides, reason completes the failure message
+func expectRefused(s *server, userID string, overrides jwt.MapClaims, reason string) error {
+	token, err := generateToken(s.secret, userID, overrides)
+	if err != nil {
+		return fmt.Errorf("failed to generate token: %w", err)
+	}
+	return expectTokenRefused(s, userID, token, reason)
+}
+
+// expectTokenRefused fails when the user allocates a relay with token
+func expectTokenRefused(s *server, userID, token, reason string) error {
+	if p, err := allocateWith(s, userID, token, userID); err == nil {
+		p.close()
+		return fmt.Errorf("%s allocated a relay %s", userID, reason)
+	}
+	return nil
+}
+
+// eventuallyAllocates retries until the user allocates a relay, then closes it
+func eventuallyAllocates(s *server, userID string) error {
+	return eventually(func() error {
+		p, err := allocate(s, userID, nil)
+		if err != nil {
+			return err
+		}
+		p.close()
+		return nil
+	})
+}
+
+// launchSibling starts another server on a free port next to s, sharing its
+// directory, binary and secret, env overrides settings of the test configuration
+func (s *server) launchSibling(logFile string, env ...string) (*server, error) {
+	port, err := freeUDPPort()
+	if err != nil {
+		return nil, err
+	}
+	return launch(s.dir, s.binary, port, s.secret, logFile, env...)
+}
+
+// logOnFailure prints the logs of the servers when the scenario returned an error
+func logOnFailure(err *error, servers ...*server) {
+	if *err == nil {
+		return
+	}
+	for _, s := range servers {
+		s.printLog()
+	}
+}
+
+func main() {
+	fmt.Println("Saturn Integration Test")
+	fmt.Println("=======================")
+
+	if err := run(); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println()
+	fmt.Println("Integration test completed successfully!")
+}
@@ -0,0 +1,1253 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// realmLabel selects the series of the test realm
+	realmLabel = fmt.Sprintf("realm=%q", realm)
+
+	// ping and pong are the data relayed between two clients
+	ping = []byte("ping from alice")
+	pong = []byte("pong from bob")
+)
+
+// suite is the state the scenarios share: the main server the other servers are
+// launched next to, and the relays of alice and bob kept open across its restart
+type suite struct {
+	s        *server
+	started  time.Time
+	certFile string // Certificate of the DTLS, WebSocket and metrics TLS listeners
+	keyFile  string
+	alice    *peer
+	bob      *peer
+}
+
+// scenarios run in order, a failure is reported with the name of its scenario
+var scenarios = []struct {
+	name string
+	run  func(st *suite) error
+}{
+	{"configuration", testConfiguration},
+	{"relaying", testRelaying},
+	{"authentication", testAuthentication},
+	{"deny list", testDenyList},
+	{"metrics", testMetrics},
+	{"zero-downtime restart", testRestart},
+	{"guarded server", testGuardedServer},
+	{"DTLS and WebSocket server", testSecureServer},
+	{"narrow server", testNarrowServer},
+	{"capped server", testCappedServer},
+	{"fleeting server", testFleetingServer},
+	{"flooded server", testFloodedServer},
+}
+
+func run() error {
+	fmt.Println("Starting Saturn...")
+	started := time.Now().Truncate(time.Second)
+	s, err := startServer()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(s.dir)
+	defer s.stop()
+	fmt.Printf("Server listening on %s, metrics on %s\n\n", s.addr, s.metricsAddr)
+
+	certFile, keyFile, err := writeDTLSCertificate(s.dir)
+	if err != nil {
+		return err
+	}
+	st := &suite{s: s, started: started, certFile: certFile, keyFile: keyFile}
+	defer func() {
+		for _, p := range []*peer{st.alice, st.bob} {
+			if p != nil {
+				p.close()
+			}
+		}
+	}()
+
+	for _, scenario := range scenarios {
+		if err := scenario.run(st); err != nil {
+			return fmt.Errorf("%s: %w", scenario.name, err)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// testConfiguration checks the effective configuration the main server reports
+func testConfiguration(st *suite) (err error) {
+	s := st.s
+	defer logOnFailure(&err, s)
+
+	// Every environment variable reaches the Config field bound to its name
+	if err := s.configMatches(); err != nil {
+		return err
+	}
+	fmt.Printf("✅ /admin/config reports all %d settings the server was started with\n", len(s.settings))
+	documented, err := documentedSettings()
+	if err != nil {
+		return err
+	}
+	if err := s.reportsSettings(documented); err != nil {
+		return err
+	}
+	fmt.Printf("✅ all %d settings documented in env.sample are bound to Config fields\n", len(documented))
+	if err := s.settingSources(map[string]string{
+		"REALM":                    "env",
+		"ENV_FILE":                 "default",
+		"MAX_PEERS_PER_ALLOCATION": "default",
+	}); err != nil {
+		return err
+	}
+	fmt.Println("✅ /admin/config reports where the settings were taken from")
+
+	// The effective configuration is only served under the admin prefix
+	legacy, err := s.metricsGet("/config")
+	if err != nil {
+		return err
+	}
+	legacy.Body.Close()
+	if legacy.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("/config answered %d instead of a 404", legacy.StatusCode)
+	}
+	fmt.Println("✅ the effective configuration is no longer served at /config")
+	return nil
+}
+
+// testRelaying allocates the relays of alice and bob, kept open for the restart,
+// and relays data between them
+func testRelaying(st *suite) (err error) {
+	s := st.s
+	defer logOnFailure(&err, s)
+
+	events, err := s.events()
+	if err != nil {
+		return err
+	}
+
+	st.alice, err = allocate(s, "alice", nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ alice allocated relay %s\n", st.alice.relay.LocalAddr())
+
+	// A sidecar on the event socket sees the authentication and the allocation live
+	for _, eventType := range []string{"auth_success", "allocation_created"} {
+		if err := waitForEvent(events, eventType, "alice"); err != nil {
+			return err
+		}
+	}
+	fmt.Println("✅ the event socket streamed alice's auth_success and allocation_created events")
+
+	st.bob, err = allocate(s, "bob", nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ bob allocated relay %s\n", st.bob.relay.LocalAddr())
+
+	// A user holding MAX_ALLOCATIONS_PER_USER relays cannot allocate another one
+	// and is told so with a 486 (Allocation Quota Reached)
+	second, err := allocate(s, "alice", nil)
+	if err == nil {
+		second.close()
+		return fmt.Errorf("alice allocated a second relay beyond MAX_ALLOCATIONS_PER_USER")
+	}
+	if !strings.Contains(err.Error(), "486") {
+		return fmt.Errorf("alice's second relay was refused without a 486: %w", err)
+	}
+	fmt.Println("✅ alice was refused a second relay beyond the allocation quota with a 486")
+
+	if err := st.alice.relayTo(st.bob, ping); err != nil {
+		return err
+	}
+	fmt.Println("✅ bob received data relayed from alice")
+	if err := st.bob.relayTo(st.alice, pong); err != nil {
+		return err
+	}
+	fmt.Println("✅ alice received data relayed from bob")
+
+	// Relayed traffic shows up as the allocation's last activity
+	allocations, err := s.allocations()
+	if err != nil {
+		return err
+	}
+	active := 0
+	for _, a := range allocations {
+		if (a.UserID == "alice" || a.UserID == "bob") && a.LastActivity.After(a.CreatedAt) {
+			active++
+		}
+	}
+	if active != 2 {
+		return fmt.Errorf("expected relayed traffic in the last activity of alice's and bob's allocations, got %+v", allocations)
+	}
+	fmt.Println("✅ /allocations reports relayed traffic as last activity")
+	return nil
+}
+
+// testAuthentication checks which tokens and credentials the main server accepts
+func testAuthentication(st *suite) (err error) {
+	s := st.s
+	defer logOnFailure(&err, s)
+
+	// Tokens from another issuer must be rejected
+	if err := expectRefused(s, "mallory", jwt.MapClaims{"iss": "other-issuer"}, "with a token from another issuer"); err != nil {
+		return err
+	}
+	fmt.Println("✅ mallory was refused a token from another issuer")
+
+	// Tokens signed with an unknown secret must be rejected
+	forged, err := generateToken("not-"+s.secret, "trudy", nil)
+	if err != nil {
+		return err
+	}
+	if err := expectTokenRefused(s, "trudy", forged, "with a token signed with an unknown secret"); err != nil {
+		return err
+	}
+	fmt.Println("✅ trudy was refused a token signed with an unknown secret")
+
+	// Validly signed tokens without the required role must be rejected
+	if err := expectRefused(s, "carol", jwt.MapClaims{"roles": []string{"viewer"}}, "without the "+requiredRole+" role"); err != nil {
+		return err
+	}
+	fmt.Println("✅ carol was refused a token without the required role")
+
+	// The required role is found whether it is the role claim, in a roles list or
+	// a roles claim holding a single string
+	for _, overrides := range []jwt.MapClaims{
+		{"role": requiredRole, "roles": nil},
+		{"roles": []string{"viewer", requiredRole}},
+		{"roles": requiredRole},
+	} {
+		holly, err := allocate(s, "holly", overrides)
+		if err != nil {
+			return fmt.Errorf("holly was refused a token with the %s role in %v: %w", requiredRole, overrides, err)
+		}
+		holly.close()
+	}
+	fmt.Println("✅ holly authenticated with the required role as role, in a roles list and as a roles string")
+
+	// Realms differing only by case and whitespace match with REALM_CASE_INSENSITIVE
+	frank, err := allocate(s, "frank", jwt.MapClaims{"realm": " " + strings.ToUpper(realm) + " "})
+	if err != nil {
+		return err
+	}
+	frank.close()
+	fmt.Println("✅ frank allocated a relay with a token realm differing in case and whitespace")
+
+	// A token whose user_id claim is not a string is refused rather than read as a user
+	if err := expectRefused(s, "eve", jwt.MapClaims{"user_id": 42}, "with a malformed user_id claim"); err != nil {
+		return err
+	}
+	fmt.Println("✅ eve was refused a token with a malformed user_id claim")
+
+	// Every business rule of Claims.Validate refuses the token with its own reason
+	claimsMatrix := []struct {
+		overrides jwt.MapClaims
+		reason    string
+	}{
+		{jwt.MapClaims{"user_id": nil}, "user_id_missing"},
+		{jwt.MapClaims{"is_verified": nil}, "is_verified_missing"},
+		{jwt.MapClaims{"is_verified": "false"}, "is_verified_false"},
+		{jwt.MapClaims{"realm": nil}, "realm_missing"},
+		{jwt.MapClaims{"realm": "elsewhere"}, "realm_mismatch"},
+		{jwt.MapClaims{"iss": nil}, "issuer_mismatch"},
+		{jwt.MapClaims{"type": nil}, "type_missing"},
+		{jwt.MapClaims{"type": "REFRESH_TOKEN"}, "type_not_access"},
+		{jwt.MapClaims{"role": nil}, "role_missing"},
+		{jwt.MapClaims{"exp": nil}, "expiry_missing"},
+		{jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, "token_expired"},
+		{jwt.MapClaims{"exp": time.Now().Add(30 * 24 * time.Hour).Unix()}, "ttl_too_long"},
+		{jwt.MapClaims{"scope": []string{"8.8.8.0/33"}}, "scope_invalid"},
+	}
+	reasons := make([]metricCheck, 0, len(claimsMatrix))
+	for _, rule := range claimsMatrix {
+		if err := expectRefused(s, "gus", rule.overrides, "with a token breaking "+rule.reason); err != nil {
+			return err
+		}
+		reasons = append(reasons, metricCheck{"saturn_token_validations_total", fmt.Sprintf(`reason=%q,result="failure"`, rule.reason), 1})
+	}
+	if err := s.expectMetrics(reasons...); err != nil {
+		return err
+	}
+	fmt.Printf("✅ gus was refused tokens breaking each of the %d claim rules, with their reasons\n", len(claimsMatrix))
+
+	// Credentials from /turn-credentials authenticate like the app token they were issued for
+	daveToken, err := generateToken(s.secret, "dave", nil)
+	if err != nil {
+		return err
+	}
+	credentials, err := s.turnCredentials(daveToken)
+	if err != nil {
+		return err
+	}
+	dave, err := allocateWith(s, "dave", credentials.Username, credentials.Password)
+	if err != nil {
+		return err
+	}
+	dave.close()
+	fmt.Printf("✅ dave allocated a relay with credentials from /turn-credentials (ttl %ds, uris %v)\n",
+		credentials.TTL, credentials.URIs)
+	return nil
+}
+
+// testDenyList rewrites the deny list of the main server while it runs
+func testDenyList(st *suite) (err error) {
+	s := st.s
+	defer logOnFailure(&err, s)
+
+	// Rewriting the deny list takes effect without a restart
+	if err := s.writeDenyList("127.0.0.0/8\n"); err != nil {
+		return err
+	}
+	refused := func() error {
+		return expectRefused(s, "grace", nil, "from a denied source")
+	}
+	if err := eventually(refused); err != nil {
+		return err
+	}
+	fmt.Println("✅ grace was refused once 127.0.0.0/8 was added to the deny list")
+
+	// A broken deny list keeps the previous rules in effect
+	if err := s.writeDenyList("not-an-ip\n"); err != nil {
+		return err
+	}
+	if err := eventually(func() error {
+		return s.expectMetrics(metricCheck{"saturn_deny_list_reloads_total", `result="failure"`, 1})
+	}); err != nil {
+		return err
+	}
+	if err := refused(); err != nil {
+		return err
+	}
+	fmt.Println("✅ grace stayed refused after an invalid deny list was written")
+
+	if err := s.writeDenyList(allowAllDenyList); err != nil {
+		return err
+	}
+	if err := eventuallyAllocates(s, "grace"); err != nil {
+		return err
+	}
+	fmt.Println("✅ grace allocated a relay once 127.0.0.0/8 was removed from the deny list")
+	return nil
+}
+
+// testMetrics runs the self-test and checks the series the previous scenarios
+// recorded on the main server
+func testMetrics(st *suite) (err error) {
+	s := st.s
+	defer logOnFailure(&err, s)
+
+	result, err := s.selfTest()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ self-test passed: %s", result)
+	fmt.Println()
+
+	portLabel := fmt.Sprintf(`port="%d"`, s.port)
+	return s.expectMetrics(
+		metricCheck{"saturn_token_validations_total", `reason="issuer_mismatch",result="failure"`, 1},
+		metricCheck{"saturn_token_validations_total", `reason="parse_error",result="failure"`, 1},
+		metricCheck{"saturn_allocation_failures_total", `reason="quota"`, 1},
+		metricCheck{"saturn_self_test_runs_total", `result="success"`, 1},
+		metricCheck{"saturn_turn_credentials_requests_total", `result="issued"`, 1},
+		metricCheck{"saturn_auth_failures_total", realmLabel + `,reason="role_not_permitted"`, 1},
+		metricCheck{"saturn_auth_failures_total", realmLabel + `,reason="token_validation_failed"`, 1},
+		metricCheck{"saturn_token_validations_total", `reason="user_id_missing",result="failure"`, 1},
+		metricCheck{"saturn_auth_failures_total", realmLabel + `,reason="ip_denied"`, 1},
+		metricCheck{"saturn_token_validation_duration_seconds_count", `algorithm="HS256",result="success"`, 1},
+		metricCheck{"saturn_token_validation_duration_seconds_count", `algorithm="HS256",result="failure"`, 1},
+		metricCheck{"saturn_auth_success_total", realmLabel + `,user_id="alice"`, 1},
+		metricCheck{"saturn_auth_success_total", realmLabel + `,user_id="bob"`, 1},
+		metricCheck{"saturn_last_auth_success_timestamp_seconds", realmLabel, float64(st.started.Unix())},
+		metricCheck{"saturn_connections_total", realmLabel + `,transport="udp"`, 2},
+		metricCheck{"saturn_active_connections", realmLabel + `,transport="udp"`, 2},
+		metricCheck{"saturn_allocation_egress_bytes_total", realmLabel + `,user_id="alice"`, float64(len(ping))},
+		metricCheck{"saturn_allocation_ingress_bytes_total", realmLabel + `,user_id="bob"`, float64(len(ping))},
+		metricCheck{"saturn_allocation_egress_bytes_total", realmLabel + `,user_id="bob"`, float64(len(pong))},
+		metricCheck{"saturn_allocation_ingress_bytes_total", realmLabel + `,user_id="alice"`, float64(len(pong))},
+		metricCheck{"saturn_user_egress_mb_total", realmLabel + `,user_id="alice"`, float64(len(ping)) / 1048576},
+		metricCheck{"saturn_user_ingress_mb_total", realmLabel + `,user_id="bob"`, float64(len(ping)) / 1048576},
+		metricCheck{"saturn_ingress_packets_total", portLabel + "," + realmLabel + `,server_id="0",transport="udp"`, 1},
+		metricCheck{"saturn_egress_packets_total", portLabel + "," + realmLabel + `,server_id="0",transport="udp"`, 1},
+		metricCheck{"saturn_listener_packets_total", `listener_id="0",` + portLabel + `,transport="udp"`, 1},
+		metricCheck{"saturn_packet_size_bytes_count", `direction="ingress"`, 1},
+		metricCheck{"saturn_packet_size_bytes_count", `direction="egress"`, 1},
+	)
+}
+
+// testRestart restarts the main server without downtime: a successor binds the same
+// port and the old process drains, relaying the sessions it holds until they close
+// and then exiting
+func testRestart(st *suite) (err error) {
+	s, alice, bob := st.s, st.alice, st.bob
+	successor, err := s.successor()
+	if err != nil {
+		return err
+	}
+	defer successor.stop()
+	defer logOnFailure(&err, s, successor)
+
+	// The successor announces it bound every listener, the signal to drain the old process
+	if err := eventually(func() error {
+		pid, err := successor.readyFilePID()
+		if err != nil {
+			return err
+		}
+		if pid != successor.cmd.Process.Pid {
+			return fmt.Errorf("the startup ready file holds PID %d instead of the successor's %d", pid, successor.cmd.Process.Pid)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if ready, err := successor.ready(); err != nil || !ready {
+		return fmt.Errorf("the successor wrote its startup ready file but is not ready: %v", err)
+	}
+	if err := s.drain(); err != nil {
+		return err
+	}
+	fmt.Printf("✅ a successor started on %s, wrote its startup ready file and the old process is draining\n", successor.addr)
+
+	// The kernel now spreads client packets over both processes, the handoff passes
+	// them to the process holding the allocation
+	if err := alice.relayTo(bob, ping); err != nil {
+		return err
+	}
+	if err := bob.relayTo(alice, pong); err != nil {
+		return err
+	}
+	fmt.Println("✅ alice and bob kept relaying through the draining process")
+
+	heidi, err := allocate(successor, "heidi", nil)
+	if err != nil {
+		return err
+	}
+	defer heidi.close()
+	if err := heidi.relayTo(alice, []byte("hello from heidi")); err != nil {
+		return err
+	}
+	allocations, err := successor.allocations()
+	if err != nil {
+		return err
+	}
+	if len(allocations) != 1 || allocations[0].UserID != "heidi" {
+		return fmt.Errorf("expected only heidi's allocation on the successor, got %+v", allocations)
+	}
+	fmt.Println("✅ heidi's new allocation was made by the successor and relays to alice")
+
+	alice.close()
+	bob.close()
+	if err := s.exited(startupTimeout); err != nil {
+		return err
+	}
+	if pid, err := successor.readyFilePID(); err != nil || pid != successor.cmd.Process.Pid {
+		return fmt.Errorf("the old process exiting removed or replaced the successor's startup ready file: %v", err)
+	}
+	fmt.Println("✅ the old process exited once alice and bob closed their relays, leaving the successor's startup ready file")
+
+	ivan, err := allocate(successor, "ivan", nil)
+	if err != nil {
+		return err
+	}
+	defer ivan.close()
+	if err := heidi.relayTo(ivan, []byte("hello from heidi")); err != nil {
+		return err
+	}
+	fmt.Println("✅ heidi kept relaying through the successor alone")
+
+	exposition, err := successor.metrics()
+	if err != nil {
+		return err
+	}
+	for _, result := range []string{"moved", "forwarded", "received"} {
+		value, _ := metricValue(exposition, "saturn_handoff_packets_total", fmt.Sprintf("result=%q", result))
+		fmt.Printf("   successor saturn_handoff_packets_total{result=%q} = %v\n", result, value)
+	}
+	return nil
+}
+
+// testGuardedServer checks peer restrictions with BLOCK_PRIVATE_PEERS, which rules out
+// relaying between the loopback relays, hence a separate server
+func testGuardedServer(st *suite) (err error) {
+	s := st.s
+	guardedPort, err := freeUDPPort()
+	if err != nil {
+		return err
+	}
+	// It also listens on a second port through PORTS
+	extraPort, err := freeUDPPort()
+	if err != nil {
+		return err
+	}
+	// Its webhook sink is down for the first deliveries, which are retried
+	sink, err := newWebhookSink(2)
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+	guarded, err := launch(s.dir, s.binary, guardedPort, s.secret, "saturn-guarded.log",
+		fmt.Sprintf("PORTS=%d,%d", guardedPort, extraPort),
+		"BLOCK_PRIVATE_PEERS=true", "PEER_ALLOWLIST=8.8.8.0/24", "STUN_REQUIRE_AUTH=true", "HANDOFF_SOCKET_PATH=",
+		"METRICS_AUTH=bearer", "METRICS_BEARER_TOKEN=scrape-"+s.secret, "METRICS_AUTH_CHALLENGE=false",
+		fmt.Sprintf("MAX_ALLOCATION_LIFETIME=%d", int(maxAllocationLifetime/time.Second)),
+		"WEBHOOK_URL="+sink.URL, "WEBHOOK_AUTH_FAILURE_THRESHOLD=1", "WEBHOOK_MAX_ATTEMPTS=5")
+	if err != nil {
+		return err
+	}
+	defer guarded.stop()
+	defer logOnFailure(&err, guarded)
+
+	if err := guarded.configMatches(); err != nil {
+		return err
+	}
+
+	// Its metrics require a bearer token and, without the challenge, refuse
+	// anything else with a 403 that does not make browsers prompt for credentials
+	unauthenticated := *guarded
+	for _, authorization := range []string{"", "Bearer wrong-token", basicAuthorization("admin", "secret")} {
+		unauthenticated.metricsAuth = authorization
+		resp, err := unauthenticated.metricsGet("/metrics")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden || resp.Header.Get("WWW-Authenticate") != "" {
+			return fmt.Errorf("metrics with authorization %q answered %d instead of a 403 without challenge", authorization, resp.StatusCode)
+		}
+	}
+	fmt.Println("✅ the guarded server's metrics refuse requests without the bearer token with a 403")
+
+	judy, err := allocate(guarded, "judy", nil)
+	if err != nil {
+		return err
+	}
+	defer judy.close()
+	if err := judy.client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}); err == nil {
+		return fmt.Errorf("judy created a permission for a private peer with BLOCK_PRIVATE_PEERS")
+	}
+	if err := judy.client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 5000}); err != nil {
+		return fmt.Errorf("judy failed to create a permission for a public peer: %w", err)
+	}
+	fmt.Println("✅ judy was refused a permission for 10.0.0.1 but got one for 8.8.8.8 with BLOCK_PRIVATE_PEERS")
+	if err := judy.client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 5000}); err == nil {
+		return fmt.Errorf("judy created a permission for a peer outside PEER_ALLOWLIST")
+	}
+	fmt.Println("✅ judy was refused a permission for 1.1.1.1 outside PEER_ALLOWLIST")
+
+	// A token's scope narrows the allowlist further, as a space-separated string too
+	kurt, err := allocate(guarded, "kurt", jwt.MapClaims{"scope": "8.8.8.4 2001:db8::/32"})
+	if err != nil {
+		return err
+	}
+	defer kurt.close()
+	if err := kurt.client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 5000}); err == nil {
+		return fmt.Errorf("kurt created a permission for a peer outside the token's scope")
+	}
+	if err := kurt.client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("8.8.8.4"), Port: 5000}); err != nil {
+		return fmt.Errorf("kurt failed to create a permission for a peer in the token's scope: %w", err)
+	}
+	fmt.Println("✅ kurt was refused a permission for 8.8.8.8 outside the token's scope but got one for 8.8.8.4")
+
+	if err := guarded.expectMetrics(
+		metricCheck{"saturn_peer_permissions_denied_total", realmLabel + `,reason="private_peer"`, 1},
+		metricCheck{"saturn_peer_permissions_denied_total", realmLabel + `,reason="not_allowlisted"`, 1},
+		metricCheck{"saturn_peer_permissions_denied_total", realmLabel + `,reason="out_of_scope"`, 1},
+	); err != nil {
+		return err
+	}
+
+	// The guarded server also requires STUN_REQUIRE_AUTH, so plain binding requests
+	// are dropped while those carrying a valid token are answered
+	if guarded.answersBinding() {
+		return fmt.Errorf("an unauthenticated binding request was answered with STUN_REQUIRE_AUTH")
+	}
+	if err := guarded.bind("judy"); err != nil {
+		return fmt.Errorf("an authenticated binding request was not answered: %w", err)
+	}
+	fmt.Println("✅ Only authenticated binding requests are answered with STUN_REQUIRE_AUTH")
+	if _, err := guarded.selfTest(); err != nil {
+		return fmt.Errorf("self-test failed with STUN_REQUIRE_AUTH: %w", err)
+	}
+
+	// Lifetimes above MAX_ALLOCATION_LIFETIME are granted at the cap, shorter ones as requested.
+	// The first ALLOCATE is granted by pion as requested and its response clamped.
+	for requested, expected := range map[time.Duration]time.Duration{
+		50 * time.Minute: maxAllocationLifetime,
+		5 * time.Minute:  5 * time.Minute,
+	} {
+		granted, err := guarded.allocateLifetime("ivan", requested)
+		if err != nil {
+			return fmt.Errorf("ivan failed to allocate a relay asking for a %s lifetime: %w", requested, err)
+		}
+		if granted != expected {
+			return fmt.Errorf("ivan asked for a %s lifetime and was granted %s instead of %s", requested, granted, expected)
+		}
+	}
+	fmt.Printf("✅ ivan asked for a 50m lifetime and was granted the MAX_ALLOCATION_LIFETIME of %s\n", maxAllocationLifetime)
+
+	// A failed authentication is notified to the webhook, which receives it once it recovers
+	forged, err := generateToken("not-"+s.secret, "trudy", nil)
+	if err != nil {
+		return err
+	}
+	if err := expectTokenRefused(guarded, "trudy", forged, "with a token signed with an unknown secret"); err != nil {
+		return err
+	}
+	select {
+	case <-sink.delivered:
+		// The forged signature is told apart from other token failures
+		if !strings.Contains(string(sink.body), `"reason":"parse_error"`) {
+			return fmt.Errorf("the webhook received the auth failure without the token reason parse_error: %s", sink.body)
+		}
+		fmt.Printf("✅ the webhook received the auth failure with its token reason after %d failed deliveries were retried\n", sink.failures)
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("the webhook did not receive the auth failure after recovering")
+	}
+
+	// In maintenance connected clients keep working while new ones are refused
+	if err := guarded.setMaintenance(`{"reason": "integration test"}`); err != nil {
+		return err
+	}
+	if ready, err := guarded.ready(); err != nil || ready {
+		return fmt.Errorf("/readyz did not fail in maintenance: %v", err)
+	}
+	if err := expectRefused(guarded, "kim", nil, "in maintenance"); err != nil {
+		return err
+	}
+	if err := judy.client.CreatePermission(&net.UDPAddr{IP: net.ParseIP("8.8.8.4"), Port: 5000}); err != nil {
+		return fmt.Errorf("judy failed to create a permission in maintenance: %w", err)
+	}
+	if err := guarded.setMaintenance(`{"enabled": false}`); err != nil {
+		return err
+	}
+	if ready, err := guarded.ready(); err != nil || !ready {
+		return fmt.Errorf("/readyz did not recover after maintenance: %v", err)
+	}
+	kim, err := allocate(guarded, "kim", nil)
+	if err != nil {
+		return fmt.Errorf("kim failed to allocate a relay after maintenance: %w", err)
+	}
+	kim.close()
+	fmt.Println("✅ kim was refused in maintenance while judy kept a working relay, and allocated once it ended")
+
+	// Every port in PORTS gets its own listeners, tagged with the port in metrics
+	extra := *guarded
+	extra.addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(extraPort))
+	if err := extra.bind("judy"); err != nil {
+		return fmt.Errorf("the second port in PORTS did not answer: %w", err)
+	}
+	lena, err := allocate(&extra, "lena", nil)
+	if err != nil {
+		return fmt.Errorf("lena failed to allocate a relay on the second port in PORTS: %w", err)
+	}
+	lena.close()
+	fmt.Printf("✅ the guarded server answers on both ports %d and %d, and allocates relays on the second\n", guardedPort, extraPort)
+
+	return guarded.expectMetrics(
+		metricCheck{"saturn_amplification_suspected_total", realmLabel + `,reason="unauthenticated_binding"`, 1},
+		metricCheck{"saturn_listener_packets_total", fmt.Sprintf(`listener_id="1",port="%d",transport="udp"`, extraPort), 1},
+		metricCheck{"saturn_auth_failures_total", realmLabel + `,reason="maintenance"`, 1},
+		metricCheck{"saturn_webhook_deliveries_total", `result="retry"`, 2},
+		metricCheck{"saturn_webhook_deliveries_total", `result="success"`, 1},
+		// ivan deleted both allocations with a zero lifetime REFRESH
+		metricCheck{"saturn_allocation_refreshes_total", realmLabel + `,type="delete"`, 2},
+	)
+}
+
+// testSecureServer checks TURN over DTLS and WebSocket, and the token settings of a
+// server with several access secrets
+func testSecureServer(st *suite) (err error) {
+	s, certFile := st.s, st.certFile
+	dtlsPort, err := freeUDPPort()
+	if err != nil {
+		return err
+	}
+	webSocketPort, err := freeTCPPort()
+	if err != nil {
+		return err
+	}
+	secure, err := s.launchSibling("saturn-dtls.log",
+		"HANDOFF_SOCKET_PATH=", "ENABLE_DTLS=true", fmt.Sprintf("DTLS_PORT=%d", dtlsPort),
+		"DTLS_CERT="+certFile, "DTLS_KEY="+st.keyFile, "JWT_LEEWAY=60",
+		fmt.Sprintf(`ACCESS_SECRETS=["blue-%s","green-%s"]`, s.secret, s.secret), "NONCE_LIFETIME=2",
+		"LOG_LEVEL=info", "ENABLE_WEBSOCKET=true", fmt.Sprintf("WEBSOCKET_PORT=%d", webSocketPort),
+		"WEBSOCKET_CERT="+certFile, "WEBSOCKET_KEY="+st.keyFile, "WEBSOCKET_PROXY_PROTOCOL=true", "WEBSOCKET_PROXY_PROTOCOL_REQUIRED=false")
+	if err != nil {
+		return err
+	}
+	defer secure.stop()
+	defer logOnFailure(&err, secure)
+
+	// TURN over DTLS: a client connected to the DTLS listener relays to one on UDP
+	dtlsAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(dtlsPort))
+	mallory, err := allocateDTLS(secure, dtlsAddr, certFile, "mallory")
+	if err != nil {
+		return fmt.Errorf("mallory failed to allocate a relay over DTLS: %w", err)
+	}
+	defer mallory.close()
+	nick, err := allocate(secure, "nick", nil)
+	if err != nil {
+		return err
+	}
+	defer nick.close()
+	if err := mallory.relayTo(nick, ping); err != nil {
+		return err
+	}
+	if err := nick.relayTo(mallory, pong); err != nil {
+		return err
+	}
+	fmt.Printf("✅ mallory relayed data to nick over the DTLS listener on port %d\n", dtlsPort)
+
+	dtlsLabels := fmt.Sprintf(`port="%d",%s,server_id="1",transport="dtls"`, dtlsPort, realmLabel)
+	if err := secure.expectMetrics(
+		metricCheck{"saturn_ingress_packets_total", dtlsLabels, 1},
+		metricCheck{"saturn_egress_packets_total", dtlsLabels, 1},
+		metricCheck{"saturn_allocation_egress_bytes_total", realmLabel + `,user_id="mallory"`, float64(len(ping))},
+	); err != nil {
+		return err
+	}
+
+	// TURN tunneled over WebSocket authenticates and relays like UDP, on the listener after the DTLS one
+	walter, err := allocateWebSocket(secure, webSocketPort, certFile, "walter", "")
+	if err != nil {
+		return fmt.Errorf("walter failed to allocate a relay over WebSocket: %w", err)
+	}
+	defer walter.close()
+	if err := walter.relayTo(nick, ping); err != nil {
+		return err
+	}
+	if err := nick.relayTo(walter, pong); err != nil {
+		return err
+	}
+	webSocketLabels := fmt.Sprintf(`port="%d",%s,server_id="2",transport="websocket"`, webSocketPort, realmLabel)
+	if err := secure.expectMetrics(
+		metricCheck{"saturn_ingress_packets_total", webSocketLabels, 1},
+		metricCheck{"saturn_egress_packets_total", webSocketLabels, 1},
+	); err != nil {
+		return err
+	}
+	fmt.Printf("✅ walter relayed data to nick over the WebSocket listener on port %d\n", webSocketPort)
+
+	// Behind a load balancer the session is attributed to the client address of its
+	// PROXY header, while walter without one keeps the TCP peer address
+	proxied := "198.51.100.7:51234"
+	wendy, err := allocateWebSocket(secure, webSocketPort, certFile, "wendy",
+		fmt.Sprintf("PROXY TCP4 198.51.100.7 127.0.0.1 51234 %d\r\n", webSocketPort))
+	if err != nil {
+		return fmt.Errorf("wendy failed to allocate a relay over WebSocket with a PROXY header: %w", err)
+	}
+	defer wendy.close()
+	if err := wendy.relayTo(nick, ping); err != nil {
+		return err
+	}
+	if err := nick.relayTo(wendy, pong); err != nil {
+		return err
+	}
+	lines, err := secure.logLines("Relay allocated")
+	if err != nil {
+		return err
+	}
+	attributed := map[string]string{}
+	for _, line := range lines {
+		attributed[fmt.Sprint(line["user_id"])] = fmt.Sprint(line["client_addr"])
+	}
+	if attributed["wendy"] != proxied || !strings.HasPrefix(attributed["walter"], "127.0.0.1:") {
+		return fmt.Errorf("relays were not attributed to the PROXY header's address: %v", attributed)
+	}
+	if _, err := allocateWebSocket(secure, webSocketPort, certFile, "xena", "PROXY TCP4 not-an-address\r\n"); err == nil {
+		return fmt.Errorf("xena allocated a relay with a malformed PROXY header")
+	}
+	// Connections are broken down by the transport of the listener the client reached
+	checks := []metricCheck{{"saturn_proxy_protocol_refusals_total", `reason="invalid"`, 1}}
+	for _, transport := range []string{"udp", "dtls", "websocket"} {
+		labels := fmt.Sprintf(`%s,transport="%s"`, realmLabel, transport)
+		checks = append(checks,
+			metricCheck{"saturn_active_connections", labels, 1},
+			metricCheck{"saturn_connections_total", labels, 1})
+	}
+	if err := secure.expectMetrics(checks...); err != nil {
+		return err
+	}
+	fmt.Printf("✅ wendy's relay was attributed to %s from the PROXY header, a malformed header was refused\n", proxied)
+
+	// Its JWT_LEEWAY tolerates 60 seconds of clock skew on expiry, in the JWT library
+	// and in the expiry double-check alike
+	olivia, err := allocate(secure, "olivia", jwt.MapClaims{"exp": time.Now().Add(-30 * time.Second).Unix()})
+	if err != nil {
+		return fmt.Errorf("olivia's token expired 30s ago was refused within JWT_LEEWAY: %w", err)
+	}
+	olivia.close()
+	if err := expectRefused(secure, "olivia", jwt.MapClaims{"exp": time.Now().Add(-2 * time.Minute).Unix()}, "with a token expired beyond JWT_LEEWAY"); err != nil {
+		return err
+	}
+	fmt.Println("✅ olivia's token expired 30s ago was accepted with a JWT_LEEWAY of 60s, one expired 2m ago was not")
+
+	// Tokens signed by any secret of ACCESS_SECRETS authenticate, recorded by its index
+	greenToken, err := generateToken("green-"+s.secret, "percy", nil)
+	if err != nil {
+		return err
+	}
+	percy, err := allocateWith(secure, "percy", greenToken, "percy")
+	if err != nil {
+		return fmt.Errorf("percy's token signed with the second secret of ACCESS_SECRETS was refused: %w", err)
+	}
+	percy.close()
+	if err := secure.expectMetrics(metricCheck{"saturn_token_validation_keys_total", `key="1"`, 1}); err != nil {
+		return err
+	}
+	fmt.Println("✅ percy's token signed with the second secret of ACCESS_SECRETS authenticated")
+
+	// Requests with a nonce older than NONCE_LIFETIME get a 438 and a fresh nonce
+	ruth, err := allocate(secure, "ruth", nil)
+	if err != nil {
+		return err
+	}
+	defer ruth.close()
+	time.Sleep(2500 * time.Millisecond)
+	peerAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	if err := ruth.client.CreatePermission(peerAddr); err == nil {
+		return fmt.Errorf("ruth created a permission with a nonce older than NONCE_LIFETIME")
+	}
+	// Without a nonce pion issued within NONCE_LIFETIME, the 438 carries one pion
+	// refuses in turn with a fresh nonce, so the client may need a second retry
+	for attempt := 1; ; attempt++ {
+		err := ruth.client.CreatePermission(peerAddr)
+		if err == nil {
+			break
+		}
+		if attempt == 2 {
+			return fmt.Errorf("ruth failed to create a permission with the fresh nonce: %w", err)
+		}
+	}
+	if err := secure.expectMetrics(metricCheck{"saturn_stale_nonce_total", realmLabel, 1}); err != nil {
+		return err
+	}
+	fmt.Println("✅ ruth's request with a nonce older than NONCE_LIFETIME got a 438, the retry with the fresh nonce succeeded")
+
+	// Both ends of ruth's allocation are logged with its relay address
+	if _, err := ruth.relay.WriteTo([]byte("ping"), peerAddr); err != nil {
+		return err
+	}
+	relayAddr := ruth.relay.LocalAddr().String()
+	ruth.close()
+	err = eventually(func() error {
+		lines, err := secure.logLines("Relay closed")
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if line["relay_addr"] != relayAddr {
+				continue
+			}
+			if line["user_id"] != "ruth" || line["egress_bytes"] != float64(4) || line["duration"] == nil {
+				return fmt.Errorf("ruth's relay was logged closed with %v", line)
+			}
+			return nil
+		}
+		return fmt.Errorf("ruth's relay %s was not logged closed", relayAddr)
+	})
+	if err != nil {
+		return err
+	}
+	lines, err = secure.logLines("Relay allocated")
+	if err != nil {
+		return err
+	}
+	allocated := false
+	for _, line := range lines {
+		allocated = allocated || (line["relay_addr"] == relayAddr && line["user_id"] == "ruth" && line["client_addr"] != "")
+	}
+	if !allocated {
+		return fmt.Errorf("ruth's relay %s was not logged allocated", relayAddr)
+	}
+	fmt.Println("✅ ruth's allocation was logged allocated and closed with its relay address and traffic")
+
+	// Tokens printed by the gen-token subcommand authenticate, verify-token reports why others are refused
+	token, err := secure.command("gen-token", "-user-id", "tess", "-ttl", "10m")
+	if err != nil {
+		return fmt.Errorf("gen-token failed: %w", err)
+	}
+	tess, err := allocateWith(secure, "tess", token, "tess")
+	if err != nil {
+		return fmt.Errorf("tess failed to allocate with a token of gen-token: %w", err)
+	}
+	tess.close()
+	if output, err := secure.command("verify-token", token); err != nil || !strings.Contains(output, `"user_id": "tess"`) {
+		return fmt.Errorf("verify-token refused the token of gen-token (%v): %s", err, output)
+	}
+	expired, err := generateToken(secure.secret, "tess", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})
+	if err != nil {
+		return err
+	}
+	if output, err := secure.command("verify-token", expired); err == nil || !strings.Contains(output, "token_expired") {
+		return fmt.Errorf("verify-token did not report the expired token (%v): %s", err, output)
+	}
+	fmt.Println("✅ tess authenticated with a token of gen-token, verify-token reported an expired one")
+	return nil
+}
+
+// testNarrowServer checks a relay port range of a single port, which a second
+// allocation exhausts, along with the metrics served over mutual TLS
+func testNarrowServer(st *suite) (err error) {
+	s, certFile := st.s, st.certFile
+	relayPort, err := freeUDPPort()
+	if err != nil {
+		return err
+	}
+	narrow, err := s.launchSibling("saturn-narrow.log", "HANDOFF_SOCKET_PATH=",
+		fmt.Sprintf("RELAY_MIN_PORT=%d", relayPort), fmt.Sprintf("RELAY_MAX_PORT=%d", relayPort),
+		fmt.Sprintf("SOCKET_RCVBUF_BYTES=%d", 1<<30), "SOCKET_SNDBUF_BYTES=65536",
+		"METRICS_AUTH=basic", "METRICS_USERNAME=admin", "METRICS_PASSWORD=admin-"+s.secret,
+		"METRICS_CREDENTIALS="+realm+"=tenant:tenant-"+s.secret+",elsewhere=stranger:stranger-"+s.secret,
+		"REALMS=elsewhere", "RELAY_PUBLIC_IPS="+realm+"=127.0.0.2,elsewhere=127.0.0.3",
+		"METRICS_TLS_CERT="+certFile, "METRICS_TLS_KEY="+st.keyFile, "METRICS_CLIENT_CA="+certFile)
+	if err != nil {
+		return err
+	}
+	defer narrow.stop()
+	defer logOnFailure(&err, narrow)
+
+	// Its metrics are served over HTTPS to clients presenting a certificate signed by METRICS_CLIENT_CA
+	anonymous := *narrow
+	anonymous.httpClient = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: narrow.httpClient.Transport.(*http.Transport).TLSClientConfig.Clone(),
+	}}
+	anonymous.httpClient.Transport.(*http.Transport).TLSClientConfig.Certificates = nil
+	if _, err := anonymous.metrics(); err == nil {
+		return fmt.Errorf("metrics were scraped without a client certificate")
+	}
+	if _, err := narrow.metrics(); err != nil {
+		return fmt.Errorf("metrics were not scraped with a client certificate: %w", err)
+	}
+	fmt.Println("✅ metrics served over HTTPS refused a client without a certificate signed by METRICS_CLIENT_CA")
+
+	quinn, err := allocate(narrow, "quinn", nil)
+	if err != nil {
+		return err
+	}
+	defer quinn.close()
+	if port := quinn.relay.LocalAddr().(*net.UDPAddr).Port; port != relayPort {
+		return fmt.Errorf("quinn's relay is on port %d outside the relay port range %d", port, relayPort)
+	}
+	// The realm's relays are advertised on its own IP from RELAY_PUBLIC_IPS
+	if ip := quinn.relay.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.2")) {
+		return fmt.Errorf("quinn's relay is advertised on %s instead of the realm's relay IP 127.0.0.2", ip)
+	}
+	if err := expectRefused(narrow, "rita", nil, "with the relay port range exhausted"); err != nil {
+		return err
+	}
+	fmt.Printf("✅ quinn's relay took the only port %d of the relay port range on the realm's relay IP and rita was refused\n", relayPort)
+
+	if err := narrow.expectMetrics(
+		metricCheck{"saturn_relay_port_exhaustion_total", realmLabel, 1},
+		metricCheck{"saturn_allocation_failures_total", `reason="port_exhausted"`, 1},
+	); err != nil {
+		return err
+	}
+
+	// Its 1 GiB receive buffer is clamped by the kernel, which is warned about,
+	// while its 64 KiB send buffer is granted
+	if clamped, err := narrow.logContains("Receive buffer clamped by the kernel"); err != nil || !clamped {
+		return fmt.Errorf("the clamped SOCKET_RCVBUF_BYTES was not warned about: %v", err)
+	}
+	if clamped, err := narrow.logContains("Send buffer clamped by the kernel"); err != nil || clamped {
+		return fmt.Errorf("the granted SOCKET_SNDBUF_BYTES was warned about: %v", err)
+	}
+	fmt.Println("✅ a SOCKET_RCVBUF_BYTES above net.core.rmem_max is warned about, a granted SOCKET_SNDBUF_BYTES is not")
+
+	// Realm credentials from METRICS_CREDENTIALS scrape only their realm's series
+	// and are refused every other endpoint
+	tenant := *narrow
+	tenant.metricsAuth = basicAuthorization("tenant", "tenant-"+s.secret)
+	exposition, err := tenant.metrics()
+	if err != nil {
+		return fmt.Errorf("the tenant failed to scrape metrics: %w", err)
+	}
+	if err := expectMetric(exposition, "saturn_relay_port_exhaustion_total", realmLabel, 1); err != nil {
+		return err
+	}
+	if strings.Contains(exposition, "go_goroutines") || strings.Contains(exposition, "saturn_allocation_failures_total") {
+		return fmt.Errorf("the tenant's metrics include series without its realm")
+	}
+	resp, err := tenant.metricsGet("/admin/config")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		return fmt.Errorf("the tenant got %d from /admin/config instead of a 403", resp.StatusCode)
+	}
+	stranger := *narrow
+	stranger.metricsAuth = basicAuthorization("stranger", "stranger-"+s.secret)
+	exposition, err = stranger.metrics()
+	if err != nil {
+		return fmt.Errorf("the stranger failed to scrape metrics: %w", err)
+	}
+	if strings.Contains(exposition, realmLabel) {
+		return fmt.Errorf("the stranger's metrics include series of realm %s", realm)
+	}
+	stranger.metricsAuth = basicAuthorization("stranger", "tenant-"+s.secret)
+	if _, err := stranger.metrics(); err == nil {
+		return fmt.Errorf("the stranger scraped metrics with the tenant's password")
+	}
+	fmt.Println("✅ realm credentials in METRICS_CREDENTIALS scrape only their realm's series and no other endpoint")
+	return nil
+}
+
+// testCappedServer checks that at MAX_TOTAL_ALLOCATIONS new clients are refused
+// while connected ones keep refreshing
+func testCappedServer(st *suite) (err error) {
+	capped, err := st.s.launchSibling("saturn-capped.log", "HANDOFF_SOCKET_PATH=", "MAX_TOTAL_ALLOCATIONS=1")
+	if err != nil {
+		return err
+	}
+	defer capped.stop()
+	defer logOnFailure(&err, capped)
+
+	uma, err := allocate(capped, "uma", nil)
+	if err != nil {
+		return err
+	}
+	defer uma.close()
+	if err := expectRefused(capped, "victor", nil, "beyond MAX_TOTAL_ALLOCATIONS"); err != nil {
+		return err
+	}
+	if err := uma.client.CreatePermission(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}); err != nil {
+		return fmt.Errorf("uma was refused a permission at MAX_TOTAL_ALLOCATIONS: %w", err)
+	}
+	if err := capped.expectMetrics(metricCheck{"saturn_auth_failures_total", realmLabel + `,reason="global_limit"`, 1}); err != nil {
+		return err
+	}
+	if logged, err := capped.logContains("Global allocation limit reached"); err != nil || !logged {
+		return fmt.Errorf("reaching MAX_TOTAL_ALLOCATIONS was not logged (%v)", err)
+	}
+	uma.close()
+	if err := eventuallyAllocates(capped, "victor"); err != nil {
+		return fmt.Errorf("victor was refused a relay after uma's was closed: %w", err)
+	}
+	fmt.Println("✅ victor was refused a relay at MAX_TOTAL_ALLOCATIONS while uma kept refreshing, and got one once uma's was closed")
+
+	// Every client of the capped server closed its allocation, so none is connected
+	err = eventually(func() error {
+		exposition, err := capped.metrics()
+		if err != nil {
+			return err
+		}
+		if value, ok := metricValue(exposition, "saturn_active_connections", realmLabel+`,transport="udp"`); !ok || value != 0 {
+			return fmt.Errorf("saturn_active_connections{%s} is %v after every allocation was closed", realmLabel, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("✅ saturn_active_connections returned to zero once every allocation was closed")
+	return nil
+}
+
+// testFleetingServer checks that permissions not refreshed within PERMISSION_LIFETIME
+// stop relaying before pion expires them, until the client refreshes them
+func testFleetingServer(st *suite) (err error) {
+	s := st.s
+	// Its secret is read from ACCESS_SECRET_FILE, overriding ACCESS_SECRET, so the
+	// clients below only authenticate when the file's secret is used
+	secretFile := filepath.Join(s.dir, "access-secret")
+	if err := os.WriteFile(secretFile, []byte(s.secret+"\n"), 0o600); err != nil {
+		return err
+	}
+	fleeting, err := s.launchSibling("saturn-fleeting.log",
+		"HANDOFF_SOCKET_PATH=", "PERMISSION_LIFETIME=10", "LOG_LEVEL=debug", "METRICS_UPDATE_INTERVAL=1",
+		"ACCESS_SECRET=not-the-secret", "ACCESS_SECRET_FILE="+secretFile)
+	if err != nil {
+		return err
+	}
+	defer fleeting.stop()
+	defer logOnFailure(&err, fleeting)
+
+	yara, err := allocate(fleeting, "yara", nil)
+	if err != nil {
+		return err
+	}
+	defer yara.close()
+	zeke, err := allocate(fleeting, "zeke", nil)
+	if err != nil {
+		return err
+	}
+	defer zeke.close()
+	if err := yara.relayTo(zeke, []byte("fresh")); err != nil {
+		return err
+	}
+	fmt.Println("✅ clients authenticated with the secret read from ACCESS_SECRET_FILE")
+	time.Sleep(11 * time.Second)
+	if _, err := yara.relay.WriteTo([]byte("stale"), zeke.relay.LocalAddr()); err != nil {
+		return err
+	}
+	_ = zeke.relay.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := zeke.relay.ReadFrom(make([]byte, 1500)); err == nil {
+		return fmt.Errorf("zeke received %d bytes over an expired permission", n)
+	}
+	if err := eventually(func() error {
+		return fleeting.expectMetrics(metricCheck{"saturn_peer_packets_dropped_total", realmLabel + `,reason="permission_expired"`, 1})
+	}); err != nil {
+		return err
+	}
+	if err := yara.relayTo(zeke, []byte("refreshed")); err != nil {
+		return fmt.Errorf("relaying after refreshing the permissions: %w", err)
+	}
+	fmt.Println("✅ permissions expired after PERMISSION_LIFETIME and relayed again once refreshed")
+
+	// Data from a peer the client never created a permission for is counted and logged
+	// with the peer's address, as every relay shares the IP yara's permission is for
+	abby, err := allocate(fleeting, "abby", nil)
+	if err != nil {
+		return err
+	}
+	defer abby.close()
+	if _, err := yara.relay.WriteTo([]byte("unasked"), abby.relay.LocalAddr()); err != nil {
+		return err
+	}
+	if err := eventually(func() error {
+		if err := fleeting.expectMetrics(metricCheck{"saturn_unpermitted_peer_drops_total", realmLabel, 1}); err != nil {
+			return err
+		}
+		drops, err := fleeting.logLines("Dropped data from a peer without a permission")
+		if err != nil {
+			return err
+		}
+		if len(drops) == 0 || drops[0]["user_id"] != "abby" || drops[0]["peer_addr"] != yara.relay.LocalAddr().String() {
+			return fmt.Errorf("expected the drop logged for abby with peer_addr %s, got %v", yara.relay.LocalAddr(), drops)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	fmt.Println("✅ data from a peer without a permission was counted and logged with the peer address")
+
+	// The gauges follow METRICS_UPDATE_INTERVAL, and their updater stops with the server
+	if err := eventually(func() error {
+		return fleeting.expectMetrics(metricCheck{"saturn_server_uptime_seconds", "", 1})
+	}); err != nil {
+		return err
+	}
+	if err := fleeting.cmd.Process.Signal(os.Interrupt); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- fleeting.cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("server exited after SIGINT: %w", err)
+		}
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("server did not exit after SIGINT")
+	}
+	for _, message := range []string{"Metrics updater stopped", "TURN server shutdown completed"} {
+		if lines, err := fleeting.logLines(message); err != nil || len(lines) == 0 {
+			return fmt.Errorf("%q was not logged on shutdown", message)
+		}
+	}
+	fmt.Println("✅ the uptime gauge was updated every METRICS_UPDATE_INTERVAL and its updater stopped on shutdown")
+	return nil
+}
+
+// testFloodedServer checks that a burst overflowing the smallest receive buffer the
+// kernel grants is counted, under a METRICS_NAMESPACE renaming every series
+func testFloodedServer(st *suite) (err error) {
+	flooded, err := st.s.launchSibling("saturn-flooded.log",
+		"HANDOFF_SOCKET_PATH=", "SOCKET_RCVBUF_BYTES=2048", "METRICS_NAMESPACE=saturn_flooded")
+	if err != nil {
+		return err
+	}
+	defer flooded.stop()
+	defer logOnFailure(&err, flooded)
+
+	flood, err := net.Dial("udp4", flooded.addr)
+	if err != nil {
+		return err
+	}
+	defer flood.Close()
+	burst := make([]byte, 1000)
+	overflows := metricCheck{"saturn_flooded_udp_rx_overflows_total", fmt.Sprintf(`listener_id="0",port="%d"`, flooded.port), 1}
+	if err := eventually(func() error {
+		for range 5000 {
+			_, _ = flood.Write(burst)
+		}
+		return flooded.expectMetrics(overflows)
+	}); err != nil {
+		return err
+	}
+	fmt.Println("✅ packets dropped by the kernel with the receive buffer full were counted")
+	exposition, err := flooded.metrics()
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(exposition, "\n") {
+		name := strings.TrimPrefix(strings.TrimPrefix(line, "# HELP "), "# TYPE ")
+		if strings.HasPrefix(name, "saturn_") && !strings.HasPrefix(name, "saturn_flooded_") {
+			return fmt.Errorf("series not renamed by METRICS_NAMESPACE: %s", line)
+		}
+	}
+	fmt.Println("✅ METRICS_NAMESPACE renamed every saturn series")
+
+	// A server whose metrics port is taken, here by the flooded server, exits with
+	// METRICS_FAIL_FATAL, and logs the bind address it could not listen on
+	return expectMetricsBindFailure(st.s, flooded.metricsAddr)
+}
+
+// expectMetricsBindFailure starts a server with METRICS_FAIL_FATAL on the metrics
+// address another server holds, and fails unless it logs the address and exits
+func expectMetricsBindFailure(s *server, metricsAddr string) error {
+	clashPort, err := freeUDPPort()
+	if err != nil {
+		return err
+	}
+	clash := exec.Command(s.binary)
+	clash.Dir = s.dir
+	clash.Env = append(append(os.Environ(), s.settings...),
+		"PORT="+strconv.Itoa(clashPort),
+		"METRICS_PORT="+strings.TrimPrefix(metricsAddr, "127.0.0.1:"),
+		"METRICS_FAIL_FATAL=true",
+		"LOG_OUTPUT=file:"+filepath.Join(s.dir, "saturn-clash.log"),
+		"HANDOFF_SOCKET_PATH=",
+		"EVENT_SOCKET_PATH=",
+	)
+	if err := clash.Start(); err != nil {
+		return err
+	}
+	clashed := &server{dir: s.dir, logFile: "saturn-clash.log"}
+	exited := make(chan error, 1)
+	go func() { exited <- clash.Wait() }()
+	select {
+	case err := <-exited:
+		if err == nil {
+			return fmt.Errorf("a server whose metrics port was taken exited without an error")
+		}
+	case <-time.After(10 * time.Second):
+		_ = clash.Process.Kill()
+		clashed.printLog()
+		return fmt.Errorf("a server whose metrics port was taken kept running with METRICS_FAIL_FATAL")
+	}
+	failures, err := clashed.logLines("Failed to start metrics server, exiting since METRICS_FAIL_FATAL is set")
+	if err != nil {
+		return err
+	}
+	if len(failures) == 0 || failures[0]["bind_addr"] != metricsAddr {
+		return fmt.Errorf("expected the metrics bind failure logged with bind_addr %s, got %v", metricsAddr, failures)
+	}
+	fmt.Println("✅ a server whose metrics port was taken logged the bind address and exited with METRICS_FAIL_FATAL")
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	stunBindingRequest = 0x0001
+	stunMagicCookie    = 0x2112A442
+	stunAttrSoftware   = 0x8022 // comprehension-optional, ignored by the server
+	stunHeaderSize     = 20
+)
+
+// bindingRequest builds a STUN binding request padded to roughly size bytes
+func bindingRequest(size int) []byte {
+	valueLen := size - stunHeaderSize - 4
+	valueLen -= valueLen % 4 // attributes are padded to 4 bytes
+
+	msg := make([]byte, stunHeaderSize+4+valueLen)
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(4+valueLen))
+	binary.BigEndian.PutUint32(msg[4:8], stunMagicCookie)
+	_, _ = rand.Read(msg[8:20])
+
+	binary.BigEndian.PutUint16(msg[20:22], stunAttrSoftware)
+	binary.BigEndian.PutUint16(msg[22:24], uint16(valueLen))
+	for i := 24; i < len(msg); i++ {
+		msg[i] = 'x'
+	}
+	return msg
+}
+
+// exchange sends the packet and reports whether the server answered
+func exchange(conn *net.UDPConn, packet []byte) bool {
+	if _, err := conn.Write(packet); err != nil {
+		fmt.Printf("❌ Failed to send packet: %v\n", err)
+		os.Exit(1)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	_, err := conn.Read(buf)
+	return err == nil
+}
+
+func main() {
+	// Get server address from environment variables
+	publicIP := os.Getenv("PUBLIC_IP")
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3478"
+	}
+	maxPacketSize := 1500
+	if value := os.Getenv("MAX_PACKET_SIZE"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			fmt.Printf("Error: invalid MAX_PACKET_SIZE %q\n", value)
+			os.Exit(1)
+		}
+		maxPacketSize = parsed
+	}
+
+	if publicIP == "" {
+		fmt.Println("Error: PUBLIC_IP environment variable is required")
+		fmt.Println("Please set it in your .env file or environment")
+		os.Exit(1)
+	}
+
+	serverAddr, err := net.ResolveUDPAddr("udp4", publicIP+":"+port)
+	if err != nil {
+		fmt.Printf("❌ Failed to resolve server address: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Testing Maximum Packet Size Guard")
+	fmt.Println("=================================")
+	fmt.Printf("Server: %s\n", serverAddr)
+	fmt.Printf("Max packet size: %d\n", maxPacketSize)
+	fmt.Println()
+
+	conn, err := net.DialUDP("udp4", nil, serverAddr)
+	if err != nil {
+		fmt.Printf("❌ Failed to connect to server: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	// A binding request at the limit must still be answered
+	fmt.Printf("Sending %d byte binding request...\n", maxPacketSize)
+	if !exchange(conn, bindingRequest(maxPacketSize)) {
+		fmt.Println("❌ Binding request within the limit was not answered")
+		os.Exit(1)
+	}
+	fmt.Println("Binding request within the limit answered")
+
+	// A jumbo binding request must be dropped before it reaches pion
+	jumbo := bindingRequest(maxPacketSize * 4)
+	fmt.Printf("Sending %d byte jumbo binding request...\n", len(jumbo))
+	if exchange(conn, jumbo) {
+		fmt.Println("❌ Jumbo binding request was answered but should have been dropped")
+		os.Exit(1)
+	}
+	fmt.Println("Jumbo binding request dropped as expected")
+
+	fmt.Println()
+	fmt.Println("Packet size guard test completed successfully!")
+	fmt.Println("Check saturn_oversized_packets_dropped_total on the metrics endpoint")
+}
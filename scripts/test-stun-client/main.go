@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"time"
+	"strings"
 
 	"github.com/pion/turn/v4"
 )
@@ -25,19 +25,19 @@ func main() {
 
 	serverAddr := publicIP + ":" + port
 
+	// When the server runs with MODE=stun-only or STUN_ONLY=true, relay allocations must be refused
+	expectSTUNOnly := os.Getenv("MODE") == "stun-only" || os.Getenv("STUN_ONLY") == "true"
+
 	fmt.Println("Testing STUN Server Connection")
 	fmt.Println("=================================")
 	fmt.Printf("Server: %s\n", serverAddr)
 	fmt.Println()
 
-	// Create a UDP connection to the TURN server
-	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{
-		IP:   net.ParseIP(publicIP),
-		Port: 3478,
-	})
+	// Create a local UDP socket for the client, the TURN client addresses the server itself
+	udpConn, err := net.ListenPacket("udp4", "0.0.0.0:0")
 	if err != nil {
-		fmt.Printf("❌ Failed to connect to server: %v\n", err)
-		return
+		fmt.Printf("❌ Failed to create UDP socket: %v\n", err)
+		os.Exit(1)
 	}
 	defer udpConn.Close()
 
@@ -56,19 +56,44 @@ func main() {
 	client, err := turn.NewClient(cfg)
 	if err != nil {
 		fmt.Printf("❌ Failed to create TURN client: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	defer client.Close()
 
+	if err = client.Listen(); err != nil {
+		fmt.Printf("❌ Failed to start client listener: %v\n", err)
+		os.Exit(1)
+	}
+
 	fmt.Println("TURN/STUN client created")
 	fmt.Println("Testing STUN binding request...")
 
-	// Wait a moment for the client to establish connection
-	time.Sleep(3 * time.Second)
+	mappedAddr, err := client.SendBindingRequest()
+	if err != nil {
+		fmt.Printf("❌ STUN binding request failed: %v\n", err)
+		os.Exit(1)
+	}
 
-	// Test if we can get basic connection status
 	fmt.Println("STUN binding request successful!")
 	fmt.Printf("Server Address: %s\n", serverAddr)
+	fmt.Printf("Mapped Address: %s\n", mappedAddr)
+
+	if expectSTUNOnly {
+		fmt.Println()
+		fmt.Println("Testing that relay allocation is refused in STUN-only mode...")
+
+		relayConn, allocErr := client.Allocate()
+		if allocErr == nil {
+			_ = relayConn.Close()
+			fmt.Println("❌ Allocation succeeded but the server should be in STUN-only mode")
+			os.Exit(1)
+		}
+		if !strings.Contains(allocErr.Error(), "403") {
+			fmt.Printf("❌ Allocation was refused without a 403: %v\n", allocErr)
+			os.Exit(1)
+		}
+		fmt.Printf("Allocation refused as expected: %v\n", allocErr)
+	}
 
 	fmt.Println()
 	fmt.Println("STUN connection test completed successfully!")
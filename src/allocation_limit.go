@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// MAX_TOTAL_ALLOCATIONS, the cap of open relay allocations across every realm, 0 disables
+	maxTotalAllocations int64
+
+	// Whether the open relay allocations reached MAX_TOTAL_ALLOCATIONS, logged when it changes
+	totalAllocationsCapped atomic.Bool
+)
+
+// InitTotalAllocationLimit caps the relay allocations open at once across every realm
+func InitTotalAllocationLimit(config *Config) {
+	maxTotalAllocations = int64(config.MaxTotalAllocations)
+	log.Info().Int("max_total_allocations", config.MaxTotalAllocations).Msg("Global allocation limit configured")
+}
+
+// TotalAllocationLimitReached reports whether the open relay allocations reached
+// MAX_TOTAL_ALLOCATIONS, so new clients must be refused
+func TotalAllocationLimitReached() bool {
+	return maxTotalAllocations > 0 && ActiveAllocations() >= maxTotalAllocations
+}
+
+// noteTotalAllocations logs when the number of open relay allocations reaches
+// MAX_TOTAL_ALLOCATIONS, and when it drops below it again
+func noteTotalAllocations(active int64) {
+	if maxTotalAllocations <= 0 {
+		return
+	}
+	if active >= maxTotalAllocations {
+		if totalAllocationsCapped.CompareAndSwap(false, true) {
+			log.Warn().
+				Int64("active_allocations", active).
+				Int64("max_total_allocations", maxTotalAllocations).
+				Msg("Global allocation limit reached - new clients are refused")
+		}
+	} else if totalAllocationsCapped.CompareAndSwap(true, false) {
+		log.Info().
+			Int64("active_allocations", active).
+			Int64("max_total_allocations", maxTotalAllocations).
+			Msg("Global allocation limit cleared - new clients are accepted again")
+	}
+}
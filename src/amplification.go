@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"runtime/debug"
+
+	"github.com/pion/stun/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// Reasons a packet is suspected of amplification abuse, recorded in
+// saturn_amplification_suspected_total
+const (
+	AmplificationSpoofedSource          = "spoofed_source"          // Request from a source no client can have
+	AmplificationResponseRatio          = "response_ratio"          // Response too large for the request it answers
+	AmplificationUnauthenticatedBinding = "unauthenticated_binding" // Binding request without valid credentials under STUN_REQUIRE_AUTH
+)
+
+// minAmplificationMaxRatio is the smallest AMPLIFICATION_MAX_RATIO accepted. The
+// response to a bare 20 byte binding request from an IPv6 client is 52 bytes.
+const minAmplificationMaxRatio = 2.6
+
+// stunTransactionIDOffset is where the transaction ID starts in the STUN header
+const stunTransactionIDOffset = 8
+
+// defaultReflectionPorts is the default AMPLIFICATION_REFLECTION_PORTS, the source
+// ports of services commonly abused for reflection: echo, qotd, chargen, DNS, TFTP,
+// portmap, NTP, NetBIOS, SNMP, CLDAP, SSDP, WS-Discovery and memcached. STUN and mDNS
+// ports are left out, since clients and peers legitimately send from them.
+const defaultReflectionPorts = "7,17,19,53,69,111,123,137,161,389,1900,3702,11211"
+
+// unroutableSourceNetworks are source ranges a request cannot have arrived from
+var unroutableSourceNetworks = mustParseCIDRList(
+	"0.0.0.0/8,224.0.0.0/4,240.0.0.0/4,::/128,ff00::/8",
+)
+
+// stunRequest is the transaction ID and size of the last STUN request read by a
+// listener, the response to it is measured against its size
+type stunRequest struct {
+	transactionID [stun.TransactionIDSize]byte
+	size          int
+}
+
+// AmplificationGuard drops the STUN traffic that makes a TURN server useful as an
+// amplifier: requests from spoofed-looking sources, responses much larger than the
+// request they answer and, with STUN_REQUIRE_AUTH, binding requests without valid
+// credentials. It runs on every inbound packet before pion parses it and on every
+// response pion writes, so only the STUN header is looked at unless a binding
+// request has to be authenticated.
+type AmplificationGuard struct {
+	maxRatio        float64       // Responses larger than this multiple of their request are dropped, 0 disables
+	reflectionPorts map[int]bool  // Source ports a request is almost always spoofed from
+	requireAuth     bool          // Binding requests must be authenticated
+	authenticator   Authenticator // Authenticates binding requests, which pion never does
+	realm           string        // Configured realm, the realm label of refused bindings
+}
+
+var (
+	// Global amplification guard instance, nil when both AMPLIFICATION_MAX_RATIO and
+	// STUN_REQUIRE_AUTH are disabled
+	Amplification *AmplificationGuard
+)
+
+// InitAmplificationGuard initializes the global amplification guard, authenticating
+// binding requests with the server's authenticator under STUN_REQUIRE_AUTH
+func InitAmplificationGuard(config *Config, authenticator Authenticator) {
+	ports, _ := parsePortList(config.ReflectionPorts) // Checked by config.Validate
+	reflectionPorts := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		reflectionPorts[port] = true
+	}
+	Amplification = &AmplificationGuard{
+		maxRatio:        config.AmplificationMaxRatio,
+		reflectionPorts: reflectionPorts,
+		requireAuth:     config.STUNRequireAuth,
+		authenticator:   authenticator,
+		realm:           config.Realm,
+	}
+	log.Info().
+		Float64("amplification_max_ratio", config.AmplificationMaxRatio).
+		Ints("reflection_ports", ports).
+		Bool("stun_require_auth", config.STUNRequireAuth).
+		Msg("STUN amplification guard enabled")
+}
+
+// Inspect checks an inbound packet and returns why it is suspected of amplification
+// abuse, or an empty string when it may be passed to pion.
+// Only STUN requests are inspected, channel data and indications get no response.
+func (g *AmplificationGuard) Inspect(packet []byte, addr net.Addr, realm string) string {
+	if !isSTUNRequest(packet) {
+		return ""
+	}
+
+	if g.spoofedLookingSource(addr) {
+		return AmplificationSpoofedSource
+	}
+
+	if g.requireAuth && binary.BigEndian.Uint16(packet[0:2]) == stun.BindingRequest.Value() &&
+		!g.authenticatedBinding(packet, addr, realm) {
+		return AmplificationUnauthenticatedBinding
+	}
+	return ""
+}
+
+// Oversized reports whether a response written to a client is larger than allowed
+// for the request it answers
+func (g *AmplificationGuard) Oversized(response []byte, request *stunRequest) bool {
+	if g.maxRatio <= 0 || request == nil || !isSTUNResponse(response) {
+		return false
+	}
+	if string(response[stunTransactionIDOffset:stunTransactionIDOffset+stun.TransactionIDSize]) != string(request.transactionID[:]) {
+		return false // Not the answer to the last request, e.g. a data indication
+	}
+	return float64(len(response)) > g.maxRatio*float64(request.size)
+}
+
+// newSTUNRequest returns the request to measure the response to a packet against,
+// or nil when the packet is not a STUN request
+func newSTUNRequest(packet []byte) *stunRequest {
+	if !isSTUNRequest(packet) {
+		return nil
+	}
+	request := &stunRequest{size: len(packet)}
+	copy(request.transactionID[:], packet[stunTransactionIDOffset:stunTransactionIDOffset+stun.TransactionIDSize])
+	return request
+}
+
+// authenticatedBinding reports whether a binding request carries a valid access
+// token as USERNAME and a MESSAGE-INTEGRITY computed with the same long-term key
+// the ALLOCATE request of that token would use. Sources that authenticated a TURN
+// request with the token are checked against the key the auth handler returned,
+// others are authenticated with the authenticator. The key is derived with the
+// REALM of the request, or the listener's realm when it has none.
+func (g *AmplificationGuard) authenticatedBinding(packet []byte, addr net.Addr, realm string) bool {
+	message := &stun.Message{Raw: append([]byte(nil), packet...)}
+	if err := message.Decode(); err != nil {
+		return false
+	}
+	if _, ok := requestKey(message, addr); ok {
+		return true
+	}
+
+	var username stun.Username
+	if err := username.GetFrom(message); err != nil {
+		return false
+	}
+	var requestRealm stun.Realm
+	if err := requestRealm.GetFrom(message); err == nil {
+		realm = requestRealm.String()
+	}
+	key, ok := g.authenticate(username.String(), realm, addr)
+	return ok && stun.MessageIntegrity(key).Check(message) == nil
+}
+
+// authenticate authenticates the token of a binding request with the authenticator.
+// It runs on the listener goroutine, so a panic is recovered like in the auth
+// handler instead of taking the server down, and the binding is refused.
+func (g *AmplificationGuard) authenticate(token, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			RecordAuthPanic()
+			denyAuthentication(g.realm, srcAddr, "", "internal_error")
+
+			log.Error().
+				Interface("panic", r).
+				Str("realm", g.realm).
+				Str("source_addr", srcAddr.String()).
+				Str("token_preview", safeTokenPreview(token)).
+				Str("stack", string(debug.Stack())).
+				Msg("Recovered from panic authenticating a binding request - binding dropped")
+			key, ok = nil, false
+		}
+	}()
+
+	_, key, ok = g.authenticator.Authenticate(token, realm, srcAddr)
+	return key, ok
+}
+
+// spoofedLookingSource reports whether a source address is one no client can have,
+// or the port of a service commonly abused for reflection
+func (g *AmplificationGuard) spoofedLookingSource(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	return udpAddr.Port == 0 || g.reflectionPorts[udpAddr.Port] || containsIP(unroutableSourceNetworks, udpAddr.IP)
+}
+
+// isSTUNRequest reports whether a packet is a STUN request
+func isSTUNRequest(packet []byte) bool {
+	return stun.IsMessage(packet) && stunClass(packet) == stun.ClassRequest
+}
+
+// isSTUNResponse reports whether a packet is a STUN success or error response
+func isSTUNResponse(packet []byte) bool {
+	if !stun.IsMessage(packet) {
+		return false
+	}
+	class := stunClass(packet)
+	return class == stun.ClassSuccessResponse || class == stun.ClassErrorResponse
+}
+
+// stunClass returns the class of a STUN message
+func stunClass(packet []byte) stun.MessageClass {
+	var messageType stun.MessageType
+	messageType.ReadValue(binary.BigEndian.Uint16(packet[0:2]))
+	return messageType.Class
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v4"
+)
+
+// fakeAuthenticator authenticates every token with the key of alice, or panics
+type fakeAuthenticator struct {
+	panics bool
+	calls  int
+}
+
+func (a *fakeAuthenticator) Authenticate(token, realm string, _ net.Addr) (Identity, []byte, bool) {
+	a.calls++
+	if a.panics {
+		panic("authenticator bug")
+	}
+	return Identity{UserID: "alice", Realm: testRealm}, turn.GenerateAuthKey(token, realm, "alice"), true
+}
+
+// useTestAmplificationGuard initializes the amplification guard from the test
+// configuration, restoring the previous guard after the test
+func useTestAmplificationGuard(t *testing.T, config *Config, authenticator Authenticator) *AmplificationGuard {
+	t.Helper()
+	previous := Amplification
+	t.Cleanup(func() { Amplification = previous })
+
+	InitAmplificationGuard(config, authenticator)
+	return Amplification
+}
+
+func TestSpoofedLookingSourceUsesConfiguredPorts(t *testing.T) {
+	config := useTestConfig(t)
+	config.ReflectionPorts = defaultReflectionPorts
+	guard := useTestAmplificationGuard(t, config, &fakeAuthenticator{})
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"192.0.2.1:53", true},
+		{"192.0.2.1:11211", true},
+		{"192.0.2.1:0", true},
+		{"192.0.2.1:3478", false},
+		{"192.0.2.1:5349", false},
+		{"192.0.2.1:5353", false},
+		{"192.0.2.1:40000", false},
+	}
+	for _, tt := range tests {
+		if got := guard.spoofedLookingSource(testAddr(t, tt.addr)); got != tt.want {
+			t.Errorf("spoofedLookingSource(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	config.ReflectionPorts = "40000"
+	guard = useTestAmplificationGuard(t, config, &fakeAuthenticator{})
+	if !guard.spoofedLookingSource(testAddr(t, "192.0.2.1:40000")) {
+		t.Error("configured port 40000 is not blocked")
+	}
+	if guard.spoofedLookingSource(testAddr(t, "192.0.2.1:53")) {
+		t.Error("port 53 is blocked although it is not configured")
+	}
+}
+
+// bindingRequest returns a binding request for token signed with key
+func bindingRequest(t *testing.T, token string, key []byte) []byte {
+	t.Helper()
+	return buildTestMessage(t,
+		stun.BindingRequest, stun.NewUsername(token), stun.NewRealm(testRealm),
+		stun.MessageIntegrity(key), stun.Fingerprint,
+	)
+}
+
+func TestAuthenticatedBinding(t *testing.T) {
+	config := useTestConfig(t)
+	useTestConnections(t)
+	authenticator := &fakeAuthenticator{}
+	guard := useTestAmplificationGuard(t, config, authenticator)
+	source := testAddr(t, "192.0.2.1:40000")
+
+	key := turn.GenerateAuthKey("token", testRealm, "alice")
+	if !guard.authenticatedBinding(bindingRequest(t, "token", key), source, testRealm) {
+		t.Error("binding signed with the token's key was refused")
+	}
+	if authenticator.calls != 1 {
+		t.Errorf("authenticator called %d times, want 1", authenticator.calls)
+	}
+	wrongKey := turn.GenerateAuthKey("token", testRealm, "mallory")
+	if guard.authenticatedBinding(bindingRequest(t, "token", wrongKey), source, testRealm) {
+		t.Error("binding signed with another key was accepted")
+	}
+
+	// A source that authenticated a TURN request is checked against its cached key
+	authenticator.calls = 0
+	authenticateTestSource(t, source, "token")
+	if !guard.authenticatedBinding(bindingRequest(t, "token", key), source, testRealm) {
+		t.Error("binding signed with the cached key was refused")
+	}
+	if authenticator.calls != 0 {
+		t.Errorf("authenticator called %d times for a cached key, want 0", authenticator.calls)
+	}
+}
+
+func TestAuthenticatedBindingRecoversPanic(t *testing.T) {
+	config := useTestConfig(t)
+	useTestConnections(t)
+	events := recordTestEvents(t)
+	guard := useTestAmplificationGuard(t, config, &fakeAuthenticator{panics: true})
+
+	key := turn.GenerateAuthKey("token", testRealm, "alice")
+	if guard.authenticatedBinding(bindingRequest(t, "token", key), testAddr(t, "192.0.2.1:40000"), testRealm) {
+		t.Error("binding was accepted although authentication panicked")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(events()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := events()
+	if len(got) != 1 || got[0].Type != EventAuthFailure || got[0].Reason != "internal_error" {
+		t.Errorf("events = %+v, want one internal_error auth failure", got)
+	}
+}
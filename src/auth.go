@@ -0,0 +1,302 @@
+package main
+
+import (
+	"net"
+	"runtime/debug"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Authenticator decides whether a TURN client may authenticate with a token.
+// It returns the identity the token carries and the long-term key pion checks the
+// MESSAGE-INTEGRITY of the client's requests with, which is derived with realm, the
+// REALM attribute the client sent. A refused token returns ok false and is recorded
+// by the implementation with its reason, see denyAuthentication.
+type Authenticator interface {
+	Authenticate(token, realm string, srcAddr net.Addr) (identity Identity, key []byte, ok bool)
+}
+
+// Identity is who a validated token authenticates. Limits, metrics and relays are
+// attributed to its realm rather than to the REALM attribute, which the client chooses.
+type Identity struct {
+	UserID string
+	Realm  string       // Realm of the token, as the configured realm its claim matched
+	Scope  []*net.IPNet // Peer networks the client's relays may reach, nil for every peer
+}
+
+// JWTAuthenticator is the default Authenticator. Tokens are JWTs signed with one of
+// TOKEN_ALGORITHMS and the key is derived from the token, the realm and the user ID,
+// so clients authenticate with the token as username and the user ID as password.
+type JWTAuthenticator struct {
+	config       *Config // Accepted realms, which the realm claim of accepted tokens matches
+	realm        string  // Configured realm, refusals are recorded under it
+	requiredRole string  // Role the token must grant, empty disables the check
+}
+
+// NewJWTAuthenticator creates the JWT authenticator for the configured token policy
+func NewJWTAuthenticator(config *Config) *JWTAuthenticator {
+	return &JWTAuthenticator{config: config, realm: config.Realm, requiredRole: config.RequiredRole}
+}
+
+// Authenticate validates the token and checks it grants the required role.
+// The scope claim of the token restricts the peers its relays may reach.
+// Refusals are recorded under the configured realm, not the client's REALM attribute.
+func (a *JWTAuthenticator) Authenticate(token, realm string, srcAddr net.Addr) (identity Identity, key []byte, ok bool) {
+	payload, err := ValidateToken(token)
+	if err != nil {
+		// The webhook gets the reason the token was refused for, so alerting can tell
+		// e.g. expired tokens from forged ones
+		denyAuthentication(a.realm, srcAddr, "", "token_validation_failed")
+		NotifyAuthFailure(sourceIP(srcAddr), a.realm, tokenFailureReason(err, "token_validation_failed"))
+
+		log.Error().
+			Err(err).
+			Str("realm", a.realm).
+			Str("source_addr", srcAddr.String()).
+			Str("token_reason", tokenFailureReason(err, TokenReasonParseError)).
+			Str("token_preview", safeTokenPreview(token)).
+			Msg("Token validation failed - authentication denied")
+		return Identity{}, nil, false
+	}
+
+	// Only tokens granting the required role may authenticate, so validly
+	// signed tokens issued for other purposes cannot allocate relays
+	if a.requiredRole != "" && !payload.HasRole(a.requiredRole) {
+		denyAuthentication(a.realm, srcAddr, payload.UserID, "role_not_permitted")
+		NotifyAuthFailure(sourceIP(srcAddr), a.realm, "role_not_permitted")
+
+		log.Warn().
+			Str("realm", a.realm).
+			Str("source_addr", srcAddr.String()).
+			Str("user_id", payload.UserID).
+			Str("role", payload.Role).
+			Strs("roles", payload.Roles).
+			Str("required_role", a.requiredRole).
+			Msg("Token lacks the required role - authentication denied")
+		return Identity{}, nil, false
+	}
+
+	// Claims.Validate only accepts realm claims matching REALM or one of REALMS, which
+	// may differ in case or whitespace with REALM_CASE_INSENSITIVE
+	tokenRealm, _ := a.config.AcceptedRealm(payload.Realm) // Checked by Claims.Validate
+	scope, _ := payload.PeerScope()                        // Checked by Claims.Validate
+	identity = Identity{UserID: payload.UserID, Realm: tokenRealm, Scope: scope}
+	return identity, turn.GenerateAuthKey(token, realm, payload.UserID), true
+}
+
+// NewAuthHandler creates the turn.AuthHandler pion calls every time a client
+// authenticates. The checks that hold whatever the strategy, the deny list, the
+// token size, STUN-only mode and the realm connection cap, are applied around the
+// authenticator, and every decision is recorded in the auth metrics and published
+// on the event socket.
+// The REALM attribute is chosen by the client, so it only goes into the key. Metrics,
+// events and logs carry the configured realm until the token is validated, and the
+// realm of the token after.
+func NewAuthHandler(config *Config, authenticator Authenticator) turn.AuthHandler {
+	stunOnly := config.IsSTUNOnly()
+
+	return func(token, clientRealm string, srcAddr net.Addr) (key []byte, ok bool) {
+		startTime := time.Now()
+		realm := config.Realm
+
+		// A panic while authenticating, e.g. on an unexpected claim type, denies
+		// this request instead of taking the whole server down
+		defer func() {
+			if r := recover(); r != nil {
+				RecordAuthPanic()
+				RecordAuthAttempt(realm, "failure")
+				denyAuthentication(realm, srcAddr, "", "internal_error")
+
+				log.Error().
+					Interface("panic", r).
+					Str("realm", realm).
+					Str("source_addr", srcAddr.String()).
+					Str("token_preview", safeTokenPreview(token)).
+					Str("stack", string(debug.Stack())).
+					Msg("Recovered from panic in auth handler - authentication denied")
+				key, ok = nil, false
+			}
+		}()
+
+		// Log authentication attempt with source address and realm
+		log.Info().
+			Str("realm", realm).
+			Str("source_addr", srcAddr.String()).
+			Str("token_preview", safeTokenPreview(token)).
+			Msg("TURN authentication attempt")
+		RecordAuthAttempt(realm, "attempt")
+
+		identity, key, ok := authorize(config, stunOnly, authenticator, token, clientRealm, srcAddr)
+
+		result := "failure"
+		if ok {
+			result = "success"
+		}
+		RecordAuthDuration(realm, result, time.Since(startTime))
+		RecordAuthAttempt(realm, result)
+		if !ok {
+			return nil, false
+		}
+
+		// The listeners verify and sign again the client's later requests with the key,
+		// see requestKey
+		Connections.SetAuthKey(srcAddr.String(), token, clientRealm, key)
+
+		RecordAuthSuccess(identity.Realm, identity.UserID)
+		PublishEvent(Event{
+			Type:       EventAuthSuccess,
+			Realm:      identity.Realm,
+			UserID:     identity.UserID,
+			SourceAddr: srcAddr.String(),
+		})
+
+		log.Info().
+			Str("realm", identity.Realm).
+			Str("source_addr", srcAddr.String()).
+			Str("user_id", identity.UserID).
+			Str("token_preview", safeTokenPreview(token)).
+			Msg("Token validation successful - authentication granted")
+		return key, true
+	}
+}
+
+// authorize applies the server's auth policy around the authenticator. clientRealm
+// is the REALM attribute, only used to derive the key.
+func authorize(config *Config, stunOnly bool, authenticator Authenticator, token, clientRealm string, srcAddr net.Addr) (identity Identity, key []byte, ok bool) {
+	realm := config.Realm
+
+	// Refuse denied sources before any other work is done
+	if IsDenied(srcAddr) {
+		denyAuthentication(realm, srcAddr, "", "ip_denied")
+		NotifyWebhook(WebhookEvent{
+			Type:     WebhookEventIPDenied,
+			SourceIP: sourceIP(srcAddr),
+			Realm:    realm,
+		})
+
+		log.Warn().
+			Str("realm", realm).
+			Str("source_addr", srcAddr.String()).
+			Msg("Source is on the deny list - authentication denied")
+		return Identity{}, nil, false
+	}
+
+	// In maintenance only sources that are already connected may authenticate,
+	// so their allocations keep being refreshed while no new clients arrive
+	if inMaintenance, reason := InMaintenance(); inMaintenance {
+		if _, _, active := Connections.Lookup(srcAddr.String()); !active {
+			denyAuthentication(realm, srcAddr, "", "maintenance")
+
+			log.Warn().
+				Str("realm", realm).
+				Str("source_addr", srcAddr.String()).
+				Str("maintenance_reason", reason).
+				Msg("Server is in maintenance - authentication denied")
+			return Identity{}, nil, false
+		}
+	}
+
+	// At MAX_TOTAL_ALLOCATIONS only sources that are already connected may authenticate,
+	// like in maintenance, whatever the limits of their realm
+	if TotalAllocationLimitReached() {
+		if _, _, active := Connections.Lookup(srcAddr.String()); !active {
+			denyAuthentication(realm, srcAddr, "", "global_limit")
+			RecordAllocationFailure(AllocationFailureQuota)
+
+			log.Warn().
+				Str("realm", realm).
+				Str("source_addr", srcAddr.String()).
+				Int64("active_allocations", ActiveAllocations()).
+				Int64("max_total_allocations", maxTotalAllocations).
+				Msg("Global allocation limit reached - authentication denied")
+			return Identity{}, nil, false
+		}
+	}
+
+	// Reject oversized tokens cheaply before any parsing work is done
+	if config.MaxTokenBytes > 0 && len(token) > config.MaxTokenBytes {
+		denyAuthentication(realm, srcAddr, "", "token_too_large")
+		NotifyAuthFailure(sourceIP(srcAddr), realm, "token_too_large")
+
+		log.Warn().
+			Str("realm", realm).
+			Str("source_addr", srcAddr.String()).
+			Int("token_bytes", len(token)).
+			Int("max_token_bytes", config.MaxTokenBytes).
+			Msg("Token too large - authentication denied")
+		return Identity{}, nil, false
+	}
+
+	// STUN binding requests are never authenticated, so any auth request
+	// in STUN-only mode is for a relay operation we do not offer. The metered
+	// listeners answer these with a 403 before they reach pion, a request that
+	// gets here anyway is answered by pion with a 400.
+	if stunOnly {
+		denyAuthentication(realm, srcAddr, "", "stun_only_mode")
+
+		log.Warn().
+			Str("realm", realm).
+			Str("source_addr", srcAddr.String()).
+			Msg("Relay request refused - server is running in STUN-only mode")
+		return Identity{}, nil, false
+	}
+
+	identity, key, ok = authenticator.Authenticate(token, clientRealm, srcAddr)
+	if !ok {
+		return Identity{}, nil, false
+	}
+
+	// Enforce the per-realm connection cap so one realm cannot starve the others.
+	// The cap counts the realm of the token, a client cannot escape it by sending
+	// another REALM attribute.
+	if !Connections.Acquire(identity.Realm, srcAddr.String(), identity.UserID, identity.Scope, config.MaxConnectionsPerRealm) {
+		denyAuthentication(identity.Realm, srcAddr, identity.UserID, "realm_connection_limit")
+		RecordAllocationFailure(AllocationFailureQuota)
+
+		log.Warn().
+			Str("realm", identity.Realm).
+			Str("source_addr", srcAddr.String()).
+			Str("user_id", identity.UserID).
+			Int("max_connections_per_realm", config.MaxConnectionsPerRealm).
+			Msg("Realm connection limit reached - authentication denied")
+		return Identity{}, nil, false
+	}
+
+	return identity, key, true
+}
+
+// denyAuthentication records an authentication refused for reason and publishes
+// it on the event socket. userID is empty when the token was not validated.
+func denyAuthentication(realm string, srcAddr net.Addr, userID, reason string) {
+	RecordAuthFailure(realm, reason)
+	PublishEvent(Event{
+		Type:       EventAuthFailure,
+		Realm:      realm,
+		UserID:     userID,
+		SourceAddr: srcAddr.String(),
+		Reason:     reason,
+	})
+}
+
+// requestKey returns the long-term key a request from source is signed with, when
+// the source authenticated with the USERNAME and REALM of the request before and its
+// MESSAGE-INTEGRITY was computed with that key. The key is the one the auth handler
+// returned to pion, so the token is not validated again on the packet path.
+func requestKey(message *stun.Message, source net.Addr) ([]byte, bool) {
+	var username stun.Username
+	var realm stun.Realm
+	if username.GetFrom(message) != nil || realm.GetFrom(message) != nil {
+		return nil, false
+	}
+	authUsername, authRealm, key, ok := Connections.AuthKey(source.String())
+	if !ok || authUsername != username.String() || authRealm != realm.String() {
+		return nil, false
+	}
+	if stun.MessageIntegrity(key).Check(message) != nil {
+		return nil, false
+	}
+	return key, true
+}
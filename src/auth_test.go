@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuthHandlerCapsConnectionsByTokenRealm(t *testing.T) {
+	config := useTestConfig(t)
+	config.MaxConnectionsPerRealm = 1
+	useTestConnections(t)
+	handler := NewAuthHandler(config, NewJWTAuthenticator(config))
+
+	token := signTestToken(t, testSecret, "alice", nil)
+	if _, ok := handler(token, "spoofed-1", testAddr(t, "192.0.2.1:40000")); !ok {
+		t.Fatal("first connection refused")
+	}
+	// Another REALM attribute does not open a connection cap of its own
+	if _, ok := handler(token, "spoofed-2", testAddr(t, "192.0.2.2:40000")); ok {
+		t.Fatal("second connection accepted beyond MAX_CONNECTIONS_PER_REALM")
+	}
+
+	realm, userID, ok := Connections.Lookup("192.0.2.1:40000")
+	if !ok || realm != testRealm || userID != "alice" {
+		t.Errorf("Lookup() = %q, %q, %v, want %q, alice, true", realm, userID, ok, testRealm)
+	}
+}
+
+func TestAuthHandlerCapsEachRealmSeparately(t *testing.T) {
+	config := useTestConfig(t)
+	config.Realms = "acme"
+	config.MaxConnectionsPerRealm = 1
+	useTestConnections(t)
+	handler := NewAuthHandler(config, NewJWTAuthenticator(config))
+
+	tests := []struct {
+		userID string
+		realm  string
+		source string
+		want   bool
+	}{
+		{"alice", testRealm, "192.0.2.1:40000", true},
+		{"bob", "acme", "192.0.2.2:40000", true}, // A full realm does not starve the others
+		{"carol", "acme", "192.0.2.3:40000", false},
+		{"dave", testRealm, "192.0.2.4:40000", false},
+	}
+	for _, tt := range tests {
+		token := signTestToken(t, testSecret, tt.userID, jwt.MapClaims{"realm": tt.realm})
+		if _, ok := handler(token, testRealm, testAddr(t, tt.source)); ok != tt.want {
+			t.Errorf("%s of realm %s accepted = %v, want %v", tt.userID, tt.realm, ok, tt.want)
+		}
+	}
+
+	if realm, userID, ok := Connections.Lookup("192.0.2.2:40000"); !ok || realm != "acme" || userID != "bob" {
+		t.Errorf("Lookup() = %q, %q, %v, want acme, bob, true", realm, userID, ok)
+	}
+}
+
+func TestJWTAuthenticatorReturnsConfiguredRealm(t *testing.T) {
+	config := useTestConfig(t)
+	config.RealmCaseInsensitive = true
+
+	token := signTestToken(t, testSecret, "alice", jwt.MapClaims{"realm": " TEST "})
+	identity, key, ok := NewJWTAuthenticator(config).Authenticate(token, "client-realm", testAddr(t, "192.0.2.1:40000"))
+	if !ok {
+		t.Fatal("Authenticate() refused the token")
+	}
+	if identity.Realm != testRealm || identity.UserID != "alice" {
+		t.Errorf("identity = %+v, want realm %q and user alice", identity, testRealm)
+	}
+	if len(key) == 0 {
+		t.Error("Authenticate() returned no key")
+	}
+}
+
+func TestJWTAuthenticatorReturnsCoHostedRealm(t *testing.T) {
+	config := useTestConfig(t)
+	config.Realms = "acme, globex"
+	config.RealmCaseInsensitive = true
+	authenticator := NewJWTAuthenticator(config)
+
+	for claim, want := range map[string]string{"acme": "acme", " GLOBEX ": "globex", "TEST": testRealm} {
+		token := signTestToken(t, testSecret, "alice", jwt.MapClaims{"realm": claim})
+		identity, _, ok := authenticator.Authenticate(token, testRealm, testAddr(t, "192.0.2.1:40000"))
+		if !ok || identity.Realm != want {
+			t.Errorf("Authenticate() of a token for %q = %+v, %v, want realm %q", claim, identity, ok, want)
+		}
+	}
+
+	token := signTestToken(t, testSecret, "alice", jwt.MapClaims{"realm": "initech"})
+	if _, _, ok := authenticator.Authenticate(token, "initech", testAddr(t, "192.0.2.1:40000")); ok {
+		t.Error("Authenticate() accepted a token for a realm in neither REALM nor REALMS")
+	}
+}
+
+func TestAuthHandlerLabelsEventsWithTokenRealm(t *testing.T) {
+	config := useTestConfig(t)
+	useTestConnections(t)
+	events := recordTestEvents(t)
+	handler := NewAuthHandler(config, NewJWTAuthenticator(config))
+
+	client := testAddr(t, "192.0.2.1:40000")
+	if _, ok := handler(signTestToken(t, "wrong-secret-0123456789abcdefghij", "alice", nil), "spoofed", client); ok {
+		t.Fatal("token signed with another secret accepted")
+	}
+	if _, ok := handler(signTestToken(t, testSecret, "alice", nil), "spoofed", client); !ok {
+		t.Fatal("valid token refused")
+	}
+
+	published := events()
+	if len(published) != 2 || published[0].Type != EventAuthFailure || published[1].Type != EventAuthSuccess {
+		t.Fatalf("events = %+v, want an auth failure and an auth success", published)
+	}
+	for _, event := range published {
+		if event.Realm != testRealm {
+			t.Errorf("%s event realm = %q, want %q", event.Type, event.Realm, testRealm)
+		}
+	}
+}
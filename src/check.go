@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// configCheck collects the results of a configuration check for the report
+type configCheck struct {
+	out    io.Writer
+	failed bool
+}
+
+// pass reports a successful check
+func (c *configCheck) pass(format string, args ...any) {
+	fmt.Fprintf(c.out, "[ OK ] %s\n", fmt.Sprintf(format, args...))
+}
+
+// fail reports a failed check
+func (c *configCheck) fail(format string, args ...any) {
+	c.failed = true
+	fmt.Fprintf(c.out, "[FAIL] %s\n", fmt.Sprintf(format, args...))
+}
+
+// RunConfigCheck validates the configuration without starting any listeners and
+// prints a report to out. It returns true when the configuration is usable.
+// This is meant for CI/CD and deploy preflight checks.
+func RunConfigCheck(config *Config, out io.Writer) bool {
+	check := &configCheck{out: out}
+
+	fmt.Fprintln(out, "Saturn configuration check")
+	fmt.Fprintln(out, "==========================")
+
+	if err := config.Validate(); err != nil {
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			check.fail("%s", problem)
+		}
+	} else {
+		check.pass("configuration values are valid")
+	}
+
+	// Resolve every bind address the listeners would use
+	network := "udp"
+	if config.IPv4Only {
+		network = "udp4"
+	}
+	ports := config.ListenPorts()
+	for _, bindAddress := range config.ListenAddresses() {
+		addr, err := net.ResolveUDPAddr(network, net.JoinHostPort(bindAddress, strconv.Itoa(ports[0])))
+		if err != nil {
+			check.fail("bind address %q does not resolve: %v", bindAddress, err)
+			continue
+		}
+		check.pass("bind address %q resolves to %s", bindAddress, addr)
+	}
+	if len(ports) > 1 {
+		check.pass("listening on ports %v", ports)
+	}
+
+	relayBindAddress := config.RelayListenAddress()
+	if addr, err := net.ResolveUDPAddr(network, net.JoinHostPort(relayBindAddress, "0")); err != nil {
+		check.fail("relay bind address %q does not resolve: %v", relayBindAddress, err)
+	} else {
+		check.pass("relays bind on %q, resolved to %s", relayBindAddress, addr.IP)
+	}
+
+	if config.PublicIP == PublicIPAuto {
+		if ip, err := DiscoverPublicIP(config); err != nil {
+			check.fail("public IP discovery: %v", err)
+		} else {
+			check.pass("public IP %s discovered through STUN", ip)
+		}
+	} else if ip := net.ParseIP(config.PublicIP); ip != nil {
+		check.pass("public IP %s", ip)
+	}
+	if ip := net.ParseIP(config.RelayAdvertisedIP()); ip != nil {
+		check.pass("relay addresses advertise %s", ip)
+	}
+
+	// Verify key files parse so a bad deploy fails here instead of at startup
+	if config.DenyCIDRsFile != "" {
+		if networks, err := loadDenyList(config.DenyCIDRsFile); err != nil {
+			check.fail("deny list %s: %v", config.DenyCIDRsFile, err)
+		} else {
+			check.pass("deny list %s parses, %d entries", config.DenyCIDRsFile, len(networks))
+		}
+	}
+
+	if config.TokenRSAPublicKeyFile != "" {
+		data, err := os.ReadFile(config.TokenRSAPublicKeyFile)
+		if err == nil {
+			_, err = jwt.ParseRSAPublicKeyFromPEM(data)
+		}
+		if err != nil {
+			check.fail("RSA public key %s: %v", config.TokenRSAPublicKeyFile, err)
+		} else {
+			check.pass("RSA public key %s parses", config.TokenRSAPublicKeyFile)
+		}
+	}
+
+	if config.TokenEdPublicKeyFile != "" {
+		if _, err := LoadEd25519PublicKey(config.TokenEdPublicKeyFile); err != nil {
+			check.fail("Ed25519 public key %s: %v", config.TokenEdPublicKeyFile, err)
+		} else {
+			check.pass("Ed25519 public key %s parses", config.TokenEdPublicKeyFile)
+		}
+	}
+
+	if config.TokenJWKSURL != "" {
+		keys := &RSAKeySet{jwksURL: config.TokenJWKSURL, client: &http.Client{Timeout: jwksFetchTimeout}}
+		if err := keys.refresh(); err != nil {
+			check.fail("JWKS %s: %v", config.TokenJWKSURL, err)
+		} else {
+			check.pass("JWKS %s loads %d keys", config.TokenJWKSURL, len(keys.jwks))
+		}
+	}
+
+	if config.EnableMetrics && config.MetricsTLSEnabled() {
+		if _, err := MetricsTLSConfig(config); err != nil {
+			check.fail("metrics TLS: %v", err)
+		} else {
+			check.pass("metrics TLS certificate loads")
+		}
+	}
+
+	if config.EnableDTLS {
+		if _, err := DTLSConfig(config); err != nil {
+			check.fail("DTLS: %v", err)
+		} else {
+			check.pass("DTLS certificate loads")
+		}
+	}
+
+	if config.EnableWebSocket && config.WebSocketCert != "" {
+		if _, err := WebSocketTLSConfig(config); err != nil {
+			check.fail("WebSocket: %v", err)
+		} else {
+			check.pass("WebSocket certificate loads")
+		}
+	}
+
+	if check.failed {
+		fmt.Fprintln(out, "Configuration check failed")
+		return false
+	}
+	fmt.Fprintln(out, "Configuration check passed")
+	return true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// claimsFromMap builds the Claims of a parsed token. The claims checked by Validate
+// are read leniently, a claim of the wrong type reads as missing.
+func claimsFromMap(claims jwt.MapClaims) Claims {
+	payload := Claims{
+		UserID:     stringClaim(claims, "user_id"),
+		Email:      stringClaim(claims, "email"),
+		Username:   stringClaim(claims, "username"),
+		IsVerified: stringClaim(claims, "is_verified"),
+		Type:       stringClaim(claims, "type"),
+		Realm:      stringClaim(claims, "realm"),
+		Role:       stringClaim(claims, "role"),
+		Roles:      rolesClaim(claims),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer: issuerClaim(claims),
+		},
+	}
+	scope, ok := scopeClaim(claims)
+	payload.Scope, payload.scopeMalformed = scope, !ok
+	// Convert numeric dates from the token to proper time.Time objects
+	if exp, ok := claims["exp"].(float64); ok {
+		payload.ExpiresAt = jwt.NewNumericDate(time.Unix(int64(exp), 0))
+	}
+	if iat, ok := claims["iat"].(float64); ok {
+		payload.IssuedAt = jwt.NewNumericDate(time.Unix(int64(iat), 0))
+	}
+	return payload
+}
+
+// Validate checks the claims follow the rules for access tokens of this server:
+// the token names its user, the user is verified, the token belongs to one of the accepted realms and its issuer,
+// it is an access token with a role and a valid scope, and it expires, neither already nor too far in the future.
+// It returns a *TokenError for the first rule broken.
+func (c *Claims) Validate(config *Config) error {
+	// Allocations, quotas and logs are attributed to the user
+	if c.UserID == "" {
+		return &TokenError{Err: ErrUserIDMissing, Reason: TokenReasonUserIDMissing}
+	}
+
+	// Only verified users can use the token
+	switch {
+	case c.IsVerified == "":
+		return &TokenError{Err: ErrTokenNotVerified, Reason: TokenReasonIsVerifiedMissing}
+	case c.IsVerified != "true":
+		return &TokenError{Err: ErrTokenNotVerified, Reason: TokenReasonIsVerifiedFalse, Claim: c.IsVerified, Expected: "true"}
+	}
+
+	// Tokens from one environment or tenant cannot be used in another
+	if c.Realm == "" {
+		return &TokenError{Err: ErrRealmMismatch, Reason: TokenReasonRealmMissing, Expected: strings.Join(config.AcceptedRealms(), ",")}
+	}
+	realm, ok := config.AcceptedRealm(c.Realm)
+	if !ok {
+		return &TokenError{Err: ErrRealmMismatch, Reason: TokenReasonRealmMismatch, Claim: c.Realm, Expected: strings.Join(config.AcceptedRealms(), ",")}
+	}
+
+	// Tokens minted by another identity provider sharing the secret are refused
+	// when an issuer is configured for the token's realm
+	if expectedIssuer := config.ExpectedIssuerFor(realm); expectedIssuer != "" && c.Issuer != expectedIssuer {
+		return &TokenError{Err: ErrIssuerMismatch, Reason: TokenReasonIssuerMismatch, Claim: c.Issuer, Expected: expectedIssuer}
+	}
+
+	// Refresh tokens or other token types cannot be used for access
+	switch {
+	case c.Type == "":
+		return &TokenError{Err: ErrTokenType, Reason: TokenReasonTypeMissing, Expected: "ACCESS_TOKEN"}
+	case c.Type != "ACCESS_TOKEN":
+		return &TokenError{Err: ErrTokenType, Reason: TokenReasonTypeNotAccess, Claim: c.Type, Expected: "ACCESS_TOKEN"}
+	}
+
+	if c.Role == "" {
+		return &TokenError{Err: ErrRoleMissing, Reason: TokenReasonRoleMissing}
+	}
+
+	// A scope that cannot be parsed is refused rather than read as no restriction
+	if c.scopeMalformed {
+		return &TokenError{Err: ErrScopeInvalid, Reason: TokenReasonScopeInvalid}
+	}
+	if _, err := c.PeerScope(); err != nil {
+		return &TokenError{Err: ErrScopeInvalid, Reason: TokenReasonScopeInvalid, Claim: strings.Join(c.Scope, " "), Cause: err}
+	}
+
+	// Expiry is the only way a token is revoked, so every token must have one
+	if c.ExpiresAt == nil {
+		return &TokenError{Err: ErrExpiryMissing, Reason: TokenReasonExpiryMissing}
+	}
+
+	// Double-check expiration time in case the JWT library didn't properly validate it.
+	// It grants the same leeway as the library so both agree on when a token expires,
+	// and JWT_EXPIRY_DOUBLE_CHECK=false leaves the decision to the library alone
+	leeway := time.Duration(config.JWTLeeway) * time.Second
+	if config.JWTExpiryDoubleCheck && c.ExpiresAt.Add(leeway).Before(time.Now()) {
+		return &TokenError{Err: ErrTokenExpired, Reason: TokenReasonExpiredDoubleCheck, Claim: c.ExpiresAt.Format(time.RFC3339)}
+	}
+
+	// Short-lived tokens are what limits the damage of a leaked token
+	if config.MaxTokenTTL > 0 {
+		maxTTL := time.Duration(config.MaxTokenTTL) * time.Second
+		if ttl := time.Until(c.ExpiresAt.Time); ttl > maxTTL {
+			return &TokenError{Err: ErrTokenTTLTooLong, Reason: TokenReasonTTLTooLong, Claim: ttl.Round(time.Second).String(), Expected: maxTTL.String()}
+		}
+	}
+
+	return nil
+}
+
+// stringClaim returns a string claim, or an empty string when the token has none
+func stringClaim(claims jwt.MapClaims, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
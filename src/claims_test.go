@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestClaimsFromMapReadsUserClaimsLeniently(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{"missing", testClaims("", jwt.MapClaims{"user_id": nil, "email": nil, "username": nil})},
+		{"wrong type", testClaims("", jwt.MapClaims{"user_id": 42, "email": true, "username": []interface{}{"a"}})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := claimsFromMap(tt.claims)
+			if payload.UserID != "" || payload.Email != "" || payload.Username != "" {
+				t.Errorf("claims read as %q, %q, %q, want empty", payload.UserID, payload.Email, payload.Username)
+			}
+		})
+	}
+}
+
+func TestValidateTokenRefusesMissingUserID(t *testing.T) {
+	useTestConfig(t)
+
+	for name, userID := range map[string]interface{}{"missing": nil, "empty": "", "wrong type": 42} {
+		t.Run(name, func(t *testing.T) {
+			token := signTestToken(t, testSecret, "", jwt.MapClaims{"user_id": userID})
+			_, err := ValidateToken(token)
+			if !errors.Is(err, ErrUserIDMissing) {
+				t.Fatalf("ValidateToken() error = %v, want %v", err, ErrUserIDMissing)
+			}
+			if reason := tokenFailureReason(err, ""); reason != TokenReasonUserIDMissing {
+				t.Errorf("reason = %q, want %q", reason, TokenReasonUserIDMissing)
+			}
+		})
+	}
+}
+
+func TestValidateTokenAcceptsTokenWithoutEmailOrUsername(t *testing.T) {
+	useTestConfig(t)
+
+	token := signTestToken(t, testSecret, "alice", jwt.MapClaims{"email": nil, "username": nil})
+	claims, err := ValidateToken(token)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	if claims.UserID != "alice" {
+		t.Errorf("UserID = %q, want alice", claims.UserID)
+	}
+}
+
+func TestValidateTokenChecksIssuerOfTokenRealm(t *testing.T) {
+	config := useTestConfig(t)
+	config.ExpectedIssuer = "https://auth.example.com," + testRealm + "=https://auth.test.example.com,acme=https://auth.acme.example.com"
+	config.Realms = "acme,globex"
+	config.RealmCaseInsensitive = true
+
+	tests := []struct {
+		name   string
+		realm  string
+		issuer string
+		want   error
+	}{
+		{"issuer of the realm", testRealm, "https://auth.test.example.com", nil},
+		{"issuer of the realm, realm in another case", " TEST ", "https://auth.test.example.com", nil},
+		{"fallback issuer", testRealm, "https://auth.example.com", ErrIssuerMismatch},
+		{"fallback issuer, realm in another case", " TEST ", "https://auth.example.com", ErrIssuerMismatch},
+		{"issuer of a co-hosted realm", "acme", "https://auth.acme.example.com", nil},
+		{"issuer of a co-hosted realm, realm in another case", "ACME", "https://auth.acme.example.com", nil},
+		{"issuer of another realm", "acme", "https://auth.test.example.com", ErrIssuerMismatch},
+		{"fallback issuer of a co-hosted realm without its own", "globex", "https://auth.example.com", nil},
+		{"issuer of another realm for a realm without its own", "globex", "https://auth.acme.example.com", ErrIssuerMismatch},
+		{"realm not accepted", "initech", "https://auth.example.com", ErrRealmMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := signTestToken(t, testSecret, "alice", jwt.MapClaims{"realm": tt.realm, "iss": tt.issuer})
+			if _, err := ValidateToken(token); !errors.Is(err, tt.want) {
+				t.Errorf("ValidateToken() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// command is a subcommand of the binary, run with the arguments following its name
+// and returning the exit status
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+// commands are the subcommands of the binary, sharing the server's configuration
+// and token code so tooling cannot drift from what the server accepts
+var commands = []command{
+	{name: "serve", summary: "run the TURN server (default)", run: serve},
+	{name: "check-config", summary: "validate the configuration, print a report and exit", run: checkConfigCommand},
+	{name: "gen-token", summary: "print an access token the server accepts", run: genTokenCommand},
+	{name: "verify-token", summary: "validate an access token and print its claims", run: verifyTokenCommand},
+}
+
+// RunCommand runs the subcommand named by the first argument and returns its exit
+// status. Without a subcommand, or when the first argument is a flag, the server is
+// run, so invocations like `saturn --check-config` keep working.
+func RunCommand(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serve(args)
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	if args[0] != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	}
+	printCommands(os.Stderr)
+	if args[0] == "help" {
+		return 0
+	}
+	return 2
+}
+
+// printCommands prints the usage of the binary and its subcommands
+func printCommands(out io.Writer) {
+	fmt.Fprintln(out, "Usage: saturn [command] [flags]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-14s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Run saturn <command> -h for the flags of a command.")
+}
+
+// newCommandFlags creates the flags of a subcommand, with the -env-file flag every
+// subcommand reads the configuration with
+func newCommandFlags(name, usage string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: saturn %s %s\n\n", name, usage)
+		flags.PrintDefaults()
+	}
+	envFile := flags.String("env-file", "", "file to read settings from, same as ENV_FILE (default .env)")
+	return flags, envFile
+}
+
+// quietLogs keeps informational logs of the server code out of a tool's output,
+// only fatal errors are logged
+func quietLogs() {
+	zerolog.SetGlobalLevel(zerolog.FatalLevel)
+}
+
+// configCheckStatus runs the configuration check and returns the exit status
+func configCheckStatus(config *Config) int {
+	if !RunConfigCheck(config, os.Stdout) {
+		return 1
+	}
+	return 0
+}
+
+// checkConfigCommand validates the configuration without starting any listeners
+func checkConfigCommand(args []string) int {
+	flags, envFile := newCommandFlags("check-config", "[flags]")
+	_ = flags.Parse(args) // Exits on error
+
+	quietLogs()
+	return configCheckStatus(GetConfig(*envFile))
+}
+
+// genTokenCommand prints an HS256 access token signed with ACCESS_SECRET. The realm,
+// type, verification status and issuer come from the configuration, as for the
+// tokens served by /turn-credentials.
+func genTokenCommand(args []string) int {
+	flags, envFile := newCommandFlags("gen-token", "[flags]")
+	userID := flags.String("user-id", "test-user-123", "user ID of the token")
+	email := flags.String("email", "", "email of the token (default <user-id>@example.com)")
+	username := flags.String("username", "", "username of the token (default the user ID)")
+	role := flags.String("role", "user", "role of the token, REQUIRED_ROLE when it is set")
+	roles := flags.String("roles", "", "comma-separated additional roles")
+	scope := flags.String("scope", "", "comma-separated peer CIDRs or IPs relays may reach (default every peer)")
+	realm := flags.String("realm", "", "realm of the token (default REALM)")
+	ttl := flags.Duration("ttl", 24*time.Hour, "lifetime of the token, at most MAX_TOKEN_TTL")
+	_ = flags.Parse(args) // Exits on error
+
+	quietLogs()
+	config := GetConfig(*envFile)
+	if config.RequiredRole != "" && !isFlagSet(flags, "role") {
+		*role = config.RequiredRole
+	}
+	if *ttl <= 0 {
+		fmt.Fprintln(os.Stderr, "-ttl must be positive")
+		return 2
+	}
+	if config.MaxTokenTTL > 0 && *ttl > time.Duration(config.MaxTokenTTL)*time.Second {
+		fmt.Fprintf(os.Stderr, "-ttl %s exceeds MAX_TOKEN_TTL of %d seconds, the server would refuse the token\n", *ttl, config.MaxTokenTTL)
+		return 2
+	}
+
+	user := Claims{
+		UserID:   *userID,
+		Email:    *email,
+		Username: *username,
+		Role:     *role,
+		Realm:    *realm,
+	}
+	for _, r := range strings.Split(*roles, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			user.Roles = append(user.Roles, r)
+		}
+	}
+	for _, network := range strings.Split(*scope, ",") {
+		if network = strings.TrimSpace(network); network != "" {
+			user.Scope = append(user.Scope, network)
+		}
+	}
+	if _, err := user.PeerScope(); err != nil {
+		fmt.Fprintf(os.Stderr, "-scope: %v\n", err)
+		return 2
+	}
+	if user.Email == "" {
+		user.Email = *userID + "@example.com"
+	}
+	if user.Username == "" {
+		user.Username = *userID
+	}
+
+	token, err := MintAccessToken(config, user, *ttl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate the token: %v\n", err)
+		return 1
+	}
+	fmt.Println(token)
+	return 0
+}
+
+// verifyTokenCommand validates a token like the server does when a client
+// authenticates, and prints its claims or the reason it was refused
+func verifyTokenCommand(args []string) int {
+	flags, envFile := newCommandFlags("verify-token", "[flags] <token|->")
+	_ = flags.Parse(args) // Exits on error
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	token := flags.Arg(0)
+	if token == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			fmt.Fprintf(os.Stderr, "Failed to read the token: %v\n", err)
+			return 1
+		}
+		token = line
+	}
+	token = strings.TrimSpace(token)
+
+	quietLogs()
+	config := GetConfig(*envFile)
+	InitTokenKeys(config)
+
+	if config.MaxTokenBytes > 0 && len(token) > config.MaxTokenBytes {
+		fmt.Printf("Token refused: token_too_large (%d bytes, MAX_TOKEN_BYTES is %d)\n", len(token), config.MaxTokenBytes)
+		return 1
+	}
+	claims, err := ValidateToken(token)
+	if err != nil {
+		fmt.Printf("Token refused: %s (%v)\n", tokenFailureReason(err, "token_validation_failed"), err)
+		return 1
+	}
+	if config.RequiredRole != "" && !claims.HasRole(config.RequiredRole) {
+		fmt.Printf("Token refused: role_not_permitted (REQUIRED_ROLE is %q)\n", config.RequiredRole)
+		return 1
+	}
+
+	encoded, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode the claims: %v\n", err)
+		return 1
+	}
+	fmt.Println("Token accepted:")
+	fmt.Println(string(encoded))
+	return 0
+}
+
+// isFlagSet reports whether the flag was given on the command line
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
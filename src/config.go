@@ -1,8 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -11,40 +21,233 @@ import (
 )
 
 type Config struct {
-	PublicIP     string `mapstructure:"PUBLIC_IP"`
-	Port         int    `mapstructure:"PORT"`
-	AccessSecret string `mapstructure:"ACCESS_SECRET"`
-	LogLevel     string `mapstructure:"LOG_LEVEL"`
-	Version      string `mapstructure:"VERSION"`
-	Branch       string `mapstructure:"BRANCH"`
-	BuiltAt      string `mapstructure:"BUILT_AT"`
-	ThreadNum    int    `mapstructure:"THREAD_NUM"`
-	Realm        string `mapstructure:"REALM"`
-	BindAddress  string `mapstructure:"BIND_ADDRESS"` // Address to bind UDP server
-	IPv4Only     bool   `mapstructure:"IPV4_ONLY"`    // Force IPv4 only mode
+	PublicIP             string `mapstructure:"PUBLIC_IP"`              // "auto" discovers it through STUN_DISCOVERY_SERVERS
+	STUNDiscoveryServers string `mapstructure:"STUN_DISCOVERY_SERVERS"` // Comma-separated host:port STUN servers tried in order for PUBLIC_IP=auto
+	STUNDiscoveryTimeout int    `mapstructure:"STUN_DISCOVERY_TIMEOUT"` // Seconds to wait for each STUN server
+	AdvertisedIP         string `mapstructure:"ADVERTISED_IP"`          // IP advertised to clients as the relay address, defaults to PUBLIC_IP
+	RelayPublicIP        string `mapstructure:"RELAY_PUBLIC_IP"`        // IP clients connect to for relays, e.g. a load balancer's public IP
+	RelayPublicIPs       string `mapstructure:"RELAY_PUBLIC_IPS"`       // Comma-separated realm=IP pairs advertising a realm's relays on its own IP
+	RelayBindAddress     string `mapstructure:"RELAY_BIND_ADDRESS"`     // Internal address relays are bound on, defaults to the first bind address
+	RelayMinPort         int    `mapstructure:"RELAY_MIN_PORT"`         // First port relays are bound on, 0 with RELAY_MAX_PORT uses ephemeral ports
+	RelayMaxPort         int    `mapstructure:"RELAY_MAX_PORT"`         // Last port relays are bound on, inclusive
+	Port                 int    `mapstructure:"PORT"`
+	Ports                string `mapstructure:"PORTS"` // Comma-separated ports, overrides PORT when set, e.g. "3478,443"
+	AccessSecret         string `mapstructure:"ACCESS_SECRET"`
+	AccessSecretFile     string `mapstructure:"ACCESS_SECRET_FILE"`     // File holding ACCESS_SECRET, e.g. a mounted Kubernetes or Docker secret, overrides it
+	AccessSecretPrevious string `mapstructure:"ACCESS_SECRET_PREVIOUS"` // Accepted alongside ACCESS_SECRET during rotation
+	AccessSecrets        string `mapstructure:"ACCESS_SECRETS"`         // JSON array of further secrets accepted alongside ACCESS_SECRET, e.g. ["blue","green"]
+
+	// Token verification configuration
+	TokenAlgorithms       string  `mapstructure:"TOKEN_ALGORITHMS"`              // Comma-separated algorithms tried in order, e.g. "HS256,RS256"
+	TokenRSAPublicKeyFile string  `mapstructure:"TOKEN_RSA_PUBLIC_KEY_FILE"`     // PEM RSA public key for RS256
+	TokenJWKSURL          string  `mapstructure:"TOKEN_JWKS_URL"`                // JWKS endpoint with RSA keys for RS256
+	TokenEdPublicKeyFile  string  `mapstructure:"TOKEN_ED25519_PUBLIC_KEY_FILE"` // PEM Ed25519 public key for EdDSA
+	MaxTokenTTL           int     `mapstructure:"MAX_TOKEN_TTL"`                 // Seconds, tokens with a longer remaining lifetime are rejected, 0 disables
+	MaxTokenBytes         int     `mapstructure:"MAX_TOKEN_BYTES"`               // Larger tokens are rejected before parsing, 0 disables
+	JWTLeeway             int     `mapstructure:"JWT_LEEWAY"`                    // Seconds of clock skew tolerated on exp, nbf and iat
+	JWTExpiryDoubleCheck  bool    `mapstructure:"JWT_EXPIRY_DOUBLE_CHECK"`       // Re-check exp after the JWT library, false trusts the library
+	ExpectedIssuer        string  `mapstructure:"EXPECTED_ISSUER"`               // Required "iss" claim, or comma-separated realm=issuer pairs, empty disables
+	RequiredRole          string  `mapstructure:"REQUIRED_ROLE"`                 // Role the token's role or roles claim must include, empty disables
+	LogLevel              string  `mapstructure:"LOG_LEVEL"`
+	LogFormat             string  `mapstructure:"LOG_FORMAT"` // "json" (default) or "console"
+	LogOutput             string  `mapstructure:"LOG_OUTPUT"` // "stdout" (default), "stderr" or "file:/path"
+	Version               string  `mapstructure:"VERSION"`
+	Branch                string  `mapstructure:"BRANCH"`
+	BuiltAt               string  `mapstructure:"BUILT_AT"`
+	ThreadNum             int     `mapstructure:"THREAD_NUM"`
+	Realm                 string  `mapstructure:"REALM"`
+	Realms                string  `mapstructure:"REALMS"`                         // Comma-separated realms of co-hosted tenants accepted in tokens besides REALM
+	RealmCaseInsensitive  bool    `mapstructure:"REALM_CASE_INSENSITIVE"`         // Token realms match after trimming whitespace and folding case
+	BindAddress           string  `mapstructure:"BIND_ADDRESS"`                   // Address to bind UDP server
+	BindAddresses         string  `mapstructure:"BIND_ADDRESSES"`                 // Comma-separated addresses, overrides BIND_ADDRESS when set
+	IPv4Only              bool    `mapstructure:"IPV4_ONLY"`                      // Force IPv4 only mode
+	Mode                  string  `mapstructure:"MODE"`                           // "turn" (default) or "stun-only"
+	STUNOnly              bool    `mapstructure:"STUN_ONLY"`                      // Same as MODE=stun-only
+	MaxPacketSize         int     `mapstructure:"MAX_PACKET_SIZE"`                // Larger inbound packets are dropped, 0 disables
+	SocketRcvbufBytes     int     `mapstructure:"SOCKET_RCVBUF_BYTES"`            // SO_RCVBUF of the listeners, 0 keeps the kernel default
+	SocketSndbufBytes     int     `mapstructure:"SOCKET_SNDBUF_BYTES"`            // SO_SNDBUF of the listeners, 0 keeps the kernel default
+	SourcePPSLimit        int     `mapstructure:"SOURCE_PPS_LIMIT"`               // Inbound packets per second accepted from one source IP, 0 disables
+	AmplificationMaxRatio float64 `mapstructure:"AMPLIFICATION_MAX_RATIO"`        // STUN responses larger than this multiple of their request are dropped, 0 disables
+	STUNRequireAuth       bool    `mapstructure:"STUN_REQUIRE_AUTH"`              // Binding requests must carry an access token and MESSAGE-INTEGRITY
+	ReflectionPorts       string  `mapstructure:"AMPLIFICATION_REFLECTION_PORTS"` // Comma-separated source ports STUN requests are dropped from as spoofed
+	DenyCIDRsFile         string  `mapstructure:"DENY_CIDRS_FILE"`                // File of CIDRs refused authentication, reloaded on change, empty disables
+	CheckConfig           bool    `mapstructure:"CHECK_CONFIG"`                   // Validate the configuration and exit, same as --check-config
+	EnvFile               string  `mapstructure:"ENV_FILE"`                       // File the settings are read from, same as --env-file
+
+	// Connection limits
+	MaxConnectionsPerRealm int    `mapstructure:"MAX_CONNECTIONS_PER_REALM"` // 0 means unlimited
+	MaxPeersPerAllocation  int    `mapstructure:"MAX_PEERS_PER_ALLOCATION"`  // 0 means unlimited
+	BlockPrivatePeers      bool   `mapstructure:"BLOCK_PRIVATE_PEERS"`       // Refuses permissions for peers in private and bogon ranges
+	PeerAllowlist          string `mapstructure:"PEER_ALLOWLIST"`            // Comma-separated peer CIDRs relays may reach, empty allows all
+	MaxAllocationsPerUser  int    `mapstructure:"MAX_ALLOCATIONS_PER_USER"`  // 0 means unlimited
+	MaxTotalAllocations    int    `mapstructure:"MAX_TOTAL_ALLOCATIONS"`     // Open allocations across every realm, 0 means unlimited
+	MaxAllocationLifetime  int    `mapstructure:"MAX_ALLOCATION_LIFETIME"`   // Seconds, longer requested allocation lifetimes are clamped, 0 disables
+	NonceLifetime          int    `mapstructure:"NONCE_LIFETIME"`            // Seconds a nonce is accepted, older ones are answered with a 438
+	PermissionLifetime     int    `mapstructure:"PERMISSION_LIFETIME"`       // Seconds a permission lasts without a refresh
+	RedisURL               string `mapstructure:"REDIS_URL"`                 // Shares the allocation quota across nodes, empty counts in memory
 
 	// Metrics configuration
-	EnableMetrics   bool   `mapstructure:"ENABLE_METRICS"`
-	MetricsPort     int    `mapstructure:"METRICS_PORT"`
-	MetricsAuth     string `mapstructure:"METRICS_AUTH"`     // "none", "basic"
-	MetricsUsername string `mapstructure:"METRICS_USERNAME"` // For basic auth
-	MetricsPassword string `mapstructure:"METRICS_PASSWORD"` // For basic auth
-	MetricsBindIP   string `mapstructure:"METRICS_BIND_IP"`  // IP to bind metrics server
+	EnableMetrics           bool   `mapstructure:"ENABLE_METRICS"`
+	MetricsNamespace        string `mapstructure:"METRICS_NAMESPACE"` // Prefix of every metric name, e.g. "saturn_eu" for saturn_eu_auth_attempts_total
+	MetricsPort             int    `mapstructure:"METRICS_PORT"`
+	MetricsAuth             string `mapstructure:"METRICS_AUTH"`               // "none", "basic", "bearer"
+	MetricsUsername         string `mapstructure:"METRICS_USERNAME"`           // For basic auth
+	MetricsPassword         string `mapstructure:"METRICS_PASSWORD"`           // For basic auth
+	MetricsCredentials      string `mapstructure:"METRICS_CREDENTIALS"`        // Further basic auth username:password pairs, realm= restricts one to a realm
+	MetricsBearerToken      string `mapstructure:"METRICS_BEARER_TOKEN"`       // For bearer auth
+	MetricsAuthChallenge    bool   `mapstructure:"METRICS_AUTH_CHALLENGE"`     // Answer failed auth with 401 and WWW-Authenticate, false answers 403
+	MetricsBindIP           string `mapstructure:"METRICS_BIND_IP"`            // IP to bind metrics server
+	MetricsAllowlist        string `mapstructure:"METRICS_IP_ALLOWLIST"`       // Comma-separated CIDRs allowed to reach metrics, empty allows all
+	MetricsTLSCert          string `mapstructure:"METRICS_TLS_CERT"`           // PEM certificate, serves metrics over HTTPS together with METRICS_TLS_KEY
+	MetricsTLSKey           string `mapstructure:"METRICS_TLS_KEY"`            // PEM private key for METRICS_TLS_CERT
+	MetricsMTLSCA           string `mapstructure:"METRICS_MTLS_CA"`            // PEM CA bundle, clients must present a certificate it signed
+	MetricsClientCA         string `mapstructure:"METRICS_CLIENT_CA"`          // Same as METRICS_MTLS_CA
+	AuthDurationBuckets     string `mapstructure:"AUTH_DURATION_BUCKETS"`      // Comma-separated seconds, empty uses 100µs to 5s buckets
+	MaxUserLabelCardinality int    `mapstructure:"MAX_USER_LABEL_CARDINALITY"` // Distinct user_id label values, further users share "_overflow", 0 means unlimited
+	TrackPerUserTraffic     bool   `mapstructure:"TRACK_PER_USER_TRAFFIC"`     // Records relayed megabytes per user, off by default for the label cardinality
+	FDWarningThreshold      int    `mapstructure:"FD_WARNING_THRESHOLD"`       // Percent of the file descriptor limit in use before warning, 0 disables
+	MetricsUpdateInterval   int    `mapstructure:"METRICS_UPDATE_INTERVAL"`    // Seconds between updates of the uptime, memory and allocation gauges
+	MetricsFailFatal        bool   `mapstructure:"METRICS_FAIL_FATAL"`         // Exit when the metrics server cannot start, false runs without metrics
+
+	// TURN credentials endpoint configuration
+	EnableTURNCredentials    bool   `mapstructure:"ENABLE_TURN_CREDENTIALS"`     // Serves /turn-credentials on the metrics server
+	TURNCredentialsTTL       int    `mapstructure:"TURN_CREDENTIALS_TTL"`        // Seconds the issued credentials stay valid
+	TURNCredentialsURIs      string `mapstructure:"TURN_CREDENTIALS_URIS"`       // Comma-separated URIs returned to clients, empty derives them from the advertised IP
+	TURNCredentialsRateLimit int    `mapstructure:"TURN_CREDENTIALS_RATE_LIMIT"` // Requests per second accepted from one source IP, 0 disables
+
+	// DTLS transport configuration
+	EnableDTLS bool   `mapstructure:"ENABLE_DTLS"` // Serve TURN over DTLS (RFC 7350) alongside UDP
+	DTLSPort   int    `mapstructure:"DTLS_PORT"`   // Port the DTLS listeners are bound on at every bind address
+	DTLSCert   string `mapstructure:"DTLS_CERT"`   // PEM certificate presented to DTLS clients
+	DTLSKey    string `mapstructure:"DTLS_KEY"`    // PEM private key of DTLS_CERT
+
+	// WebSocket transport configuration
+	EnableWebSocket bool   `mapstructure:"ENABLE_WEBSOCKET"` // Serve TURN over WebSocket alongside UDP
+	WebSocketPort   int    `mapstructure:"WEBSOCKET_PORT"`   // TCP port the WebSocket listeners are bound on at every bind address
+	WebSocketPath   string `mapstructure:"WEBSOCKET_PATH"`   // HTTP path clients upgrade to WebSocket on
+	WebSocketCert   string `mapstructure:"WEBSOCKET_CERT"`   // PEM certificate for wss, empty serves plain ws behind a TLS proxy
+	WebSocketKey    string `mapstructure:"WEBSOCKET_KEY"`    // PEM private key of WEBSOCKET_CERT
+
+	// PROXY protocol configuration, honored on the WebSocket listeners only
+	WebSocketProxyProtocol         bool `mapstructure:"WEBSOCKET_PROXY_PROTOCOL"`          // Read client addresses from PROXY protocol headers on the WebSocket listeners
+	WebSocketProxyProtocolRequired bool `mapstructure:"WEBSOCKET_PROXY_PROTOCOL_REQUIRED"` // Close connections without a PROXY header, false keeps their TCP peer address
+
+	// Event socket configuration
+	EventSocketPath string `mapstructure:"EVENT_SOCKET_PATH"` // Unix socket streaming auth and allocation events, empty disables
+
+	// Restart handoff configuration
+	HandoffSocketPath string `mapstructure:"HANDOFF_SOCKET_PATH"` // Unix socket passing packets between an old and a new process, empty disables
+	StartupReadyFile  string `mapstructure:"STARTUP_READY_FILE"`  // File written once every listener is bound, empty disables
+
+	// Maintenance configuration
+	MaintenanceMode bool `mapstructure:"MAINTENANCE_MODE"` // Start in maintenance, refusing new clients, see /admin/maintenance
+
+	// Webhook configuration
+	WebhookURL                  string `mapstructure:"WEBHOOK_URL"`                    // Empty disables webhooks
+	WebhookAuthFailureThreshold int    `mapstructure:"WEBHOOK_AUTH_FAILURE_THRESHOLD"` // Failures from one IP before notifying
+	WebhookAuthFailureWindow    int    `mapstructure:"WEBHOOK_AUTH_FAILURE_WINDOW"`    // Seconds over which failures are counted
+	WebhookDebounce             int    `mapstructure:"WEBHOOK_DEBOUNCE"`               // Seconds between repeated events for the same source
+	WebhookMaxAttempts          int    `mapstructure:"WEBHOOK_MAX_ATTEMPTS"`           // Delivery attempts per batch, 1 disables retries
+
+	// Traffic persistence configuration
+	TrafficStatePath          string `mapstructure:"TRAFFIC_STATE_PATH"`           // File to persist lifetime traffic totals, empty disables
+	TrafficStateFlushInterval int    `mapstructure:"TRAFFIC_STATE_FLUSH_INTERVAL"` // Seconds between flushes
 }
 
+// Server modes supported by the MODE setting
+const (
+	ModeTURN     = "turn"      // STUN binding and TURN relaying
+	ModeSTUNOnly = "stun-only" // STUN binding only, allocations are refused
+)
+
+// metricsNamespacePattern matches the metric name prefixes Prometheus accepts
+var metricsNamespacePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// PublicIPAuto is the PUBLIC_IP value that discovers the public IP through STUN
+const PublicIPAuto = "auto"
+
 var (
 	Conf Config
 	once sync.Once
+
+	// Where each setting was taken from, keyed by setting name
+	settingSources map[string]string
+)
+
+// Sources a setting can be taken from, reported by SettingSources
+const (
+	SettingSourceDefault = "default"  // Built-in default
+	SettingSourceEnvFile = "env_file" // The env file, .env unless ENV_FILE or --env-file select another
+	SettingSourceEnv     = "env"      // An environment variable
+	SettingSourceFlag    = "flag"     // A command line flag
 )
 
-// Get are responsible to load env and get data an return the struct
-func GetConfig() *Config {
+// defaultEnvFile is the file the settings are read from without ENV_FILE or --env-file
+const defaultEnvFile = ".env"
+
+// Get are responsible to load env and get data an return the struct.
+// Settings are read from envFile, or from ENV_FILE or .env when it is empty, and
+// environment variables take precedence over the file.
+func GetConfig(envFile string) *Config {
 	// Set default values
 	viper.SetDefault("ENABLE_METRICS", false)
 	viper.SetDefault("METRICS_PORT", 9090)
+	viper.SetDefault("METRICS_NAMESPACE", "saturn")
+	viper.SetDefault("AUTH_DURATION_BUCKETS", "")
+	viper.SetDefault("MAX_USER_LABEL_CARDINALITY", 10000)
+	viper.SetDefault("TRACK_PER_USER_TRAFFIC", false)
+	viper.SetDefault("FD_WARNING_THRESHOLD", 80)
+	viper.SetDefault("METRICS_UPDATE_INTERVAL", 30)
+	viper.SetDefault("METRICS_FAIL_FATAL", false)
 	viper.SetDefault("LOG_LEVEL", "info")
+	viper.SetDefault("LOG_FORMAT", LogFormatJSON)
+	viper.SetDefault("LOG_OUTPUT", "stdout")
 	viper.SetDefault("BIND_ADDRESS", "0.0.0.0")
+	viper.SetDefault("BIND_ADDRESSES", "")
+	viper.SetDefault("PORTS", "")
+	viper.SetDefault("STUN_DISCOVERY_SERVERS", "stun.l.google.com:19302,stun.cloudflare.com:3478")
+	viper.SetDefault("STUN_DISCOVERY_TIMEOUT", 3)
+	viper.SetDefault("ADVERTISED_IP", "")
+	viper.SetDefault("RELAY_PUBLIC_IP", "")
+	viper.SetDefault("RELAY_PUBLIC_IPS", "")
+	viper.SetDefault("RELAY_BIND_ADDRESS", "")
+	viper.SetDefault("RELAY_MIN_PORT", 0)
+	viper.SetDefault("RELAY_MAX_PORT", 0)
 	viper.SetDefault("IPV4_ONLY", true) // Default to IPv4 only to avoid IPv6 issues
+	viper.SetDefault("MODE", ModeTURN)
+	viper.SetDefault("STUN_ONLY", false)
+	viper.SetDefault("CHECK_CONFIG", false)
+	viper.SetDefault("ACCESS_SECRET_FILE", "")
+	viper.SetDefault("TOKEN_ALGORITHMS", TokenAlgHS256)
+	viper.SetDefault("TOKEN_RSA_PUBLIC_KEY_FILE", "")
+	viper.SetDefault("TOKEN_JWKS_URL", "")
+	viper.SetDefault("TOKEN_ED25519_PUBLIC_KEY_FILE", "")
+	viper.SetDefault("MAX_TOKEN_TTL", 7*24*60*60) // Generous cap, one week
+	viper.SetDefault("MAX_TOKEN_BYTES", 8192)
+	viper.SetDefault("JWT_LEEWAY", 0)
+	viper.SetDefault("JWT_EXPIRY_DOUBLE_CHECK", true)
+	viper.SetDefault("EXPECTED_ISSUER", "")
+	viper.SetDefault("REQUIRED_ROLE", "")
+	viper.SetDefault("REALM_CASE_INSENSITIVE", false)
+	viper.SetDefault("REALMS", "")
+	viper.SetDefault("MAX_PACKET_SIZE", 1500)
+	viper.SetDefault("SOCKET_RCVBUF_BYTES", 0)
+	viper.SetDefault("SOCKET_SNDBUF_BYTES", 0)
+	viper.SetDefault("SOURCE_PPS_LIMIT", 20000)     // High enough for legitimate media from a busy NAT
+	viper.SetDefault("AMPLIFICATION_MAX_RATIO", 10) // Above the largest ratio pion answers a well-formed request with
+	viper.SetDefault("STUN_REQUIRE_AUTH", false)
+	viper.SetDefault("AMPLIFICATION_REFLECTION_PORTS", defaultReflectionPorts)
+	viper.SetDefault("DENY_CIDRS_FILE", "")
+	viper.SetDefault("MAX_CONNECTIONS_PER_REALM", 0)
+	viper.SetDefault("MAX_PEERS_PER_ALLOCATION", 0)
+	viper.SetDefault("BLOCK_PRIVATE_PEERS", false)
+	viper.SetDefault("PEER_ALLOWLIST", "")
+	viper.SetDefault("MAX_ALLOCATIONS_PER_USER", 0)
+	viper.SetDefault("MAX_TOTAL_ALLOCATIONS", 0)
+	viper.SetDefault("MAX_ALLOCATION_LIFETIME", 0)
+	viper.SetDefault("NONCE_LIFETIME", int(maxPionNonceLifetime.Seconds())) // pion's own lifetime
+	viper.SetDefault("PERMISSION_LIFETIME", int(maxPionPermissionLifetime.Seconds()))
+	viper.SetDefault("REDIS_URL", "")
 
 	// Set THREAD_NUM default based on CPU count if not specified in environment
 	if os.Getenv("THREAD_NUM") == "" {
@@ -57,30 +260,99 @@ func GetConfig() *Config {
 
 	// Security defaults
 	viper.SetDefault("METRICS_AUTH", "none")
+	viper.SetDefault("METRICS_BEARER_TOKEN", "")
+	viper.SetDefault("METRICS_CREDENTIALS", "")
+	viper.SetDefault("METRICS_AUTH_CHALLENGE", true)
 	viper.SetDefault("METRICS_BIND_IP", "127.0.0.1") // Bind to localhost by default for security
+	viper.SetDefault("METRICS_IP_ALLOWLIST", "")
+	viper.SetDefault("METRICS_TLS_CERT", "")
+	viper.SetDefault("METRICS_TLS_KEY", "")
+	viper.SetDefault("METRICS_MTLS_CA", "")
+	viper.SetDefault("METRICS_CLIENT_CA", "")
 
-	// Load environment variables from .env file
-	viper.AutomaticEnv()
-	viper.SetConfigFile(".env")
-	_ = viper.ReadInConfig()
+	// TURN credentials endpoint defaults
+	viper.SetDefault("ENABLE_TURN_CREDENTIALS", false)
+	viper.SetDefault("TURN_CREDENTIALS_TTL", 3600)
+	viper.SetDefault("TURN_CREDENTIALS_URIS", "")
+	viper.SetDefault("TURN_CREDENTIALS_RATE_LIMIT", 5)
 
-	// Read all environment variables and set them in Viper
-	for _, env := range os.Environ() {
-		parts := strings.SplitN(env, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		key := parts[0]
-		val := parts[1]
+	// Event socket defaults
+	viper.SetDefault("EVENT_SOCKET_PATH", "")
+
+	// Restart handoff defaults
+	viper.SetDefault("HANDOFF_SOCKET_PATH", "")
+	viper.SetDefault("STARTUP_READY_FILE", "")
+	viper.SetDefault("ENABLE_DTLS", false)
+	viper.SetDefault("DTLS_PORT", 5349)
+	viper.SetDefault("DTLS_CERT", "")
+	viper.SetDefault("DTLS_KEY", "")
+	viper.SetDefault("ENABLE_WEBSOCKET", false)
+	viper.SetDefault("WEBSOCKET_PORT", 8443)
+	viper.SetDefault("WEBSOCKET_PATH", "/turn")
+	viper.SetDefault("WEBSOCKET_CERT", "")
+	viper.SetDefault("WEBSOCKET_KEY", "")
+	viper.SetDefault("WEBSOCKET_PROXY_PROTOCOL", false)
+	viper.SetDefault("WEBSOCKET_PROXY_PROTOCOL_REQUIRED", true)
+	viper.SetDefault("MAINTENANCE_MODE", false)
+
+	// Webhook defaults
+	viper.SetDefault("WEBHOOK_URL", "")
+	viper.SetDefault("WEBHOOK_AUTH_FAILURE_THRESHOLD", 5)
+	viper.SetDefault("WEBHOOK_AUTH_FAILURE_WINDOW", 60)
+	viper.SetDefault("WEBHOOK_DEBOUNCE", 300)
+	viper.SetDefault("WEBHOOK_MAX_ATTEMPTS", 5)
+
+	// Traffic persistence defaults
+	viper.SetDefault("TRAFFIC_STATE_PATH", "")
+	viper.SetDefault("TRAFFIC_STATE_FLUSH_INTERVAL", 60)
+
+	// Load environment variables from the env file, a missing file is not an error
+	// The type is set explicitly since names like .env.staging have no known extension
+	envFileSource := SettingSourceFlag
+	if envFile == "" {
+		envFile, envFileSource = os.Getenv("ENV_FILE"), SettingSourceEnv
+	}
+	if envFile == "" {
+		envFile, envFileSource = defaultEnvFile, SettingSourceDefault
+	}
+	viper.SetConfigFile(envFile)
+	viper.SetConfigType("env")
+	if err := viper.ReadInConfig(); err != nil && envFile != defaultEnvFile {
+		log.Warn().Err(err).Str("env_file", envFile).Msg("Failed to read the env file, using defaults and environment variables")
+	}
 
-		viper.Set(key, val)
+	// Bind every setting to the environment variable of the same name, which takes
+	// precedence over the env file. Variables that are set but empty count too, so
+	// e.g. BIND_ADDRESSES= clears a value from the file
+	viper.AllowEmptyEnv(true)
+	for _, name := range settingNames() {
+		_ = viper.BindEnv(name)
 	}
+	viper.Set("ENV_FILE", envFile)
 
-	// Print out all keys Viper knows about
+	// Record where every setting was taken from, the environment wins over the file
+	settingSources = make(map[string]string)
+	for _, name := range settingNames() {
+		switch _, inEnv := os.LookupEnv(name); {
+		case name == "ENV_FILE":
+			settingSources[name] = envFileSource
+		case inEnv:
+			settingSources[name] = SettingSourceEnv
+		case viper.InConfig(name):
+			settingSources[name] = SettingSourceEnvFile
+		default:
+			settingSources[name] = SettingSourceDefault
+		}
+	}
+
+	// Strip quotes around values in place
+	// Keys are not rewritten to dotted paths, since a setting that prefixes another one
+	// (e.g. REALM and REALM_CASE_INSENSITIVE) would be shadowed by the nested key
 	for _, key := range viper.AllKeys() {
-		val := strings.Trim(viper.GetString(key), "\"")
-		newKey := strings.ReplaceAll(key, "_", ".")
-		viper.Set(newKey, val)
+		val := viper.GetString(key)
+		if trimmed := strings.Trim(val, "\""); trimmed != val {
+			viper.Set(key, trimmed)
+		}
 	}
 
 	once.Do(func() {
@@ -89,7 +361,639 @@ func GetConfig() *Config {
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed unmarshall config")
 		}
+		// A file that cannot be read leaves ACCESS_SECRET as it is, Validate reports it
+		if Conf.AccessSecretFile != "" {
+			if secret, err := readSecretFile(Conf.AccessSecretFile); err == nil {
+				Conf.AccessSecret = secret
+			}
+		}
 	})
 
 	return &Conf
 }
+
+// readSecretFile reads a secret from a file, without the trailing newline editors
+// and `kubectl create secret --from-file` leave in it
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+// settingNames returns the name of every setting, the mapstructure tags of Config
+func settingNames() []string {
+	var names []string
+	fields := reflect.TypeOf(Config{})
+	for i := range fields.NumField() {
+		if name := fields.Field(i).Tag.Get("mapstructure"); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// redactedValue replaces secrets in the redacted configuration
+const redactedValue = "[REDACTED]"
+
+// secretSettings are the settings masked by Redacted
+var secretSettings = map[string]bool{
+	"ACCESS_SECRET":          true,
+	"ACCESS_SECRET_PREVIOUS": true,
+	"ACCESS_SECRETS":         true,
+	"METRICS_PASSWORD":       true,
+	"METRICS_CREDENTIALS":    true,
+	"METRICS_BEARER_TOKEN":   true,
+	"REDIS_URL":              true, // Redis URLs commonly embed a password
+	"WEBHOOK_URL":            true, // Webhook URLs commonly embed a token
+}
+
+// Redacted returns the effective configuration keyed by setting name with secrets masked.
+// It shows the values that took effect after the defaults, .env file and environment
+// were merged, and is safe to log or serve.
+func (c *Config) Redacted() map[string]any {
+	settings := make(map[string]any)
+	value := reflect.ValueOf(c).Elem()
+	for i := range value.NumField() {
+		name := value.Type().Field(i).Tag.Get("mapstructure")
+		if name == "" {
+			continue
+		}
+		field := value.Field(i).Interface()
+		if secretSettings[name] && field != "" {
+			field = redactedValue
+		}
+		settings[name] = field
+	}
+	return settings
+}
+
+// SettingSources returns where each setting was taken from, keyed by setting name.
+// Together with Redacted it shows which of the defaults, the env file, the
+// environment and the flags won for every setting.
+func SettingSources() map[string]string {
+	return settingSources
+}
+
+// ListenAddresses returns the addresses to bind UDP listeners to.
+// BIND_ADDRESSES takes precedence over the single BIND_ADDRESS.
+func (c *Config) ListenAddresses() []string {
+	var addresses []string
+	for _, address := range strings.Split(c.BindAddresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		addresses = []string{c.BindAddress}
+	}
+	return addresses
+}
+
+// ListenPorts returns the ports to listen on: PORTS when set, otherwise PORT.
+// Every bind address gets THREAD_NUM listeners on each of them.
+func (c *Config) ListenPorts() []int {
+	if ports, err := parsePortList(c.Ports); err == nil && len(ports) > 0 {
+		return ports
+	}
+	return []int{c.Port}
+}
+
+// RelayAdvertisedIP returns the IP advertised to clients in relay addresses.
+// RELAY_PUBLIC_IP, or ADVERTISED_IP, lets deployments behind NAT, a load balancer
+// or anycast advertise a different address than the one relays are bound on.
+func (c *Config) RelayAdvertisedIP() string {
+	if ip := strings.TrimSpace(c.RelayPublicIP); ip != "" {
+		return ip
+	}
+	if ip := strings.TrimSpace(c.AdvertisedIP); ip != "" {
+		return ip
+	}
+	return c.PublicIP
+}
+
+// RelayListenAddress returns the internal address relays are bound on.
+// Relays are shared by all listeners and bound on the first bind address
+// unless RELAY_BIND_ADDRESS is set.
+func (c *Config) RelayListenAddress() string {
+	if address := strings.TrimSpace(c.RelayBindAddress); address != "" {
+		return address
+	}
+	return c.ListenAddresses()[0]
+}
+
+// AccessSecretList returns the secrets of ACCESS_SECRETS, in the order they are tried
+func (c *Config) AccessSecretList() ([]string, error) {
+	if strings.TrimSpace(c.AccessSecrets) == "" {
+		return nil, nil
+	}
+
+	var secrets []string
+	if err := json.Unmarshal([]byte(c.AccessSecrets), &secrets); err != nil {
+		return nil, errors.New("must be a JSON array of strings")
+	}
+	for i, secret := range secrets {
+		if secret == "" {
+			return nil, fmt.Errorf("secret %d is empty", i)
+		}
+	}
+	return secrets, nil
+}
+
+// TokenAlgorithmList returns the configured verification algorithms in order.
+// Algorithm names are case-insensitive and returned in their canonical JWT spelling.
+func (c *Config) TokenAlgorithmList() []string {
+	var algorithms []string
+	for _, alg := range strings.Split(c.TokenAlgorithms, ",") {
+		if alg = strings.TrimSpace(alg); alg == "" {
+			continue
+		}
+		for _, known := range []string{TokenAlgHS256, TokenAlgRS256, TokenAlgEdDSA} {
+			if strings.EqualFold(alg, known) {
+				alg = known
+			}
+		}
+		algorithms = append(algorithms, alg)
+	}
+	return algorithms
+}
+
+// AcceptedRealms returns the realms tokens may be issued for, REALM first and then
+// the co-hosted realms of REALMS
+func (c *Config) AcceptedRealms() []string {
+	realms := []string{c.Realm}
+	for _, realm := range strings.Split(c.Realms, ",") {
+		if realm = strings.TrimSpace(realm); realm != "" {
+			realms = append(realms, realm)
+		}
+	}
+	return realms
+}
+
+// AcceptedRealm returns the accepted realm that realm, e.g. a token's realm claim, names,
+// as configured. Realms must match exactly unless REALM_CASE_INSENSITIVE is set, in
+// which case both sides are trimmed and compared without regard to case.
+func (c *Config) AcceptedRealm(realm string) (string, bool) {
+	for _, accepted := range c.AcceptedRealms() {
+		if realm == accepted || c.RealmCaseInsensitive && strings.EqualFold(strings.TrimSpace(realm), strings.TrimSpace(accepted)) {
+			return accepted, true
+		}
+	}
+	return "", false
+}
+
+// ExpectedIssuerFor returns the issuer tokens for realm must carry in their "iss"
+// claim, or an empty string when the issuer is not checked for that realm.
+// Realms are matched like AcceptedRealm does when REALM_CASE_INSENSITIVE is set.
+func (c *Config) ExpectedIssuerFor(realm string) string {
+	fallback, perRealm, err := parseIssuerList(c.ExpectedIssuer)
+	if err != nil {
+		return ""
+	}
+	if issuer, ok := perRealm[realm]; ok {
+		return issuer
+	}
+	if c.RealmCaseInsensitive {
+		for issuerRealm, issuer := range perRealm {
+			if strings.EqualFold(issuerRealm, strings.TrimSpace(realm)) {
+				return issuer
+			}
+		}
+	}
+	return fallback
+}
+
+// TURNURIs returns the URIs served with TURN credentials.
+// TURN_CREDENTIALS_URIS takes precedence over the URIs derived from the advertised IP,
+// which list every listening port so clients can fall back to e.g. 443, and the
+// DTLS port as a turns URI when ENABLE_DTLS is set.
+func (c *Config) TURNURIs() []string {
+	var uris []string
+	for _, uri := range strings.Split(c.TURNCredentialsURIs, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	if len(uris) > 0 {
+		return uris
+	}
+
+	for _, port := range c.ListenPorts() {
+		hostPort := net.JoinHostPort(c.RelayAdvertisedIP(), strconv.Itoa(port))
+		uris = append(uris, "stun:"+hostPort, "turn:"+hostPort+"?transport=udp")
+	}
+	if c.EnableDTLS {
+		hostPort := net.JoinHostPort(c.RelayAdvertisedIP(), strconv.Itoa(c.DTLSPort))
+		uris = append(uris, "turns:"+hostPort+"?transport=udp")
+	}
+	return uris
+}
+
+// RelayPortRangeEnabled reports whether relays are bound between RELAY_MIN_PORT and RELAY_MAX_PORT
+func (c *Config) RelayPortRangeEnabled() bool {
+	return c.RelayMinPort != 0 && c.RelayMaxPort != 0
+}
+
+// MetricsTLSEnabled reports whether the metrics endpoints are served over HTTPS
+func (c *Config) MetricsTLSEnabled() bool {
+	return c.MetricsTLSCert != "" && c.MetricsTLSKey != ""
+}
+
+// MetricsClientCAFile returns the CA bundle client certificates of the metrics server
+// are verified with, METRICS_MTLS_CA or METRICS_CLIENT_CA, or empty without mTLS
+func (c *Config) MetricsClientCAFile() string {
+	if c.MetricsMTLSCA != "" {
+		return c.MetricsMTLSCA
+	}
+	return c.MetricsClientCA
+}
+
+// STUNDiscoveryServerList returns the STUN servers tried in order to discover the public IP
+func (c *Config) STUNDiscoveryServerList() []string {
+	var servers []string
+	for _, server := range strings.Split(c.STUNDiscoveryServers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// IsSTUNOnly reports whether the server is configured to refuse relay allocations,
+// either with MODE=stun-only or STUN_ONLY=true
+func (c *Config) IsSTUNOnly() bool {
+	return c.STUNOnly || strings.EqualFold(strings.TrimSpace(c.Mode), ModeSTUNOnly)
+}
+
+// PacketGuardsEnabled reports whether a guard needs the listeners wrapped to inspect
+// their packets or attribute their allocations, whether metrics are enabled or not:
+// the packet size and rate limits, the amplification guard, the lifetime, nonce and
+// permission expiry, the connection and allocation caps, and STUN-only mode.
+func (c *Config) PacketGuardsEnabled() bool {
+	return c.MaxPacketSize > 0 ||
+		c.SourcePPSLimit > 0 ||
+		c.AmplificationMaxRatio > 0 || c.STUNRequireAuth ||
+		c.MaxAllocationLifetime > 0 ||
+		c.NonceLifetime < int(maxPionNonceLifetime.Seconds()) ||
+		c.PermissionLifetime < int(maxPionPermissionLifetime.Seconds()) ||
+		c.MaxConnectionsPerRealm > 0 ||
+		c.MaxAllocationsPerUser > 0 ||
+		c.MaxTotalAllocations > 0 ||
+		c.IsSTUNOnly()
+}
+
+// Validate checks the configuration for errors that would prevent the server from starting.
+// All problems are reported together rather than stopping at the first one.
+func (c *Config) Validate() error {
+	var problems []error
+	addProblem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	switch {
+	case c.PublicIP == "":
+		addProblem("PUBLIC_IP is required")
+	case c.PublicIP == PublicIPAuto:
+		servers := c.STUNDiscoveryServerList()
+		if len(servers) == 0 {
+			addProblem("PUBLIC_IP=auto requires STUN_DISCOVERY_SERVERS")
+		}
+		for _, server := range servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				addProblem("STUN_DISCOVERY_SERVERS entry %q must be host:port", server)
+			}
+		}
+		if c.STUNDiscoveryTimeout < 1 {
+			addProblem("STUN_DISCOVERY_TIMEOUT must be at least 1")
+		}
+	case net.ParseIP(c.PublicIP) == nil:
+		addProblem("PUBLIC_IP %q is not a valid IP address", c.PublicIP)
+	}
+	if c.AdvertisedIP != "" && net.ParseIP(strings.TrimSpace(c.AdvertisedIP)) == nil {
+		addProblem("ADVERTISED_IP %q is not a valid IP address", c.AdvertisedIP)
+	}
+	if relayPublicIP := strings.TrimSpace(c.RelayPublicIP); relayPublicIP != "" {
+		ip := net.ParseIP(relayPublicIP)
+		switch {
+		case ip == nil:
+			addProblem("RELAY_PUBLIC_IP %q is not a valid IP address", c.RelayPublicIP)
+		case ip.IsUnspecified():
+			addProblem("RELAY_PUBLIC_IP %q cannot be reached by clients", c.RelayPublicIP)
+		case c.IPv4Only && ip.To4() == nil:
+			addProblem("RELAY_PUBLIC_IP %q is an IPv6 address but IPV4_ONLY is set", c.RelayPublicIP)
+		}
+		if advertisedIP := strings.TrimSpace(c.AdvertisedIP); advertisedIP != "" && advertisedIP != relayPublicIP {
+			addProblem("RELAY_PUBLIC_IP and ADVERTISED_IP disagree, set only RELAY_PUBLIC_IP")
+		}
+	}
+	if realmIPs, err := parseRealmIPs(c.RelayPublicIPs); err != nil {
+		addProblem("RELAY_PUBLIC_IPS: %v", err)
+	} else {
+		for realm, ip := range realmIPs {
+			if c.IPv4Only && ip.To4() == nil {
+				addProblem("RELAY_PUBLIC_IPS entry for realm %q is an IPv6 address but IPV4_ONLY is set", realm)
+			}
+			// No token of another realm authenticates, so its relays would never be allocated
+			if _, ok := c.AcceptedRealm(realm); !ok {
+				addProblem("RELAY_PUBLIC_IPS entry for realm %q names neither REALM nor one of REALMS", realm)
+			}
+		}
+	}
+	if relayBindAddress := strings.TrimSpace(c.RelayBindAddress); relayBindAddress != "" {
+		// Host names such as fly-global-services are resolved at startup
+		if ip := net.ParseIP(relayBindAddress); ip != nil && c.IPv4Only && ip.To4() == nil {
+			addProblem("RELAY_BIND_ADDRESS %q is an IPv6 address but IPV4_ONLY is set", c.RelayBindAddress)
+		}
+		if strings.ContainsAny(relayBindAddress, ", ") {
+			addProblem("RELAY_BIND_ADDRESS %q must be a single address", c.RelayBindAddress)
+		}
+	}
+	if _, err := logFormat(c.LogFormat); err != nil {
+		addProblem("%v", err)
+	}
+	if _, _, err := parseLogOutput(c.LogOutput); err != nil {
+		addProblem("%v", err)
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		addProblem("PORT %d is out of range", c.Port)
+	}
+	if _, err := parsePortList(c.Ports); err != nil {
+		addProblem("PORTS: %v", err)
+	}
+	for _, port := range c.ListenPorts() {
+		if port >= 1 && port <= 65535 && !canBindPort(port) {
+			addProblem("port %d is privileged, run as root, grant CAP_NET_BIND_SERVICE or lower net.ipv4.ip_unprivileged_port_start", port)
+		}
+	}
+	if c.EnableDTLS {
+		if c.DTLSPort < 1 || c.DTLSPort > 65535 {
+			addProblem("DTLS_PORT %d is out of range", c.DTLSPort)
+		} else if !canBindPort(c.DTLSPort) {
+			addProblem("DTLS_PORT %d is privileged, run as root, grant CAP_NET_BIND_SERVICE or lower net.ipv4.ip_unprivileged_port_start", c.DTLSPort)
+		}
+		if slices.Contains(c.ListenPorts(), c.DTLSPort) {
+			addProblem("DTLS_PORT %d is already a UDP port, DTLS needs a port of its own", c.DTLSPort)
+		}
+		if c.DTLSCert == "" || c.DTLSKey == "" {
+			addProblem("ENABLE_DTLS requires DTLS_CERT and DTLS_KEY")
+		}
+	}
+	if c.EnableWebSocket {
+		if c.WebSocketPort < 1 || c.WebSocketPort > 65535 {
+			addProblem("WEBSOCKET_PORT %d is out of range", c.WebSocketPort)
+		} else if !canBindPort(c.WebSocketPort) {
+			addProblem("WEBSOCKET_PORT %d is privileged, run as root, grant CAP_NET_BIND_SERVICE or lower net.ipv4.ip_unprivileged_port_start", c.WebSocketPort)
+		}
+		if c.EnableMetrics && c.WebSocketPort == c.MetricsPort {
+			addProblem("WEBSOCKET_PORT %d is already the METRICS_PORT", c.WebSocketPort)
+		}
+		if !strings.HasPrefix(c.WebSocketPath, "/") {
+			addProblem("WEBSOCKET_PATH %q must start with /", c.WebSocketPath)
+		}
+		if (c.WebSocketCert == "") != (c.WebSocketKey == "") {
+			addProblem("WEBSOCKET_CERT and WEBSOCKET_KEY must be set together")
+		}
+	}
+	if c.WebSocketProxyProtocol && !c.EnableWebSocket {
+		addProblem("WEBSOCKET_PROXY_PROTOCOL requires ENABLE_WEBSOCKET=true, the UDP and DTLS listeners do not read PROXY protocol headers")
+	}
+	if c.RelayPortRangeEnabled() {
+		switch {
+		case c.RelayMinPort < 1 || c.RelayMaxPort > 65535:
+			addProblem("RELAY_MIN_PORT and RELAY_MAX_PORT must be between 1 and 65535")
+		case c.RelayMinPort > c.RelayMaxPort:
+			addProblem("RELAY_MIN_PORT %d must not exceed RELAY_MAX_PORT %d", c.RelayMinPort, c.RelayMaxPort)
+		}
+		ports := c.ListenPorts()
+		if c.EnableDTLS {
+			ports = append(ports, c.DTLSPort)
+		}
+		for _, port := range ports {
+			if port >= c.RelayMinPort && port <= c.RelayMaxPort {
+				addProblem("port %d is inside the relay port range %d-%d", port, c.RelayMinPort, c.RelayMaxPort)
+			}
+		}
+	} else if c.RelayMinPort != 0 || c.RelayMaxPort != 0 {
+		addProblem("RELAY_MIN_PORT and RELAY_MAX_PORT must be set together")
+	}
+	if c.ThreadNum < 1 {
+		addProblem("THREAD_NUM must be at least 1")
+	}
+	if mode := strings.TrimSpace(c.Mode); !strings.EqualFold(mode, ModeTURN) && !strings.EqualFold(mode, ModeSTUNOnly) {
+		addProblem("unknown MODE %q, expected %q or %q", c.Mode, ModeTURN, ModeSTUNOnly)
+	}
+	if c.MaxPacketSize < 0 {
+		addProblem("MAX_PACKET_SIZE must not be negative")
+	}
+	if c.SocketRcvbufBytes < 0 {
+		addProblem("SOCKET_RCVBUF_BYTES must not be negative")
+	}
+	if c.SocketSndbufBytes < 0 {
+		addProblem("SOCKET_SNDBUF_BYTES must not be negative")
+	}
+	if c.SourcePPSLimit < 0 {
+		addProblem("SOURCE_PPS_LIMIT must not be negative")
+	}
+	if c.AmplificationMaxRatio != 0 && c.AmplificationMaxRatio < minAmplificationMaxRatio {
+		addProblem("AMPLIFICATION_MAX_RATIO must be 0 or at least %g, binding responses are up to %g times their request", minAmplificationMaxRatio, minAmplificationMaxRatio)
+	}
+	if _, err := parsePortList(c.ReflectionPorts); err != nil {
+		addProblem("AMPLIFICATION_REFLECTION_PORTS: %v", err)
+	}
+	if c.MaxConnectionsPerRealm < 0 {
+		addProblem("MAX_CONNECTIONS_PER_REALM must not be negative")
+	}
+	if c.MaxPeersPerAllocation < 0 {
+		addProblem("MAX_PEERS_PER_ALLOCATION must not be negative")
+	}
+	if _, err := parseCIDRList(c.PeerAllowlist); err != nil {
+		addProblem("PEER_ALLOWLIST: %v", err)
+	}
+	if c.MaxAllocationsPerUser < 0 {
+		addProblem("MAX_ALLOCATIONS_PER_USER must not be negative")
+	}
+	if c.MaxTotalAllocations < 0 {
+		addProblem("MAX_TOTAL_ALLOCATIONS must not be negative")
+	}
+	if c.MaxAllocationLifetime < 0 || c.MaxAllocationLifetime >= int(maxPionAllocationLifetime.Seconds()) {
+		addProblem("MAX_ALLOCATION_LIFETIME must be between 0 and %d seconds", int(maxPionAllocationLifetime.Seconds())-1)
+	}
+	if c.NonceLifetime < 1 || c.NonceLifetime > int(maxPionNonceLifetime.Seconds()) {
+		addProblem("NONCE_LIFETIME must be between 1 and %d seconds", int(maxPionNonceLifetime.Seconds()))
+	}
+	if c.PermissionLifetime < int(minPermissionLifetime.Seconds()) || c.PermissionLifetime > int(maxPionPermissionLifetime.Seconds()) {
+		addProblem("PERMISSION_LIFETIME must be between %d and %d seconds", int(minPermissionLifetime.Seconds()), int(maxPionPermissionLifetime.Seconds()))
+	}
+	if c.RedisURL != "" {
+		if u, err := url.Parse(c.RedisURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") {
+			addProblem("REDIS_URL must be a redis:// or rediss:// URL")
+		}
+	}
+
+	// Token verification
+	if c.MaxTokenBytes < 0 {
+		addProblem("MAX_TOKEN_BYTES must not be negative")
+	}
+	if c.MaxTokenTTL < 0 {
+		addProblem("MAX_TOKEN_TTL must not be negative")
+	}
+	if c.JWTLeeway < 0 {
+		addProblem("JWT_LEEWAY must not be negative")
+	}
+	seenRealms := make(map[string]bool)
+	for _, realm := range c.AcceptedRealms() {
+		if c.RealmCaseInsensitive {
+			realm = strings.ToLower(strings.TrimSpace(realm))
+		}
+		if seenRealms[realm] {
+			addProblem("REALMS lists %q more than once or repeats REALM", realm)
+		}
+		seenRealms[realm] = true
+	}
+	if _, perRealm, err := parseIssuerList(c.ExpectedIssuer); err != nil {
+		addProblem("EXPECTED_ISSUER: %v", err)
+	} else {
+		// No token of another realm passes Claims.Validate, so its issuer would never be checked
+		for realm := range perRealm {
+			if _, ok := c.AcceptedRealm(realm); !ok {
+				addProblem("EXPECTED_ISSUER entry for realm %q names neither REALM nor one of REALMS", realm)
+			}
+		}
+	}
+	algorithms := c.TokenAlgorithmList()
+	if len(algorithms) == 0 {
+		addProblem("TOKEN_ALGORITHMS must list at least one algorithm")
+	}
+	for _, alg := range algorithms {
+		switch alg {
+		case TokenAlgHS256:
+			if c.AccessSecretFile != "" {
+				if _, err := readSecretFile(c.AccessSecretFile); err != nil {
+					addProblem("ACCESS_SECRET_FILE: %v", err)
+				}
+			}
+			if c.AccessSecret == "" {
+				addProblem("ACCESS_SECRET is required for HS256 tokens")
+			}
+			if _, err := c.AccessSecretList(); err != nil {
+				addProblem("ACCESS_SECRETS: %v", err)
+			}
+		case TokenAlgRS256:
+			if c.TokenRSAPublicKeyFile == "" && c.TokenJWKSURL == "" {
+				addProblem("RS256 requires TOKEN_RSA_PUBLIC_KEY_FILE or TOKEN_JWKS_URL")
+			}
+		case TokenAlgEdDSA:
+			if c.TokenEdPublicKeyFile == "" {
+				addProblem("EdDSA requires TOKEN_ED25519_PUBLIC_KEY_FILE")
+			}
+		default:
+			addProblem("unsupported token algorithm %q in TOKEN_ALGORITHMS", alg)
+		}
+	}
+
+	// Metrics endpoint
+	if c.EnableMetrics {
+		if c.MetricsPort < 1 || c.MetricsPort > 65535 {
+			addProblem("METRICS_PORT %d is out of range", c.MetricsPort)
+		}
+		switch c.MetricsAuth {
+		case "none":
+		case "basic":
+			if (c.MetricsUsername == "" || c.MetricsPassword == "") && c.MetricsCredentials == "" {
+				addProblem("METRICS_AUTH=basic requires METRICS_USERNAME and METRICS_PASSWORD, or METRICS_CREDENTIALS")
+			}
+		case "bearer":
+			if c.MetricsBearerToken == "" {
+				addProblem("METRICS_AUTH=bearer requires METRICS_BEARER_TOKEN")
+			}
+		default:
+			addProblem("unknown METRICS_AUTH %q, expected \"none\", \"basic\" or \"bearer\"", c.MetricsAuth)
+		}
+	}
+	if (c.MetricsTLSCert == "") != (c.MetricsTLSKey == "") {
+		addProblem("METRICS_TLS_CERT and METRICS_TLS_KEY must be set together")
+	}
+	if c.MetricsMTLSCA != "" && c.MetricsClientCA != "" && c.MetricsMTLSCA != c.MetricsClientCA {
+		addProblem("METRICS_MTLS_CA and METRICS_CLIENT_CA name different files, set only one")
+	}
+	if c.MetricsClientCAFile() != "" && !c.MetricsTLSEnabled() {
+		addProblem("METRICS_MTLS_CA or METRICS_CLIENT_CA requires METRICS_TLS_CERT and METRICS_TLS_KEY")
+	}
+	if _, err := parseCIDRList(c.MetricsAllowlist); err != nil {
+		addProblem("METRICS_IP_ALLOWLIST: %v", err)
+	}
+	if _, err := parseMetricsCredentials(c.MetricsCredentials); err != nil {
+		addProblem("METRICS_CREDENTIALS: %v", err)
+	}
+
+	if c.FDWarningThreshold < 0 || c.FDWarningThreshold > 100 {
+		addProblem("FD_WARNING_THRESHOLD must be a percentage between 0 and 100")
+	}
+	if c.MetricsUpdateInterval < 1 {
+		addProblem("METRICS_UPDATE_INTERVAL must be at least 1 second")
+	}
+	if !metricsNamespacePattern.MatchString(c.MetricsNamespace) {
+		addProblem("METRICS_NAMESPACE %q must start with a letter or underscore and contain only letters, digits and underscores", c.MetricsNamespace)
+	}
+	if c.MaxUserLabelCardinality < 0 {
+		addProblem("MAX_USER_LABEL_CARDINALITY must not be negative")
+	}
+	if _, err := parseBuckets(c.AuthDurationBuckets); err != nil {
+		addProblem("AUTH_DURATION_BUCKETS: %v", err)
+	}
+
+	if c.EnableTURNCredentials {
+		if !c.EnableMetrics {
+			addProblem("ENABLE_TURN_CREDENTIALS requires ENABLE_METRICS=true, the endpoint is served on the metrics server")
+		}
+		if c.TURNCredentialsTTL < 1 {
+			addProblem("TURN_CREDENTIALS_TTL must be at least 1")
+		} else if c.MaxTokenTTL > 0 && c.TURNCredentialsTTL > c.MaxTokenTTL {
+			addProblem("TURN_CREDENTIALS_TTL must not exceed MAX_TOKEN_TTL")
+		}
+		if c.TURNCredentialsRateLimit < 0 {
+			addProblem("TURN_CREDENTIALS_RATE_LIMIT must not be negative")
+		}
+		hs256 := false
+		for _, alg := range algorithms {
+			hs256 = hs256 || alg == TokenAlgHS256
+		}
+		if !hs256 {
+			addProblem("ENABLE_TURN_CREDENTIALS requires HS256 in TOKEN_ALGORITHMS to mint credentials")
+		}
+	}
+
+	// Unix socket paths are limited to about 104 bytes, depending on the platform
+	if len(c.EventSocketPath) > 104 {
+		addProblem("EVENT_SOCKET_PATH is longer than the 104 bytes a Unix socket path may have")
+	}
+	if c.HandoffSocketPath != "" && len(c.HandoffSocketPath+handoffDrainingSuffix) > 104 {
+		addProblem("HANDOFF_SOCKET_PATH is longer than the %d bytes left for it in a Unix socket path", 104-len(handoffDrainingSuffix))
+	}
+
+	if c.StartupReadyFile != "" {
+		if info, err := os.Stat(filepath.Dir(c.StartupReadyFile)); err != nil || !info.IsDir() {
+			addProblem("STARTUP_READY_FILE must be in an existing directory")
+		}
+	}
+
+	if c.WebhookURL != "" {
+		// Only the scheme and host are reported, the path and query often carry a token
+		switch u, err := url.Parse(c.WebhookURL); {
+		case err != nil:
+			addProblem("WEBHOOK_URL must be an http or https URL")
+		case u.Scheme != "http" && u.Scheme != "https":
+			addProblem("WEBHOOK_URL %q must be an http or https URL", (&url.URL{Scheme: u.Scheme, Host: u.Host}).String())
+		}
+		if c.WebhookMaxAttempts < 1 {
+			addProblem("WEBHOOK_MAX_ATTEMPTS must be at least 1")
+		}
+	}
+
+	return errors.Join(problems...)
+}
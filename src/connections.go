@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// connectionIdleTimeout is how long a source stays active without authenticating again.
+// TURN clients refresh their allocation well before the default 10 minute lifetime,
+// and every refresh goes through the auth handler, so an idle source is a gone client.
+const connectionIdleTimeout = 10 * time.Minute
+
+// trackedConnection is an active connection from a single source address
+type trackedConnection struct {
+	userID    string
+	transport string       // Transport the source reached the server over, the transport label of the metrics
+	scope     []*net.IPNet // Peer networks of the token's scope claim, nil allows every peer
+	lastSeen  time.Time
+	peers     map[string]struct{} // Distinct peer IPs permitted, only tracked when peers are capped
+	auth      authKey             // Key the source last authenticated with
+}
+
+// authKey is the long-term key a source authenticated with, so its later requests
+// can be verified and signed again without validating its token another time
+type authKey struct {
+	username string // USERNAME of the requests, the access token
+	realm    string // REALM attribute the key was derived with
+	key      []byte
+}
+
+// ConnectionTracker keeps track of active connections per realm.
+// A connection is identified by its source address and stays active for as long
+// as the client keeps authenticating within the idle timeout.
+type ConnectionTracker struct {
+	mu          sync.Mutex
+	idleTimeout time.Duration
+	realms      map[string]map[string]*trackedConnection // realm -> source address -> connection
+	total       uint64                                   // Connections established since the server started
+}
+
+var (
+	// Global connection tracker instance
+	Connections = NewConnectionTracker(connectionIdleTimeout)
+)
+
+// NewConnectionTracker creates a new ConnectionTracker
+func NewConnectionTracker(idleTimeout time.Duration) *ConnectionTracker {
+	return &ConnectionTracker{
+		idleTimeout: idleTimeout,
+		realms:      make(map[string]map[string]*trackedConnection),
+	}
+}
+
+// Acquire marks the source as active in the realm on behalf of the user, with the
+// peer scope of the token it authenticated with.
+// Sources that are already active are always accepted and only have their user, scope
+// and last seen time refreshed, so a client authenticating with a new token gets its scope.
+// New sources are refused when the realm already holds limit connections, a limit of 0 means unlimited.
+func (t *ConnectionTracker) Acquire(realm, source, userID string, scope []*net.IPNet, limit int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sources, exists := t.realms[realm]
+	if !exists {
+		sources = make(map[string]*trackedConnection)
+		t.realms[realm] = sources
+	}
+
+	if conn, active := sources[source]; active {
+		conn.userID = userID
+		conn.scope = scope
+		conn.lastSeen = time.Now()
+		return true
+	}
+
+	if limit > 0 && len(sources) >= limit {
+		return false
+	}
+
+	conn := &trackedConnection{userID: userID, transport: ClientTransport(source), scope: scope, lastSeen: time.Now()}
+	sources[source] = conn
+	t.total++
+	RecordConnection(realm, conn.transport)
+	return true
+}
+
+// Lookup returns the realm and user of the active connection from source
+func (t *ConnectionTracker) Lookup(source string) (realm string, userID string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for realm, sources := range t.realms {
+		if conn, active := sources[source]; active {
+			return realm, conn.userID, true
+		}
+	}
+	return "", "", false
+}
+
+// Scope returns the peer networks the active connection from source may reach, nil
+// when its token has no scope or the source has no active connection
+func (t *ConnectionTracker) Scope(source string) []*net.IPNet {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, sources := range t.realms {
+		if conn, active := sources[source]; active {
+			return conn.scope
+		}
+	}
+	return nil
+}
+
+// SetAuthKey remembers the long-term key the active connection from source
+// authenticated with, under the USERNAME and REALM its requests carried
+func (t *ConnectionTracker) SetAuthKey(source, username, realm string, key []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, sources := range t.realms {
+		if conn, active := sources[source]; active {
+			conn.auth = authKey{username: username, realm: realm, key: key}
+			return
+		}
+	}
+}
+
+// AuthKey returns the long-term key the active connection from source last
+// authenticated with, and the USERNAME and REALM it was derived from
+func (t *ConnectionTracker) AuthKey(source string) (username, realm string, key []byte, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, sources := range t.realms {
+		if conn, active := sources[source]; active && conn.auth.key != nil {
+			return conn.auth.username, conn.auth.realm, conn.auth.key, true
+		}
+	}
+	return "", "", nil, false
+}
+
+// Release ends the active connection from source, once the allocation it was made for
+// is closed, without waiting for the idle timeout
+func (t *ConnectionTracker) Release(source string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for realm, sources := range t.realms {
+		if conn, active := sources[source]; active {
+			delete(sources, source)
+			RecordDisconnection(realm, conn.transport)
+			return
+		}
+	}
+}
+
+// AddPeer registers a peer the source wants to relay to.
+// Peers that are already known are always accepted. New peers are refused once the
+// connection already has limit peers, a limit of 0 means unlimited and nothing is tracked.
+// Sources without an active connection are accepted, as is every peer for them.
+// The realm of the connection is returned for metering.
+func (t *ConnectionTracker) AddPeer(source, peer string, limit int) (ok bool, realm string) {
+	if limit <= 0 {
+		return true, ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for realm, sources := range t.realms {
+		conn, active := sources[source]
+		if !active {
+			continue
+		}
+
+		if _, known := conn.peers[peer]; known {
+			return true, realm
+		}
+		if len(conn.peers) >= limit {
+			return false, realm
+		}
+		if conn.peers == nil {
+			conn.peers = make(map[string]struct{})
+		}
+		conn.peers[peer] = struct{}{}
+		return true, realm
+	}
+	return true, ""
+}
+
+// Count returns the number of active connections in the realm
+func (t *ConnectionTracker) Count(realm string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.realms[realm])
+}
+
+// Totals returns the number of active connections across all realms and the number
+// of connections established since the server started
+func (t *ConnectionTracker) Totals() (active int, total uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, sources := range t.realms {
+		active += len(sources)
+	}
+	return active, t.total
+}
+
+// Sweep removes connections that have been idle for longer than the idle timeout
+func (t *ConnectionTracker) Sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := time.Now().Add(-t.idleTimeout)
+	for realm, sources := range t.realms {
+		for source, conn := range sources {
+			if conn.lastSeen.Before(cutoff) {
+				delete(sources, source)
+				RecordDisconnection(realm, conn.transport)
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Results of a /turn-credentials request
+const (
+	CredentialsIssued       = "issued"
+	CredentialsUnauthorized = "unauthorized"
+	CredentialsRateLimited  = "rate_limited"
+	CredentialsBadRequest   = "bad_request"
+	CredentialsError        = "error"
+)
+
+// TURNCredentials is the /turn-credentials response in the coturn REST API format
+type TURNCredentials struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int      `json:"ttl"`
+	URIs     []string `json:"uris"`
+}
+
+// TURNCredentialsHandler serves time-limited TURN credentials to frontends.
+// Callers authenticate with an app access token as a Bearer token, or with the
+// metrics basic auth credentials and a user_id query parameter for backends.
+// The credentials are a short-lived access token minted for the same user, so the
+// access secret never leaves the server and the regular TURN auth path applies.
+func TURNCredentialsHandler(config *Config) http.Handler {
+	var limiter *SourceRateLimiter
+	if config.TURNCredentialsRateLimit > 0 {
+		limiter = NewSourceRateLimiter(config.TURNCredentialsRateLimit)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			RecordTURNCredentials(CredentialsBadRequest)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if limiter != nil {
+			if ip, ok := parseHostIP(r.RemoteAddr); ok {
+				if allowed, _ := limiter.AllowIP(ip); !allowed {
+					RecordTURNCredentials(CredentialsRateLimited)
+					http.Error(w, "Too many requests", http.StatusTooManyRequests)
+					return
+				}
+			}
+		}
+
+		user, expiresAt, status := authenticateCredentialsRequest(config, r)
+		if status != http.StatusOK {
+			if status == http.StatusBadRequest {
+				RecordTURNCredentials(CredentialsBadRequest)
+				http.Error(w, "user_id is required", status)
+				return
+			}
+			RecordTURNCredentials(CredentialsUnauthorized)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Saturn"`)
+			http.Error(w, "Authentication required", status)
+			return
+		}
+
+		// The credentials never outlive the app token they were issued for
+		ttl := time.Duration(config.TURNCredentialsTTL) * time.Second
+		if !expiresAt.IsZero() && time.Until(expiresAt) < ttl {
+			ttl = time.Until(expiresAt).Truncate(time.Second)
+		}
+
+		token, err := MintAccessToken(config, user, ttl)
+		if err != nil {
+			RecordTURNCredentials(CredentialsError)
+			log.Error().Err(err).Str("user_id", user.UserID).Msg("Failed to mint TURN credentials")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		RecordTURNCredentials(CredentialsIssued)
+		log.Debug().
+			Str("user_id", user.UserID).
+			Str("remote_addr", r.RemoteAddr).
+			Dur("ttl", ttl).
+			Msg("TURN credentials issued")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(TURNCredentials{
+			Username: token,
+			Password: user.UserID, // Password must match the UserID from the token
+			TTL:      int(ttl.Seconds()),
+			URIs:     config.TURNURIs(),
+		})
+	})
+}
+
+// authenticateCredentialsRequest identifies the user credentials are requested for.
+// It returns the user, the expiry of the app token if one was presented, and the
+// HTTP status to answer with when the request is not authenticated.
+func authenticateCredentialsRequest(config *Config, r *http.Request) (Claims, time.Time, int) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		claims, err := ValidateToken(strings.TrimSpace(token))
+		if err != nil {
+			return Claims{}, time.Time{}, http.StatusUnauthorized
+		}
+		user := Claims{
+			UserID:   claims.UserID,
+			Email:    claims.Email,
+			Username: claims.Username,
+			Role:     claims.Role,
+			Roles:    claims.Roles,
+		}
+		return user, claims.ExpiresAt.Time, http.StatusOK
+	}
+
+	// Backends may request credentials on behalf of a user with the metrics credentials
+	username, password, ok := r.BasicAuth()
+	if !ok || config.MetricsUsername == "" || config.MetricsPassword == "" ||
+		subtle.ConstantTimeCompare([]byte(username), []byte(config.MetricsUsername)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(config.MetricsPassword)) != 1 {
+		return Claims{}, time.Time{}, http.StatusUnauthorized
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		return Claims{}, time.Time{}, http.StatusBadRequest
+	}
+	role := "user"
+	if config.RequiredRole != "" {
+		role = config.RequiredRole
+	}
+	return Claims{UserID: userID, Username: userID, Role: role}, time.Time{}, http.StatusOK
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// denyListReloadDelay batches the burst of events an editor or a config map
+// update produces into a single reload
+const denyListReloadDelay = 100 * time.Millisecond
+
+// DenyList holds the source networks refused by the auth handler.
+// The list is loaded from a file and swapped atomically whenever the file changes,
+// so it can be updated without a restart.
+type DenyList struct {
+	path     string
+	networks atomic.Pointer[[]*net.IPNet]
+}
+
+var (
+	// Global deny list instance, nil when DENY_CIDRS_FILE is not set
+	Denied *DenyList
+)
+
+// InitDenyList loads DENY_CIDRS_FILE and starts watching it for changes
+func InitDenyList(config *Config) {
+	denyList, err := NewDenyList(config.DenyCIDRsFile)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", config.DenyCIDRsFile).Msg("Failed to load the deny list")
+	}
+	Denied = denyList
+
+	if err := denyList.Watch(); err != nil {
+		log.Error().Err(err).Str("path", config.DenyCIDRsFile).Msg("Failed to watch the deny list, changes require a restart")
+	}
+}
+
+// NewDenyList loads the deny list from path
+func NewDenyList(path string) (*DenyList, error) {
+	denyList := &DenyList{path: filepath.Clean(path)}
+	networks, err := loadDenyList(denyList.path)
+	if err != nil {
+		return nil, err
+	}
+	denyList.networks.Store(&networks)
+	SetDenyListEntries(len(networks))
+
+	log.Info().Str("path", denyList.path).Int("entries", len(networks)).Msg("Deny list loaded")
+	return denyList, nil
+}
+
+// loadDenyList parses a deny list file with one CIDR or IP address per line.
+// Blank lines and lines starting with # are ignored.
+func loadDenyList(path string) ([]*net.IPNet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []*net.IPNet
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := bytes.TrimSpace(scanner.Bytes())
+		if len(entry) == 0 || entry[0] == '#' {
+			continue
+		}
+		parsed, err := parseCIDRList(string(entry))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		networks = append(networks, parsed...)
+	}
+	return networks, scanner.Err()
+}
+
+// Contains reports whether ip is denied
+func (d *DenyList) Contains(ip net.IP) bool {
+	return containsIP(*d.networks.Load(), ip)
+}
+
+// IsDenied reports whether the source address is on the deny list
+func IsDenied(addr net.Addr) bool {
+	if Denied == nil {
+		return false
+	}
+	ip := net.ParseIP(sourceIP(addr))
+	return ip != nil && Denied.Contains(ip)
+}
+
+// Reload parses the file again and swaps in the new list.
+// The previous list stays in effect when the file cannot be read or parsed.
+func (d *DenyList) Reload() {
+	networks, err := loadDenyList(d.path)
+	if err != nil {
+		RecordDenyListReload("failure")
+		log.Error().Err(err).Str("path", d.path).Msg("Failed to reload the deny list, keeping the previous list")
+		return
+	}
+
+	d.networks.Store(&networks)
+	RecordDenyListReload("success")
+	SetDenyListEntries(len(networks))
+	log.Info().Str("path", d.path).Int("entries", len(networks)).Msg("Deny list reloaded")
+}
+
+// Watch reloads the list whenever the file changes.
+// The directory is watched rather than the file, so files replaced by a rename,
+// as editors and Kubernetes config maps do, keep being picked up.
+func (d *DenyList) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(d.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// Kubernetes swaps config map contents through the ..data symlink
+				if filepath.Clean(event.Name) == d.path || filepath.Base(event.Name) == "..data" {
+					reload = time.After(denyListReloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error().Err(err).Str("path", d.path).Msg("Deny list watcher error")
+			case <-reload:
+				reload = nil
+				d.Reload()
+			}
+		}
+	}()
+	return nil
+}
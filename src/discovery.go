@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// DiscoverPublicIP asks the configured STUN servers in order for the address this
+// host is seen from and returns the IP reported by the first one that answers
+func DiscoverPublicIP(config *Config) (string, error) {
+	network := "udp"
+	if config.IPv4Only {
+		network = "udp4"
+	}
+	timeout := time.Duration(config.STUNDiscoveryTimeout) * time.Second
+
+	var failures []string
+	for _, server := range config.STUNDiscoveryServerList() {
+		ip, err := discoverPublicIP(network, server, timeout)
+		if err != nil {
+			log.Warn().Err(err).Str("stun_server", server).Msg("STUN server did not report the public IP, trying the next one")
+			failures = append(failures, fmt.Sprintf("%s: %v", server, err))
+			continue
+		}
+
+		log.Info().Str("stun_server", server).Str("public_ip", ip.String()).Msg("Public IP discovered")
+		return ip.String(), nil
+	}
+
+	if len(failures) == 0 {
+		return "", errors.New("no STUN_DISCOVERY_SERVERS configured")
+	}
+	return "", fmt.Errorf("no STUN server reported the public IP (%s)", strings.Join(failures, "; "))
+}
+
+// discoverPublicIP sends a binding request to a single STUN server and returns
+// the IP of the XOR-MAPPED-ADDRESS in its response
+func discoverPublicIP(network, server string, timeout time.Duration) (net.IP, error) {
+	serverAddr, err := net.ResolveUDPAddr(network, server)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	request, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(request.Raw, serverAddr); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		response := &stun.Message{Raw: buf[:n]}
+		if err := response.Decode(); err != nil || response.TransactionID != request.TransactionID {
+			continue // Not the answer to our request
+		}
+
+		var mapped stun.XORMappedAddress
+		if err := mapped.GetFrom(response); err != nil {
+			return nil, fmt.Errorf("binding response has no mapped address: %w", err)
+		}
+		return mapped.IP, nil
+	}
+}
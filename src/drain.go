@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Whether a drain was started, the server then refuses new allocations
+	draining atomic.Bool
+
+	// errServerDraining is returned to pion for allocations requested while draining
+	errServerDraining = errors.New("server is draining")
+)
+
+// drainStatus is the /admin/drain response
+type drainStatus struct {
+	Draining    bool  `json:"draining"`
+	Allocations int64 `json:"allocations"`
+}
+
+// IsDraining reports whether the server is draining
+func IsDraining() bool {
+	return draining.Load()
+}
+
+// StartDrain stops the server from taking new allocations while it keeps relaying
+// the open ones. It reports whether the drain was started by this call.
+func StartDrain() bool {
+	if !draining.CompareAndSwap(false, true) {
+		return false
+	}
+	SetDraining(true)
+
+	log.Info().
+		Int64("allocations", ActiveAllocations()).
+		Bool("handoff", Handoff != nil).
+		Msg("Drain started, new allocations are refused and open allocations keep relaying")
+	return true
+}
+
+// DrainHandler serves /admin/drain. POST starts the drain, GET reports whether the
+// server is draining and how many allocations are still open.
+func DrainHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			StartDrain()
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(drainStatus{
+			Draining:    IsDraining(),
+			Allocations: ActiveAllocations(),
+		})
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// Transports clients reach the server over, the transport label of the traffic metrics
+const (
+	TransportUDP       = "udp"
+	TransportDTLS      = "dtls"
+	TransportWebSocket = "websocket"
+)
+
+// sessionTransports holds the transport of every DTLS and WebSocket session by client
+// address, sources without a session reach the server over plain UDP
+var sessionTransports sync.Map
+
+// ClientTransport returns the transport the client at source reaches the server over
+func ClientTransport(source string) string {
+	if transport, ok := sessionTransports.Load(source); ok {
+		return transport.(string)
+	}
+	return TransportUDP
+}
+
+const (
+	// dtlsHandshakeTimeout bounds how long a client may take to complete the handshake
+	dtlsHandshakeTimeout = 10 * time.Second
+	// dtlsIdleTimeout closes sessions that sent nothing for longer than the longest
+	// allocation lifetime, by then any allocation of the session has expired
+	dtlsIdleTimeout = maxPionAllocationLifetime
+	// dtlsQueueSize is how many decrypted packets may wait for pion
+	dtlsQueueSize = 256
+	// dtlsBufferSize fits the largest UDP payload
+	dtlsBufferSize = 65535
+)
+
+// DTLSPacketConn terminates TURN over DTLS (RFC 7350) and presents the decrypted
+// packets of every session as a single net.PacketConn.
+// pion handles it like a UDP listener, so the metrics, guards and quotas of
+// MetricsPacketConn apply to DTLS clients as they do to UDP ones.
+type DTLSPacketConn struct {
+	listener net.Listener
+	packets  chan routedPacket
+	closed   chan struct{}
+	once     sync.Once
+
+	mu       sync.Mutex
+	sessions map[string]net.Conn // Sessions by client address
+}
+
+// DTLSConfig loads the certificate presented to DTLS clients
+func DTLSConfig(config *Config) (*dtls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(config.DTLSCert, config.DTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load DTLS certificate: %w", err)
+	}
+	return &dtls.Config{
+		Certificates:         []tls.Certificate{certificate},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}, nil
+}
+
+// ListenDTLS listens for DTLS sessions on addr
+func ListenDTLS(addr *net.UDPAddr, dtlsConfig *dtls.Config) (*DTLSPacketConn, error) {
+	listener, err := dtls.Listen(addr.Network(), addr, dtlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &DTLSPacketConn{
+		listener: listener,
+		packets:  make(chan routedPacket, dtlsQueueSize),
+		closed:   make(chan struct{}),
+		sessions: make(map[string]net.Conn),
+	}
+	go conn.accept()
+	return conn, nil
+}
+
+// accept serves every session accepted by the listener until it is closed
+func (d *DTLSPacketConn) accept() {
+	for {
+		session, err := d.listener.Accept()
+		if err != nil {
+			select {
+			case <-d.closed:
+				return
+			default:
+			}
+			log.Debug().Err(err).Msg("Failed to accept DTLS session")
+			continue
+		}
+		go d.serve(session)
+	}
+}
+
+// serve completes the handshake of a session and queues its decrypted packets
+func (d *DTLSPacketConn) serve(session net.Conn) {
+	addr := session.RemoteAddr()
+	defer session.Close()
+
+	if conn, ok := session.(*dtls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+		err := conn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			log.Debug().Err(err).Str("client_addr", addr.String()).Msg("DTLS handshake failed")
+			return
+		}
+	}
+
+	d.mu.Lock()
+	d.sessions[addr.String()] = session
+	sessionTransports.Store(addr.String(), TransportDTLS)
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		if d.sessions[addr.String()] == session {
+			delete(d.sessions, addr.String())
+			sessionTransports.Delete(addr.String())
+		}
+		d.mu.Unlock()
+	}()
+
+	buf := make([]byte, dtlsBufferSize)
+	for {
+		_ = session.SetReadDeadline(time.Now().Add(dtlsIdleTimeout))
+		n, err := session.Read(buf)
+		if err != nil {
+			return
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		select {
+		case d.packets <- routedPacket{data: data, addr: addr}:
+		case <-d.closed:
+			return
+		}
+	}
+}
+
+// ReadFrom returns the next decrypted packet of any session
+func (d *DTLSPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-d.packets:
+		return copy(p, packet.data), packet.addr, nil
+	case <-d.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteTo encrypts a packet for the session of addr
+func (d *DTLSPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	d.mu.Lock()
+	session, ok := d.sessions[addr.String()]
+	d.mu.Unlock()
+	if !ok {
+		return 0, errors.New("no DTLS session with " + addr.String())
+	}
+	return session.Write(p)
+}
+
+// Close closes the listener and every session
+func (d *DTLSPacketConn) Close() error {
+	var err error
+	d.once.Do(func() {
+		close(d.closed)
+		err = d.listener.Close()
+
+		d.mu.Lock()
+		for _, session := range d.sessions {
+			_ = session.Close()
+		}
+		d.mu.Unlock()
+	})
+	return err
+}
+
+// LocalAddr returns the address the listener is bound on
+func (d *DTLSPacketConn) LocalAddr() net.Addr {
+	return d.listener.Addr()
+}
+
+// SetDeadline is a no-op, sessions are bounded by dtlsIdleTimeout
+func (d *DTLSPacketConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is a no-op, ReadFrom returns once the connection is closed
+func (d *DTLSPacketConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes go to the session of their client
+func (d *DTLSPacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
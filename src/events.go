@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Event types streamed on the event socket
+const (
+	EventAuthSuccess       = "auth_success"
+	EventAuthFailure       = "auth_failure"
+	EventAllocationCreated = "allocation_created"
+	EventAllocationClosed  = "allocation_closed"
+)
+
+const (
+	// eventClientQueueSize is how many events a slow client may fall behind before
+	// further events are dropped for it
+	eventClientQueueSize = 1024
+	eventWriteTimeout    = time.Second
+)
+
+// Event is a single auth or allocation event, written to the socket as one JSON line
+type Event struct {
+	Type       string    `json:"type"`
+	Realm      string    `json:"realm,omitempty"`
+	UserID     string    `json:"user_id,omitempty"`
+	SourceAddr string    `json:"source_addr,omitempty"`
+	RelayAddr  string    `json:"relay_addr,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// eventClient is a connected reader of the event socket
+type eventClient struct {
+	conn  net.Conn
+	queue chan []byte
+}
+
+// EventSocket streams newline-delimited JSON events to every client connected
+// to a Unix domain socket. Each client has its own bounded queue, so a slow
+// client loses events instead of delaying the auth path or other clients.
+type EventSocket struct {
+	path     string
+	listener net.Listener
+
+	mu      sync.Mutex
+	clients map[*eventClient]struct{}
+}
+
+var (
+	// Global event socket instance, nil when EVENT_SOCKET_PATH is not set
+	Events *EventSocket
+)
+
+// InitEventSocket listens on EVENT_SOCKET_PATH and starts accepting clients
+func InitEventSocket(config *Config) {
+	events, err := NewEventSocket(config.EventSocketPath)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", config.EventSocketPath).Msg("Failed to open the event socket")
+	}
+	Events = events
+	RegisterEventHook("event_socket", events.Publish)
+
+	log.Info().Str("path", config.EventSocketPath).Msg("Event socket enabled")
+}
+
+// NewEventSocket listens on the Unix socket at path, replacing a stale socket
+// left behind by a previous run
+func NewEventSocket(path string) (*EventSocket, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("event socket path exists and is not a socket")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	events := &EventSocket{
+		path:     path,
+		listener: listener,
+		clients:  make(map[*eventClient]struct{}),
+	}
+	go events.accept()
+	return events, nil
+}
+
+// accept registers connecting clients until the socket is closed
+func (s *EventSocket) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error().Err(err).Msg("Failed to accept event socket client")
+			continue
+		}
+
+		client := &eventClient{conn: conn, queue: make(chan []byte, eventClientQueueSize)}
+		s.mu.Lock()
+		s.clients[client] = struct{}{}
+		count := len(s.clients)
+		s.mu.Unlock()
+		SetEventSocketClients(count)
+
+		log.Info().Int("clients", count).Msg("Event socket client connected")
+		go s.write(client)
+	}
+}
+
+// write sends queued events to the client until it disconnects
+func (s *EventSocket) write(client *eventClient) {
+	defer s.remove(client)
+
+	for line := range client.queue {
+		_ = client.conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := client.conn.Write(line); err != nil {
+			return
+		}
+	}
+}
+
+// remove disconnects the client
+func (s *EventSocket) remove(client *eventClient) {
+	s.mu.Lock()
+	_, ok := s.clients[client]
+	delete(s.clients, client)
+	count := len(s.clients)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	client.conn.Close()
+	SetEventSocketClients(count)
+	log.Info().Int("clients", count).Msg("Event socket client disconnected")
+}
+
+// Close stops accepting clients, disconnects the connected ones and removes the socket
+func (s *EventSocket) Close() {
+	_ = s.listener.Close()
+
+	s.mu.Lock()
+	for client := range s.clients {
+		client.conn.Close()
+	}
+	s.mu.Unlock()
+}
+
+// PublishEvent timestamps the event and calls the registered event hooks with it,
+// the first of which is the event socket when EVENT_SOCKET_PATH is set
+func PublishEvent(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	runEventHooks(event)
+}
+
+// Publish sends the event to every connected client.
+// Clients whose queue is full miss the event, which is counted as dropped.
+func (s *EventSocket) Publish(event Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Str("type", event.Type).Msg("Failed to encode event")
+		return
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for client := range s.clients {
+		select {
+		case client.queue <- line:
+		default:
+			RecordEventDropped(event.Type)
+		}
+	}
+}
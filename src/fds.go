@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Whether open file descriptors were above the warning threshold at the last sample
+	fdPressure bool
+)
+
+// openFDs counts the open file descriptors of the process.
+// It reports false where /proc/self/fd is not available, i.e. outside Linux.
+func openFDs() (int, bool) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, false
+	}
+	// Reading the directory itself holds a descriptor that is listed too
+	return len(entries) - 1, true
+}
+
+// maxFDs returns the soft limit on open file descriptors
+func maxFDs() (uint64, bool) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, false
+	}
+	return limit.Cur, true
+}
+
+// UpdateFDMetrics samples open file descriptors against the limit and logs a warning
+// when usage crosses thresholdPercent of the limit, a threshold of 0 disables the warning.
+// Every relay allocation holds a socket, so running out of descriptors shows up as
+// allocation failures that are hard to diagnose without this.
+func UpdateFDMetrics(thresholdPercent int) {
+	open, ok := openFDs()
+	if !ok {
+		return
+	}
+	limit, ok := maxFDs()
+	if !ok {
+		return
+	}
+
+	if ServerMetrics != nil {
+		ServerMetrics.OpenFDs.Set(float64(open))
+		ServerMetrics.MaxFDs.Set(float64(limit))
+	}
+
+	if thresholdPercent <= 0 || limit == 0 {
+		return
+	}
+
+	usage := float64(open) / float64(limit) * 100
+	switch {
+	case usage >= float64(thresholdPercent) && !fdPressure:
+		fdPressure = true
+		log.Warn().
+			Int("open_fds", open).
+			Uint64("max_fds", limit).
+			Float64("usage_percent", usage).
+			Int("threshold_percent", thresholdPercent).
+			Msg("Open file descriptors are nearing the limit, allocations may start failing")
+	case usage < float64(thresholdPercent) && fdPressure:
+		fdPressure = false
+		log.Info().
+			Int("open_fds", open).
+			Uint64("max_fds", limit).
+			Float64("usage_percent", usage).
+			Msg("Open file descriptors are back below the warning threshold")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// handoffDrainingSuffix names the path a starting process moves the socket of
+	// the process it replaces to, so both can reach each other
+	handoffDrainingSuffix = ".draining"
+	// handoffWriteTimeout bounds how long a listener waits on a full handoff socket
+	handoffWriteTimeout = 10 * time.Millisecond
+	// handoffQueueSize is how many routed packets may wait for a listener
+	handoffQueueSize = 256
+	// handoffBufferSize fits the largest UDP payload and the address header
+	handoffBufferSize = 65535 + 512
+)
+
+// Results of routing a packet, recorded in saturn_handoff_packets_total
+const (
+	HandoffMoved     = "moved"     // Passed to another listener of this process
+	HandoffForwarded = "forwarded" // Sent to the other process
+	HandoffReceived  = "received"  // Received from the other process
+	HandoffDropped   = "dropped"   // Lost because no listener could take it
+)
+
+// allocateRequest is the STUN message type of an ALLOCATE request
+var allocateRequest = stun.NewType(stun.MethodAllocate, stun.ClassRequest)
+
+// routedPacket is a client packet passed to a listener by the handoff router
+type routedPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// HandoffRouter keeps sessions alive while an old and a new process share the
+// listening port through SO_REUSEPORT during a restart.
+// The kernel spreads client packets over the listeners of both processes and moves
+// clients between listeners whenever one joins or leaves, so a packet can arrive
+// at a listener that does not hold the client's allocation. Such packets are passed
+// to the listener holding it, or over a Unix datagram socket to the other process,
+// before pion sees them.
+type HandoffRouter struct {
+	path string
+	conn *net.UnixConn
+	// Whether a replaced process may still be reachable at the draining path
+	peer atomic.Bool
+
+	mu        sync.RWMutex
+	listeners []*MetricsPacketConn
+	owners    map[string]*MetricsPacketConn // Listener holding the allocation, by local and client address
+}
+
+var (
+	// Global handoff router, nil when HANDOFF_SOCKET_PATH is not set
+	Handoff *HandoffRouter
+)
+
+// InitHandoff binds HANDOFF_SOCKET_PATH, taking it over from a running process
+func InitHandoff(config *Config) {
+	handoff, err := NewHandoffRouter(config.HandoffSocketPath)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", config.HandoffSocketPath).Msg("Failed to open the handoff socket")
+	}
+	Handoff = handoff
+
+	log.Info().
+		Str("path", config.HandoffSocketPath).
+		Bool("replacing_process", handoff.peer.Load()).
+		Msg("Restart handoff enabled")
+}
+
+// NewHandoffRouter binds the handoff socket at path. A socket already there belongs
+// to the process being replaced and is moved to the draining path, where it keeps
+// receiving the packets of the sessions that process holds.
+func NewHandoffRouter(path string) (*HandoffRouter, error) {
+	handoff := &HandoffRouter{
+		path:   path,
+		owners: make(map[string]*MetricsPacketConn),
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("handoff socket path exists and is not a socket")
+		}
+		if err := os.Rename(path, path+handoffDrainingSuffix); err != nil {
+			return nil, err
+		}
+		handoff.peer.Store(true)
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	handoff.conn = conn
+
+	go handoff.receive()
+	return handoff, nil
+}
+
+// AddListener routes the packets of listener through the handoff
+func (h *HandoffRouter) AddListener(listener *MetricsPacketConn) {
+	listener.handoff = h
+	listener.routed = make(chan routedPacket, handoffQueueSize)
+
+	h.mu.Lock()
+	h.listeners = append(h.listeners, listener)
+	h.mu.Unlock()
+}
+
+// Claim records that listener holds the allocation of the client
+func (h *HandoffRouter) Claim(listener *MetricsPacketConn, clientAddr string) {
+	h.mu.Lock()
+	h.owners[handoffKey(listener.LocalAddr().String(), clientAddr)] = listener
+	h.mu.Unlock()
+}
+
+// Release forgets the allocation of the client held by listener
+func (h *HandoffRouter) Release(listener *MetricsPacketConn, clientAddr string) {
+	key := handoffKey(listener.LocalAddr().String(), clientAddr)
+	h.mu.Lock()
+	if h.owners[key] == listener {
+		delete(h.owners, key)
+	}
+	h.mu.Unlock()
+}
+
+// route passes a packet read by listener on to where the client's allocation lives.
+// It reports whether the packet was passed on, listener must then drop it.
+func (h *HandoffRouter) route(listener *MetricsPacketConn, packet []byte, addr net.Addr) bool {
+	local := listener.LocalAddr().String()
+	h.mu.RLock()
+	owner := h.owners[handoffKey(local, addr.String())]
+	h.mu.RUnlock()
+
+	switch {
+	case owner == listener:
+		return false
+	case owner != nil:
+		RecordHandoffPacket(HandoffMoved)
+		owner.route(bytes.Clone(packet), addr)
+		return true
+	case IsDraining():
+		// Everything but the open allocations belongs to the process replacing this one
+		return h.forward(h.path, local, packet, addr)
+	case h.peer.Load() && !startsSession(packet):
+		// Requests and channel data of allocations held by the replaced process
+		return h.forward(h.path+handoffDrainingSuffix, local, packet, addr)
+	default:
+		return false
+	}
+}
+
+// forward sends a packet to the process bound at path. It reports false when the
+// process cannot be reached, the packet is then handled locally.
+func (h *HandoffRouter) forward(path, local string, packet []byte, addr net.Addr) bool {
+	source := addr.String()
+	if len(source) > 255 || len(local) > 255 {
+		return false
+	}
+
+	datagram := make([]byte, 0, 2+len(source)+len(local)+len(packet))
+	datagram = append(datagram, byte(len(source)))
+	datagram = append(datagram, source...)
+	datagram = append(datagram, byte(len(local)))
+	datagram = append(datagram, local...)
+	datagram = append(datagram, packet...)
+
+	_ = h.conn.SetWriteDeadline(time.Now().Add(handoffWriteTimeout))
+	if _, err := h.conn.WriteToUnix(datagram, &net.UnixAddr{Name: path, Net: "unixgram"}); err != nil {
+		// The replaced process finished draining and exited
+		if (errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT)) &&
+			path != h.path && h.peer.CompareAndSwap(true, false) {
+			log.Info().Str("path", path).Msg("Replaced process is gone, no longer forwarding packets to it")
+		}
+		return false
+	}
+
+	RecordHandoffPacket(HandoffForwarded)
+	return true
+}
+
+// receive passes the packets forwarded by the other process to the listener
+// holding the client's allocation, or to a listener bound on the same address.
+// Received packets are never forwarded again, so they cannot loop.
+func (h *HandoffRouter) receive() {
+	buf := make([]byte, handoffBufferSize)
+	for {
+		n, err := h.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error().Err(err).Msg("Failed to read from the handoff socket")
+			continue
+		}
+
+		source, local, packet, ok := parseHandoffDatagram(buf[:n])
+		if !ok {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", source)
+		if err != nil {
+			continue
+		}
+
+		listener := h.listenerFor(local, source)
+		if listener == nil {
+			RecordHandoffPacket(HandoffDropped)
+			continue
+		}
+		RecordHandoffPacket(HandoffReceived)
+		listener.route(bytes.Clone(packet), addr)
+	}
+}
+
+// listenerFor returns the listener holding the client's allocation, or else the
+// first listener bound on the local address
+func (h *HandoffRouter) listenerFor(local, source string) *MetricsPacketConn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if owner := h.owners[handoffKey(local, source)]; owner != nil {
+		return owner
+	}
+	for _, listener := range h.listeners {
+		if listener.LocalAddr().String() == local {
+			return listener
+		}
+	}
+	return nil
+}
+
+// Close stops receiving forwarded packets. The socket file is left in place, it
+// belongs to the process replacing this one once that has started.
+func (h *HandoffRouter) Close() {
+	_ = h.conn.Close()
+}
+
+// handoffKey identifies a client of a listener address
+func handoffKey(local, client string) string {
+	return local + " " + client
+}
+
+// parseHandoffDatagram splits a forwarded datagram into the client address, the
+// local address it was received on and the client's packet
+func parseHandoffDatagram(datagram []byte) (source, local string, packet []byte, ok bool) {
+	if len(datagram) < 1 || len(datagram) < 1+int(datagram[0]) {
+		return "", "", nil, false
+	}
+	source, datagram = string(datagram[1:1+int(datagram[0])]), datagram[1+int(datagram[0]):]
+
+	if len(datagram) < 1 || len(datagram) < 1+int(datagram[0]) {
+		return "", "", nil, false
+	}
+	local, packet = string(datagram[1:1+int(datagram[0])]), datagram[1+int(datagram[0]):]
+	return source, local, packet, true
+}
+
+// startsSession reports whether a packet is a STUN binding or allocate request.
+// They start new sessions, which belong to the newest process.
+func startsSession(packet []byte) bool {
+	if !stun.IsMessage(packet) {
+		return false
+	}
+	messageType := binary.BigEndian.Uint16(packet[0:2])
+	return messageType == stun.BindingRequest.Value() || messageType == allocateRequest.Value()
+}
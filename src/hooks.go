@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// eventHookTimeout is how long the auth and allocation paths wait for a hook
+	eventHookTimeout = 100 * time.Millisecond
+
+	// Reasons an event hook failed
+	EventHookPanic   = "panic"
+	EventHookTimeout = "timeout"
+)
+
+// EventHook is a callback for the events published by the auth and allocation paths.
+// Hooks run synchronously on these paths, so they should return quickly and hand
+// slow work, like network calls, to their own goroutine.
+type EventHook func(event Event)
+
+// eventHook is a registered hook, named for its logs and metrics
+type eventHook struct {
+	name string
+	hook EventHook
+}
+
+var (
+	// eventHooks is the copy-on-write list of registered hooks, read without a lock
+	// on every event
+	eventHooks   atomic.Pointer[[]eventHook]
+	eventHooksMu sync.Mutex // Serializes registrations
+)
+
+// RegisterEventHook registers a hook called for every auth_success, auth_failure,
+// allocation_created and allocation_closed event. Hooks are called in the order
+// they were registered. A hook that panics or runs longer than eventHookTimeout
+// is logged and counted, and the next hooks are called regardless.
+func RegisterEventHook(name string, hook EventHook) {
+	eventHooksMu.Lock()
+	defer eventHooksMu.Unlock()
+
+	var hooks []eventHook
+	if current := eventHooks.Load(); current != nil {
+		hooks = append(hooks, *current...)
+	}
+	hooks = append(hooks, eventHook{name: name, hook: hook})
+	eventHooks.Store(&hooks)
+
+	log.Debug().Str("hook", name).Int("hooks", len(hooks)).Msg("Event hook registered")
+}
+
+// runEventHooks calls the registered hooks with the event, one after another
+func runEventHooks(event Event) {
+	hooks := eventHooks.Load()
+	if hooks == nil {
+		return
+	}
+	for _, h := range *hooks {
+		h.run(event)
+	}
+}
+
+// run calls the hook with the event, waiting for it at most eventHookTimeout.
+// A hook that times out keeps running in its goroutine, but the event path moves on.
+func (h eventHook) run(event Event) {
+	done := make(chan any, 1)
+	go func() {
+		defer func() {
+			done <- recover()
+		}()
+		h.hook(event)
+	}()
+
+	timer := time.NewTimer(eventHookTimeout)
+	defer timer.Stop()
+	select {
+	case recovered := <-done:
+		if recovered != nil {
+			RecordEventHookFailure(h.name, EventHookPanic)
+			log.Error().
+				Str("hook", h.name).
+				Str("type", event.Type).
+				Str("panic", fmt.Sprint(recovered)).
+				Msg("Event hook panicked")
+		}
+	case <-timer.C:
+		RecordEventHookFailure(h.name, EventHookTimeout)
+		log.Warn().
+			Str("hook", h.name).
+			Str("type", event.Type).
+			Dur("timeout", eventHookTimeout).
+			Msg("Event hook timed out")
+	}
+}
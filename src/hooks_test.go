@@ -0,0 +1,98 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// useTestEventHooks gives the test no registered hooks, restoring the previous ones
+// after the test
+func useTestEventHooks(t *testing.T) {
+	t.Helper()
+	previous := eventHooks.Load()
+	t.Cleanup(func() { eventHooks.Store(previous) })
+	eventHooks.Store(nil)
+}
+
+// hookFailures returns how often the hook failed for the reason
+func hookFailures(t *testing.T, metrics *Metrics, hook, reason string) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := metrics.EventHookFailures.WithLabelValues(hook, reason).Write(&metric); err != nil {
+		t.Fatalf("failed to read the hook failures: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestEventHooksRunInRegistrationOrder(t *testing.T) {
+	useTestEventHooks(t)
+
+	var mu sync.Mutex
+	var calls []string
+	for _, name := range []string{"first", "second", "third"} {
+		RegisterEventHook(name, func(event Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, name+":"+event.Type)
+		})
+	}
+
+	PublishEvent(Event{Type: EventAuthSuccess})
+	PublishEvent(Event{Type: EventAuthFailure})
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"first:" + EventAuthSuccess, "second:" + EventAuthSuccess, "third:" + EventAuthSuccess,
+		"first:" + EventAuthFailure, "second:" + EventAuthFailure, "third:" + EventAuthFailure,
+	}
+	if !slices.Equal(calls, want) {
+		t.Errorf("hooks called as %q, want %q", calls, want)
+	}
+}
+
+func TestEventHookPanicIsIsolated(t *testing.T) {
+	useTestEventHooks(t)
+	metrics := useTestMetrics(t)
+	before := hookFailures(t, metrics, "panicking", EventHookPanic)
+
+	RegisterEventHook("panicking", func(Event) { panic("hook bug") })
+	events := recordTestEvents(t)
+
+	PublishEvent(Event{Type: EventAllocationCreated, UserID: "alice"})
+
+	if got := events(); len(got) != 1 || got[0].UserID != "alice" || got[0].Timestamp.IsZero() {
+		t.Errorf("next hook received %+v, want the stamped event of alice", got)
+	}
+	if got := hookFailures(t, metrics, "panicking", EventHookPanic) - before; got != 1 {
+		t.Errorf("panics counted = %v, want 1", got)
+	}
+}
+
+func TestEventHookTimeoutDoesNotBlockEvents(t *testing.T) {
+	useTestEventHooks(t)
+	metrics := useTestMetrics(t)
+	before := hookFailures(t, metrics, "slow", EventHookTimeout)
+
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	RegisterEventHook("slow", func(Event) { <-release })
+	events := recordTestEvents(t)
+
+	start := time.Now()
+	PublishEvent(Event{Type: EventAllocationClosed})
+	if elapsed := time.Since(start); elapsed > 10*eventHookTimeout {
+		t.Errorf("PublishEvent() took %s with a blocked hook, want about %s", elapsed, eventHookTimeout)
+	}
+
+	if got := events(); len(got) != 1 {
+		t.Errorf("next hook received %d events, want 1", len(got))
+	}
+	if got := hookFailures(t, metrics, "slow", EventHookTimeout) - before; got != 1 {
+		t.Errorf("timeouts counted = %v, want 1", got)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// Types of allocation refreshes, recorded in saturn_allocation_refreshes_total
+const (
+	AllocationRefreshed = "refresh" // The allocation was kept alive
+	AllocationDeleted   = "delete"  // The client released the allocation with a zero lifetime
+)
+
+const (
+	// defaultAllocationLifetime is the lifetime pion grants requests without LIFETIME
+	defaultAllocationLifetime = 10 * time.Minute
+	// maxPionAllocationLifetime is the lifetime from which pion ignores the requested
+	// LIFETIME and grants defaultAllocationLifetime instead
+	maxPionAllocationLifetime = time.Hour
+)
+
+var (
+	// Longest allocation lifetime granted to clients, 0 when MAX_ALLOCATION_LIFETIME is disabled
+	maxAllocationLifetime time.Duration
+)
+
+// InitAllocationLifetimeCap initializes the allocation lifetime cap
+func InitAllocationLifetimeCap(config *Config) {
+	maxAllocationLifetime = time.Duration(config.MaxAllocationLifetime) * time.Second
+	log.Info().
+		Dur("max_allocation_lifetime", maxAllocationLifetime).
+		Msg("Allocation lifetime cap enabled")
+}
+
+// clampAllocationLifetime rewrites an authenticated ALLOCATE or REFRESH request from
+// source asking for a lifetime above MAX_ALLOCATION_LIFETIME to ask for the cap
+// instead, so pion grants the cap and tells the client in its response when to refresh.
+// Since LIFETIME is covered by MESSAGE-INTEGRITY, the request is signed again with the
+// key the source last authenticated with, see requestKey. Other requests are left
+// alone and answered by pion as usual, like the first authenticated ALLOCATE, whose
+// response clampGrantedLifetime rewrites instead.
+func clampAllocationLifetime(packet []byte, source net.Addr) ([]byte, bool) {
+	if maxAllocationLifetime <= 0 || !isSTUNRequest(packet) {
+		return nil, false
+	}
+	var messageType stun.MessageType
+	messageType.ReadValue(binary.BigEndian.Uint16(packet[0:2]))
+	if messageType.Method != stun.MethodAllocate && messageType.Method != stun.MethodRefresh {
+		return nil, false
+	}
+
+	message := &stun.Message{Raw: append([]byte(nil), packet...)}
+	if err := message.Decode(); err != nil {
+		return nil, false
+	}
+	requested := defaultAllocationLifetime
+	if value, err := message.Get(stun.AttrLifetime); err == nil && len(value) == 4 {
+		requested = time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+	}
+	if requested <= maxAllocationLifetime {
+		return nil, false
+	}
+
+	key, ok := requestKey(message, source)
+	if !ok {
+		return nil, false
+	}
+	clamped, err := withLifetime(message, maxAllocationLifetime, key)
+	if err != nil {
+		return nil, false
+	}
+
+	log.Debug().
+		Str("method", messageType.Method.String()).
+		Str("source_addr", source.String()).
+		Dur("requested_lifetime", requested).
+		Dur("granted_lifetime", maxAllocationLifetime).
+		Msg("Clamped requested allocation lifetime to MAX_ALLOCATION_LIFETIME")
+	return clamped, true
+}
+
+// clampGrantedLifetime rewrites an ALLOCATE or REFRESH success response to the client
+// granting a lifetime above MAX_ALLOCATION_LIFETIME to grant the cap, so the client
+// refreshes within it. This happens to the first ALLOCATE of a client, which reaches
+// pion before the client authenticated and so cannot be clamped. The response is
+// signed again with the key pion signed it with, the one the client authenticated with.
+func clampGrantedLifetime(response []byte, clientAddr net.Addr) ([]byte, bool) {
+	if maxAllocationLifetime <= 0 || !stun.IsMessage(response) {
+		return nil, false
+	}
+	messageType := binary.BigEndian.Uint16(response[0:2])
+	if messageType != stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse).Value() &&
+		messageType != stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse).Value() {
+		return nil, false
+	}
+
+	message := &stun.Message{Raw: append([]byte(nil), response...)}
+	if err := message.Decode(); err != nil {
+		return nil, false
+	}
+	value, err := message.Get(stun.AttrLifetime)
+	if err != nil || len(value) != 4 || time.Duration(binary.BigEndian.Uint32(value))*time.Second <= maxAllocationLifetime {
+		return nil, false
+	}
+
+	_, _, key, ok := Connections.AuthKey(clientAddr.String())
+	if !ok || stun.MessageIntegrity(key).Check(message) != nil {
+		return nil, false
+	}
+	clamped, err := withLifetime(message, maxAllocationLifetime, key)
+	if err != nil {
+		return nil, false
+	}
+
+	log.Debug().
+		Str("client_addr", clientAddr.String()).
+		Dur("granted_lifetime", maxAllocationLifetime).
+		Msg("Clamped granted allocation lifetime to MAX_ALLOCATION_LIFETIME")
+	return clamped, true
+}
+
+// withLifetime returns the message with its LIFETIME set, or added, and signed again
+// with key
+func withLifetime(message *stun.Message, lifetime time.Duration, key []byte) ([]byte, error) {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+
+	rewritten := &stun.Message{Type: message.Type, TransactionID: message.TransactionID}
+	rewritten.WriteHeader()
+	hasLifetime := false
+	for _, attribute := range message.Attributes {
+		// Only FINGERPRINT may follow MESSAGE-INTEGRITY, both are added again below
+		if attribute.Type == stun.AttrMessageIntegrity {
+			break
+		}
+		if attribute.Type == stun.AttrLifetime {
+			rewritten.Add(stun.AttrLifetime, value)
+			hasLifetime = true
+			continue
+		}
+		rewritten.Add(attribute.Type, attribute.Value)
+	}
+	if !hasLifetime {
+		rewritten.Add(stun.AttrLifetime, value)
+	}
+	if err := stun.MessageIntegrity(key).AddTo(rewritten); err != nil {
+		return nil, err
+	}
+	if message.Contains(stun.AttrFingerprint) {
+		if err := stun.Fingerprint.AddTo(rewritten); err != nil {
+			return nil, err
+		}
+	}
+	return rewritten.Raw, nil
+}
+
+// grantedRefresh returns the lifetime granted by a REFRESH success response,
+// zero when the client deleted its allocation
+func grantedRefresh(response []byte) (time.Duration, bool) {
+	if !stun.IsMessage(response) ||
+		binary.BigEndian.Uint16(response[0:2]) != stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse).Value() {
+		return 0, false
+	}
+
+	message := &stun.Message{Raw: append([]byte(nil), response...)}
+	if err := message.Decode(); err != nil {
+		return 0, false
+	}
+	value, err := message.Get(stun.AttrLifetime)
+	if err != nil || len(value) != 4 {
+		return 0, false
+	}
+	return time.Duration(binary.BigEndian.Uint32(value)) * time.Second, true
+}
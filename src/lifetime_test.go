@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v4"
+)
+
+// useTestAllocationLifetimeCap sets MAX_ALLOCATION_LIFETIME, restoring it after the test
+func useTestAllocationLifetimeCap(t *testing.T, lifetime time.Duration) {
+	t.Helper()
+	previous := maxAllocationLifetime
+	t.Cleanup(func() { maxAllocationLifetime = previous })
+	maxAllocationLifetime = lifetime
+}
+
+// authenticateTestSource registers source as authenticated with the token, and
+// returns the key its requests are signed with
+func authenticateTestSource(t *testing.T, source net.Addr, token string) []byte {
+	t.Helper()
+	key := turn.GenerateAuthKey(token, testRealm, "alice")
+	Connections.Acquire(testRealm, source.String(), "alice", nil, 0)
+	Connections.SetAuthKey(source.String(), token, testRealm, key)
+	return key
+}
+
+func lifetimeAttribute(lifetime time.Duration) stun.RawAttribute {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+	return stun.RawAttribute{Type: stun.AttrLifetime, Value: value}
+}
+
+// assertLifetime checks the LIFETIME of a message signed with key
+func assertLifetime(t *testing.T, raw, key []byte, want time.Duration) {
+	t.Helper()
+	message := &stun.Message{Raw: raw}
+	if err := message.Decode(); err != nil {
+		t.Fatalf("failed to decode the message: %v", err)
+	}
+	if err := stun.MessageIntegrity(key).Check(message); err != nil {
+		t.Errorf("MESSAGE-INTEGRITY check failed: %v", err)
+	}
+	if err := stun.Fingerprint.Check(message); err != nil {
+		t.Errorf("FINGERPRINT check failed: %v", err)
+	}
+	value, err := message.Get(stun.AttrLifetime)
+	if err != nil || len(value) != 4 {
+		t.Fatalf("no LIFETIME: %v", err)
+	}
+	if got := time.Duration(binary.BigEndian.Uint32(value)) * time.Second; got != want {
+		t.Errorf("LIFETIME = %s, want %s", got, want)
+	}
+}
+
+func TestClampAllocationLifetime(t *testing.T) {
+	useTestAllocationLifetimeCap(t, 5*time.Minute)
+	useTestConnections(t)
+	source := testAddr(t, "192.0.2.1:40000")
+	key := authenticateTestSource(t, source, "token")
+
+	request := func(username string, lifetime time.Duration, key []byte) []byte {
+		return buildTestMessage(t,
+			stun.NewType(stun.MethodRefresh, stun.ClassRequest), lifetimeAttribute(lifetime),
+			stun.NewUsername(username), stun.NewRealm(testRealm), testNonce(time.Now()),
+			stun.MessageIntegrity(key), stun.Fingerprint,
+		)
+	}
+
+	clamped, ok := clampAllocationLifetime(request("token", time.Hour, key), source)
+	if !ok {
+		t.Fatal("request above the cap was not clamped")
+	}
+	assertLifetime(t, clamped, key, 5*time.Minute)
+
+	otherKey := turn.GenerateAuthKey("other-token", testRealm, "alice")
+	tests := []struct {
+		name    string
+		request []byte
+		source  net.Addr
+	}{
+		{"lifetime within the cap", request("token", time.Minute, key), source},
+		{"source not authenticated", request("token", time.Hour, key), testAddr(t, "192.0.2.2:40000")},
+		{"another token", request("other-token", time.Hour, otherKey), source},
+		{"wrong integrity", request("token", time.Hour, otherKey), source},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := clampAllocationLifetime(tt.request, tt.source); ok {
+				t.Error("request was clamped")
+			}
+		})
+	}
+}
+
+func TestClampGrantedLifetime(t *testing.T) {
+	useTestAllocationLifetimeCap(t, 5*time.Minute)
+	useTestConnections(t)
+	client := testAddr(t, "192.0.2.1:40000")
+	key := authenticateTestSource(t, client, "token")
+
+	response := func(lifetime time.Duration) []byte {
+		return buildTestMessage(t,
+			stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+			&stun.XORMappedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 40000}, lifetimeAttribute(lifetime),
+			stun.MessageIntegrity(key), stun.Fingerprint,
+		)
+	}
+
+	clamped, ok := clampGrantedLifetime(response(time.Hour), client)
+	if !ok {
+		t.Fatal("lifetime granted above the cap was not clamped")
+	}
+	assertLifetime(t, clamped, key, 5*time.Minute)
+
+	if _, ok := clampGrantedLifetime(response(time.Minute), client); ok {
+		t.Error("lifetime granted within the cap was clamped")
+	}
+	if _, ok := clampGrantedLifetime(response(time.Hour), testAddr(t, "192.0.2.2:40000")); ok {
+		t.Error("response to a client that did not authenticate was clamped")
+	}
+}
@@ -1,35 +1,119 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"     // For enhanced error handling with stack traces
 	"github.com/rs/zerolog"     // Zero-allocation JSON logger
 	"github.com/rs/zerolog/log" // Global logger instance
 )
 
+// Log formats supported by the LOG_FORMAT setting
+const (
+	LogFormatJSON    = "json"    // Structured JSON, one event per line
+	LogFormatConsole = "console" // Human-readable output for local development
+)
+
 // InitLogger configures and initializes the zerolog logging system with the following settings:
-// - Sets the time format to Unix timestamp for standardized time representation
 // - Initializes the global log level to the most verbose (Trace) initially
-// - Configures JSON output for structured, parseable logs
+// - Configures JSON output with Unix timestamps, or human-readable console output with LOG_FORMAT=console
+// - Writes to stdout, stderr or a file as set by LOG_OUTPUT
 // - Sets up the global logger instance
 //
 // This function should be called early in the application startup process
 // before any logging is needed.
-func InitLogger() {
-	// Configure zerolog to use Unix timestamp format for consistent time representation
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-
+func InitLogger(config *Config) {
 	// Set the most verbose logging level initially
 	// This ensures all logs are captured until a more specific level is set
 	zerolog.SetGlobalLevel(zerolog.TraceLevel)
 
-	// Configure the global logger to output structured JSON logs directly to stdout
-	// This ensures logs are parseable by log aggregation tools like ELK, Fluentd, etc.
-	log.Logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
+	// Invalid settings fall back to JSON on stdout so the failure itself gets logged
+	format, formatErr := logFormat(config.LogFormat)
+	output, outputErr := openLogOutput(config.LogOutput)
+
+	if format == LogFormatConsole {
+		// Human-readable timestamps for local development
+		zerolog.TimeFieldFormat = time.RFC3339
+		log.Logger = zerolog.New(zerolog.ConsoleWriter{
+			Out:        output,
+			TimeFormat: time.DateTime,
+			NoColor:    output != os.Stdout && output != os.Stderr, // No color codes in log files
+		}).With().Timestamp().Logger()
+	} else {
+		// Configure zerolog to use Unix timestamp format for consistent time representation
+		// JSON logs are parseable by log aggregation tools like ELK, Fluentd, etc.
+		zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+		log.Logger = zerolog.New(output).With().Timestamp().Logger()
+	}
+
+	if formatErr != nil {
+		log.Fatal().Err(formatErr).Msg("Invalid log configuration")
+	}
+	if outputErr != nil {
+		log.Fatal().Err(outputErr).Msg("Invalid log configuration")
+	}
 
 	// Log confirmation that the logger has been initialized
-	log.Trace().Msg("Zerolog initialized with JSON output")
+	log.Trace().Str("format", format).Str("output", config.LogOutput).Msg("Zerolog initialized")
+}
+
+// logFormat normalizes the LOG_FORMAT setting, an empty value means JSON
+func logFormat(value string) (string, error) {
+	switch format := strings.ToLower(strings.TrimSpace(value)); format {
+	case "", LogFormatJSON:
+		return LogFormatJSON, nil
+	case LogFormatConsole:
+		return LogFormatConsole, nil
+	default:
+		return LogFormatJSON, fmt.Errorf("unknown LOG_FORMAT %q, expected %q or %q", value, LogFormatJSON, LogFormatConsole)
+	}
+}
+
+// parseLogOutput splits the LOG_OUTPUT setting into its destination and, for files, the path.
+// An empty value means stdout.
+func parseLogOutput(value string) (destination string, path string, err error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "" || value == "stdout":
+		return "stdout", "", nil
+	case value == "stderr":
+		return "stderr", "", nil
+	case strings.HasPrefix(value, "file:"):
+		path = strings.TrimPrefix(value, "file:")
+		if path == "" {
+			return "", "", fmt.Errorf("LOG_OUTPUT %q is missing the file path", value)
+		}
+		return "file", path, nil
+	default:
+		return "", "", fmt.Errorf("unknown LOG_OUTPUT %q, expected \"stdout\", \"stderr\" or \"file:/path\"", value)
+	}
+}
+
+// openLogOutput returns the writer for the LOG_OUTPUT setting.
+// Log files are appended to and kept open for the lifetime of the process.
+// On error stdout is returned so logging keeps working.
+func openLogOutput(value string) (io.Writer, error) {
+	destination, path, err := parseLogOutput(value)
+	if err != nil {
+		return os.Stdout, err
+	}
+
+	switch destination {
+	case "stderr":
+		return os.Stderr, nil
+	case "file":
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return os.Stdout, fmt.Errorf("failed to open log file: %w", err)
+		}
+		return file, nil
+	default:
+		return os.Stdout, nil
+	}
 }
 
 // ErrorWithStack logs an error along with its complete stack trace.
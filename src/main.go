@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,59 +17,211 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func main() { //nolint:cyclop
-	config := GetConfig()
+func main() {
+	os.Exit(RunCommand(os.Args[1:]))
+}
+
+// serve runs the TURN server until it receives SIGINT or SIGTERM or finishes draining
+func serve(args []string) int { //nolint:cyclop
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	checkConfig := flags.Bool("check-config", false, "validate the configuration, print a report and exit")
+	check := flags.Bool("check", false, "same as --check-config")
+	envFile := flags.String("env-file", "", "file to read settings from, same as ENV_FILE (default .env)")
+	_ = flags.Parse(args) // Exits on error
+
+	config := GetConfig(*envFile)
+
+	// Preflight mode: validate and exit without starting any listeners
+	if *checkConfig || *check || config.CheckConfig {
+		return configCheckStatus(config)
+	}
+
 	publicIP := config.PublicIP
-	port := config.Port
+	ports := config.ListenPorts()
 	realm := config.Realm
 	threadNum := config.ThreadNum
-	bindAddress := config.BindAddress
+	bindAddresses := config.ListenAddresses()
 	ipv4Only := config.IPv4Only
+	stunOnly := config.IsSTUNOnly()
 
-	InitLogger()
+	InitLogger(config)
 	SetLogLevel(config)
 
+	// Discover the public IP through STUN before anything advertises it
+	if config.PublicIP == PublicIPAuto {
+		ip, err := DiscoverPublicIP(config)
+		if err != nil {
+			log.Fatal().Err(err).Strs("stun_servers", config.STUNDiscoveryServerList()).Msg("Failed to discover the public IP")
+		}
+		config.PublicIP = ip
+		publicIP = ip
+	}
+
+	// A ready file left by the previous process must not announce this one
+	ClearReadyFile(config)
+
 	// Initialize Prometheus metrics if enabled
 	if config.EnableMetrics {
 		InitMetrics(config)
 		StartMetricsServer(config)
 	}
 
+	// Load the token verification keys for the configured algorithms
+	InitTokenKeys(config)
+
+	// Start webhook notifications for security events if configured
+	if config.WebhookURL != "" {
+		InitWebhooks(config)
+	}
+
+	// Refuse sources on the deny list, reloaded whenever the file changes
+	if config.DenyCIDRsFile != "" {
+		InitDenyList(config)
+	}
+
+	// Restrict relaying to the allowed peer networks if configured
+	if config.PeerAllowlist != "" {
+		InitPeerAllowlist(config)
+	}
+
+	// Stream auth and allocation events to sidecars if configured
+	if config.EventSocketPath != "" {
+		InitEventSocket(config)
+	}
+
+	// Pass packets to the listener or process holding their allocation during restarts
+	// Packets are routed by the metered listeners, so this needs metrics enabled
+	if config.HandoffSocketPath != "" {
+		if config.EnableMetrics {
+			InitHandoff(config)
+		} else {
+			log.Warn().Msg("HANDOFF_SOCKET_PATH is set but metrics are disabled, restarts will not hand off sessions")
+		}
+	}
+
+	// Refuse new clients from the start, e.g. for a node that should not take traffic yet
+	if config.MaintenanceMode {
+		SetMaintenance(true, "MAINTENANCE_MODE")
+	}
+
+	// The guards below inspect packets in the metered listeners, which wrap the
+	// listeners whenever a guard is configured, see Config.PacketGuardsEnabled
+
+	// Throttle floods from single source IPs before pion parses their packets
+	if config.SourcePPSLimit > 0 {
+		InitSourceRateLimiter(config)
+	}
+
+	// Drop STUN traffic that would make the server an amplifier for spoofed sources
+	// Binding requests are authenticated with the same authenticator as TURN requests
+	authenticator := NewJWTAuthenticator(config)
+	if config.AmplificationMaxRatio > 0 || config.STUNRequireAuth {
+		InitAmplificationGuard(config, authenticator)
+	}
+
+	// Clamp the allocation lifetimes clients request
+	if config.MaxAllocationLifetime > 0 {
+		InitAllocationLifetimeCap(config)
+	}
+
+	// Answer TURN requests with a 403 in STUN-only mode, in the metered listeners
+	if stunOnly {
+		InitSTUNOnlyMode()
+	}
+
+	// Expire nonces before pion does
+	InitNonceLifetime(config)
+
+	// Expire permissions before pion does, checked by the metered relays
+	InitPermissionLifetime(config)
+
+	// Cap open relay allocations per user, shared across nodes when REDIS_URL is set
+	if config.MaxAllocationsPerUser > 0 {
+		InitAllocationQuota(config)
+	}
+
+	// Cap open relay allocations across every realm, counted by the metered relays
+	if config.MaxTotalAllocations > 0 {
+		InitTotalAllocationLimit(config)
+	}
+
+	// Restore and periodically persist lifetime traffic totals if configured
+	// Traffic is only metered when metrics are enabled
+	stopTrafficState := func() {}
+	if config.TrafficStatePath != "" {
+		if config.EnableMetrics {
+			stopTrafficState = StartTrafficStatePersistence(config)
+		} else {
+			log.Warn().Msg("TRAFFIC_STATE_PATH is set but metrics are disabled, traffic state will not be persisted")
+		}
+	}
+
 	// Log server startup configuration
 	log.Info().
 		Str("public_ip", publicIP).
-		Int("port", port).
+		Str("advertised_ip", config.RelayAdvertisedIP()).
+		Ints("ports", ports).
 		Str("realm", realm).
 		Int("thread_num", threadNum).
-		Str("bind_address", bindAddress).
+		Strs("bind_addresses", bindAddresses).
 		Bool("ipv4_only", ipv4Only).
+		Str("mode", config.Mode).
+		Bool("stun_only", stunOnly).
+		Int("max_connections_per_realm", config.MaxConnectionsPerRealm).
+		Int("max_packet_size", config.MaxPacketSize).
+		Int("source_pps_limit", config.SourcePPSLimit).
+		Float64("amplification_max_ratio", config.AmplificationMaxRatio).
+		Bool("stun_require_auth", config.STUNRequireAuth).
+		Int("max_peers_per_allocation", config.MaxPeersPerAllocation).
+		Bool("block_private_peers", config.BlockPrivatePeers).
+		Str("peer_allowlist", config.PeerAllowlist).
+		Int("max_allocations_per_user", config.MaxAllocationsPerUser).
+		Int("max_total_allocations", config.MaxTotalAllocations).
+		Int("max_token_bytes", config.MaxTokenBytes).
+		Bool("dtls_enabled", config.EnableDTLS).
+		Bool("websocket_enabled", config.EnableWebSocket).
 		Bool("metrics_enabled", config.EnableMetrics).
 		Int("metrics_port", config.MetricsPort).
 		Msg("Starting TURN server with configuration")
+	log.Info().
+		Interface("config", config.Redacted()).
+		Interface("sources", SettingSources()).
+		Msg("Effective configuration")
 
-	if len(publicIP) == 0 {
-		log.Fatal().Msg("'public-ip' is required")
+	if err := config.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration")
 	}
 
 	// For Fly.io UDP, we must bind to the special fly-global-services address
 	// This is required for UDP traffic to be properly routed by Fly.io
-	// Can be configured via BIND_ADDRESS environment variable
+	// Can be configured via BIND_ADDRESS environment variable, or BIND_ADDRESSES
+	// to listen on several interfaces of a multi-homed host
+	// Every bind address is listened on at each of PORTS, e.g. 3478 and 443 for
+	// clients behind firewalls that only let well-known ports through
 	// Use IPv4 only to avoid IPv6 DNS resolution issues
 	network := "udp"
 	if ipv4Only {
 		network = "udp4"
 	}
-	addr, err := net.ResolveUDPAddr(network, bindAddress+":"+strconv.Itoa(port))
-	if err != nil {
-		log.Fatal().Msgf("Failed to parse server address: %s", err)
-	}
+	addrs := make([]*net.UDPAddr, 0, len(bindAddresses)*len(ports))
+	for _, bindAddress := range bindAddresses {
+		for _, port := range ports {
+			addr, err := net.ResolveUDPAddr(network, net.JoinHostPort(bindAddress, strconv.Itoa(port)))
+			if err != nil {
+				log.Fatal().Err(err).Str("bind_address", bindAddress).Int("port", port).Msg("Failed to parse server address")
+			}
 
-	log.Info().
-		Str("resolved_network", addr.Network()).
-		Str("resolved_address", addr.String()).
-		Str("bind_address", bindAddress).
-		Bool("ipv4_only", ipv4Only).
-		Msg("Resolved UDP address for binding")
+			log.Info().
+				Str("resolved_network", addr.Network()).
+				Str("resolved_address", addr.String()).
+				Str("bind_address", bindAddress).
+				Int("port", port).
+				Bool("ipv4_only", ipv4Only).
+				Msg("Resolved UDP address for binding")
+
+			addrs = append(addrs, addr)
+		}
+	}
 
 	// Create `numThreads` UDP listeners to pass into pion/turn
 	// pion/turn itself doesn't allocate any UDP sockets, but lets the user pass them in
@@ -76,7 +231,7 @@ func main() { //nolint:cyclop
 	listenerConfig := &net.ListenConfig{
 		Control: func(network, address string, conn syscall.RawConn) error { // nolint: revive
 			var operr error
-			if err = conn.Control(func(fd uintptr) {
+			if err := conn.Control(func(fd uintptr) {
 				// Set SO_REUSEPORT for load balancing
 				operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1)
 				if operr != nil {
@@ -84,6 +239,13 @@ func main() { //nolint:cyclop
 				}
 				// Set SO_REUSEADDR for better address reuse
 				operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				if operr != nil {
+					return
+				}
+				// Larger buffers absorb bursts that would otherwise be dropped under load
+				operr = setSocketBuffers(int(fd), config.SocketRcvbufBytes, config.SocketSndbufBytes)
+				// Packets dropped with the buffer full are reported with the next packet read
+				enableRxQueueOverflow(int(fd))
 			}); err != nil {
 				return err
 			}
@@ -92,110 +254,253 @@ func main() { //nolint:cyclop
 		},
 	}
 
-	// For Fly.io deployment, we need to use the same address resolution as the main server
-	// The RelayAddress should be the public IP that clients connect to,
-	// but the Address should be what we can actually bind to inside the container
+	// Behind NAT or a load balancer (Fly.io, AWS NLB, ...) the address clients connect to
+	// differs from the one we can bind to. The RelayAddress is RELAY_PUBLIC_IP, ADVERTISED_IP
+	// or the public IP, while the Address is RELAY_BIND_ADDRESS or the first bind address,
+	// resolved the same way as the listeners so fly-global-services works
 	relayNetwork := "udp"
 	if ipv4Only {
 		relayNetwork = "udp4"
 	}
-	relayAddr, err := net.ResolveUDPAddr(relayNetwork, bindAddress+":0")
+	relayBindAddress := config.RelayListenAddress()
+	relayAddr, err := net.ResolveUDPAddr(relayNetwork, net.JoinHostPort(relayBindAddress, "0"))
 	if err != nil {
-		log.Fatal().Err(err).Str("bind_address", bindAddress).Msg("Failed to resolve relay address")
+		log.Fatal().Err(err).Str("relay_bind_address", relayBindAddress).Msg("Failed to resolve relay address")
 	}
 
-	relayAddressGenerator := &turn.RelayAddressGeneratorStatic{
-		RelayAddress: net.ParseIP(publicIP), // Clients connect to the public IP
-		Address:      relayAddr.IP.String(), // Use the resolved fly-global-services IP for binding
+	// Relays are bound on ephemeral ports, or within RELAY_MIN_PORT and RELAY_MAX_PORT
+	// for firewalls that only open a range
+	newRelayAddressGenerator := func(advertisedIP string) turn.RelayAddressGenerator {
+		if config.RelayPortRangeEnabled() {
+			return NewRelayPortRangeGenerator(net.ParseIP(advertisedIP), relayAddr.IP.String(), config.RelayMinPort, config.RelayMaxPort)
+		}
+		return &turn.RelayAddressGeneratorStatic{
+			RelayAddress: net.ParseIP(advertisedIP), // Clients connect to the advertised IP
+			Address:      relayAddr.IP.String(),     // Relays are bound on the resolved internal address
+		}
+	}
+	relayAddressGenerator := newRelayAddressGenerator(config.RelayAdvertisedIP())
+	log.Info().
+		Str("relay_public_ip", config.RelayAdvertisedIP()).
+		Str("relay_bind_address", relayBindAddress).
+		Str("resolved_relay_address", relayAddr.IP.String()).
+		Int("relay_min_port", config.RelayMinPort).
+		Int("relay_max_port", config.RelayMaxPort).
+		Msg("Relay addresses configured")
+
+	// Realms in RELAY_PUBLIC_IPS advertise their relays on their own IP, bound on the same address.
+	// pion only validates the default generator, so the realm ones are validated here.
+	// They are keyed by the accepted realm they name, the realm identities carry.
+	realmIPs, _ := parseRealmIPs(config.RelayPublicIPs) // Checked by config.Validate
+	realmRelayAddressGenerators := make(map[string]turn.RelayAddressGenerator, len(realmIPs))
+	for realm, ip := range realmIPs {
+		realm, _ = config.AcceptedRealm(realm) // Checked by config.Validate
+		generator := newRelayAddressGenerator(ip.String())
+		if err := generator.Validate(); err != nil {
+			log.Fatal().Err(err).Str("realm", realm).Msg("Invalid relay address for realm")
+		}
+		realmRelayAddressGenerators[realm] = generator
+		log.Info().
+			Str("realm", realm).
+			Str("relay_public_ip", ip.String()).
+			Msg("Relay address configured for realm")
 	}
 
-	packetConnConfigs := make([]turn.PacketConnConfig, threadNum)
-	for i := range threadNum {
+	// Every bind address and port gets its own set of `numThreads` listeners
+	// A listener that fails to bind only degrades the server, startup is aborted
+	// when none of them come up
+	packetConnConfigs := make([]turn.PacketConnConfig, 0, len(addrs)*threadNum)
+	var listenErrs []error
+	// Listeners are metered for the traffic metrics and for the packet guards,
+	// which apply whether metrics are enabled or not
+	meteredListeners := config.EnableMetrics || config.PacketGuardsEnabled()
+	for i := range len(addrs) * threadNum {
+		addr := addrs[i/threadNum]
 		conn, listErr := listenerConfig.ListenPacket(context.Background(), addr.Network(), addr.String())
 		if listErr != nil {
-			log.Fatal().Msgf("Failed to allocate UDP listener at %s:%s", addr.Network(), addr.String())
+			listenErrs = append(listenErrs, listErr)
+			log.Error().
+				Err(listErr).
+				Int("server_id", i).
+				Int("port", addr.Port).
+				Str("network", addr.Network()).
+				Str("bind_addr", addr.String()).
+				Msgf("Failed to allocate UDP listener at %s:%s", addr.Network(), addr.String())
+			continue
 		}
 
 		// Log the actual local address to debug binding issues
 		localAddr := conn.LocalAddr()
 		log.Info().
 			Int("server_id", i).
+			Int("port", addr.Port).
 			Str("network", addr.Network()).
 			Str("bind_addr", addr.String()).
 			Str("actual_local_addr", localAddr.String()).
 			Msgf("Server %d listening on %s", i, localAddr.String())
+		LogSocketBuffers(i, conn, config)
 
-		// Use the connection directly, with metrics tracking if enabled
+		// Use the connection directly, metered when metrics or a packet guard is enabled
+		// Each listener gets its own relay generator so relays can be metered per allocation
 		wrappedConn := conn
-		if config.EnableMetrics {
-			wrappedConn = NewMetricsPacketConn(wrappedConn, realm)
+		var metricsConn *MetricsPacketConn
+		if meteredListeners {
+			metricsConn = NewMetricsPacketConn(wrappedConn, realm, i, addr.Port, TransportUDP, config.MaxPacketSize)
+			wrappedConn = metricsConn
+			if Handoff != nil {
+				Handoff.AddListener(metricsConn)
+			}
 		}
 
-		packetConnConfigs[i] = turn.PacketConnConfig{
-			PacketConn:            wrappedConn,
-			RelayAddressGenerator: relayAddressGenerator,
+		packetConnConfig := turn.PacketConnConfig{
+			PacketConn: wrappedConn,
 		}
+
+		// In STUN-only mode the relay address generator is left unset so pion
+		// refuses every ALLOCATE request while still answering BINDING requests
+		if !stunOnly {
+			packetConnConfig.RelayAddressGenerator = NewMeteredRelayGenerator(relayAddressGenerator, realmRelayAddressGenerators, metricsConn, config.MaxAllocationsPerUser)
+			packetConnConfig.PermissionHandler = NewPermissionHandler(config)
+		}
+
+		packetConnConfigs = append(packetConnConfigs, packetConnConfig)
 	}
 
-	server, err := turn.NewServer(turn.ServerConfig{
-		Realm: realm,
-		// Set AuthHandler callback
-		// This is called every time a user tries to authenticate with the TURN server
-		// Return the key for that user, or false when no user is found
-		AuthHandler: func(accessToken string, realm string, srcAddr net.Addr) ([]byte, bool) { //nolint:revive
-			startTime := time.Now()
+	// DTLS sessions are terminated here and their packets handed to pion as if
+	// they came from one more UDP listener per bind address, so the guards,
+	// metrics and quotas above apply to them unchanged
+	// They are not handed off on restart, a new process cannot decrypt them
+	if config.EnableDTLS {
+		dtlsConfig, err := DTLSConfig(config)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to configure DTLS")
+		}
+		for j, bindAddress := range bindAddresses {
+			serverID := len(addrs)*threadNum + j
+			addr, err := net.ResolveUDPAddr(network, net.JoinHostPort(bindAddress, strconv.Itoa(config.DTLSPort)))
+			if err != nil {
+				log.Fatal().Err(err).Str("bind_address", bindAddress).Int("port", config.DTLSPort).Msg("Failed to parse DTLS address")
+			}
+			conn, listErr := ListenDTLS(addr, dtlsConfig)
+			if listErr != nil {
+				listenErrs = append(listenErrs, listErr)
+				log.Error().
+					Err(listErr).
+					Int("server_id", serverID).
+					Int("port", addr.Port).
+					Str("bind_addr", addr.String()).
+					Msgf("Failed to allocate DTLS listener at %s", addr.String())
+				continue
+			}
 
-			// Log authentication attempt with source address and realm
 			log.Info().
-				Str("realm", realm).
-				Str("source_addr", srcAddr.String()).
-				Str("token_preview", safeTokenPreview(accessToken)).
-				Msg("TURN authentication attempt")
+				Int("server_id", serverID).
+				Int("port", addr.Port).
+				Str("transport", TransportDTLS).
+				Str("actual_local_addr", conn.LocalAddr().String()).
+				Msgf("Server %d listening for DTLS on %s", serverID, conn.LocalAddr().String())
+
+			var wrappedConn net.PacketConn = conn
+			var metricsConn *MetricsPacketConn
+			if meteredListeners {
+				metricsConn = NewMetricsPacketConn(wrappedConn, realm, serverID, addr.Port, TransportDTLS, config.MaxPacketSize)
+				wrappedConn = metricsConn
+			}
 
-			// Record authentication attempt
-			RecordAuthAttempt(realm, "attempt")
+			packetConnConfig := turn.PacketConnConfig{
+				PacketConn: wrappedConn,
+			}
+			if !stunOnly {
+				packetConnConfig.RelayAddressGenerator = NewMeteredRelayGenerator(relayAddressGenerator, realmRelayAddressGenerators, metricsConn, config.MaxAllocationsPerUser)
+				packetConnConfig.PermissionHandler = NewPermissionHandler(config)
+			}
 
-			payload, err := ValidateToken(accessToken)
+			packetConnConfigs = append(packetConnConfigs, packetConnConfig)
+		}
+	}
 
+	// WebSocket sessions are bridged to pion the same way, numbered after the DTLS listeners
+	// They are not handed off on restart either, their TCP connections end with the process
+	if config.EnableWebSocket {
+		tlsConfig, err := WebSocketTLSConfig(config)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to configure WebSocket")
+		}
+		tcpNetwork := "tcp"
+		if ipv4Only {
+			tcpNetwork = "tcp4"
+		}
+		firstServerID := len(addrs) * threadNum
+		if config.EnableDTLS {
+			firstServerID += len(bindAddresses)
+		}
+		for j, bindAddress := range bindAddresses {
+			serverID := firstServerID + j
+			addr, err := net.ResolveTCPAddr(tcpNetwork, net.JoinHostPort(bindAddress, strconv.Itoa(config.WebSocketPort)))
 			if err != nil {
-				// Record authentication failure with timing
-				duration := time.Since(startTime)
-				if ServerMetrics != nil {
-					ServerMetrics.AuthDuration.WithLabelValues(realm, "failure").Observe(duration.Seconds())
-				}
-				RecordAuthAttempt(realm, "failure")
-				RecordAuthFailure(realm, "token_validation_failed")
-
+				log.Fatal().Err(err).Str("bind_address", bindAddress).Int("port", config.WebSocketPort).Msg("Failed to parse WebSocket address")
+			}
+			conn, listErr := ListenWebSocket(addr, config.WebSocketPath, tlsConfig, ProxyProtocolModeFor(config))
+			if listErr != nil {
+				listenErrs = append(listenErrs, listErr)
 				log.Error().
-					Err(err).
-					Str("realm", realm).
-					Str("source_addr", srcAddr.String()).
-					Str("token_preview", safeTokenPreview(accessToken)).
-					Msg("Token validation failed - authentication denied")
-				return nil, false
+					Err(listErr).
+					Int("server_id", serverID).
+					Int("port", addr.Port).
+					Str("bind_addr", addr.String()).
+					Msgf("Failed to allocate WebSocket listener at %s", addr.String())
+				continue
+			}
+
+			log.Info().
+				Int("server_id", serverID).
+				Int("port", addr.Port).
+				Str("transport", TransportWebSocket).
+				Str("path", config.WebSocketPath).
+				Bool("tls", tlsConfig != nil).
+				Str("actual_local_addr", conn.LocalAddr().String()).
+				Msgf("Server %d listening for WebSocket on %s", serverID, conn.LocalAddr().String())
+
+			var wrappedConn net.PacketConn = conn
+			var metricsConn *MetricsPacketConn
+			if meteredListeners {
+				metricsConn = NewMetricsPacketConn(wrappedConn, realm, serverID, addr.Port, TransportWebSocket, config.MaxPacketSize)
+				wrappedConn = metricsConn
 			}
 
-			// Record successful authentication with timing
-			duration := time.Since(startTime)
-			if ServerMetrics != nil {
-				ServerMetrics.AuthDuration.WithLabelValues(realm, "success").Observe(duration.Seconds())
+			packetConnConfig := turn.PacketConnConfig{
+				PacketConn: wrappedConn,
+			}
+			if !stunOnly {
+				packetConnConfig.RelayAddressGenerator = NewMeteredRelayGenerator(relayAddressGenerator, realmRelayAddressGenerators, metricsConn, config.MaxAllocationsPerUser)
+				packetConnConfig.PermissionHandler = NewPermissionHandler(config)
 			}
-			RecordAuthAttempt(realm, "success")
-			RecordAuthSuccess(realm, payload.UserID)
-			RecordConnection(realm)
 
-			// Log successful authentication
-			log.Info().
-				Str("realm", realm).
-				Str("source_addr", srcAddr.String()).
-				Str("user_id", payload.UserID).
-				Str("token_preview", safeTokenPreview(accessToken)).
-				Msg("Token validation successful - authentication granted")
+			packetConnConfigs = append(packetConnConfigs, packetConnConfig)
+		}
+	}
 
-			return turn.GenerateAuthKey(accessToken, realm, payload.UserID), true
-		},
+	if len(packetConnConfigs) == 0 {
+		log.Fatal().Err(errors.Join(listenErrs...)).Msg("Failed to allocate any UDP listener")
+	}
+	if len(listenErrs) > 0 {
+		log.Warn().
+			Int("listeners", len(packetConnConfigs)).
+			Int("failed_listeners", len(listenErrs)).
+			Msg("Some UDP listeners failed to bind, continuing with fewer threads")
+	}
+	SetRunningThreads(len(packetConnConfigs))
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: realm,
+		// AuthHandler is called every time a user tries to authenticate with the TURN server
+		// It returns the key for that user, or false when authentication is refused
+		AuthHandler: NewAuthHandler(config, authenticator),
 		// PacketConnConfigs is a list of UDP Listeners and the configuration around them
 		PacketConnConfigs: packetConnConfigs,
+		// Sized so packets above MAX_PACKET_SIZE are detected and dropped rather than truncated
+		InboundMTU: inboundMTU(config.MaxPacketSize),
+		// pion has no nonce setting, NONCE_LIFETIME is enforced by the metered listeners
 	})
 	if err != nil {
 		log.Panic().Msgf("Failed to create TURN server: %s", err)
@@ -203,31 +508,108 @@ func main() { //nolint:cyclop
 
 	log.Info().Msg("TURN server created successfully, waiting for connections")
 
-	// Record server start time for uptime tracking
+	// Every listener is bound, so a restart may drain the old process now
+	MarkStarted(config, len(packetConnConfigs))
+
+	// The background loops below stop once the server is closed, so serve returns
+	// without leaving them running
+	stopped := make(chan struct{})
+	var background sync.WaitGroup
+
+	// Expire idle connections so they stop counting against the realm limit
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				Connections.Sweep()
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	// Update the uptime, memory and allocation metrics every METRICS_UPDATE_INTERVAL
+	stopMetricsUpdater := func() {}
 	if ServerMetrics != nil {
-		// Set up a goroutine to update server uptime and memory metrics every 30 seconds
-		go func() {
-			startTime := time.Now()
-			ticker := time.NewTicker(30 * time.Second)
-			defer ticker.Stop()
+		stopMetricsUpdater = StartMetricsUpdater(time.Duration(config.MetricsUpdateInterval) * time.Second)
+	}
 
-			for range ticker.C {
-				ServerMetrics.ServerUptime.Set(time.Since(startTime).Seconds())
-				UpdateMemoryMetrics()
+	// Sample file descriptor usage so pressure is logged before allocations start failing
+	// The gauges are only exported when metrics are enabled, the warning is always logged
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		UpdateFDMetrics(config.FDWarningThreshold)
+
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				UpdateFDMetrics(config.FDWarningThreshold)
+			case <-stopped:
+				return
 			}
-		}()
-	}
+		}
+	}()
+
+	// A drain started through /admin/drain ends once the last allocation is closed
+	drained := make(chan struct{})
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if IsDraining() && server.AllocationCount() == 0 {
+					close(drained)
+					return
+				}
+			case <-stopped:
+				return
+			}
+		}
+	}()
 
-	// Block until user sends SIGINT or SIGTERM
+	// Block until user sends SIGINT or SIGTERM, or the drain completes
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigs
-
-	log.Info().Str("signal", sig.String()).Msg("Received shutdown signal, closing TURN server")
+	defer signal.Stop(sigs)
+	select {
+	case sig := <-sigs:
+		log.Info().Str("signal", sig.String()).Msg("Received shutdown signal, closing TURN server")
+	case <-drained:
+		log.Info().Msg("Drain completed, no allocations left, closing TURN server")
+	}
 
 	if err = server.Close(); err != nil {
 		log.Panic().Msgf("Failed to close TURN server: %s", err)
 	}
+	close(stopped)
+	background.Wait()
+
+	stopMetricsUpdater()
+
+	// Listeners are closed, so no more traffic can be recorded after the final flush
+	stopTrafficState()
+
+	if Events != nil {
+		Events.Close()
+	}
+	if Handoff != nil {
+		Handoff.Close()
+	}
+	RemoveReadyFile(config)
 
 	log.Info().Msg("TURN server shutdown completed")
+	return 0
 }
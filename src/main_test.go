@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+)
+
+const (
+	testRealm  = "test"
+	testSecret = "test-secret-0123456789abcdefghijkl"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// useTestConfig makes a configuration accepting HS256 tokens signed with testSecret
+// for testRealm the global configuration, restoring the previous one after the test
+func useTestConfig(t testing.TB) *Config {
+	t.Helper()
+	previous := Conf
+	t.Cleanup(func() { Conf = previous })
+
+	Conf = Config{
+		Realm:                testRealm,
+		AccessSecret:         testSecret,
+		TokenAlgorithms:      TokenAlgHS256,
+		MaxTokenTTL:          7 * 24 * 60 * 60,
+		MaxTokenBytes:        8192,
+		JWTExpiryDoubleCheck: true,
+	}
+	return &Conf
+}
+
+// testClaims returns the claims of a token the test configuration accepts, with the
+// overrides applied. A nil override removes the claim.
+func testClaims(userID string, overrides jwt.MapClaims) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"user_id":     userID,
+		"email":       userID + "@example.com",
+		"username":    userID,
+		"is_verified": "true",
+		"role":        "user",
+		"type":        "ACCESS_TOKEN",
+		"realm":       testRealm,
+		"exp":         time.Now().Add(time.Hour).Unix(),
+		"iat":         time.Now().Unix(),
+	}
+	for claim, value := range overrides {
+		if value == nil {
+			delete(claims, claim)
+			continue
+		}
+		claims[claim] = value
+	}
+	return claims
+}
+
+// signTestToken signs the claims of testClaims with an HS256 secret
+func signTestToken(t testing.TB, secret, userID string, overrides jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims(userID, overrides)).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+var (
+	// testMetrics are the metrics of every test using useTestMetrics, registered once
+	// since the collectors cannot be registered twice
+	testMetrics     *Metrics
+	testMetricsOnce sync.Once
+)
+
+// useTestMetrics enables the metrics, disabling them again after the test
+func useTestMetrics(t testing.TB) *Metrics {
+	t.Helper()
+	previous := ServerMetrics
+	t.Cleanup(func() { ServerMetrics = previous })
+
+	testMetricsOnce.Do(func() {
+		InitMetrics(&Config{Realm: testRealm, MetricsNamespace: "saturn", ThreadNum: 1})
+		testMetrics = ServerMetrics
+	})
+	ServerMetrics = testMetrics
+	return testMetrics
+}
+
+// useTestConnections gives the test an empty connection tracker, restoring the
+// previous one after the test
+func useTestConnections(t testing.TB) *ConnectionTracker {
+	t.Helper()
+	previous := Connections
+	t.Cleanup(func() { Connections = previous })
+
+	Connections = NewConnectionTracker(connectionIdleTimeout)
+	return Connections
+}
+
+// testAddr returns the UDP address of a test client
+func testAddr(t testing.TB, address string) net.Addr {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatalf("failed to resolve %s: %v", address, err)
+	}
+	return addr
+}
+
+// recordTestEvents registers an event hook collecting the published events,
+// unregistering it after the test
+func recordTestEvents(t testing.TB) func() []Event {
+	t.Helper()
+	previous := eventHooks.Load()
+	t.Cleanup(func() { eventHooks.Store(previous) })
+
+	var mu sync.Mutex
+	var events []Event
+	RegisterEventHook("test", func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	})
+	return func() []Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Event(nil), events...)
+	}
+}
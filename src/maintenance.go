@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maintenanceState is whether the server is in maintenance and why
+type maintenanceState struct {
+	mu      sync.RWMutex
+	enabled bool
+	reason  string
+}
+
+var (
+	// Maintenance mode, set by MAINTENANCE_MODE or /admin/maintenance
+	maintenance maintenanceState
+
+	// errServerInMaintenance is returned to pion for allocations requested in maintenance
+	errServerInMaintenance = errors.New("server is in maintenance")
+)
+
+// maintenanceStatus is the /admin/maintenance request and response
+type maintenanceStatus struct {
+	Enabled     bool   `json:"enabled"`
+	Reason      string `json:"reason,omitempty"`
+	Allocations int64  `json:"allocations"`
+}
+
+// InMaintenance reports whether the server is in maintenance and the reason given for it
+func InMaintenance() (bool, string) {
+	maintenance.mu.RLock()
+	defer maintenance.mu.RUnlock()
+	return maintenance.enabled, maintenance.reason
+}
+
+// SetMaintenance enters or leaves maintenance. In maintenance, sources without an
+// active connection are refused authentication and no new allocations are made,
+// while the open allocations keep relaying until their clients release them.
+func SetMaintenance(enabled bool, reason string) {
+	maintenance.mu.Lock()
+	changed := maintenance.enabled != enabled
+	maintenance.enabled = enabled
+	maintenance.reason = reason
+	if !enabled {
+		maintenance.reason = ""
+	}
+	maintenance.mu.Unlock()
+	SetMaintenanceMode(enabled)
+
+	if !changed {
+		return
+	}
+	if enabled {
+		log.Info().
+			Str("reason", reason).
+			Int64("allocations", ActiveAllocations()).
+			Msg("Maintenance started, new clients are refused and open allocations keep relaying")
+	} else {
+		log.Info().
+			Int64("allocations", ActiveAllocations()).
+			Msg("Maintenance ended, new clients are accepted again")
+	}
+}
+
+// MaintenanceHandler serves /admin/maintenance. POST enters maintenance, or leaves it
+// with {"enabled": false}, and takes an optional "reason". GET reports the state and
+// how many allocations are still open.
+func MaintenanceHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			request := maintenanceStatus{Enabled: true}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			SetMaintenance(request.Enabled, request.Reason)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		enabled, reason := InMaintenance()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(maintenanceStatus{
+			Enabled:     enabled,
+			Reason:      reason,
+			Allocations: ActiveAllocations(),
+		})
+	})
+}
@@ -2,9 +2,21 @@ package main
 
 import (
 	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -16,14 +28,32 @@ type Metrics struct {
 	// Authentication metrics
 	AuthAttempts     *prometheus.CounterVec
 	AuthSuccesses    *prometheus.CounterVec
+	LastAuthSuccess  *prometheus.GaugeVec
 	AuthFailures     *prometheus.CounterVec
 	AuthDuration     *prometheus.HistogramVec
+	AuthPanics       prometheus.Counter
 	TokenValidations *prometheus.CounterVec
+	TokenDuration    *prometheus.HistogramVec
+	TokenKeys        *prometheus.CounterVec
+	TokenAlgorithms  *prometheus.CounterVec
 
 	// Connection metrics
 	ActiveConnections *prometheus.GaugeVec
 	TotalConnections  *prometheus.CounterVec
 
+	// Allocation metrics
+	AllocationFailures     *prometheus.CounterVec
+	RelayPortExhaustion    *prometheus.CounterVec
+	AllocationRefreshes    *prometheus.CounterVec
+	AllocationIngressBytes *prometheus.CounterVec
+	AllocationEgressBytes  *prometheus.CounterVec
+	AllocationMaxIdle      prometheus.Gauge
+	PeerLimitHits          *prometheus.CounterVec
+	PeersDenied            *prometheus.CounterVec
+	AmplificationSuspected *prometheus.CounterVec
+	PeerPacketsDropped     *prometheus.CounterVec
+	UnpermittedPeerDrops   *prometheus.CounterVec
+
 	// Server metrics
 	ServerUptime      prometheus.Gauge
 	ConfiguredThreads prometheus.Gauge
@@ -38,26 +68,138 @@ type Metrics struct {
 	GoroutineCount prometheus.Gauge
 	GCCount        prometheus.Counter
 
+	// File descriptor metrics
+	OpenFDs prometheus.Gauge
+	MaxFDs  prometheus.Gauge
+
 	// Network traffic metrics
 	IngressTrafficMB *prometheus.CounterVec
 	EgressTrafficMB  *prometheus.CounterVec
+	UserIngressMB    *prometheus.CounterVec
+	UserEgressMB     *prometheus.CounterVec
 	IngressPackets   *prometheus.CounterVec
 	EgressPackets    *prometheus.CounterVec
+	OversizedPackets *prometheus.CounterVec
+	StaleNonces      *prometheus.CounterVec
+	SourceRateDrops  *prometheus.CounterVec
+	ListenerPackets  *prometheus.CounterVec
+	RxOverflows      *prometheus.CounterVec
+	PacketSizes      *prometheus.HistogramVec
+
+	// Webhook metrics
+	WebhookDeliveries *prometheus.CounterVec
+	WebhooksDropped   *prometheus.CounterVec
+
+	// Deny list metrics
+	DenyListReloads *prometheus.CounterVec
+	DenyListEntries prometheus.Gauge
+
+	// Event socket metrics
+	EventsDropped      *prometheus.CounterVec
+	EventSocketClients prometheus.Gauge
+	EventHookFailures  *prometheus.CounterVec
+
+	// PROXY protocol metrics
+	ProxyProtocolRefusals *prometheus.CounterVec
+
+	// Self-test metrics
+	SelfTestRuns     *prometheus.CounterVec
+	SelfTestSuccess  prometheus.Gauge
+	SelfTestDuration *prometheus.GaugeVec
+
+	// TURN credentials endpoint metrics
+	TURNCredentials *prometheus.CounterVec
+
+	// Restart handoff metrics
+	Draining       prometheus.Gauge
+	HandoffPackets *prometheus.CounterVec
+
+	// Maintenance metrics
+	MaintenanceMode prometheus.Gauge
 }
 
 var (
 	// Global metrics instance
 	ServerMetrics *Metrics
+
+	// Bounds of saturn_packet_size_bytes, from STUN requests and audio RTP packets
+	// up to full-size video RTP packets at common MTUs
+	packetSizeBuckets = []float64{64, 128, 256, 384, 512, 768, 1024, 1200, 1400, 1500}
+
+	// Bounds the user_id label values of the per-user metrics
+	userLabels = newUserLabelGuard(0)
+
+	// Whether relayed traffic is recorded per user, see TRACK_PER_USER_TRAFFIC
+	trackUserTraffic bool
 )
 
-// InitMetrics initializes all Prometheus metrics and registers them with the default registry
+// userLabelOverflow is the user_id label shared by users beyond MAX_USER_LABEL_CARDINALITY
+const userLabelOverflow = "_overflow"
+
+// userLabelGuard bounds the number of distinct user_id label values.
+// Every series of a label value lives in the registry until the process exits,
+// so a client rotating user IDs could otherwise grow it without bound.
+// Users seen after the limit is reached share the overflow label.
+type userLabelGuard struct {
+	mu     sync.RWMutex
+	limit  int // 0 means unlimited
+	seen   map[string]struct{}
+	warned bool
+}
+
+// newUserLabelGuard creates a userLabelGuard allowing limit distinct user IDs
+func newUserLabelGuard(limit int) *userLabelGuard {
+	return &userLabelGuard{
+		limit: limit,
+		seen:  make(map[string]struct{}),
+	}
+}
+
+// label returns the user_id label value to record for userID
+func (g *userLabelGuard) label(userID string) string {
+	if g.limit <= 0 {
+		return userID
+	}
+
+	g.mu.RLock()
+	_, known := g.seen[userID]
+	g.mu.RUnlock()
+	if known {
+		return userID
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, known := g.seen[userID]; known {
+		return userID
+	}
+	if len(g.seen) < g.limit {
+		g.seen[userID] = struct{}{}
+		return userID
+	}
+
+	if !g.warned {
+		g.warned = true
+		log.Warn().
+			Int("max_user_label_cardinality", g.limit).
+			Str("overflow_label", userLabelOverflow).
+			Msg("User label cardinality limit reached, further users are recorded under the overflow label")
+	}
+	return userLabelOverflow
+}
+
+// InitMetrics initializes all Prometheus metrics and registers them with the default registry.
+// Metric names are prefixed with METRICS_NAMESPACE, "saturn" by default.
 func InitMetrics(config *Config) {
+	namespace := config.MetricsNamespace
 	ServerMetrics = &Metrics{
 		// Authentication attempt counter by realm and source
 		AuthAttempts: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: "saturn_auth_attempts_total",
-				Help: "Total number of authentication attempts",
+				Namespace: namespace,
+				Name:      "auth_attempts_total",
+				Help:      "Total number of authentication attempts",
 			},
 			[]string{"realm", "result"},
 		),
@@ -65,17 +207,29 @@ func InitMetrics(config *Config) {
 		// Successful authentication counter by realm
 		AuthSuccesses: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: "saturn_auth_success_total",
-				Help: "Total number of successful authentications",
+				Namespace: namespace,
+				Name:      "auth_success_total",
+				Help:      "Total number of successful authentications",
 			},
 			[]string{"realm", "user_id"},
 		),
 
+		// Time of the last successful authentication by realm, a liveness signal for auth
+		LastAuthSuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "last_auth_success_timestamp_seconds",
+				Help:      "Unix time of the last successful authentication",
+			},
+			[]string{"realm"},
+		),
+
 		// Failed authentication counter by realm and reason
 		AuthFailures: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: "saturn_auth_failures_total",
-				Help: "Total number of failed authentications",
+				Namespace: namespace,
+				Name:      "auth_failures_total",
+				Help:      "Total number of failed authentications",
 			},
 			[]string{"realm", "reason"},
 		),
@@ -83,61 +237,206 @@ func InitMetrics(config *Config) {
 		// Authentication duration histogram
 		AuthDuration: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
-				Name:    "saturn_auth_duration_seconds",
-				Help:    "Duration of authentication requests",
-				Buckets: prometheus.DefBuckets,
+				Namespace: namespace,
+				Name:      "auth_duration_seconds",
+				Help:      "Duration of authentication requests",
+				Buckets:   authDurationBuckets(config),
 			},
 			[]string{"realm", "result"},
 		),
 
+		AuthPanics: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "auth_panics_total",
+				Help:      "Total number of panics recovered in the authentication handler",
+			},
+		),
+
+		// Token validation duration histogram, the parse and verify part of AuthDuration
+		TokenDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "token_validation_duration_seconds",
+				Help:      "Duration of token parsing and signature verification by algorithm",
+				Buckets:   authDurationBuckets(config),
+			},
+			[]string{"algorithm", "result"},
+		),
+
 		// Token validation counter by result
 		TokenValidations: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: "saturn_token_validations_total",
-				Help: "Total number of token validation attempts",
+				Namespace: namespace,
+				Name:      "token_validations_total",
+				Help:      "Total number of token validation attempts",
 			},
 			[]string{"result", "reason"},
 		),
 
-		// Active connections gauge by realm
+		// Successful token validations by signing key
+		TokenKeys: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "token_validation_keys_total",
+				Help:      "Total number of successful token validations by the signing key that validated them",
+			},
+			[]string{"key"},
+		),
+
+		// Successful token validations by signing algorithm
+		TokenAlgorithms: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "token_alg_used_total",
+				Help:      "Total number of successful token validations by the algorithm that validated them",
+			},
+			[]string{"alg"},
+		),
+
+		// Active connections gauge by realm and transport
 		ActiveConnections: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "saturn_active_connections",
-				Help: "Number of currently active TURN connections",
+				Namespace: namespace,
+				Name:      "active_connections",
+				Help:      "Number of currently active TURN connections",
 			},
-			[]string{"realm"},
+			[]string{"realm", "transport"},
 		),
 
-		// Total connections counter by realm
+		// Total connections counter by realm and transport
 		TotalConnections: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: "saturn_connections_total",
-				Help: "Total number of TURN connections established",
+				Namespace: namespace,
+				Name:      "connections_total",
+				Help:      "Total number of TURN connections established",
+			},
+			[]string{"realm", "transport"},
+		),
+
+		// Relay allocation failures by cause
+		AllocationFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "allocation_failures_total",
+				Help:      "Total number of failed relay allocations",
+			},
+			[]string{"reason"},
+		),
+
+		RelayPortExhaustion: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "relay_port_exhaustion_total",
+				Help:      "Total number of relay allocations refused because every port between RELAY_MIN_PORT and RELAY_MAX_PORT was in use",
 			},
 			[]string{"realm"},
 		),
 
+		// Allocation refreshes by realm, deletions are refreshes with a zero lifetime
+		AllocationRefreshes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "allocation_refreshes_total",
+				Help:      "Total number of allocation refreshes granted, by type (refresh or delete)",
+			},
+			[]string{"realm", "type"},
+		),
+
+		// Per-allocation relay traffic by realm and user
+		AllocationIngressBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "allocation_ingress_bytes_total",
+				Help:      "Total bytes received by relays from peers",
+			},
+			[]string{"realm", "user_id"},
+		),
+
+		AllocationEgressBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "allocation_egress_bytes_total",
+				Help:      "Total bytes sent by relays to peers",
+			},
+			[]string{"realm", "user_id"},
+		),
+
+		AllocationMaxIdle: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "allocation_max_idle_seconds",
+				Help:      "Seconds since the longest idle open allocation last relayed a packet",
+			},
+		),
+
+		// Permissions refused for exceeding the peer cap
+		PeerLimitHits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "peer_limit_hits_total",
+				Help:      "Total number of permissions refused because an allocation reached its peer limit",
+			},
+			[]string{"realm"},
+		),
+
+		PeersDenied: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "peer_permissions_denied_total",
+				Help:      "Total number of permissions refused by the peer policy",
+			},
+			[]string{"realm", "reason"},
+		),
+		PeerPacketsDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "peer_packets_dropped_total",
+				Help:      "Total number of relayed packets dropped because the peer policy does not allow their destination or their permission expired",
+			},
+			[]string{"realm", "reason"},
+		),
+		UnpermittedPeerDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "unpermitted_peer_drops_total",
+				Help:      "Total number of packets received on relays from peers without a permission or channel binding",
+			},
+			[]string{"realm"},
+		),
+		AmplificationSuspected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "amplification_suspected_total",
+				Help:      "Total number of STUN packets dropped as suspected amplification abuse",
+			},
+			[]string{"realm", "reason"},
+		),
+
 		// Server uptime gauge
 		ServerUptime: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "saturn_server_uptime_seconds",
-				Help: "Server uptime in seconds",
+				Namespace: namespace,
+				Name:      "server_uptime_seconds",
+				Help:      "Server uptime in seconds",
 			},
 		),
 
 		// Configured threads gauge
 		ConfiguredThreads: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "saturn_configured_threads",
-				Help: "Number of configured server threads",
+				Namespace: namespace,
+				Name:      "configured_threads",
+				Help:      "Number of server threads (UDP listeners) serving traffic",
 			},
 		),
 
 		// Configured realms gauge
 		ConfiguredRealms: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "saturn_configured_realms",
-				Help: "Configured realms for the server",
+				Namespace: namespace,
+				Name:      "configured_realms",
+				Help:      "Configured realms for the server",
 			},
 			[]string{"realm"},
 		),
@@ -145,96 +444,343 @@ func InitMetrics(config *Config) {
 		// Memory usage metrics
 		MemoryUsage: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "saturn_memory_usage_bytes",
-				Help: "Current memory usage in bytes",
+				Namespace: namespace,
+				Name:      "memory_usage_bytes",
+				Help:      "Current memory usage in bytes",
 			},
 		),
 
 		HeapInUse: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "saturn_heap_inuse_bytes",
-				Help: "Bytes in in-use spans",
+				Namespace: namespace,
+				Name:      "heap_inuse_bytes",
+				Help:      "Bytes in in-use spans",
 			},
 		),
 
 		HeapIdle: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "saturn_heap_idle_bytes",
-				Help: "Bytes in idle (unused) spans",
+				Namespace: namespace,
+				Name:      "heap_idle_bytes",
+				Help:      "Bytes in idle (unused) spans",
 			},
 		),
 
 		HeapSys: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "saturn_heap_sys_bytes",
-				Help: "Bytes obtained from system for heap",
+				Namespace: namespace,
+				Name:      "heap_sys_bytes",
+				Help:      "Bytes obtained from system for heap",
 			},
 		),
 
 		StackInUse: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "saturn_stack_inuse_bytes",
-				Help: "Bytes in stack spans",
+				Namespace: namespace,
+				Name:      "stack_inuse_bytes",
+				Help:      "Bytes in stack spans",
 			},
 		),
 
 		GoroutineCount: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "saturn_goroutines_count",
-				Help: "Number of goroutines that currently exist",
+				Namespace: namespace,
+				Name:      "goroutines_count",
+				Help:      "Number of goroutines that currently exist",
+			},
+		),
+
+		OpenFDs: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "open_fds",
+				Help:      "Number of open file descriptors",
+			},
+		),
+
+		MaxFDs: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "max_fds",
+				Help:      "Maximum number of open file descriptors (soft RLIMIT_NOFILE)",
 			},
 		),
 
 		GCCount: prometheus.NewCounter(
 			prometheus.CounterOpts{
-				Name: "saturn_gc_count_total",
-				Help: "Total number of garbage collection cycles",
+				Namespace: namespace,
+				Name:      "gc_count_total",
+				Help:      "Total number of garbage collection cycles",
 			},
 		),
 
 		// Network traffic metrics
 		IngressTrafficMB: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: "saturn_ingress_traffic_mb_total",
-				Help: "Total ingress (incoming) traffic in megabytes",
+				Namespace: namespace,
+				Name:      "ingress_traffic_mb_total",
+				Help:      "Total ingress (incoming) traffic in megabytes",
 			},
-			[]string{"realm"},
+			[]string{"realm", "server_id", "port", "transport"},
 		),
 
 		EgressTrafficMB: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: "saturn_egress_traffic_mb_total",
-				Help: "Total egress (outgoing) traffic in megabytes",
+				Namespace: namespace,
+				Name:      "egress_traffic_mb_total",
+				Help:      "Total egress (outgoing) traffic in megabytes",
 			},
-			[]string{"realm"},
+			[]string{"realm", "server_id", "port", "transport"},
+		),
+
+		UserIngressMB: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "user_ingress_mb_total",
+				Help:      "Total traffic in megabytes received by a user's relays from peers",
+			},
+			[]string{"realm", "user_id"},
+		),
+
+		UserEgressMB: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "user_egress_mb_total",
+				Help:      "Total traffic in megabytes sent by a user's relays to peers",
+			},
+			[]string{"realm", "user_id"},
 		),
 
 		IngressPackets: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: "saturn_ingress_packets_total",
-				Help: "Total number of ingress (incoming) packets",
+				Namespace: namespace,
+				Name:      "ingress_packets_total",
+				Help:      "Total number of ingress (incoming) packets",
 			},
-			[]string{"realm"},
+			[]string{"realm", "server_id", "port", "transport"},
 		),
 
 		EgressPackets: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Name: "saturn_egress_packets_total",
-				Help: "Total number of egress (outgoing) packets",
+				Namespace: namespace,
+				Name:      "egress_packets_total",
+				Help:      "Total number of egress (outgoing) packets",
+			},
+			[]string{"realm", "server_id", "port", "transport"},
+		),
+
+		ListenerPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "listener_packets_total",
+				Help:      "Total number of packets received by each UDP and DTLS listener, including dropped packets",
+			},
+			[]string{"listener_id", "port", "transport"},
+		),
+
+		RxOverflows: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "udp_rx_overflows_total",
+				Help:      "Total number of packets the kernel dropped because a UDP listener's receive buffer was full",
+			},
+			[]string{"listener_id", "port"},
+		),
+
+		PacketSizes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "packet_size_bytes",
+				Help:      "Size of the packets exchanged with clients by direction",
+				Buckets:   packetSizeBuckets,
+			},
+			[]string{"direction"},
+		),
+
+		OversizedPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "oversized_packets_dropped_total",
+				Help:      "Total number of inbound packets dropped for exceeding the maximum packet size",
 			},
 			[]string{"realm"},
 		),
+
+		StaleNonces: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "stale_nonce_total",
+				Help:      "Total number of TURN requests answered with a 438 for a nonce older than the nonce lifetime",
+			},
+			[]string{"realm"},
+		),
+
+		SourceRateDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "source_rate_drops_total",
+				Help:      "Total number of inbound packets dropped because their source IP exceeded the packet rate limit",
+			},
+			[]string{"realm"},
+		),
+
+		// Webhook metrics
+		WebhookDeliveries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "webhook_deliveries_total",
+				Help:      "Total number of webhook batch delivery attempts by result (success, retry, failure)",
+			},
+			[]string{"result"},
+		),
+
+		WebhooksDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "webhooks_dropped_total",
+				Help:      "Total number of webhook events dropped because the queue was full",
+			},
+			[]string{"type"},
+		),
+
+		DenyListReloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "deny_list_reloads_total",
+				Help:      "Total number of deny list reloads by result",
+			},
+			[]string{"result"},
+		),
+
+		DenyListEntries: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "deny_list_entries",
+				Help:      "Number of networks on the deny list in effect",
+			},
+		),
+
+		EventsDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "events_dropped_total",
+				Help:      "Total number of event socket events dropped for slow clients",
+			},
+			[]string{"type"},
+		),
+
+		EventSocketClients: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "event_socket_clients",
+				Help:      "Number of clients connected to the event socket",
+			},
+		),
+
+		EventHookFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "event_hook_failures_total",
+				Help:      "Total number of event hook calls that panicked or timed out",
+			},
+			[]string{"hook", "reason"},
+		),
+
+		ProxyProtocolRefusals: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "proxy_protocol_refusals_total",
+				Help:      "Total number of TCP connections refused for a missing or invalid PROXY protocol header",
+			},
+			[]string{"reason"},
+		),
+
+		SelfTestRuns: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "self_test_runs_total",
+				Help:      "Total number of self-tests by result",
+			},
+			[]string{"result"},
+		),
+
+		SelfTestSuccess: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "self_test_success",
+				Help:      "Whether the last self-test succeeded (1) or failed (0)",
+			},
+		),
+
+		SelfTestDuration: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "self_test_latency_seconds",
+				Help:      "Latency of the last successful self-test by stage",
+			},
+			[]string{"stage"},
+		),
+
+		TURNCredentials: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "turn_credentials_requests_total",
+				Help:      "Total number of /turn-credentials requests by result",
+			},
+			[]string{"result"},
+		),
+
+		Draining: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "draining",
+				Help:      "Whether the server is draining (1) and refuses new allocations, or not (0)",
+			},
+		),
+
+		MaintenanceMode: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "maintenance_mode",
+				Help:      "Whether the server is in maintenance (1) and refuses new clients, or not (0)",
+			},
+		),
+
+		HandoffPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "handoff_packets_total",
+				Help:      "Total number of client packets routed by the restart handoff by result",
+			},
+			[]string{"result"},
+		),
 	}
 
 	// Register all metrics with Prometheus
 	prometheus.MustRegister(
 		ServerMetrics.AuthAttempts,
 		ServerMetrics.AuthSuccesses,
+		ServerMetrics.LastAuthSuccess,
 		ServerMetrics.AuthFailures,
 		ServerMetrics.AuthDuration,
+		ServerMetrics.AuthPanics,
 		ServerMetrics.TokenValidations,
+		ServerMetrics.TokenDuration,
+		ServerMetrics.TokenKeys,
+		ServerMetrics.TokenAlgorithms,
 		ServerMetrics.ActiveConnections,
 		ServerMetrics.TotalConnections,
+		ServerMetrics.AllocationFailures,
+		ServerMetrics.RelayPortExhaustion,
+		ServerMetrics.AllocationRefreshes,
+		ServerMetrics.AllocationIngressBytes,
+		ServerMetrics.AllocationEgressBytes,
+		ServerMetrics.AllocationMaxIdle,
+		ServerMetrics.PeerLimitHits,
+		ServerMetrics.PeersDenied,
+		ServerMetrics.AmplificationSuspected,
+		ServerMetrics.PeerPacketsDropped,
+		ServerMetrics.UnpermittedPeerDrops,
 		ServerMetrics.ServerUptime,
 		ServerMetrics.ConfiguredThreads,
 		ServerMetrics.ConfiguredRealms,
@@ -245,27 +791,143 @@ func InitMetrics(config *Config) {
 		ServerMetrics.StackInUse,
 		ServerMetrics.GoroutineCount,
 		ServerMetrics.GCCount,
+		ServerMetrics.OpenFDs,
+		ServerMetrics.MaxFDs,
 		ServerMetrics.IngressTrafficMB,
 		ServerMetrics.EgressTrafficMB,
+		ServerMetrics.UserIngressMB,
+		ServerMetrics.UserEgressMB,
 		ServerMetrics.IngressPackets,
 		ServerMetrics.EgressPackets,
+		ServerMetrics.OversizedPackets,
+		ServerMetrics.StaleNonces,
+		ServerMetrics.SourceRateDrops,
+		ServerMetrics.ListenerPackets,
+		ServerMetrics.RxOverflows,
+		ServerMetrics.PacketSizes,
+		ServerMetrics.WebhookDeliveries,
+		ServerMetrics.WebhooksDropped,
+		ServerMetrics.DenyListReloads,
+		ServerMetrics.DenyListEntries,
+		ServerMetrics.EventsDropped,
+		ServerMetrics.EventSocketClients,
+		ServerMetrics.EventHookFailures,
+		ServerMetrics.ProxyProtocolRefusals,
+		ServerMetrics.SelfTestRuns,
+		ServerMetrics.SelfTestSuccess,
+		ServerMetrics.SelfTestDuration,
+		ServerMetrics.TURNCredentials,
+		ServerMetrics.Draining,
+		ServerMetrics.MaintenanceMode,
+		ServerMetrics.HandoffPackets,
 	)
 
+	userLabels = newUserLabelGuard(config.MaxUserLabelCardinality)
+	trackUserTraffic = config.TrackPerUserTraffic
+
 	// Set initial static metrics
 	ServerMetrics.ConfiguredThreads.Set(float64(config.ThreadNum))
-	ServerMetrics.ConfiguredRealms.WithLabelValues(config.Realm).Set(1)
+	for _, realm := range config.AcceptedRealms() {
+		ServerMetrics.ConfiguredRealms.WithLabelValues(realm).Set(1)
+	}
 
 	log.Info().Msg("Prometheus metrics initialized and registered")
 }
 
+// defaultAuthDurationBuckets are the auth duration histogram buckets used without
+// AUTH_DURATION_BUCKETS. HS256 validation takes well under a millisecond, while
+// RS256 and auth hitting the network (e.g. a JWKS refresh) take milliseconds to
+// seconds, which the Prometheus defaults tuned for HTTP latencies do not resolve.
+var defaultAuthDurationBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5,
+}
+
+// authDurationBuckets returns the configured auth duration histogram buckets,
+// falling back to defaultAuthDurationBuckets when none are configured
+func authDurationBuckets(config *Config) []float64 {
+	buckets, err := parseBuckets(config.AuthDurationBuckets)
+	if err != nil {
+		log.Warn().Err(err).Msg("Invalid AUTH_DURATION_BUCKETS, using default buckets")
+		return defaultAuthDurationBuckets
+	}
+	if len(buckets) == 0 {
+		return defaultAuthDurationBuckets
+	}
+	return buckets
+}
+
+// parseBuckets parses a comma-separated list of positive, strictly increasing histogram bucket bounds
+func parseBuckets(list string) ([]float64, error) {
+	var buckets []float64
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		bound, err := strconv.ParseFloat(entry, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %w", entry, err)
+		}
+		if bound <= 0 || math.IsInf(bound, 0) || math.IsNaN(bound) {
+			return nil, fmt.Errorf("bucket %q must be a positive finite number", entry)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be strictly increasing, got %v after %v", bound, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+}
+
 // SecurityMiddleware provides authentication for metrics endpoints
 func SecurityMiddleware(config *Config) func(http.Handler) http.Handler {
+	allowlist, err := parseCIDRList(config.MetricsAllowlist)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid METRICS_IP_ALLOWLIST")
+	}
+	credentials, err := parseMetricsCredentials(config.MetricsCredentials)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid METRICS_CREDENTIALS")
+	}
+	if config.MetricsUsername != "" && config.MetricsPassword != "" {
+		credentials = append([]metricsCredential{{username: config.MetricsUsername, password: config.MetricsPassword}}, credentials...)
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Source IP check, enforced before authentication so credentials alone are not enough
+			if len(allowlist) > 0 && !isAllowedSource(r, allowlist) {
+				log.Warn().
+					Str("remote_addr", r.RemoteAddr).
+					Str("path", r.URL.Path).
+					Msg("Metrics access denied by IP allowlist")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
 			// Authentication check
 			switch config.MetricsAuth {
 			case "basic":
-				if !basicAuth(w, r, config.MetricsUsername, config.MetricsPassword) {
+				realm, ok := basicAuth(w, r, credentials, config.MetricsAuthChallenge)
+				if !ok {
+					return
+				}
+				// Tenant credentials only scrape their own realm's metrics
+				if realm != "" {
+					if r.URL.Path != "/metrics" {
+						log.Warn().
+							Str("remote_addr", r.RemoteAddr).
+							Str("path", r.URL.Path).
+							Str("realm", realm).
+							Msg("Metrics access denied to a realm credential")
+						http.Error(w, "Forbidden", http.StatusForbidden)
+						return
+					}
+					r = r.WithContext(withMetricsRealm(r.Context(), realm))
+				}
+			case "bearer":
+				if !bearerAuth(w, r, config.MetricsBearerToken, config.MetricsAuthChallenge) {
 					return
 				}
 			case "none":
@@ -287,36 +949,164 @@ func SecurityMiddleware(config *Config) func(http.Handler) http.Handler {
 	}
 }
 
-// basicAuth implements HTTP Basic Authentication
-func basicAuth(w http.ResponseWriter, r *http.Request, expectedUsername, expectedPassword string) bool {
-	if expectedUsername == "" || expectedPassword == "" {
-		log.Error().Msg("Basic auth configured but username/password not set")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+// isAllowedSource checks the request's remote IP against the allowlist
+func isAllowedSource(r *http.Request, allowlist []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
 		return false
 	}
+	return containsIP(allowlist, ip)
+}
+
+// basicAuth implements HTTP Basic Authentication against a set of credentials and
+// returns the realm the matching credential is restricted to
+func basicAuth(w http.ResponseWriter, r *http.Request, credentials []metricsCredential, challenge bool) (string, bool) {
+	if len(credentials) == 0 {
+		log.Error().Msg("Basic auth configured but no username/password set")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return "", false
+	}
 
 	username, password, ok := r.BasicAuth()
 	if !ok {
-		w.Header().Set("WWW-Authenticate", `Basic realm="Saturn Metrics"`)
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
-		return false
+		denyMetricsAuth(w, `Basic realm="Saturn Metrics"`, "Authentication required", challenge)
+		return "", false
 	}
 
 	// Use constant-time comparison to prevent timing attacks
-	if subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) != 1 ||
-		subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) != 1 {
+	// Every credential is compared, so the time taken does not tell which one matched
+	var realm string
+	matched := 0
+	for _, credential := range credentials {
+		match := subtle.ConstantTimeCompare([]byte(username), []byte(credential.username)) &
+			subtle.ConstantTimeCompare([]byte(password), []byte(credential.password))
+		if match == 1 && matched == 0 {
+			realm = credential.realm
+		}
+		matched |= match
+	}
+	if matched != 1 {
 		log.Warn().
 			Str("username", username).
 			Str("remote_addr", r.RemoteAddr).
 			Msg("Metrics basic auth failed")
-		w.Header().Set("WWW-Authenticate", `Basic realm="Saturn Metrics"`)
-		http.Error(w, "Authentication failed", http.StatusUnauthorized)
+		denyMetricsAuth(w, `Basic realm="Saturn Metrics"`, "Authentication failed", challenge)
+		return "", false
+	}
+
+	return realm, true
+}
+
+// bearerAuth implements bearer token authentication as used by Prometheus
+// scrape configs with authorization credentials
+func bearerAuth(w http.ResponseWriter, r *http.Request, expectedToken string, challenge bool) bool {
+	if expectedToken == "" {
+		log.Error().Msg("Bearer auth configured but token not set")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		denyMetricsAuth(w, `Bearer realm="Saturn Metrics"`, "Authentication required", challenge)
+		return false
+	}
+
+	// Use constant-time comparison to prevent timing attacks
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(expectedToken)) != 1 {
+		log.Warn().
+			Str("remote_addr", r.RemoteAddr).
+			Msg("Metrics bearer auth failed")
+		denyMetricsAuth(w, `Bearer realm="Saturn Metrics"`, "Authentication failed", challenge)
 		return false
 	}
 
 	return true
 }
 
+// denyMetricsAuth answers a request that failed metrics authentication. With the
+// challenge it is a 401 with WWW-Authenticate, which makes browsers prompt for
+// credentials, without it a plain 403 for machine scrapers.
+func denyMetricsAuth(w http.ResponseWriter, authenticate, message string, challenge bool) {
+	if !challenge {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", authenticate)
+	http.Error(w, message, http.StatusUnauthorized)
+}
+
+// adminConfig is the JSON body of the /admin/config endpoint
+type adminConfig struct {
+	Settings map[string]any    `json:"settings"`
+	Sources  map[string]string `json:"sources"`
+}
+
+// serverInfo is the JSON body of the /info endpoint
+type serverInfo struct {
+	Service        string `json:"service"`
+	Version        string `json:"version"`
+	Realm          string `json:"realm"`
+	Threads        int    `json:"threads"`
+	MetricsEnabled bool   `json:"metrics_enabled"`
+	MetricsAuth    string `json:"metrics_auth"`
+	MetricsBindIP  string `json:"metrics_bind_ip"`
+
+	// Live runtime counts
+	ActiveAllocations int64  `json:"active_allocations"`
+	ActiveConnections int    `json:"active_connections"`
+	TotalConnections  uint64 `json:"total_connections"`
+	IngressBytesTotal int64  `json:"ingress_bytes_total"`
+	EgressBytesTotal  int64  `json:"egress_bytes_total"`
+}
+
+// MetricsTLSConfig builds the TLS configuration of the metrics server.
+// It returns nil when TLS is disabled. With METRICS_MTLS_CA or METRICS_CLIENT_CA set, clients must
+// present a certificate signed by one of its CAs or the handshake is refused.
+func MetricsTLSConfig(config *Config) (*tls.Config, error) {
+	if !config.MetricsTLSEnabled() {
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(config.MetricsTLSCert, config.MetricsTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metrics TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile := config.MetricsClientCAFile(); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metrics mTLS CA: %w", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("metrics mTLS CA contains no PEM certificates")
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// metricsStartFailed reports a metrics server that could not start, which is fatal
+// with METRICS_FAIL_FATAL. Otherwise the TURN server keeps running without metrics.
+func metricsStartFailed(config *Config, bindAddr string, err error) {
+	if config.MetricsFailFatal {
+		log.Fatal().Err(err).Str("bind_addr", bindAddr).Msg("Failed to start metrics server, exiting since METRICS_FAIL_FATAL is set")
+	}
+	log.Error().Err(err).Str("bind_addr", bindAddr).Msg("Failed to start metrics server, running without metrics")
+}
+
 // StartMetricsServer starts the HTTP server for Prometheus metrics endpoint
 func StartMetricsServer(config *Config) {
 	if !config.EnableMetrics {
@@ -329,7 +1119,15 @@ func StartMetricsServer(config *Config) {
 	securityMiddleware := SecurityMiddleware(config)
 
 	// Protected metrics endpoint
-	mux.Handle("/metrics", securityMiddleware(promhttp.Handler()))
+	// Requests of realm credentials get only the series of their realm
+	metricsHandler := promhttp.Handler()
+	mux.Handle("/metrics", securityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if realm := metricsRealm(r.Context()); realm != "" {
+			promhttp.HandlerFor(realmGatherer{Gatherer: prometheus.DefaultGatherer, realm: realm}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+			return
+		}
+		metricsHandler.ServeHTTP(w, r)
+	})))
 
 	// Health check endpoint (no authentication required)
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -337,28 +1135,119 @@ func StartMetricsServer(config *Config) {
 		_, _ = w.Write([]byte("OK"))
 	})
 
+	// Protected admin configuration endpoint
+	// The effective configuration, secrets masked, together with where each setting was taken from
+	mux.HandleFunc("/admin/config", securityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(adminConfig{
+			Settings: config.Redacted(),
+			Sources:  SettingSources(),
+		})
+	})).ServeHTTP)
+
 	// Protected info endpoint
+	// Reports the configuration together with live runtime counts
 	mux.HandleFunc("/info", securityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activeConnections, totalConnections := Connections.Totals()
+		ingressBytes, egressBytes := TrafficBytes()
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		info := `{
-			"service": "saturn-turn-server",
-			"version": "` + config.Version + `",
-			"realm": "` + config.Realm + `",
-			"threads": ` + strconv.Itoa(config.ThreadNum) + `,
-			"metrics_enabled": ` + strconv.FormatBool(config.EnableMetrics) + `,
-			"metrics_auth": "` + config.MetricsAuth + `",
-			"metrics_bind_ip": "` + config.MetricsBindIP + `"
-		}`
-		_, _ = w.Write([]byte(info))
+		_ = json.NewEncoder(w).Encode(serverInfo{
+			Service:           "saturn-turn-server",
+			Version:           config.Version,
+			Realm:             config.Realm,
+			Threads:           config.ThreadNum,
+			MetricsEnabled:    config.EnableMetrics,
+			MetricsAuth:       config.MetricsAuth,
+			MetricsBindIP:     config.MetricsBindIP,
+			ActiveAllocations: ActiveAllocations(),
+			ActiveConnections: activeConnections,
+			TotalConnections:  totalConnections,
+			IngressBytesTotal: ingressBytes,
+			EgressBytesTotal:  egressBytes,
+		})
+	})).ServeHTTP)
+
+	// Protected self-test endpoint
+	// Authenticates and allocates a relay against the server's own listener
+	selfTester := NewSelfTester(config)
+	mux.HandleFunc("/selftest", securityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := selfTester.Run()
+
+		status := http.StatusOK
+		if !result.Success {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(result)
 	})).ServeHTTP)
 
+	// TURN credentials endpoint
+	// Not behind the security middleware, it authenticates app tokens itself
+	if config.EnableTURNCredentials {
+		mux.Handle("/turn-credentials", TURNCredentialsHandler(config))
+	}
+
+	// Protected allocation listing
+	// Open relay allocations with their age and last activity, longest idle first
+	mux.HandleFunc("/allocations", securityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(OpenAllocations())
+	})).ServeHTTP)
+
+	// Readiness endpoint (no authentication required)
+	// Fails while draining or in maintenance, so load balancers stop sending new clients
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !IsStarted() {
+			http.Error(w, "Starting", http.StatusServiceUnavailable)
+			return
+		}
+		if inMaintenance, _ := InMaintenance(); inMaintenance {
+			http.Error(w, "Maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		if IsDraining() {
+			http.Error(w, "Draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	// Protected drain endpoint
+	// POST stops new allocations for a restart while the open ones keep relaying
+	mux.HandleFunc("/admin/drain", securityMiddleware(DrainHandler()).ServeHTTP)
+
+	// Protected maintenance endpoint
+	// POST refuses new clients before the node is taken down, existing ones are unaffected
+	mux.HandleFunc("/admin/maintenance", securityMiddleware(MaintenanceHandler()).ServeHTTP)
+
 	// Determine bind address
 	bindAddr := config.MetricsBindIP + ":" + strconv.Itoa(config.MetricsPort)
 
+	// Never fall back to plain HTTP when TLS was asked for but cannot be set up
+	tlsConfig, err := MetricsTLSConfig(config)
+	if err != nil {
+		metricsStartFailed(config, bindAddr, err)
+		return
+	}
+
+	// Bound before the TURN listeners start, so a port conflict is reported, or stops
+	// the server with METRICS_FAIL_FATAL, before any client is served without metrics
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		metricsStartFailed(config, bindAddr, err)
+		return
+	}
+
 	server := &http.Server{
-		Addr:    bindAddr,
-		Handler: mux,
+		Addr:      bindAddr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
 	}
 
 	// Start HTTP metrics server in a goroutine
@@ -366,11 +1255,20 @@ func StartMetricsServer(config *Config) {
 		log.Info().
 			Str("bind_addr", bindAddr).
 			Str("auth", config.MetricsAuth).
+			Bool("tls", tlsConfig != nil).
+			Bool("mtls", config.MetricsClientCAFile() != "").
 			Str("endpoint", "/metrics").
 			Msg("Starting Prometheus metrics server")
 
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Error().Err(err).Msg("Failed to start metrics server")
+		var err error
+		if tlsConfig != nil {
+			// The certificate is already loaded into TLSConfig
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Str("bind_addr", bindAddr).Msg("Metrics server stopped, metrics are no longer served")
 		}
 	}()
 
@@ -378,6 +1276,12 @@ func StartMetricsServer(config *Config) {
 	if config.MetricsAuth != "none" {
 		log.Info().Str("auth_type", config.MetricsAuth).Msg("Metrics endpoint authentication enabled")
 	}
+	if config.MetricsAllowlist != "" {
+		log.Info().Str("allowlist", config.MetricsAllowlist).Msg("Metrics endpoint restricted by IP allowlist")
+	}
+	if config.MetricsClientCAFile() != "" {
+		log.Info().Str("client_ca", config.MetricsClientCAFile()).Msg("Metrics endpoint requires client certificates")
+	}
 	if config.MetricsBindIP != "0.0.0.0" {
 		log.Info().Str("bind_ip", config.MetricsBindIP).Msg("Metrics endpoint bound to specific IP")
 	}
@@ -391,7 +1295,8 @@ func RecordAuthAttempt(realm, result string) {
 // RecordAuthSuccess records a successful authentication
 func RecordAuthSuccess(realm, userID string) {
 	if ServerMetrics != nil {
-		ServerMetrics.AuthSuccesses.WithLabelValues(realm, userID).Inc()
+		ServerMetrics.AuthSuccesses.WithLabelValues(realm, userLabels.label(userID)).Inc()
+		ServerMetrics.LastAuthSuccess.WithLabelValues(realm).SetToCurrentTime()
 	}
 }
 
@@ -402,6 +1307,20 @@ func RecordAuthFailure(realm, reason string) {
 	}
 }
 
+// RecordAuthPanic records a panic recovered in the authentication handler
+func RecordAuthPanic() {
+	if ServerMetrics != nil {
+		ServerMetrics.AuthPanics.Inc()
+	}
+}
+
+// RecordAuthDuration records how long an authentication decision took by result
+func RecordAuthDuration(realm, result string, duration time.Duration) {
+	if ServerMetrics != nil {
+		ServerMetrics.AuthDuration.WithLabelValues(realm, result).Observe(duration.Seconds())
+	}
+}
+
 // RecordTokenValidation records a token validation attempt
 func RecordTokenValidation(result, reason string) {
 	if ServerMetrics != nil {
@@ -409,21 +1328,294 @@ func RecordTokenValidation(result, reason string) {
 	}
 }
 
-// RecordConnection records a new connection
-func RecordConnection(realm string) {
+// RecordTokenValidationDuration records how long verifying a token with an algorithm took
+func RecordTokenValidationDuration(alg, result string, duration time.Duration) {
+	if ServerMetrics != nil {
+		ServerMetrics.TokenDuration.WithLabelValues(alg, result).Observe(duration.Seconds())
+	}
+}
+
+// RecordTokenKey records which signing key validated a token
+func RecordTokenKey(key string) {
 	if ServerMetrics != nil {
-		ServerMetrics.TotalConnections.WithLabelValues(realm).Inc()
-		ServerMetrics.ActiveConnections.WithLabelValues(realm).Inc()
+		ServerMetrics.TokenKeys.WithLabelValues(key).Inc()
 	}
 }
 
-// RecordDisconnection records a connection ending
-func RecordDisconnection(realm string) {
+// RecordTokenAlgorithm records which algorithm validated a token
+func RecordTokenAlgorithm(alg string) {
 	if ServerMetrics != nil {
-		ServerMetrics.ActiveConnections.WithLabelValues(realm).Dec()
+		ServerMetrics.TokenAlgorithms.WithLabelValues(alg).Inc()
 	}
 }
 
+// RecordConnection records a new connection over the transport
+func RecordConnection(realm, transport string) {
+	if ServerMetrics != nil {
+		ServerMetrics.TotalConnections.WithLabelValues(realm, transport).Inc()
+		ServerMetrics.ActiveConnections.WithLabelValues(realm, transport).Inc()
+	}
+}
+
+// RecordDisconnection records a connection over the transport ending
+func RecordDisconnection(realm, transport string) {
+	if ServerMetrics != nil {
+		ServerMetrics.ActiveConnections.WithLabelValues(realm, transport).Dec()
+	}
+}
+
+// RecordAllocationFailure records a failed relay allocation
+func RecordAllocationFailure(reason string) {
+	if ServerMetrics != nil {
+		ServerMetrics.AllocationFailures.WithLabelValues(reason).Inc()
+	}
+}
+
+// RecordRelayPortExhaustion records a relay allocation refused because the relay port range is exhausted
+func RecordRelayPortExhaustion(realm string) {
+	if ServerMetrics != nil {
+		ServerMetrics.RelayPortExhaustion.WithLabelValues(realm).Inc()
+	}
+}
+
+// RecordAllocationIngress records bytes received by a relay from a peer,
+// also as user traffic when TRACK_PER_USER_TRAFFIC is enabled
+func RecordAllocationIngress(realm, userID string, bytes int64) {
+	if ServerMetrics != nil {
+		userLabel := userLabels.label(userID)
+		ServerMetrics.AllocationIngressBytes.WithLabelValues(realm, userLabel).Add(float64(bytes))
+		if trackUserTraffic {
+			ServerMetrics.UserIngressMB.WithLabelValues(realm, userLabel).Add(float64(bytes) / 1048576.0)
+		}
+	}
+}
+
+// RecordAllocationEgress records bytes sent by a relay to a peer,
+// also as user traffic when TRACK_PER_USER_TRAFFIC is enabled
+func RecordAllocationEgress(realm, userID string, bytes int64) {
+	if ServerMetrics != nil {
+		userLabel := userLabels.label(userID)
+		ServerMetrics.AllocationEgressBytes.WithLabelValues(realm, userLabel).Add(float64(bytes))
+		if trackUserTraffic {
+			ServerMetrics.UserEgressMB.WithLabelValues(realm, userLabel).Add(float64(bytes) / 1048576.0)
+		}
+	}
+}
+
+// RecordPeerLimitHit records a permission refused by the peer cap
+func RecordPeerLimitHit(realm string) {
+	if ServerMetrics != nil {
+		ServerMetrics.PeerLimitHits.WithLabelValues(realm).Inc()
+	}
+}
+
+// RecordPeerDenied records a permission refused by the peer policy
+func RecordPeerDenied(realm, reason string) {
+	if ServerMetrics != nil {
+		ServerMetrics.PeersDenied.WithLabelValues(realm, reason).Inc()
+	}
+}
+
+// RecordAllocationRefresh records a granted allocation refresh of the given type
+func RecordAllocationRefresh(realm, refreshType string) {
+	if ServerMetrics != nil {
+		ServerMetrics.AllocationRefreshes.WithLabelValues(realm, refreshType).Inc()
+	}
+}
+
+// RecordPeerPacketDropped records a relayed packet dropped by the peer policy or an expired permission
+func RecordPeerPacketDropped(realm, reason string) {
+	if ServerMetrics != nil {
+		ServerMetrics.PeerPacketsDropped.WithLabelValues(realm, reason).Inc()
+	}
+}
+
+// RecordUnpermittedPeerDrop records a packet received from a peer without a permission
+func RecordUnpermittedPeerDrop(realm string) {
+	if ServerMetrics != nil {
+		ServerMetrics.UnpermittedPeerDrops.WithLabelValues(realm).Inc()
+	}
+}
+
+// RecordAmplificationSuspected records a STUN packet dropped as suspected amplification abuse
+func RecordAmplificationSuspected(realm, reason string) {
+	if ServerMetrics != nil {
+		ServerMetrics.AmplificationSuspected.WithLabelValues(realm, reason).Inc()
+	}
+}
+
+// SetRunningThreads records the number of listeners that actually came up,
+// which is lower than configured when some of them failed to bind
+func SetRunningThreads(threads int) {
+	if ServerMetrics != nil {
+		ServerMetrics.ConfiguredThreads.Set(float64(threads))
+	}
+}
+
+// RecordWebhookDelivery records a webhook batch delivery attempt, failure is a batch
+// given up on after its last attempt
+func RecordWebhookDelivery(result string) {
+	if ServerMetrics != nil {
+		ServerMetrics.WebhookDeliveries.WithLabelValues(result).Inc()
+	}
+}
+
+// RecordWebhookDropped records a webhook event dropped on a full queue
+func RecordWebhookDropped(eventType string) {
+	if ServerMetrics != nil {
+		ServerMetrics.WebhooksDropped.WithLabelValues(eventType).Inc()
+	}
+}
+
+// RecordDenyListReload records the result of a deny list reload
+func RecordDenyListReload(result string) {
+	if ServerMetrics != nil {
+		ServerMetrics.DenyListReloads.WithLabelValues(result).Inc()
+	}
+}
+
+// SetDenyListEntries records the number of networks on the deny list in effect
+func SetDenyListEntries(count int) {
+	if ServerMetrics != nil {
+		ServerMetrics.DenyListEntries.Set(float64(count))
+	}
+}
+
+// RecordEventDropped records an event socket event a slow client missed
+func RecordEventDropped(eventType string) {
+	if ServerMetrics != nil {
+		ServerMetrics.EventsDropped.WithLabelValues(eventType).Inc()
+	}
+}
+
+// SetEventSocketClients records the number of connected event socket clients
+func SetEventSocketClients(count int) {
+	if ServerMetrics != nil {
+		ServerMetrics.EventSocketClients.Set(float64(count))
+	}
+}
+
+// RecordEventHookFailure records an event hook call that panicked or timed out
+func RecordEventHookFailure(hook, reason string) {
+	if ServerMetrics != nil {
+		ServerMetrics.EventHookFailures.WithLabelValues(hook, reason).Inc()
+	}
+}
+
+// RecordProxyProtocolRefusal records a connection refused for its PROXY protocol header
+func RecordProxyProtocolRefusal(reason string) {
+	if ServerMetrics != nil {
+		ServerMetrics.ProxyProtocolRefusals.WithLabelValues(reason).Inc()
+	}
+}
+
+// RecordSelfTest records the outcome of a self-test
+func RecordSelfTest(result SelfTestResult) {
+	if ServerMetrics == nil {
+		return
+	}
+	if !result.Success {
+		ServerMetrics.SelfTestRuns.WithLabelValues("failure").Inc()
+		ServerMetrics.SelfTestSuccess.Set(0)
+		return
+	}
+	ServerMetrics.SelfTestRuns.WithLabelValues("success").Inc()
+	ServerMetrics.SelfTestSuccess.Set(1)
+	ServerMetrics.SelfTestDuration.WithLabelValues("binding").Set(result.BindingLatencyMs / 1000)
+	if result.AllocateLatencyMs > 0 {
+		ServerMetrics.SelfTestDuration.WithLabelValues("allocate").Set(result.AllocateLatencyMs / 1000)
+	}
+}
+
+// RecordTURNCredentials records the result of a /turn-credentials request
+func RecordTURNCredentials(result string) {
+	if ServerMetrics != nil {
+		ServerMetrics.TURNCredentials.WithLabelValues(result).Inc()
+	}
+}
+
+// SetMaintenanceMode records whether the server is in maintenance
+func SetMaintenanceMode(enabled bool) {
+	if ServerMetrics != nil {
+		value := 0.0
+		if enabled {
+			value = 1
+		}
+		ServerMetrics.MaintenanceMode.Set(value)
+	}
+}
+
+// SetDraining records whether the server is draining
+func SetDraining(draining bool) {
+	if ServerMetrics != nil {
+		value := 0.0
+		if draining {
+			value = 1
+		}
+		ServerMetrics.Draining.Set(value)
+	}
+}
+
+// RecordHandoffPacket records a client packet routed by the restart handoff
+func RecordHandoffPacket(result string) {
+	if ServerMetrics != nil {
+		ServerMetrics.HandoffPackets.WithLabelValues(result).Inc()
+	}
+}
+
+// UpdateAllocationMetrics updates the idle time of the longest idle open allocation
+func UpdateAllocationMetrics() {
+	if ServerMetrics == nil {
+		return
+	}
+
+	idle := 0.0
+	if allocations := OpenAllocations(); len(allocations) > 0 {
+		idle = allocations[0].IdleSeconds
+	}
+	ServerMetrics.AllocationMaxIdle.Set(idle)
+}
+
+// StartMetricsUpdater updates the uptime, memory and allocation metrics every
+// interval, and returns a function that stops the updates and waits for them to end.
+// Each wait is lengthened by up to a tenth of the interval, so the nodes of a fleet
+// started together do not read their memory statistics in lockstep.
+func StartMetricsUpdater(interval time.Duration) (stop func()) {
+	startTime := time.Now()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		timer := time.NewTimer(jitterInterval(interval))
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-timer.C:
+				ServerMetrics.ServerUptime.Set(time.Since(startTime).Seconds())
+				UpdateMemoryMetrics()
+				UpdateAllocationMetrics()
+				timer.Reset(jitterInterval(interval))
+			case <-done:
+				log.Debug().Msg("Metrics updater stopped")
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// jitterInterval lengthens the interval by a random duration of up to a tenth of it
+func jitterInterval(interval time.Duration) time.Duration {
+	return interval + rand.N(interval/10+1)
+}
+
 // UpdateMemoryMetrics updates memory-related metrics
 func UpdateMemoryMetrics() {
 	if ServerMetrics == nil {
@@ -464,22 +1656,90 @@ func getGCCountTracker() *gcCountTracker {
 	return gcTracker
 }
 
-// RecordIngressTraffic records incoming traffic in bytes
-func RecordIngressTraffic(realm string, bytes int64) {
+// RecordIngressTraffic records incoming traffic in bytes received by the listener serverID on port over transport
+func RecordIngressTraffic(realm, serverID, port, transport string, bytes int64) {
+	ingressBytesTotal.Add(bytes)
+	if Traffic != nil {
+		Traffic.AddIngress(realm, bytes)
+	}
 	if ServerMetrics != nil {
 		// Convert bytes to megabytes (1 MB = 1,048,576 bytes)
 		megabytes := float64(bytes) / 1048576.0
-		ServerMetrics.IngressTrafficMB.WithLabelValues(realm).Add(megabytes)
-		ServerMetrics.IngressPackets.WithLabelValues(realm).Inc()
+		ServerMetrics.IngressTrafficMB.WithLabelValues(realm, serverID, port, transport).Add(megabytes)
+		ServerMetrics.IngressPackets.WithLabelValues(realm, serverID, port, transport).Inc()
 	}
 }
 
-// RecordEgressTraffic records outgoing traffic in bytes
-func RecordEgressTraffic(realm string, bytes int64) {
+// RecordEgressTraffic records outgoing traffic in bytes sent by the listener serverID on port over transport
+func RecordEgressTraffic(realm, serverID, port, transport string, bytes int64) {
+	egressBytesTotal.Add(bytes)
+	if Traffic != nil {
+		Traffic.AddEgress(realm, bytes)
+	}
 	if ServerMetrics != nil {
 		// Convert bytes to megabytes (1 MB = 1,048,576 bytes)
 		megabytes := float64(bytes) / 1048576.0
-		ServerMetrics.EgressTrafficMB.WithLabelValues(realm).Add(megabytes)
-		ServerMetrics.EgressPackets.WithLabelValues(realm).Inc()
+		ServerMetrics.EgressTrafficMB.WithLabelValues(realm, serverID, port, transport).Add(megabytes)
+		ServerMetrics.EgressPackets.WithLabelValues(realm, serverID, port, transport).Inc()
+	}
+}
+
+// ListenerPacketCounter registers the packet counter of the listener listenerID bound
+// on port for transport, so idle listeners are exported at zero. It returns nil when
+// metrics are disabled.
+func ListenerPacketCounter(listenerID, port, transport string) prometheus.Counter {
+	if ServerMetrics == nil {
+		return nil
+	}
+	return ServerMetrics.ListenerPackets.WithLabelValues(listenerID, port, transport)
+}
+
+// RxOverflowCounter registers the receive buffer overflow counter of the UDP listener
+// listenerID bound on port, so listeners without drops are exported at zero. It returns
+// nil when metrics are disabled.
+func RxOverflowCounter(listenerID, port string) prometheus.Counter {
+	if ServerMetrics == nil {
+		return nil
+	}
+	return ServerMetrics.RxOverflows.WithLabelValues(listenerID, port)
+}
+
+// SeedTrafficMetrics pre-seeds the traffic counters with persisted lifetime totals.
+// Persisted totals are not per listener, so they are seeded without a server_id, port and transport.
+func SeedTrafficMetrics(realm string, totals TrafficTotals) {
+	if ServerMetrics != nil {
+		ServerMetrics.IngressTrafficMB.WithLabelValues(realm, "", "", "").Add(float64(totals.IngressBytes) / 1048576.0)
+		ServerMetrics.EgressTrafficMB.WithLabelValues(realm, "", "", "").Add(float64(totals.EgressBytes) / 1048576.0)
+		ServerMetrics.IngressPackets.WithLabelValues(realm, "", "", "").Add(float64(totals.IngressPackets))
+		ServerMetrics.EgressPackets.WithLabelValues(realm, "", "", "").Add(float64(totals.EgressPackets))
+	}
+}
+
+// RecordPacketSize records the size of a packet received from ("ingress") or
+// sent to ("egress") a client
+func RecordPacketSize(direction string, bytes int) {
+	if ServerMetrics != nil {
+		ServerMetrics.PacketSizes.WithLabelValues(direction).Observe(float64(bytes))
+	}
+}
+
+// RecordStaleNonce records a request refused for a nonce older than NONCE_LIFETIME
+func RecordStaleNonce(realm string) {
+	if ServerMetrics != nil {
+		ServerMetrics.StaleNonces.WithLabelValues(realm).Inc()
+	}
+}
+
+// RecordOversizedPacketDropped records an inbound packet dropped for exceeding the maximum packet size
+func RecordOversizedPacketDropped(realm string) {
+	if ServerMetrics != nil {
+		ServerMetrics.OversizedPackets.WithLabelValues(realm).Inc()
+	}
+}
+
+// RecordSourceRateDrop records an inbound packet dropped by the source packet rate limit
+func RecordSourceRateDrop(realm string) {
+	if ServerMetrics != nil {
+		ServerMetrics.SourceRateDrops.WithLabelValues(realm).Inc()
 	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricsCredential is a username and password accepted by METRICS_AUTH=basic.
+// A credential with a realm only scrapes /metrics, restricted to that realm's series.
+type metricsCredential struct {
+	username string
+	password string
+	realm    string // Empty grants every endpoint and series
+}
+
+// metricsRealmKey is the request context key of the realm a metrics request is restricted to
+type metricsRealmKey struct{}
+
+// withMetricsRealm returns ctx restricted to the series of realm
+func withMetricsRealm(ctx context.Context, realm string) context.Context {
+	return context.WithValue(ctx, metricsRealmKey{}, realm)
+}
+
+// metricsRealm returns the realm a metrics request is restricted to, empty when it is not
+func metricsRealm(ctx context.Context) string {
+	realm, _ := ctx.Value(metricsRealmKey{}).(string)
+	return realm
+}
+
+// parseMetricsCredentials parses METRICS_CREDENTIALS, comma-separated username:password
+// entries, each optionally prefixed with realm= to restrict it to that realm
+func parseMetricsCredentials(list string) ([]metricsCredential, error) {
+	var credentials []metricsCredential
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var credential metricsCredential
+		userPass := entry
+		// The realm prefix ends before the username, which may not contain a colon
+		if realm, rest, found := strings.Cut(entry, "="); found && !strings.Contains(realm, ":") {
+			credential.realm = strings.TrimSpace(realm)
+			userPass = rest
+			if credential.realm == "" {
+				return nil, fmt.Errorf("empty realm in metrics credential for %q", strings.Split(rest, ":")[0])
+			}
+		}
+		username, password, found := strings.Cut(userPass, ":")
+		if !found || username == "" || password == "" {
+			return nil, fmt.Errorf("metrics credential must be username:password or realm=username:password, got an entry for %q", strings.Split(userPass, ":")[0])
+		}
+		if seen[username] {
+			return nil, fmt.Errorf("duplicate metrics credential for %q", username)
+		}
+		seen[username] = true
+
+		credential.username = username
+		credential.password = password
+		credentials = append(credentials, credential)
+	}
+	return credentials, nil
+}
+
+// realmGatherer gathers only the series labeled with its realm. Realm labels are
+// the configured realm or the realm of a validated token, never the REALM attribute
+// a client sent, so clients cannot add series to another tenant's scrape.
+// Series without a realm label, e.g. process and runtime metrics, describe the whole
+// server and are left out as well.
+type realmGatherer struct {
+	prometheus.Gatherer
+	realm string
+}
+
+// Gather returns the metric families of the wrapped gatherer restricted to the realm
+func (g realmGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]*dto.MetricFamily, 0, len(families))
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "realm" && label.GetValue() == g.realm {
+					metrics = append(metrics, metric)
+					break
+				}
+			}
+		}
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			filtered = append(filtered, family)
+		}
+	}
+	return filtered, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gaugeValue returns the current value of a gauge
+func gaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := gauge.Write(&metric); err != nil {
+		t.Fatalf("failed to read the gauge: %v", err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func TestJitterInterval(t *testing.T) {
+	for _, interval := range []time.Duration{time.Nanosecond, time.Second, 30 * time.Second} {
+		for range 100 {
+			if got := jitterInterval(interval); got < interval || got > interval+interval/10 {
+				t.Fatalf("jitterInterval(%s) = %s, want between %s and %s", interval, got, interval, interval+interval/10)
+			}
+		}
+	}
+}
+
+func TestMetricsUpdaterStopsOnCancellation(t *testing.T) {
+	metrics := useTestMetrics(t)
+	metrics.ServerUptime.Set(0)
+
+	stop := StartMetricsUpdater(10 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for gaugeValue(t, metrics.ServerUptime) == 0 {
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatal("the updater never set the uptime")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop did not return, the updater goroutine is still running")
+	}
+
+	uptime := gaugeValue(t, metrics.ServerUptime)
+	time.Sleep(50 * time.Millisecond)
+	if got := gaugeValue(t, metrics.ServerUptime); got != uptime {
+		t.Errorf("uptime changed from %v to %v after stop", uptime, got)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxPionNonceLifetime is how long pion accepts the nonces it issues
+	maxPionNonceLifetime = time.Hour
+	// pionNonceLength is the length of pion's nonces, a hex-encoded millisecond
+	// timestamp of 8 bytes followed by its 32 byte HMAC
+	pionNonceLength = 2 * (8 + 32)
+)
+
+var (
+	// How long a nonce is accepted after it was issued, NONCE_LIFETIME
+	nonceLifetime = maxPionNonceLifetime
+
+	// issuedNonce is the latest nonce pion issued in a 401 or 438 response.
+	// pion's nonces are not bound to a client, so any client may be handed it.
+	issuedNonce atomic.Pointer[stun.Nonce]
+
+	// placeholderNonce is handed to clients with a stale nonce while pion issued none
+	// within NONCE_LIFETIME. It is not a nonce of pion's, so the client's retry is
+	// answered by pion with a 438 and a nonce of its own.
+	placeholderNonce = stun.NewNonce("stale")
+)
+
+// InitNonceLifetime initializes how long nonces are accepted
+func InitNonceLifetime(config *Config) {
+	nonceLifetime = time.Duration(config.NonceLifetime) * time.Second
+	log.Info().
+		Dur("nonce_lifetime", nonceLifetime).
+		Msg("Nonce lifetime configured")
+}
+
+// staleNonceResponse returns the 438 (Stale Nonce) response to an authenticated TURN
+// request whose NONCE was issued by pion longer than NONCE_LIFETIME ago. pion accepts
+// its nonces for an hour and has no setting for it, so the listener answers such
+// requests itself instead of passing them to pion. The response carries the latest
+// nonce pion issued, which the client retries with, or placeholderNonce when that one
+// is stale too. A client replaying a captured request cannot get past the 438, since
+// the retry must be signed again.
+// It reports false for any other packet.
+func staleNonceResponse(packet []byte, realm string) ([]byte, bool) {
+	if !isSTUNRequest(packet) {
+		return nil, false
+	}
+	var messageType stun.MessageType
+	messageType.ReadValue(binary.BigEndian.Uint16(packet[0:2]))
+	if messageType.Method == stun.MethodBinding {
+		return nil, false
+	}
+
+	message := &stun.Message{Raw: append([]byte(nil), packet...)}
+	if err := message.Decode(); err != nil {
+		return nil, false
+	}
+	var nonce stun.Nonce
+	if err := nonce.GetFrom(message); err != nil {
+		return nil, false
+	}
+	if issued, ok := nonceIssuedAt(nonce); !ok || time.Since(issued) <= nonceLifetime {
+		return nil, false
+	}
+
+	fresh := placeholderNonce
+	if latest := issuedNonce.Load(); latest != nil {
+		if issued, _ := nonceIssuedAt(*latest); time.Since(issued) <= nonceLifetime {
+			fresh = *latest
+		}
+	}
+	response, err := stun.Build(
+		&stun.Message{TransactionID: message.TransactionID},
+		stun.NewType(messageType.Method, stun.ClassErrorResponse),
+		stun.CodeStaleNonce,
+		stun.NewRealm(realm),
+		fresh,
+	)
+	if err != nil {
+		return nil, false
+	}
+	return response.Raw, true
+}
+
+// noteIssuedNonce keeps the nonce of a 401 (Unauthorized) or 438 (Stale Nonce)
+// response pion wrote, for staleNonceResponse to hand out
+func noteIssuedNonce(response []byte) {
+	if !isSTUNResponse(response) || stunClass(response) != stun.ClassErrorResponse {
+		return
+	}
+	message := &stun.Message{Raw: append([]byte(nil), response...)}
+	if err := message.Decode(); err != nil {
+		return
+	}
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(message); err != nil || (code.Code != stun.CodeUnauthorized && code.Code != stun.CodeStaleNonce) {
+		return
+	}
+	var nonce stun.Nonce
+	if err := nonce.GetFrom(message); err != nil {
+		return
+	}
+	if _, ok := nonceIssuedAt(nonce); ok {
+		issuedNonce.Store(&nonce)
+	}
+}
+
+// nonceIssuedAt returns when pion issued a nonce, reporting false for nonces that
+// are not pion's
+func nonceIssuedAt(nonce stun.Nonce) (time.Time, bool) {
+	if len(nonce) != pionNonceLength {
+		return time.Time{}, false
+	}
+	var issuedAt [8]byte
+	if _, err := hex.Decode(issuedAt[:], nonce[:16]); err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(int64(binary.BigEndian.Uint64(issuedAt[:]))), true // nolint:gosec
+}
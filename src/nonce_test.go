@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+// testNonce returns a nonce in pion's format issued at the time
+func testNonce(issued time.Time) stun.Nonce {
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(issued.UnixMilli()))
+	return stun.NewNonce(hex.EncodeToString(timestamp[:]) + strings.Repeat("ab", 32))
+}
+
+// useTestNonceLifetime sets NONCE_LIFETIME and forgets the nonces pion issued,
+// restoring both after the test
+func useTestNonceLifetime(t *testing.T, lifetime time.Duration) {
+	t.Helper()
+	previousLifetime, previousNonce := nonceLifetime, issuedNonce.Load()
+	t.Cleanup(func() {
+		nonceLifetime = previousLifetime
+		issuedNonce.Store(previousNonce)
+	})
+	nonceLifetime = lifetime
+	issuedNonce.Store(nil)
+}
+
+func buildTestMessage(t *testing.T, setters ...stun.Setter) []byte {
+	t.Helper()
+	message, err := stun.Build(append([]stun.Setter{stun.TransactionID}, setters...)...)
+	if err != nil {
+		t.Fatalf("failed to build STUN message: %v", err)
+	}
+	return message.Raw
+}
+
+func TestStaleNonceResponse(t *testing.T) {
+	useTestNonceLifetime(t, time.Minute)
+	createPermission := stun.NewType(stun.MethodCreatePermission, stun.ClassRequest)
+	stale := testNonce(time.Now().Add(-2 * time.Minute))
+
+	request := buildTestMessage(t, createPermission, stun.NewUsername("token"), stun.NewRealm(testRealm), stale)
+	original := append([]byte(nil), request...)
+
+	// Without a fresh nonce from pion, the client is handed one pion refuses
+	response, ok := staleNonceResponse(request, testRealm)
+	if !ok {
+		t.Fatal("request with a stale nonce was not answered")
+	}
+	if !bytes.Equal(request, original) {
+		t.Error("request was modified")
+	}
+	assertStaleNonceResponse(t, response, request, placeholderNonce)
+
+	// Once pion issued a nonce, the client is handed that one
+	issued := testNonce(time.Now())
+	noteIssuedNonce(buildTestMessage(t,
+		stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse),
+		stun.CodeUnauthorized, stun.NewRealm(testRealm), issued,
+	))
+	response, ok = staleNonceResponse(request, testRealm)
+	if !ok {
+		t.Fatal("request with a stale nonce was not answered")
+	}
+	assertStaleNonceResponse(t, response, request, issued)
+}
+
+func TestStaleNonceResponseIgnoresOtherPackets(t *testing.T) {
+	useTestNonceLifetime(t, time.Minute)
+	stale := testNonce(time.Now().Add(-2 * time.Minute))
+
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"fresh nonce", buildTestMessage(t, stun.NewType(stun.MethodRefresh, stun.ClassRequest), testNonce(time.Now()))},
+		{"no nonce", buildTestMessage(t, stun.NewType(stun.MethodAllocate, stun.ClassRequest))},
+		{"nonce not of pion", buildTestMessage(t, stun.NewType(stun.MethodRefresh, stun.ClassRequest), placeholderNonce)},
+		{"binding", buildTestMessage(t, stun.BindingRequest, stale)},
+		{"response", buildTestMessage(t, stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse), stale)},
+		{"ChannelData", []byte{0x40, 0x00, 0x00, 0x04, 1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := staleNonceResponse(tt.packet, testRealm); ok {
+				t.Error("packet was answered with a 438")
+			}
+		})
+	}
+}
+
+func assertStaleNonceResponse(t *testing.T, response, request []byte, wantNonce stun.Nonce) {
+	t.Helper()
+	message := &stun.Message{Raw: response}
+	if err := message.Decode(); err != nil {
+		t.Fatalf("failed to decode the response: %v", err)
+	}
+	if !bytes.Equal(response[stunTransactionIDOffset:stunTransactionIDOffset+stun.TransactionIDSize], request[stunTransactionIDOffset:stunTransactionIDOffset+stun.TransactionIDSize]) {
+		t.Error("response does not answer the request's transaction")
+	}
+	if message.Type != stun.NewType(stun.MethodCreatePermission, stun.ClassErrorResponse) {
+		t.Errorf("response type = %s, want a CreatePermission error response", message.Type)
+	}
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(message); err != nil || code.Code != stun.CodeStaleNonce {
+		t.Errorf("error code = %v (%v), want 438", code.Code, err)
+	}
+	var realm stun.Realm
+	if err := realm.GetFrom(message); err != nil || realm.String() != testRealm {
+		t.Errorf("realm = %q (%v), want %q", realm, err, testRealm)
+	}
+	var nonce stun.Nonce
+	if err := nonce.GetFrom(message); err != nil || !bytes.Equal(nonce, wantNonce) {
+		t.Errorf("nonce = %q (%v), want %q", nonce, err, wantNonce)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+
+	"github.com/pion/turn/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Reasons a permission for a peer is refused by the peer policy
+const (
+	PeerDeniedPrivate        = "private_peer"    // The peer is in a private or bogon range
+	PeerDeniedNotAllowlisted = "not_allowlisted" // The peer is outside PEER_ALLOWLIST
+	PeerDeniedOutOfScope     = "out_of_scope"    // The peer is outside the scope claim of the client's token
+)
+
+var (
+	// Peer networks relays may reach, nil when PEER_ALLOWLIST is empty and every peer is allowed
+	peerAllowlist []*net.IPNet
+)
+
+// privatePeerNetworks are the peer ranges refused with BLOCK_PRIVATE_PEERS: private,
+// loopback, link-local, shared, documentation, benchmarking, multicast and reserved
+// ranges that a client could use to reach services inside the server's network.
+// IPv4-mapped IPv6 peers are matched against the IPv4 ranges.
+var privatePeerNetworks = mustParseCIDRList(
+	"0.0.0.0/8,10.0.0.0/8,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,172.16.0.0/12," +
+		"192.0.0.0/24,192.0.2.0/24,192.88.99.0/24,192.168.0.0/16,198.18.0.0/15," +
+		"198.51.100.0/24,203.0.113.0/24,224.0.0.0/4,240.0.0.0/4," +
+		"::/128,::1/128,64:ff9b:1::/48,100::/64,2001:db8::/32,fc00::/7,fe80::/10,ff00::/8",
+)
+
+// InitPeerAllowlist loads PEER_ALLOWLIST, relays may then only reach the listed networks
+func InitPeerAllowlist(config *Config) {
+	networks, err := parseCIDRList(config.PeerAllowlist)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid PEER_ALLOWLIST")
+	}
+	peerAllowlist = networks
+
+	log.Info().Str("peer_allowlist", config.PeerAllowlist).Msg("Relaying restricted to the peer allowlist")
+}
+
+// PeerAllowed reports whether relays may reach the peer IP under PEER_ALLOWLIST
+func PeerAllowed(peerIP net.IP) bool {
+	return peerAllowlist == nil || containsIP(peerAllowlist, peerIP)
+}
+
+// NewPermissionHandler creates the turn.PermissionHandler enforcing the peer policy.
+// Peers in private or bogon ranges are refused when BLOCK_PRIVATE_PEERS is set, so
+// clients cannot use the relay to reach internal services, and peers outside
+// PEER_ALLOWLIST are refused when it is set, as are peers outside the scope claim
+// of the client's token, before the per-allocation peer limit is applied.
+// Granted permissions are recorded for PERMISSION_LIFETIME.
+func NewPermissionHandler(config *Config) turn.PermissionHandler {
+	peerLimit := NewPeerLimitPermissionHandler(config.MaxPeersPerAllocation)
+
+	return func(clientAddr net.Addr, peerIP net.IP) bool {
+		if config.BlockPrivatePeers && containsIP(privatePeerNetworks, peerIP) {
+			denyPeer(clientAddr, peerIP, PeerDeniedPrivate)
+			return false
+		}
+		if !PeerAllowed(peerIP) {
+			denyPeer(clientAddr, peerIP, PeerDeniedNotAllowlisted)
+			return false
+		}
+		if scope := Connections.Scope(clientAddr.String()); scope != nil && !containsIP(scope, peerIP) {
+			denyPeer(clientAddr, peerIP, PeerDeniedOutOfScope)
+			return false
+		}
+		if !peerLimit(clientAddr, peerIP) {
+			return false
+		}
+		grantPermission(clientAddr, peerIP)
+		return true
+	}
+}
+
+// denyPeer records and logs a permission refused by the peer policy
+func denyPeer(clientAddr net.Addr, peerIP net.IP, reason string) {
+	realm, userID, _ := Connections.Lookup(clientAddr.String())
+	RecordPeerDenied(realm, reason)
+	log.Warn().
+		Str("realm", realm).
+		Str("user_id", userID).
+		Str("client_addr", clientAddr.String()).
+		Str("peer_ip", peerIP.String()).
+		Str("reason", reason).
+		Msg("Permission refused - peer is not allowed by the peer policy")
+}
+
+// mustParseCIDRList parses a built-in list of CIDRs
+func mustParseCIDRList(list string) []*net.IPNet {
+	networks, err := parseCIDRList(list)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
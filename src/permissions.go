@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxPionPermissionLifetime is how long pion keeps a permission without a refresh
+	maxPionPermissionLifetime = 5 * time.Minute
+	// minPermissionLifetime is the shortest PERMISSION_LIFETIME, shorter ones would
+	// have clients spend their traffic refreshing permissions
+	minPermissionLifetime = 10 * time.Second
+
+	// PeerDroppedPermissionExpired is the drop reason of packets to or from a peer
+	// whose permission was not refreshed within PERMISSION_LIFETIME
+	PeerDroppedPermissionExpired = "permission_expired"
+)
+
+// permissionStatus is the state of a client's permission for a peer IP
+type permissionStatus int
+
+const (
+	permissionGranted permissionStatus = iota // Created or refreshed within the permission lifetime
+	permissionExpired                         // Not refreshed within PERMISSION_LIFETIME, pion may still hold it
+	permissionMissing                         // Never created, or expired by pion as well
+)
+
+var (
+	// How long a permission lasts without a refresh, PERMISSION_LIFETIME
+	permissionLifetime = maxPionPermissionLifetime
+
+	// permissionGrants holds when each client last created or refreshed the
+	// permission for a peer IP
+	permissionGrants = struct {
+		mu     sync.Mutex
+		grants map[string]map[string]time.Time // Grant times by client address, then peer IP
+	}{grants: make(map[string]map[string]time.Time)}
+)
+
+// InitPermissionLifetime initializes how long permissions last without a refresh
+func InitPermissionLifetime(config *Config) {
+	permissionLifetime = time.Duration(config.PermissionLifetime) * time.Second
+	log.Info().
+		Dur("permission_lifetime", permissionLifetime).
+		Msg("Permission lifetime configured")
+}
+
+// grantPermission records that the client created or refreshed its permission for
+// the peer IP. pion calls the permission handler for both, and for channel bindings.
+func grantPermission(clientAddr net.Addr, peerIP net.IP) {
+	permissionGrants.mu.Lock()
+	defer permissionGrants.mu.Unlock()
+	peers, ok := permissionGrants.grants[clientAddr.String()]
+	if !ok {
+		peers = make(map[string]time.Time)
+		permissionGrants.grants[clientAddr.String()] = peers
+	}
+	peers[peerIP.String()] = time.Now()
+}
+
+// peerPermission returns the state of the client's permission for the peer IP.
+// A permission not refreshed within PERMISSION_LIFETIME is still held by pion for
+// up to five minutes, so the relay drops the peer's packets in the meantime.
+func peerPermission(clientAddr string, peerIP net.IP) permissionStatus {
+	permissionGrants.mu.Lock()
+	granted, ok := permissionGrants.grants[clientAddr][peerIP.String()]
+	permissionGrants.mu.Unlock()
+
+	switch age := time.Since(granted); {
+	case !ok || age > maxPionPermissionLifetime:
+		return permissionMissing
+	case age > permissionLifetime:
+		return permissionExpired
+	default:
+		return permissionGranted
+	}
+}
+
+// forgetPermissions removes the grants of a client whose allocation was closed
+func forgetPermissions(clientAddr string) {
+	permissionGrants.mu.Lock()
+	delete(permissionGrants.grants, clientAddr)
+	permissionGrants.mu.Unlock()
+}
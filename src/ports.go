@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// capNetBindService is the capability bit allowing to bind ports below 1024
+	capNetBindService = 10
+	// defaultUnprivilegedPortStart is the first port any process may bind on Linux
+	defaultUnprivilegedPortStart = 1024
+)
+
+// parsePortList parses a comma-separated list of UDP ports, rejecting ports out of
+// range and ports listed twice
+func parsePortList(list string) ([]int, error) {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		port, err := strconv.Atoi(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", entry)
+		}
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("port %d is out of range", port)
+		}
+		if seen[port] {
+			return nil, fmt.Errorf("port %d is listed twice", port)
+		}
+		seen[port] = true
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// canBindPort reports whether the process may bind the port. Ports below
+// net.ipv4.ip_unprivileged_port_start need root or CAP_NET_BIND_SERVICE.
+// Where /proc is not available, i.e. outside Linux, it reports true and leaves
+// the decision to the kernel when the listener is bound.
+func canBindPort(port int) bool {
+	if port >= unprivilegedPortStart() || os.Geteuid() == 0 {
+		return true
+	}
+	capabilities, ok := effectiveCapabilities()
+	return !ok || capabilities&(1<<capNetBindService) != 0
+}
+
+// unprivilegedPortStart returns the first port unprivileged processes may bind
+func unprivilegedPortStart() int {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	if err != nil {
+		return defaultUnprivilegedPortStart
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return defaultUnprivilegedPortStart
+	}
+	return start
+}
+
+// effectiveCapabilities returns the effective capability set of the process.
+// It reports false where /proc/self/status is not available.
+func effectiveCapabilities() (uint64, bool) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			capabilities, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			return capabilities, err == nil
+		}
+	}
+	return 0, false
+}
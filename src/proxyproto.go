@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// proxyHeaderTimeout bounds how long a connection may take to send its PROXY header
+	proxyHeaderTimeout = webSocketHandshakeTimeout
+	// proxyV1MaxLength is the longest v1 header, "PROXY TCP6" with the longest addresses
+	proxyV1MaxLength = 107
+	// proxyV2MaxLength bounds the addresses and TLVs of a v2 header, load balancers
+	// send a few hundred bytes at most
+	proxyV2MaxLength = 4096
+
+	// Reasons a connection is refused by a PROXY protocol listener
+	ProxyProtocolMissing = "missing"
+	ProxyProtocolInvalid = "invalid"
+)
+
+// ProxyProtocolMode is whether a TCP listener reads PROXY protocol headers
+type ProxyProtocolMode int
+
+const (
+	ProxyProtocolOff      ProxyProtocolMode = iota // Clients connect directly
+	ProxyProtocolOptional                          // Connections without a header keep their TCP peer address
+	ProxyProtocolRequired                          // Connections without a header are closed
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolModeFor returns the PROXY protocol mode of the configured WebSocket listeners
+func ProxyProtocolModeFor(config *Config) ProxyProtocolMode {
+	switch {
+	case !config.WebSocketProxyProtocol:
+		return ProxyProtocolOff
+	case config.WebSocketProxyProtocolRequired:
+		return ProxyProtocolRequired
+	default:
+		return ProxyProtocolOptional
+	}
+}
+
+// proxiedConn is a connection whose client address was read from its PROXY header.
+// Reads go through the buffer the header was read with, which may hold the first
+// bytes sent after it.
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+func (c *proxiedConn) RemoteAddr() net.Addr       { return c.remote }
+
+// acceptedConn is a connection, or the error accepting it, handed to Accept
+type acceptedConn struct {
+	conn net.Conn
+	err  error
+}
+
+// ProxyProtocolListener reads the PROXY protocol v1 or v2 header a load balancer
+// sends ahead of each connection, and reports the client address it carries as the
+// connection's remote address. Headers are read in a goroutine per connection, so
+// a client that is slow to send one does not hold up the others.
+type ProxyProtocolListener struct {
+	net.Listener
+	mode     ProxyProtocolMode
+	accepted chan acceptedConn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// NewProxyProtocolListener reads the PROXY headers of the connections of listener
+func NewProxyProtocolListener(listener net.Listener, mode ProxyProtocolMode) *ProxyProtocolListener {
+	l := &ProxyProtocolListener{
+		Listener: listener,
+		mode:     mode,
+		accepted: make(chan acceptedConn),
+		closed:   make(chan struct{}),
+	}
+	go l.accept()
+	return l
+}
+
+// accept reads the header of every new connection until the listener is closed
+func (l *ProxyProtocolListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Temporary errors, like running out of file descriptors, are retried by Accept's caller
+			select {
+			case l.accepted <- acceptedConn{err: err}:
+				continue
+			case <-l.closed:
+				return
+			}
+		}
+		go l.readHeader(conn)
+	}
+}
+
+// readHeader hands the connection to Accept once its header is read, or closes it
+// when the header is invalid, or missing while required
+func (l *ProxyProtocolListener) readHeader(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	reader := bufio.NewReader(conn)
+	remote, present, err := readProxyHeader(reader)
+	switch {
+	case err != nil && !present:
+		// Closed or timed out before sending anything, like a TCP health check
+		conn.Close()
+		return
+	case err != nil:
+		l.refuse(conn, ProxyProtocolInvalid, err)
+		return
+	case !present && l.mode == ProxyProtocolRequired:
+		l.refuse(conn, ProxyProtocolMissing, nil)
+		return
+	case remote == nil:
+		// No header, or one from the load balancer itself, such as a health check
+		remote = conn.RemoteAddr()
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	select {
+	case l.accepted <- acceptedConn{conn: &proxiedConn{Conn: conn, reader: reader, remote: remote}}:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// refuse closes a connection whose PROXY header was invalid or missing
+func (l *ProxyProtocolListener) refuse(conn net.Conn, reason string, err error) {
+	RecordProxyProtocolRefusal(reason)
+	log.Debug().
+		Err(err).
+		Str("reason", reason).
+		Str("source_addr", conn.RemoteAddr().String()).
+		Str("listen_addr", l.Addr().String()).
+		Msg("Refused a connection without a valid PROXY protocol header")
+	conn.Close()
+}
+
+// Accept returns the next connection whose header was read
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case accepted := <-l.accepted:
+		return accepted.conn, accepted.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections
+func (l *ProxyProtocolListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header. present reports whether
+// the connection started with one, and remote is nil when the header carries no
+// client address, for connections of the load balancer itself.
+func readProxyHeader(reader *bufio.Reader) (remote net.Addr, present bool, err error) {
+	start, err := reader.Peek(1)
+	if err != nil {
+		return nil, false, err
+	}
+	switch start[0] {
+	case 'P':
+		if prefix, err := reader.Peek(6); err != nil || string(prefix) != "PROXY " {
+			return nil, false, nil
+		}
+		remote, err = readProxyV1(reader)
+		return remote, true, err
+	case proxyV2Signature[0]:
+		if prefix, err := reader.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(prefix, proxyV2Signature) {
+			return nil, false, nil
+		}
+		remote, err = readProxyV2(reader)
+		return remote, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
+// readProxyV1 reads a human-readable v1 header, like
+// "PROXY TCP4 198.51.100.7 203.0.113.10 51234 443\r\n"
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, errors.New("v1 header is too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("malformed v1 source address %s port %s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary v2 header, skipping its TLVs
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	if version := header[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported v2 header version %d", version)
+	}
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if length > proxyV2MaxLength {
+		return nil, fmt.Errorf("v2 header of %d bytes is too long", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is sent by the load balancer for its own connections
+	const commandLocal, commandProxy = 0x0, 0x1
+	switch command := header[12] & 0x0f; command {
+	case commandLocal:
+		return nil, nil
+	case commandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+
+	const familyInet, familyInet6 = 0x1, 0x2
+	switch family := header[13] >> 4; family {
+	case familyInet:
+		if length < 12 {
+			return nil, errors.New("truncated v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case familyInet6:
+		if length < 36 {
+			return nil, errors.New("truncated v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// Unspecified or Unix addresses leave the TCP peer address in place
+		return nil, nil
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// redisQuotaTTL is how long a Redis quota counter outlives its last refresh.
+	// Counters of held allocations are refreshed well before they expire, so a
+	// counter only runs out once no live node holds allocations for the user,
+	// e.g. when its only node died without releasing them.
+	redisQuotaTTL       = 15 * time.Minute
+	redisQuotaKeyPrefix = "saturn:allocations:"
+	redisQuotaTimeout   = 500 * time.Millisecond
+)
+
+// AllocationQuota counts open relay allocations per user
+type AllocationQuota interface {
+	// Acquire counts a new allocation for the user unless the user already holds
+	// limit allocations, a limit of 0 means unlimited
+	Acquire(realm, userID string, limit int) bool
+	// Release uncounts an allocation acquired for the user
+	Release(realm, userID string)
+}
+
+var (
+	// Global allocation quota instance, nil when allocations are not capped per user
+	Quota AllocationQuota
+)
+
+// InitAllocationQuota sets up the per-user allocation quota.
+// Allocations are counted in memory unless REDIS_URL is set, in which case the
+// counters are shared by every node using the same Redis.
+func InitAllocationQuota(config *Config) {
+	if config.RedisURL == "" {
+		Quota = NewMemoryQuota()
+		log.Info().
+			Int("max_allocations_per_user", config.MaxAllocationsPerUser).
+			Msg("Per-user allocation quota enabled")
+		return
+	}
+
+	quota, err := NewRedisQuota(config.RedisURL)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to set up the Redis allocation quota")
+	}
+	Quota = quota
+	log.Info().
+		Int("max_allocations_per_user", config.MaxAllocationsPerUser).
+		Msg("Per-user allocation quota enabled, shared through Redis")
+}
+
+// quotaKey identifies a user within a realm
+type quotaKey struct {
+	realm  string
+	userID string
+}
+
+// MemoryQuota counts allocations per user in this process only
+type MemoryQuota struct {
+	mu     sync.Mutex
+	counts map[quotaKey]int
+}
+
+// NewMemoryQuota creates a new MemoryQuota
+func NewMemoryQuota() *MemoryQuota {
+	return &MemoryQuota{counts: make(map[quotaKey]int)}
+}
+
+// Acquire counts a new allocation for the user unless the limit is reached
+func (q *MemoryQuota) Acquire(realm, userID string, limit int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := quotaKey{realm: realm, userID: userID}
+	if limit > 0 && q.counts[key] >= limit {
+		return false
+	}
+	q.counts[key]++
+	return true
+}
+
+// Release uncounts an allocation of the user
+func (q *MemoryQuota) Release(realm, userID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := quotaKey{realm: realm, userID: userID}
+	if q.counts[key] <= 1 {
+		delete(q.counts, key)
+		return
+	}
+	q.counts[key]--
+}
+
+// users returns the users that hold at least one allocation
+func (q *MemoryQuota) users() []quotaKey {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	users := make([]quotaKey, 0, len(q.counts))
+	for key := range q.counts {
+		users = append(users, key)
+	}
+	return users
+}
+
+// acquireScript increments the counter unless it already reached the limit and
+// refreshes its TTL, in a single round trip so concurrent nodes cannot overshoot
+var acquireScript = redis.NewScript(`
+local count = tonumber(redis.call("GET", KEYS[1]) or "0")
+local limit = tonumber(ARGV[1])
+if limit > 0 and count >= limit then
+	return 0
+end
+redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+// releaseScript decrements the counter and removes it once it drops to zero,
+// a counter that already expired is left alone instead of going negative
+var releaseScript = redis.NewScript(`
+local count = tonumber(redis.call("GET", KEYS[1]) or "0")
+if count <= 1 then
+	redis.call("DEL", KEYS[1])
+	return 0
+end
+return redis.call("DECR", KEYS[1])
+`)
+
+// RedisQuota counts allocations per user in Redis so the limit holds across nodes.
+// The allocations held by this node are also counted locally, which lets their
+// counters be kept alive while dead nodes' counts expire.
+// Redis errors fail open: the allocation is allowed rather than refused.
+type RedisQuota struct {
+	client *redis.Client
+	local  *MemoryQuota // Allocations held by this node
+}
+
+// NewRedisQuota connects to the Redis at url and starts refreshing the counters
+func NewRedisQuota(url string) (*RedisQuota, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid REDIS_URL")
+	}
+
+	quota := &RedisQuota{
+		client: redis.NewClient(options),
+		local:  NewMemoryQuota(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := quota.client.Ping(ctx).Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to connect to Redis")
+	}
+
+	go quota.refreshLoop()
+	return quota, nil
+}
+
+// Acquire counts a new allocation for the user in Redis unless the limit is reached
+func (q *RedisQuota) Acquire(realm, userID string, limit int) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisQuotaTimeout)
+	defer cancel()
+
+	acquired, err := acquireScript.Run(ctx, q.client, []string{redisQuotaKey(realm, userID)},
+		limit, redisQuotaTTL.Milliseconds()).Int()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("realm", realm).
+			Str("user_id", userID).
+			Msg("Failed to acquire allocation quota from Redis, allowing the allocation")
+		// Still counted locally so the matching Release is balanced
+		q.local.Acquire(realm, userID, 0)
+		return true
+	}
+	if acquired == 0 {
+		return false
+	}
+
+	q.local.Acquire(realm, userID, 0)
+	return true
+}
+
+// Release uncounts an allocation of the user in Redis
+func (q *RedisQuota) Release(realm, userID string) {
+	q.local.Release(realm, userID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisQuotaTimeout)
+	defer cancel()
+
+	if err := releaseScript.Run(ctx, q.client, []string{redisQuotaKey(realm, userID)}).Err(); err != nil {
+		log.Error().
+			Err(err).
+			Str("realm", realm).
+			Str("user_id", userID).
+			Msg("Failed to release allocation quota in Redis, the counter will expire")
+	}
+}
+
+// refreshLoop keeps the counters of allocations held by this node from expiring
+func (q *RedisQuota) refreshLoop() {
+	ticker := time.NewTicker(redisQuotaTTL / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		users := q.local.users()
+		if len(users) == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		pipe := q.client.Pipeline()
+		for _, user := range users {
+			pipe.PExpire(ctx, redisQuotaKey(user.realm, user.userID), redisQuotaTTL)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Error().Err(err).Int("users", len(users)).Msg("Failed to refresh allocation quota counters in Redis")
+		}
+		cancel()
+	}
+}
+
+// redisQuotaKey returns the Redis key counting the user's allocations
+func redisQuotaKey(realm, userID string) string {
+	return redisQuotaKeyPrefix + realm + ":" + userID
+}
+
+// allocateErrorResponse is the STUN message type of an ALLOCATE error response
+var allocateErrorResponse = stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse)
+
+// quotaErrorResponse returns the 486 (Allocation Quota Reached) response replacing
+// the 508 (Insufficient Capacity) pion answers the ALLOCATE request denied by the
+// allocation quota with. pion does not look at the errors of the relay generator,
+// so the generator records the refused request on its listener, see
+// MetricsPacketConn.markQuotaDenied. It reports false for any other response.
+func quotaErrorResponse(response []byte, denied *stunRequest) ([]byte, bool) {
+	if denied == nil || len(response) < stunTransactionIDOffset+stun.TransactionIDSize ||
+		!stun.IsMessage(response) || binary.BigEndian.Uint16(response[0:2]) != allocateErrorResponse.Value() {
+		return nil, false
+	}
+	if string(response[stunTransactionIDOffset:stunTransactionIDOffset+stun.TransactionIDSize]) != string(denied.transactionID[:]) {
+		return nil, false
+	}
+	message := &stun.Message{Raw: append([]byte(nil), response...)}
+	var code stun.ErrorCodeAttribute
+	if err := message.Decode(); err != nil || code.GetFrom(message) != nil || code.Code != stun.CodeInsufficientCapacity {
+		return nil, false
+	}
+
+	replacement, err := stun.Build(
+		&stun.Message{TransactionID: denied.transactionID},
+		allocateErrorResponse,
+		stun.CodeAllocQuotaReached,
+	)
+	if err != nil {
+		return nil, false
+	}
+	return replacement.Raw, true
+}
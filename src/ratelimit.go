@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	sourceLimiterShards = 64 // Spreads lock contention across listener goroutines
+	sourceRateWindow    = time.Second
+	sourceIdleTimeout   = time.Minute // Sources without packets for this long are forgotten
+)
+
+// sourceRate counts the packets received from one source IP in the current window
+type sourceRate struct {
+	windowStart time.Time
+	packets     int
+	lastSeen    time.Time
+}
+
+// sourceLimiterShard is one lock-protected slice of the tracked sources
+type sourceLimiterShard struct {
+	mu      sync.Mutex
+	sources map[netip.Prefix]*sourceRate
+}
+
+// SourceRateLimiter limits the packets per second accepted from a single source IP.
+// It runs on every inbound packet before pion parses it, to blunt UDP floods, so
+// sources are spread over sharded maps keyed by clientPrefix: IPv6 sources are
+// limited per /64, since a single client controls every address in it.
+type SourceRateLimiter struct {
+	limit  int
+	shards [sourceLimiterShards]sourceLimiterShard
+}
+
+var (
+	// Global source rate limiter instance, nil when SOURCE_PPS_LIMIT is 0
+	SourceLimiter *SourceRateLimiter
+)
+
+// NewSourceRateLimiter creates a limiter allowing limit packets per second per source IP
+// and starts the cleanup of idle sources
+func NewSourceRateLimiter(limit int) *SourceRateLimiter {
+	limiter := &SourceRateLimiter{limit: limit}
+	for i := range limiter.shards {
+		limiter.shards[i].sources = make(map[netip.Prefix]*sourceRate)
+	}
+
+	go func() {
+		ticker := time.NewTicker(sourceIdleTimeout)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			limiter.Sweep()
+		}
+	}()
+
+	return limiter
+}
+
+// InitSourceRateLimiter initializes the global source rate limiter
+func InitSourceRateLimiter(config *Config) {
+	SourceLimiter = NewSourceRateLimiter(config.SourcePPSLimit)
+	log.Info().Int("source_pps_limit", config.SourcePPSLimit).Msg("Source packet rate limiting enabled")
+}
+
+// shard returns the shard holding the source
+func (l *SourceRateLimiter) shard(source netip.Prefix) *sourceLimiterShard {
+	bytes := source.Addr().As16()
+	var hash uint32 = 2166136261 // FNV-1a
+	for _, b := range bytes {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	return &l.shards[hash%sourceLimiterShards]
+}
+
+// Allow records a packet from the address and reports whether it is within the limit.
+// exceeded is true only for the first packet over the limit in a window, so callers
+// can log and notify once per window instead of once per packet.
+func (l *SourceRateLimiter) Allow(addr net.Addr) (allowed bool, exceeded bool) {
+	ip, ok := sourceAddrIP(addr)
+	if !ok {
+		return true, false
+	}
+	return l.AllowIP(ip)
+}
+
+// AllowIP records an event from the IP and reports whether it is within the limit, see Allow
+func (l *SourceRateLimiter) AllowIP(ip netip.Addr) (allowed bool, exceeded bool) {
+	source := clientPrefix(ip)
+
+	shard := l.shard(source)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	rate, tracked := shard.sources[source]
+	if !tracked {
+		rate = &sourceRate{windowStart: now}
+		shard.sources[source] = rate
+	}
+	if now.Sub(rate.windowStart) >= sourceRateWindow {
+		rate.windowStart = now
+		rate.packets = 0
+	}
+	rate.lastSeen = now
+	rate.packets++
+
+	return rate.packets <= l.limit, rate.packets == l.limit+1
+}
+
+// Sweep forgets sources that have not sent packets within the idle timeout
+func (l *SourceRateLimiter) Sweep() {
+	cutoff := time.Now().Add(-sourceIdleTimeout)
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		for source, rate := range shard.sources {
+			if rate.lastSeen.Before(cutoff) {
+				delete(shard.sources, source)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pion/turn/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Allocation failure reasons
+const (
+	AllocationFailureQuota         = "quota"          // A quota or connection limit denied the allocation
+	AllocationFailurePortExhausted = "port_exhausted" // No relay port could be bound
+	AllocationFailureInternal      = "internal"       // Any other relay allocation error
+	AllocationFailureDraining      = "draining"       // The server is draining and takes no new allocations
+	AllocationFailureMaintenance   = "maintenance"    // The server is in maintenance and takes no new allocations
+)
+
+var (
+	// Number of relay allocations that are currently open
+	activeAllocations atomic.Int64
+
+	// Registry of the relay allocations that are currently open
+	openAllocations = struct {
+		mu    sync.Mutex
+		conns map[*AllocationPacketConn]struct{}
+	}{conns: make(map[*AllocationPacketConn]struct{})}
+)
+
+// AllocationInfo describes an open relay allocation, served as JSON on /allocations
+type AllocationInfo struct {
+	Realm        string    `json:"realm"`
+	UserID       string    `json:"user_id"`
+	ClientAddr   string    `json:"client_addr"`
+	RelayAddr    string    `json:"relay_addr"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActivity time.Time `json:"last_activity"` // Last packet relayed in either direction, or the creation time
+	IdleSeconds  float64   `json:"idle_seconds"`
+}
+
+// errAllocationQuotaExceeded is returned to pion when a user reached MAX_ALLOCATIONS_PER_USER.
+// pion answers every error of the relay generator with a 508 (Insufficient Capacity),
+// which the listener replaces with a 486 (Allocation Quota Reached).
+var errAllocationQuotaExceeded = errors.New("allocation quota exceeded")
+
+// ActiveAllocations returns the number of relay allocations that are currently open
+func ActiveAllocations() int64 {
+	return activeAllocations.Load()
+}
+
+// OpenAllocations returns the open relay allocations, longest idle first
+func OpenAllocations() []AllocationInfo {
+	openAllocations.mu.Lock()
+	conns := make([]*AllocationPacketConn, 0, len(openAllocations.conns))
+	for conn := range openAllocations.conns {
+		conns = append(conns, conn)
+	}
+	openAllocations.mu.Unlock()
+
+	now := time.Now()
+	allocations := make([]AllocationInfo, 0, len(conns))
+	for _, conn := range conns {
+		lastActivity := conn.LastActivity()
+		allocations = append(allocations, AllocationInfo{
+			Realm:        conn.realm,
+			UserID:       conn.userID,
+			ClientAddr:   conn.clientAddr,
+			RelayAddr:    conn.LocalAddr().String(),
+			CreatedAt:    conn.createdAt,
+			LastActivity: lastActivity,
+			IdleSeconds:  now.Sub(lastActivity).Seconds(),
+		})
+	}
+	sort.Slice(allocations, func(i, j int) bool {
+		return allocations[i].LastActivity.Before(allocations[j].LastActivity)
+	})
+	return allocations
+}
+
+// MeteredRelayGenerator wraps a turn.RelayAddressGenerator to meter relay allocations.
+// When bound to a listener, every relay it allocates is labeled with the realm and
+// user that authenticated from the listener's current client address, which gives
+// per-allocation ingress/egress instead of aggregate per-listener counts.
+type MeteredRelayGenerator struct {
+	turn.RelayAddressGenerator
+	realmGenerators       map[string]turn.RelayAddressGenerator // Generators of realms advertising their own relay IP
+	listener              *MetricsPacketConn                    // nil disables per-allocation metering and quotas
+	maxAllocationsPerUser int                                   // Enforced through Quota when set, 0 means unlimited
+}
+
+// NewMeteredRelayGenerator creates a new MeteredRelayGenerator wrapper.
+// listener may be nil, in which case only allocation failures are metered.
+// Relays of a realm in realmGenerators are allocated by that realm's generator,
+// every other relay by generator.
+func NewMeteredRelayGenerator(generator turn.RelayAddressGenerator, realmGenerators map[string]turn.RelayAddressGenerator, listener *MetricsPacketConn, maxAllocationsPerUser int) *MeteredRelayGenerator {
+	return &MeteredRelayGenerator{
+		RelayAddressGenerator: generator,
+		realmGenerators:       realmGenerators,
+		listener:              listener,
+		maxAllocationsPerUser: maxAllocationsPerUser,
+	}
+}
+
+// AllocatePacketConn allocates a UDP relay and records the failure cause when it fails
+func (g *MeteredRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	// The auth handler registered the client identity before pion asked for the relay,
+	// with the realm of its token rather than the REALM attribute it sent.
+	// Relays of unknown clients are still counted, but their traffic is not metered
+	// and they are not held against a user's allocation quota
+	var realm, userID, clientAddr string
+	if g.listener != nil {
+		if client := g.listener.LastSource(); client != nil {
+			clientAddr = client.String()
+			realm, userID, _ = Connections.Lookup(clientAddr)
+		}
+	}
+
+	// A draining server keeps relaying its allocations but takes no new ones
+	if IsDraining() {
+		RecordAllocationFailure(AllocationFailureDraining)
+		log.Warn().
+			Str("realm", realm).
+			Str("user_id", userID).
+			Str("client_addr", clientAddr).
+			Msg("Relay allocation refused - server is draining")
+		return nil, nil, errServerDraining
+	}
+
+	// Connected clients may still authenticate in maintenance, but get no new relays
+	if inMaintenance, reason := InMaintenance(); inMaintenance {
+		RecordAllocationFailure(AllocationFailureMaintenance)
+		log.Warn().
+			Str("realm", realm).
+			Str("user_id", userID).
+			Str("client_addr", clientAddr).
+			Str("maintenance_reason", reason).
+			Msg("Relay allocation refused - server is in maintenance")
+		return nil, nil, errServerInMaintenance
+	}
+
+	// Enforce the per-user allocation quota before a relay port is bound
+	var quota AllocationQuota
+	if Quota != nil && realm != "" {
+		if !Quota.Acquire(realm, userID, g.maxAllocationsPerUser) {
+			RecordAllocationFailure(AllocationFailureQuota)
+			log.Warn().
+				Str("realm", realm).
+				Str("user_id", userID).
+				Str("client_addr", clientAddr).
+				Int("max_allocations_per_user", g.maxAllocationsPerUser).
+				Msg("Relay allocation refused - user reached the allocation quota")
+			g.listener.markQuotaDenied()
+			return nil, nil, errAllocationQuotaExceeded
+		}
+		quota = Quota
+	}
+
+	conn, addr, err := g.generatorFor(realm).AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		if quota != nil {
+			quota.Release(realm, userID)
+		}
+		reason := classifyAllocationError(err)
+		RecordAllocationFailure(reason)
+		if errors.Is(err, errRelayPortsExhausted) {
+			RecordRelayPortExhaustion(realm)
+			log.Error().
+				Str("realm", realm).
+				Str("user_id", userID).
+				Str("client_addr", clientAddr).
+				Int64("active_allocations", ActiveAllocations()).
+				Msg("Relay allocation refused - every port between RELAY_MIN_PORT and RELAY_MAX_PORT is in use, widen the range")
+			return nil, nil, err
+		}
+		log.Error().
+			Err(err).
+			Str("network", network).
+			Int("requested_port", requestedPort).
+			Str("reason", reason).
+			Msg("Relay allocation failed")
+		return nil, nil, err
+	}
+
+	if g.listener == nil {
+		return conn, addr, nil
+	}
+
+	// Relays of unknown clients are logged too, so every relay address seen in captured
+	// traffic can be traced to its client
+	log.Info().
+		Str("realm", realm).
+		Str("user_id", userID).
+		Str("client_addr", clientAddr).
+		Str("relay_addr", addr.String()).
+		Msg("Relay allocated")
+
+	PublishEvent(Event{
+		Type:       EventAllocationCreated,
+		Realm:      realm,
+		UserID:     userID,
+		SourceAddr: clientAddr,
+		RelayAddr:  addr.String(),
+	})
+
+	allocation := NewAllocationPacketConn(conn, realm, userID)
+	allocation.quota = quota
+	allocation.clientAddr = clientAddr
+	allocation.relayAddr = addr.String()
+	if clientAddr != "" {
+		allocation.scope = Connections.Scope(clientAddr)
+	}
+	if Handoff != nil && clientAddr != "" {
+		// Packets of the client reaching another listener during a restart are passed here
+		Handoff.Claim(g.listener, clientAddr)
+		allocation.listener = g.listener
+	}
+	return allocation, addr, nil
+}
+
+// generatorFor returns the generator allocating the relays of realm, the realm of
+// the client's token
+func (g *MeteredRelayGenerator) generatorFor(realm string) turn.RelayAddressGenerator {
+	if generator, ok := g.realmGenerators[realm]; ok {
+		return generator
+	}
+	return g.RelayAddressGenerator
+}
+
+// AllocateConn allocates a TCP relay and records the failure cause when it fails
+func (g *MeteredRelayGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocateConn(network, requestedPort)
+	if err != nil {
+		RecordAllocationFailure(classifyAllocationError(err))
+		return nil, nil, err
+	}
+	return conn, addr, nil
+}
+
+// NewPeerLimitPermissionHandler creates a turn.PermissionHandler that refuses new
+// permissions once a client already relays to maxPeers distinct peer IPs.
+// A relay fanning out to many peers is a sign of amplification or scanning.
+func NewPeerLimitPermissionHandler(maxPeers int) turn.PermissionHandler {
+	return func(clientAddr net.Addr, peerIP net.IP) bool {
+		ok, realm := Connections.AddPeer(clientAddr.String(), peerIP.String(), maxPeers)
+		if !ok {
+			RecordPeerLimitHit(realm)
+			log.Warn().
+				Str("realm", realm).
+				Str("client_addr", clientAddr.String()).
+				Str("peer_ip", peerIP.String()).
+				Int("max_peers_per_allocation", maxPeers).
+				Msg("Permission refused - allocation reached its peer limit, possible amplification or scanning")
+		}
+		return ok
+	}
+}
+
+// classifyAllocationError maps a relay allocation error to a failure reason
+func classifyAllocationError(err error) string {
+	switch {
+	case errors.Is(err, errRelayPortsExhausted),
+		errors.Is(err, syscall.EADDRINUSE),
+		errors.Is(err, syscall.EADDRNOTAVAIL),
+		// pion's RelayAddressGeneratorPortRange gives up after MaxRetries with an unexported error
+		strings.Contains(err.Error(), "max retries exceeded"):
+		return AllocationFailurePortExhausted
+	default:
+		return AllocationFailureInternal
+	}
+}
+
+// AllocationPacketConn wraps a relay net.PacketConn to track traffic metrics per allocation.
+// Open allocations are counted until the relay is closed.
+type AllocationPacketConn struct {
+	net.PacketConn
+	realm      string // Empty when the client identity is unknown, traffic is then not metered
+	userID     string
+	quota      AllocationQuota    // Released on close, nil when the allocation is not held against a quota
+	clientAddr string             // Address of the client the relay was allocated for, empty when unknown
+	relayAddr  string             // Relay address advertised to the client
+	scope      []*net.IPNet       // Peer networks of the client's token scope, nil allows every peer
+	listener   *MetricsPacketConn // Listener the client's packets are routed to by the handoff, nil without one
+	createdAt  time.Time
+	// Unix nanoseconds of the last packet relayed in either direction
+	lastActivity atomic.Int64
+	ingressBytes atomic.Int64 // Bytes received from peers
+	egressBytes  atomic.Int64 // Bytes sent to peers
+	closed       atomic.Bool
+}
+
+// NewAllocationPacketConn creates a new AllocationPacketConn wrapper
+func NewAllocationPacketConn(conn net.PacketConn, realm, userID string) *AllocationPacketConn {
+	noteTotalAllocations(activeAllocations.Add(1))
+	allocation := &AllocationPacketConn{
+		PacketConn: conn,
+		realm:      realm,
+		userID:     userID,
+		createdAt:  time.Now(),
+	}
+	allocation.lastActivity.Store(allocation.createdAt.UnixNano())
+
+	openAllocations.mu.Lock()
+	openAllocations.conns[allocation] = struct{}{}
+	openAllocations.mu.Unlock()
+	return allocation
+}
+
+// LastActivity returns when the allocation last relayed a packet, or its creation time
+func (a *AllocationPacketConn) LastActivity() time.Time {
+	return time.Unix(0, a.lastActivity.Load())
+}
+
+// ReadFrom reads a packet sent by a peer to the relay and records it as allocation ingress.
+// Packets from peers the client has no permission for are dropped here rather than
+// by pion, so they are counted and logged, and so are those from peers whose
+// permission expired under PERMISSION_LIFETIME.
+func (a *AllocationPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = a.PacketConn.ReadFrom(p)
+		if err != nil {
+			break
+		}
+		status := a.peerPermission(addr)
+		if status == permissionGranted {
+			break
+		}
+		if status == permissionExpired {
+			RecordPeerPacketDropped(a.realm, PeerDroppedPermissionExpired)
+			continue
+		}
+		RecordUnpermittedPeerDrop(a.realm)
+		log.Debug().
+			Str("realm", a.realm).
+			Str("user_id", a.userID).
+			Str("client_addr", a.clientAddr).
+			Str("relay_addr", a.relayAddr).
+			Str("peer_addr", addr.String()).
+			Msg("Dropped data from a peer without a permission")
+	}
+	if err == nil && n > 0 {
+		a.lastActivity.Store(time.Now().UnixNano())
+		a.ingressBytes.Add(int64(n))
+		if a.realm != "" {
+			RecordAllocationIngress(a.realm, a.userID, int64(n))
+		}
+	}
+	return n, addr, err
+}
+
+// WriteTo writes a packet from the relay to a peer and records it as allocation egress.
+// Like MetricsPacketConn.WriteTo, only the bytes written are recorded and short
+// writes are reported as io.ErrShortWrite.
+// Packets to peers outside PEER_ALLOWLIST or the scope of the token the allocation
+// was made with, or whose permission expired under PERMISSION_LIFETIME, are dropped,
+// while pion is told they were sent.
+func (a *AllocationPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && !PeerAllowed(udpAddr.IP) {
+		RecordPeerPacketDropped(a.realm, PeerDeniedNotAllowlisted)
+		return len(p), nil
+	}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && a.scope != nil && !containsIP(a.scope, udpAddr.IP) {
+		RecordPeerPacketDropped(a.realm, PeerDeniedOutOfScope)
+		return len(p), nil
+	}
+	if a.peerPermission(addr) == permissionExpired {
+		RecordPeerPacketDropped(a.realm, PeerDroppedPermissionExpired)
+		return len(p), nil
+	}
+
+	n, err = a.PacketConn.WriteTo(p, addr)
+	if n > 0 {
+		a.lastActivity.Store(time.Now().UnixNano())
+		a.egressBytes.Add(int64(n))
+		if a.realm != "" {
+			RecordAllocationEgress(a.realm, a.userID, int64(n))
+		}
+	}
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// peerPermission returns the state of the client's permission for the peer at addr.
+// Without the client address or a UDP peer nothing can be checked, and pion decides.
+func (a *AllocationPacketConn) peerPermission(addr net.Addr) permissionStatus {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || a.clientAddr == "" {
+		return permissionGranted
+	}
+	return peerPermission(a.clientAddr, udpAddr.IP)
+}
+
+// Close closes the relay and logs the end of the allocation
+func (a *AllocationPacketConn) Close() error {
+	if !a.closed.CompareAndSwap(false, true) {
+		return a.PacketConn.Close()
+	}
+	noteTotalAllocations(activeAllocations.Add(-1))
+	openAllocations.mu.Lock()
+	delete(openAllocations.conns, a)
+	openAllocations.mu.Unlock()
+	if a.quota != nil {
+		a.quota.Release(a.realm, a.userID)
+	}
+	if a.listener != nil {
+		Handoff.Release(a.listener, a.clientAddr)
+	}
+	// The client has no allocation left on its address, so its connection ends with it
+	if a.clientAddr != "" {
+		Connections.Release(a.clientAddr)
+		forgetPermissions(a.clientAddr)
+	}
+
+	// Logged with the same fields as "Relay allocated", so both ends of an allocation
+	// can be correlated with captured traffic
+	log.Info().
+		Str("realm", a.realm).
+		Str("user_id", a.userID).
+		Str("client_addr", a.clientAddr).
+		Str("relay_addr", a.relayAddr).
+		Dur("duration", time.Since(a.createdAt)).
+		Int64("ingress_bytes", a.ingressBytes.Load()).
+		Int64("egress_bytes", a.egressBytes.Load()).
+		Msg("Relay closed")
+	PublishEvent(Event{
+		Type:       EventAllocationClosed,
+		Realm:      a.realm,
+		UserID:     a.userID,
+		SourceAddr: a.clientAddr,
+		RelayAddr:  a.LocalAddr().String(),
+	})
+	return a.PacketConn.Close()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// errRelayPortsExhausted is returned to pion when every port of the relay port range is
+// bound, pion answers the ALLOCATE request with a 508 (Insufficient Capacity)
+var errRelayPortsExhausted = errors.New("relay port range exhausted")
+
+// RelayPortRangeGenerator allocates relays on ports between RELAY_MIN_PORT and RELAY_MAX_PORT.
+// Unlike pion's RelayAddressGeneratorPortRange, which gives up after a few random picks,
+// every port of the range is tried before an allocation fails, so a failure means the
+// range is exhausted rather than unlucky.
+type RelayPortRangeGenerator struct {
+	RelayAddress net.IP // IP clients reach the relays on
+	Address      string // Address the relays are bound on
+	MinPort      int
+	MaxPort      int // Inclusive
+}
+
+// NewRelayPortRangeGenerator creates a RelayPortRangeGenerator for the inclusive range minPort to maxPort
+func NewRelayPortRangeGenerator(relayAddress net.IP, address string, minPort, maxPort int) *RelayPortRangeGenerator {
+	return &RelayPortRangeGenerator{
+		RelayAddress: relayAddress,
+		Address:      address,
+		MinPort:      minPort,
+		MaxPort:      maxPort,
+	}
+}
+
+// Validate is called by pion on startup and checks the generator is configured
+func (g *RelayPortRangeGenerator) Validate() error {
+	switch {
+	case g.RelayAddress == nil:
+		return errors.New("relay address is not set")
+	case g.Address == "":
+		return errors.New("relay bind address is not set")
+	case g.MinPort < 1 || g.MaxPort > 65535 || g.MinPort > g.MaxPort:
+		return fmt.Errorf("invalid relay port range %d-%d", g.MinPort, g.MaxPort)
+	default:
+		return nil
+	}
+}
+
+// AllocatePacketConn binds a relay on the requested port, or else on the first free port
+// of the range starting from a random one, so relays spread over the range
+func (g *RelayPortRangeGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	if requestedPort != 0 {
+		return g.listen(network, requestedPort)
+	}
+
+	size := g.MaxPort - g.MinPort + 1
+	start := rand.IntN(size)
+	for i := range size {
+		port := g.MinPort + (start+i)%size
+		conn, addr, err := g.listen(network, port)
+		if err == nil {
+			return conn, addr, nil
+		}
+		// Any other error would fail on every port alike
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, errRelayPortsExhausted
+}
+
+// listen binds a relay on port and returns it with the address advertised to the client
+func (g *RelayPortRangeGenerator) listen(network string, port int) (net.PacketConn, net.Addr, error) {
+	conn, err := net.ListenPacket(network, net.JoinHostPort(g.Address, strconv.Itoa(port)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	relayAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		conn.Close()
+		return nil, nil, errors.New("relay is not a UDP socket")
+	}
+	return conn, &net.UDPAddr{IP: g.RelayAddress, Port: relayAddr.Port}, nil
+}
+
+// AllocateConn is not supported, relays are UDP only
+func (g *RelayPortRangeGenerator) AllocateConn(string, int) (net.Conn, net.Addr, error) {
+	return nil, nil, errors.New("TCP relays are not supported")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pion/turn/v4"
+)
+
+// fakeRelayGenerator allocates loopback relays and counts them
+type fakeRelayGenerator struct {
+	allocated int
+}
+
+func (g *fakeRelayGenerator) Validate() error { return nil }
+
+func (g *fakeRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	g.allocated++
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.LocalAddr(), nil
+}
+
+func (g *fakeRelayGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, errors.New("TCP relays are not supported")
+}
+
+func TestMeteredRelayGeneratorSelectsGeneratorByTokenRealm(t *testing.T) {
+	config := useTestConfig(t)
+	config.Realms = "acme"
+	useTestConnections(t)
+	handler := NewAuthHandler(config, NewJWTAuthenticator(config))
+
+	// The client's token is issued for the co-hosted realm acme, while it claims
+	// the realm of another generator in its REALM attribute
+	client := testAddr(t, "192.0.2.1:40000")
+	if _, ok := handler(signTestToken(t, testSecret, "alice", jwt.MapClaims{"realm": "acme"}), "other", client); !ok {
+		t.Fatal("authentication refused")
+	}
+
+	fallback, tokenRealm, otherRealm := &fakeRelayGenerator{}, &fakeRelayGenerator{}, &fakeRelayGenerator{}
+	listener := NewMetricsPacketConn(nil, testRealm, 0, 3478, TransportUDP, 0)
+	listener.lastSource.Store(sourceAddr{addr: client})
+	generator := NewMeteredRelayGenerator(fallback, map[string]turn.RelayAddressGenerator{
+		"acme":  tokenRealm,
+		"other": otherRealm,
+	}, listener, 0)
+
+	conn, _, err := generator.AllocatePacketConn("udp4", 0)
+	if err != nil {
+		t.Fatalf("AllocatePacketConn() error = %v", err)
+	}
+	defer conn.Close()
+
+	if tokenRealm.allocated != 1 || otherRealm.allocated != 0 || fallback.allocated != 0 {
+		t.Errorf("allocations = %d of the token realm, %d of the REALM attribute and %d of the default, want 1, 0, 0",
+			tokenRealm.allocated, otherRealm.allocated, fallback.allocated)
+	}
+}
+
+// BenchmarkAllocationPacketConn relays packets between a permitted peer and an
+// allocation, to the peer for egress and from it for ingress
+func BenchmarkAllocationPacketConn(b *testing.B) {
+	clientAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+	peer := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}
+	payload := make([]byte, testPayloadSize)
+
+	allocation := NewAllocationPacketConn(&fakePacketConn{packet: payload, addr: peer}, testRealm, "alice")
+	allocation.clientAddr = clientAddr.String()
+	grantPermission(clientAddr, peer.IP)
+	b.Cleanup(func() { _ = allocation.Close() })
+
+	buf := make([]byte, testPayloadSize)
+	b.Run("egress", func(b *testing.B) {
+		b.SetBytes(testPayloadSize)
+		b.ReportAllocs()
+		for range b.N {
+			_, _ = allocation.WriteTo(payload, peer)
+		}
+	})
+	b.Run("ingress", func(b *testing.B) {
+		b.SetBytes(testPayloadSize)
+		b.ReportAllocs()
+		for range b.N {
+			_, _, _ = allocation.ReadFrom(buf)
+		}
+	})
+}
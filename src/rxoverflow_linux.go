@@ -0,0 +1,37 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+)
+
+// rxOverflowOOBSize is the control message buffer that fits the SO_RXQ_OVFL counter
+var rxOverflowOOBSize = unix.CmsgSpace(4)
+
+// enableRxQueueOverflow asks the kernel to attach the number of packets it dropped on
+// the socket, because its receive buffer was full, to the packets read from it.
+// It is best effort, listeners work the same without it.
+func enableRxQueueOverflow(fd int) {
+	_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+}
+
+// rxQueueOverflow returns the SO_RXQ_OVFL drop counter of the socket from the control
+// messages of a packet. The kernel only attaches it once the socket dropped a packet.
+func rxQueueOverflow(oob []byte) (uint32, bool) {
+	if len(oob) == 0 {
+		return 0, false
+	}
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, message := range messages {
+		if message.Header.Level == unix.SOL_SOCKET && message.Header.Type == unix.SO_RXQ_OVFL && len(message.Data) >= 4 {
+			return binary.NativeEndian.Uint32(message.Data), true
+		}
+	}
+	return 0, false
+}
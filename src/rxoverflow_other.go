@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+// rxOverflowOOBSize is 0 where SO_RXQ_OVFL is not available, which disables the counter
+var rxOverflowOOBSize = 0
+
+// enableRxQueueOverflow does nothing, SO_RXQ_OVFL is Linux only
+func enableRxQueueOverflow(int) {}
+
+// rxQueueOverflow never finds a drop counter, SO_RXQ_OVFL is Linux only
+func rxQueueOverflow([]byte) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	// selfTestUserID is the user the self-test authenticates as
+	selfTestUserID = "saturn-self-test"
+	// selfTestMinInterval is how long a self-test result is reused, so the
+	// endpoint cannot be used to make the server allocate relays in a loop
+	selfTestMinInterval = 10 * time.Second
+	selfTestTimeout     = 5 * time.Second
+)
+
+// SelfTestResult is the outcome of a self-test, served as JSON on /selftest
+type SelfTestResult struct {
+	Success           bool      `json:"success"`
+	Stage             string    `json:"stage"` // Last stage reached: "token", "binding" or "allocate"
+	Error             string    `json:"error,omitempty"`
+	BindingLatencyMs  float64   `json:"binding_latency_ms"`
+	AllocateLatencyMs float64   `json:"allocate_latency_ms,omitempty"`
+	RelayAddress      string    `json:"relay_address,omitempty"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+// SelfTester runs the TURN client flow against the server's own listener.
+// It catches auth and relay regressions that a port-level health check misses.
+type SelfTester struct {
+	mu     sync.Mutex
+	config *Config
+	last   *SelfTestResult
+}
+
+// NewSelfTester creates a new SelfTester for the configured server
+func NewSelfTester(config *Config) *SelfTester {
+	return &SelfTester{config: config}
+}
+
+// Run performs a self-test, or returns the previous result when it is recent enough
+func (t *SelfTester) Run() SelfTestResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.last != nil && time.Since(t.last.Timestamp) < selfTestMinInterval {
+		return *t.last
+	}
+
+	result := t.run()
+	t.last = &result
+	RecordSelfTest(result)
+	return result
+}
+
+// run binds, authenticates and allocates a relay like a regular client would
+func (t *SelfTester) run() SelfTestResult {
+	result := SelfTestResult{Stage: "token", Timestamp: time.Now()}
+
+	token, err := selfTestToken(t.config)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	target, err := selfTestTarget(t.config)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	serverAddr := target.String()
+
+	conn, err := net.ListenPacket(target.Network(), ":0")
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: serverAddr,
+		TURNServerAddr: serverAddr,
+		Conn:           conn,
+		Username:       token,
+		Password:       selfTestUserID, // Password must match the UserID from the token
+		Realm:          t.config.Realm,
+		RTO:            selfTestTimeout / 4,
+	})
+	if err != nil {
+		conn.Close()
+		result.Error = err.Error()
+		return result
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Stage = "binding"
+	start := time.Now()
+	if err := t.bind(client, target, token); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.BindingLatencyMs = float64(time.Since(start).Microseconds()) / 1000
+
+	// Relays are never offered in STUN-only mode, a working binding is all there is to test
+	if t.config.IsSTUNOnly() {
+		result.Success = true
+		return result
+	}
+
+	result.Stage = "allocate"
+	start = time.Now()
+	relay, err := client.Allocate()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.AllocateLatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	result.RelayAddress = relay.LocalAddr().String()
+	_ = relay.Close()
+
+	result.Success = true
+	return result
+}
+
+// bind sends a binding request, authenticated with the token when STUN_REQUIRE_AUTH
+// is set since the server would drop a plain one
+func (t *SelfTester) bind(client *turn.Client, target net.Addr, token string) error {
+	if !t.config.STUNRequireAuth {
+		_, err := client.SendBindingRequest()
+		return err
+	}
+
+	request, err := stun.Build(
+		stun.TransactionID,
+		stun.BindingRequest,
+		stun.NewUsername(token),
+		stun.NewRealm(t.config.Realm),
+		stun.NewLongTermIntegrity(token, t.config.Realm, selfTestUserID),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = client.PerformTransaction(request, target, false)
+	return err
+}
+
+// selfTestToken mints a short-lived access token for the self-test user
+func selfTestToken(config *Config) (string, error) {
+	role := "user"
+	if config.RequiredRole != "" {
+		role = config.RequiredRole
+	}
+	return MintAccessToken(config, Claims{
+		UserID:   selfTestUserID,
+		Email:    selfTestUserID + "@localhost",
+		Username: selfTestUserID,
+		Role:     role,
+	}, time.Minute)
+}
+
+// selfTestTarget returns the address of the server's first listener, on the first port.
+// Listeners bound to every interface are reached over loopback.
+func selfTestTarget(config *Config) (*net.UDPAddr, error) {
+	network := "udp"
+	if config.IPv4Only {
+		network = "udp4"
+	}
+	addr, err := net.ResolveUDPAddr(network, net.JoinHostPort(config.ListenAddresses()[0], strconv.Itoa(config.ListenPorts()[0])))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve the listener address")
+	}
+
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	return addr, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v4"
+	"github.com/rs/zerolog"
+)
+
+// startTestServer runs serve on a free loopback port with the test secret and realm,
+// and returns its address and a channel receiving serve's exit status
+func startTestServer(t *testing.T) (*net.UDPAddr, <-chan int) {
+	t.Helper()
+	previousConf, previousLevel := Conf, zerolog.GlobalLevel()
+	t.Cleanup(func() {
+		Conf = previousConf
+		zerolog.SetGlobalLevel(previousLevel)
+		draining.Store(false)
+		started.Store(false)
+	})
+
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	addr := probe.LocalAddr().(*net.UDPAddr) //nolint:forcetypeassert
+	probe.Close()
+
+	for name, value := range map[string]string{
+		"ENV_FILE":       t.TempDir() + "/.env",
+		"ACCESS_SECRET":  testSecret,
+		"REALM":          testRealm,
+		"PUBLIC_IP":      "127.0.0.1",
+		"BIND_ADDRESS":   "127.0.0.1",
+		"PORT":           strconv.Itoa(addr.Port),
+		"THREAD_NUM":     "1",
+		"LOG_LEVEL":      "disabled",
+		"LOG_OUTPUT":     "stderr",
+		"ENABLE_METRICS": "false",
+	} {
+		t.Setenv(name, value)
+	}
+
+	status := make(chan int, 1)
+	go func() { status <- serve(nil) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !IsStarted() {
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return addr, status
+}
+
+// refreshAllocation refreshes the client's allocation with a REFRESH request signed
+// with the long-term key of the token, after fetching a nonce with an unsigned one
+func refreshAllocation(t *testing.T, client *turn.Client, token, userID string, lifetime time.Duration) time.Duration {
+	t.Helper()
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(lifetime/time.Second))
+	refreshType := stun.NewType(stun.MethodRefresh, stun.ClassRequest)
+
+	challenge, err := stun.Build(stun.TransactionID, refreshType, stun.RawAttribute{Type: stun.AttrLifetime, Value: value}, stun.Fingerprint)
+	if err != nil {
+		t.Fatalf("failed to build REFRESH: %v", err)
+	}
+	result, err := client.PerformTransaction(challenge, client.TURNServerAddr(), false)
+	if err != nil {
+		t.Fatalf("unsigned REFRESH failed: %v", err)
+	}
+	var nonce stun.Nonce
+	if err := nonce.GetFrom(result.Msg); err != nil {
+		t.Fatalf("unsigned REFRESH was answered without a nonce: %v", err)
+	}
+
+	key := turn.GenerateAuthKey(token, testRealm, userID)
+	request, err := stun.Build(stun.TransactionID, refreshType,
+		stun.RawAttribute{Type: stun.AttrLifetime, Value: value},
+		stun.NewUsername(token), stun.NewRealm(testRealm), nonce,
+		stun.MessageIntegrity(key), stun.Fingerprint,
+	)
+	if err != nil {
+		t.Fatalf("failed to build REFRESH: %v", err)
+	}
+	result, err = client.PerformTransaction(request, client.TURNServerAddr(), false)
+	if err != nil {
+		t.Fatalf("REFRESH failed: %v", err)
+	}
+	if result.Msg.Type.Class != stun.ClassSuccessResponse {
+		var code stun.ErrorCodeAttribute
+		_ = code.GetFrom(result.Msg)
+		t.Fatalf("REFRESH was refused: %v", code)
+	}
+	granted, err := result.Msg.Get(stun.AttrLifetime)
+	if err != nil || len(granted) != 4 {
+		t.Fatalf("REFRESH response has no LIFETIME: %v", err)
+	}
+	return time.Duration(binary.BigEndian.Uint32(granted)) * time.Second
+}
+
+func TestServeAllocatesRelaysAndRefreshes(t *testing.T) {
+	useTestConnections(t)
+	addr, status := startTestServer(t)
+	token := signTestToken(t, testSecret, "alice", nil)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: addr.String(),
+		TURNServerAddr: addr.String(),
+		Conn:           conn,
+		Username:       token,
+		Password:       "alice",
+		Realm:          testRealm,
+		RTO:            200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to create the client: %v", err)
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		t.Fatalf("client failed to listen: %v", err)
+	}
+
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("ALLOCATE failed: %v", err)
+	}
+	if got := ActiveAllocations(); got != 1 {
+		t.Errorf("ActiveAllocations() = %d after ALLOCATE, want 1", got)
+	}
+
+	// The relay forwards to a peer on loopback
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer peer.Close()
+	if _, err := relay.WriteTo([]byte("hello"), peer.LocalAddr()); err != nil {
+		t.Fatalf("failed to write through the relay: %v", err)
+	}
+	buf := make([]byte, 64)
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("peer received nothing through the relay: %v", err)
+	}
+	if string(buf[:n]) != "hello" || from.String() != relay.LocalAddr().String() {
+		t.Errorf("peer received %q from %s, want \"hello\" from %s", buf[:n], from, relay.LocalAddr())
+	}
+
+	if granted := refreshAllocation(t, client, token, "alice", 5*time.Minute); granted != 5*time.Minute {
+		t.Errorf("REFRESH granted %s, want 5m", granted)
+	}
+
+	// Closing the relay deletes the allocation with a zero lifetime REFRESH, so a
+	// drain completes and serve returns
+	relay.Close()
+	StartDrain()
+	select {
+	case code := <-status:
+		if code != 0 {
+			t.Errorf("serve() = %d, want 0", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve did not return after the allocation was deleted and the server drained")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+)
+
+// setSocketBuffers sets the receive and send buffer sizes of a socket, a size of 0
+// keeps the kernel default. The kernel clamps them to net.core.rmem_max and
+// net.core.wmem_max without an error.
+func setSocketBuffers(fd int, rcvBytes, sndBytes int) error {
+	if rcvBytes > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvBytes); err != nil {
+			return err
+		}
+	}
+	if sndBytes > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, sndBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// socketBuffers reads back the receive and send buffer sizes of conn.
+// Linux reports twice the size that was set, the extra half is its bookkeeping overhead.
+func socketBuffers(conn net.PacketConn) (rcvBytes, sndBytes int, ok bool) {
+	sc, isSyscallConn := conn.(syscall.Conn)
+	if !isSyscallConn {
+		return 0, 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var rcvErr, sndErr error
+	if err := raw.Control(func(fd uintptr) {
+		rcvBytes, rcvErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		sndBytes, sndErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	}); err != nil || rcvErr != nil || sndErr != nil {
+		return 0, 0, false
+	}
+	return rcvBytes, sndBytes, true
+}
+
+// LogSocketBuffers logs the effective buffer sizes of the listener serverID, and warns
+// when the kernel granted less than SOCKET_RCVBUF_BYTES or SOCKET_SNDBUF_BYTES
+func LogSocketBuffers(serverID int, conn net.PacketConn, config *Config) {
+	rcvBytes, sndBytes, ok := socketBuffers(conn)
+	if !ok {
+		return
+	}
+
+	log.Info().
+		Int("server_id", serverID).
+		Int("rcvbuf_bytes", rcvBytes).
+		Int("sndbuf_bytes", sndBytes).
+		Msg("Listener socket buffers")
+
+	// The kernel doubles what it grants, so half the reported size is what was granted
+	if config.SocketRcvbufBytes > 0 && rcvBytes/2 < config.SocketRcvbufBytes {
+		log.Warn().
+			Int("server_id", serverID).
+			Int("requested_bytes", config.SocketRcvbufBytes).
+			Int("granted_bytes", rcvBytes/2).
+			Msg("Receive buffer clamped by the kernel, raise net.core.rmem_max to get SOCKET_RCVBUF_BYTES")
+	}
+	if config.SocketSndbufBytes > 0 && sndBytes/2 < config.SocketSndbufBytes {
+		log.Warn().
+			Int("server_id", serverID).
+			Int("requested_bytes", config.SocketSndbufBytes).
+			Int("granted_bytes", sndBytes/2).
+			Msg("Send buffer clamped by the kernel, raise net.core.wmem_max to get SOCKET_SNDBUF_BYTES")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Whether every listener is bound, /readyz answers 503 until then
+var started atomic.Bool
+
+// IsStarted reports whether the server has bound all its listeners
+func IsStarted() bool {
+	return started.Load()
+}
+
+// MarkStarted records that every listener is bound and writes STARTUP_READY_FILE,
+// which tells a supervisor restarting the server that the old process may drain
+func MarkStarted(config *Config, listeners int) {
+	started.Store(true)
+	log.Info().Int("listeners", listeners).Msg("All listeners bound, server is ready")
+
+	if config.StartupReadyFile == "" {
+		return
+	}
+	if err := writeReadyFile(config.StartupReadyFile); err != nil {
+		log.Error().Err(err).Str("path", config.StartupReadyFile).Msg("Failed to write the startup ready file")
+		return
+	}
+	log.Info().Str("path", config.StartupReadyFile).Msg("Startup ready file written")
+}
+
+// ClearReadyFile removes a STARTUP_READY_FILE left by a previous process, so it is
+// not taken for this process being ready before its listeners are bound
+func ClearReadyFile(config *Config) {
+	if config.StartupReadyFile == "" {
+		return
+	}
+	if err := os.Remove(config.StartupReadyFile); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("path", config.StartupReadyFile).Msg("Failed to remove a stale startup ready file")
+	}
+}
+
+// RemoveReadyFile removes STARTUP_READY_FILE on shutdown, unless a successor has
+// already replaced it with its own
+func RemoveReadyFile(config *Config) {
+	if config.StartupReadyFile == "" {
+		return
+	}
+	contents, err := os.ReadFile(config.StartupReadyFile)
+	if err != nil || strings.TrimSpace(string(contents)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(config.StartupReadyFile); err != nil {
+		log.Warn().Err(err).Str("path", config.StartupReadyFile).Msg("Failed to remove the startup ready file")
+	}
+}
+
+// writeReadyFile atomically writes the PID of the process to path, a supervisor
+// polling for the file never reads it half-written
+func writeReadyFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.WriteString(strconv.Itoa(os.Getpid()) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
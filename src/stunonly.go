@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/pion/stun/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// Whether authenticated TURN requests are answered with a 403 (Forbidden), in STUN-only mode
+var relayRequestsForbidden bool
+
+// InitSTUNOnlyMode makes the listeners answer authenticated TURN requests with a 403 (Forbidden)
+func InitSTUNOnlyMode() {
+	relayRequestsForbidden = true
+	log.Info().Msg("STUN-only mode enabled, authenticated TURN requests are answered with a 403")
+}
+
+// forbiddenResponse returns the 403 (Forbidden) response to an authenticated TURN
+// request in STUN-only mode. pion answers a refused authentication with a 400 (Bad
+// Request) and has no way to refuse an ALLOCATE with another code, so the listener
+// answers these requests itself instead of passing them to pion. Requests without
+// a USERNAME still get pion's 401 (Unauthorized), clients expect the challenge and
+// only read the error of their authenticated retry.
+// It reports false for binding requests and any other packet.
+func forbiddenResponse(packet []byte) ([]byte, bool) {
+	if !relayRequestsForbidden || !isSTUNRequest(packet) {
+		return nil, false
+	}
+	var messageType stun.MessageType
+	messageType.ReadValue(binary.BigEndian.Uint16(packet[0:2]))
+	if messageType.Method == stun.MethodBinding {
+		return nil, false
+	}
+
+	message := &stun.Message{Raw: append([]byte(nil), packet...)}
+	if err := message.Decode(); err != nil || !message.Contains(stun.AttrUsername) {
+		return nil, false
+	}
+	response, err := stun.Build(
+		&stun.Message{TransactionID: message.TransactionID},
+		stun.NewType(messageType.Method, stun.ClassErrorResponse),
+		stun.CodeForbidden,
+	)
+	if err != nil {
+		return nil, false
+	}
+	return response.Raw, true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/stun/v3"
+)
+
+// useTestSTUNOnlyMode sets whether TURN requests are forbidden, restoring it after the test
+func useTestSTUNOnlyMode(t *testing.T, forbidden bool) {
+	t.Helper()
+	previous := relayRequestsForbidden
+	t.Cleanup(func() { relayRequestsForbidden = previous })
+	relayRequestsForbidden = forbidden
+}
+
+func TestForbiddenResponse(t *testing.T) {
+	useTestSTUNOnlyMode(t, true)
+
+	for _, method := range []stun.Method{stun.MethodAllocate, stun.MethodRefresh, stun.MethodCreatePermission, stun.MethodChannelBind} {
+		t.Run(method.String(), func(t *testing.T) {
+			packet := buildTestMessage(t, stun.NewType(method, stun.ClassRequest), stun.NewUsername("token"))
+			raw, ok := forbiddenResponse(packet)
+			if !ok {
+				t.Fatal("request was not answered with a 403")
+			}
+
+			response := &stun.Message{Raw: raw}
+			if err := response.Decode(); err != nil {
+				t.Fatalf("failed to decode the response: %v", err)
+			}
+			if response.Type != stun.NewType(method, stun.ClassErrorResponse) {
+				t.Errorf("response type = %s, want the error response of %s", response.Type, method)
+			}
+			if string(response.Raw[stunTransactionIDOffset:stunTransactionIDOffset+stun.TransactionIDSize]) !=
+				string(packet[stunTransactionIDOffset:stunTransactionIDOffset+stun.TransactionIDSize]) {
+				t.Error("response does not carry the transaction ID of the request")
+			}
+			var code stun.ErrorCodeAttribute
+			if err := code.GetFrom(response); err != nil || code.Code != stun.CodeForbidden {
+				t.Errorf("error code = %v (%v), want 403", code.Code, err)
+			}
+		})
+	}
+}
+
+func TestForbiddenResponseIgnoresOtherPackets(t *testing.T) {
+	useTestSTUNOnlyMode(t, true)
+	allocate := buildTestMessage(t, stun.NewType(stun.MethodAllocate, stun.ClassRequest), stun.NewUsername("token"))
+
+	tests := map[string][]byte{
+		"unauthenticated ALLOCATE": buildTestMessage(t, stun.NewType(stun.MethodAllocate, stun.ClassRequest)),
+		"binding request":          buildTestMessage(t, stun.BindingRequest),
+		"ALLOCATE response":        buildTestMessage(t, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse)),
+		"ChannelData":              channelDataPacket(100),
+	}
+	for name, packet := range tests {
+		if _, ok := forbiddenResponse(packet); ok {
+			t.Errorf("%s was answered with a 403", name)
+		}
+	}
+
+	relayRequestsForbidden = false
+	if _, ok := forbiddenResponse(allocate); ok {
+		t.Error("ALLOCATE was answered with a 403 outside of STUN-only mode")
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
-	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -12,25 +14,30 @@ import (
 // Claims defines the custom JWT claims structure for our application tokens.
 // It extends the standard JWT RegisteredClaims with additional application-specific fields.
 type Claims struct {
-	UserID               string `json:"user_id"`     // Unique identifier for the user
-	Email                string `json:"email"`       // User's email address
-	Username             string `json:"username"`    // User's username
-	IsVerified           string `json:"is_verified"` // Verification status ("true" or "false")
-	Role                 string `json:"role"`        // User's assigned role for authorization
-	Type                 string `json:"type"`        // Token type (e.g., "ACCESS_TOKEN")
-	Realm                string `json:"realm"`       // Authentication realm, used for multi-tenant environments
-	jwt.RegisteredClaims        // Standard JWT claims (iat, exp, etc.)
+	UserID               string   `json:"user_id"`     // Unique identifier for the user
+	Email                string   `json:"email"`       // User's email address
+	Username             string   `json:"username"`    // User's username
+	IsVerified           string   `json:"is_verified"` // Verification status ("true" or "false")
+	Role                 string   `json:"role"`        // User's assigned role for authorization
+	Roles                []string `json:"roles"`       // Additional roles, optional, a single role string in the token reads as one role
+	Type                 string   `json:"type"`        // Token type (e.g., "ACCESS_TOKEN")
+	Realm                string   `json:"realm"`       // Authentication realm, used for multi-tenant environments
+	Scope                []string `json:"scope"`       // Peer CIDRs or IPs relays may reach, optional, every peer when empty
+	jwt.RegisteredClaims          // Standard JWT claims (iat, exp, etc.)
+
+	scopeMalformed bool // The scope claim is neither a string nor a list of strings
 }
 
 // ValidateToken validates a JWT token string and returns the claims if valid.
 // It performs multiple checks:
 // 1. Token signature validation
-// 2. Token expiration check
-// 3. Verification status check
-// 4. Realm validation
-// 5. Token type verification
+// 2. Token expiration check, tolerating JWT_LEEWAY of clock skew
+// 3. The business rules of Claims.Validate
+//
+// The time spent verifying the signature with each algorithm is recorded in
+// saturn_token_validation_duration_seconds.
 //
-// Returns the parsed Claims if valid, or an error if validation fails.
+// Returns the parsed Claims if valid, or a *TokenError with the reason the token was refused.
 func ValidateToken(tokenString string) (*Claims, error) {
 	// Record token validation attempt
 	defer func() {
@@ -39,104 +46,237 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	}()
 
 	// Parse and validate the JWT token
-	// Conf.AccessSecret is the secret key used to sign tokens
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(Conf.AccessSecret), nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	// The configured algorithms are tried in order so HS256 and RS256 tokens can both be
+	// in flight during a migration. For HS256, Conf.AccessSecret is the secret key used to
+	// sign tokens and Conf.AccessSecretPrevious and Conf.AccessSecrets are tried next so
+	// tokens signed before a rotation, or by another secret of a set, keep working
+	token, alg, key, err := parseToken(tokenString)
 
 	// Handle token parsing errors
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
-			log.Error().Msgf("Invalid token [Reason: token expired]")
-			RecordTokenValidation("failure", "token_expired")
-			// Token is expired
-			return nil, fmt.Errorf("token expired")
+			return nil, refuseToken(&TokenError{Err: ErrTokenExpired, Reason: TokenReasonExpired, Cause: err})
 		}
-
-		log.Error().Err(err).Msg("failed to parse token")
-		RecordTokenValidation("failure", "parse_error")
-		return nil, err
+		return nil, refuseToken(&TokenError{Err: ErrTokenMalformed, Reason: TokenReasonParseError, Cause: err})
 	}
 
 	// Extract claims from the token and check validity
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok || !token.Valid {
-		log.Error().Msgf("Invalid token [Reason: claims not valid]")
-		RecordTokenValidation("failure", "invalid_claims")
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	// Check if user is verified
-	// This ensures only verified users can use the token
-	if _, ok := claims["is_verified"]; !ok {
-		log.Error().Msgf("Invalid token [Reason: is_verified not found]")
-		RecordTokenValidation("failure", "is_verified_missing")
-		return nil, fmt.Errorf("invalid token")
-	}
-	if claims["is_verified"].(string) != "true" {
-		log.Error().Msgf("Invalid token [Reason: is_verified not true]")
-		RecordTokenValidation("failure", "is_verified_false")
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	// Validate token realm matches server realm
-	// This prevents tokens from one environment being used in another
-	if _, ok := claims["realm"]; !ok {
-		log.Error().Msgf("Invalid token [Reason: realm not found]")
-		RecordTokenValidation("failure", "realm_missing")
-		return nil, fmt.Errorf("invalid token")
-	}
-	if claims["realm"].(string) != Conf.Realm {
-		log.Error().Msgf("Invalid token [Reason: realm mismatch]")
-		RecordTokenValidation("failure", "realm_mismatch")
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	// Ensure token type is ACCESS_TOKEN
-	// This prevents refresh tokens or other token types from being used for access
-	if _, ok := claims["type"]; !ok {
-		log.Error().Msgf("Invalid token [Reason: type not found]")
-		RecordTokenValidation("failure", "type_missing")
-		return nil, fmt.Errorf("invalid token")
-	}
-	if claims["type"].(string) != "ACCESS_TOKEN" {
-		log.Error().Msgf("Invalid token [Reason: type not access]")
-		RecordTokenValidation("failure", "type_not_access")
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	// Ensure user role is present
-	if _, ok := claims["role"]; !ok {
-		log.Error().Msgf("Invalid token [Reason: role not found]")
-		RecordTokenValidation("failure", "role_missing")
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	// Construct a proper Claims struct from the parsed map claims
-	payload := Claims{
-		UserID:     claims["user_id"].(string),
-		Email:      claims["email"].(string),
-		Username:   claims["username"].(string),
-		IsVerified: claims["is_verified"].(string),
-		Type:       claims["type"].(string),
-		Realm:      claims["realm"].(string),
-		Role:       claims["role"].(string),
-		RegisteredClaims: jwt.RegisteredClaims{
-			// Convert numeric dates from the token to proper time.Time objects
-			ExpiresAt: jwt.NewNumericDate(time.Unix(int64(claims["exp"].(float64)), 0)),
-			IssuedAt:  jwt.NewNumericDate(time.Unix(int64(claims["iat"].(float64)), 0)),
-		},
-	}
-
-	// Double-check expiration time
-	// This is a safeguard in case the JWT library didn't properly validate expiration
-	if payload.ExpiresAt.Before(time.Now()) {
-		RecordTokenValidation("failure", "token_expired_double_check")
-		return nil, fmt.Errorf("token expired")
+		return nil, refuseToken(&TokenError{Err: ErrTokenMalformed, Reason: TokenReasonInvalidClaims})
+	}
+
+	// Check the claims against the business rules for access tokens
+	payload := claimsFromMap(claims)
+	if err := payload.Validate(&Conf); err != nil {
+		var tokenErr *TokenError
+		if errors.As(err, &tokenErr) {
+			return nil, refuseToken(tokenErr)
+		}
+		return nil, err
 	}
 
 	// Record successful token validation
 	RecordTokenValidation("success", "valid")
+	RecordTokenKey(key)
+	RecordTokenAlgorithm(alg)
 
 	return &payload, nil
 }
+
+// refuseToken logs a refused token and records it with the reason of err
+func refuseToken(err *TokenError) *TokenError {
+	log.Error().
+		Err(err.Cause).
+		Str("claim", err.Claim).
+		Str("expected", err.Expected).
+		Msgf("Invalid token [Reason: %s]", err.Reason)
+	RecordTokenValidation("failure", err.Reason)
+	return err
+}
+
+// MintAccessToken signs an HS256 access token for the user that this server accepts.
+// The realm is the user's, REALM when it is empty, and the issuer the one expected for
+// that realm. The type and verification status are filled in, and the token expires
+// after ttl. Only HS256 tokens can be minted, since the RS256
+// keys are public keys.
+func MintAccessToken(config *Config, user Claims, ttl time.Duration) (string, error) {
+	hs256 := false
+	for _, alg := range config.TokenAlgorithmList() {
+		if alg == TokenAlgHS256 {
+			hs256 = true
+		}
+	}
+	if !hs256 || config.AccessSecret == "" {
+		return "", errors.New("minting tokens requires HS256 in TOKEN_ALGORITHMS")
+	}
+
+	realm := user.Realm
+	if realm == "" {
+		realm = config.Realm
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"user_id":     user.UserID,
+		"email":       user.Email,
+		"username":    user.Username,
+		"is_verified": "true",
+		"role":        user.Role,
+		"type":        "ACCESS_TOKEN",
+		"realm":       realm,
+		"exp":         now.Add(ttl).Unix(),
+		"iat":         now.Unix(),
+	}
+	if len(user.Roles) > 0 {
+		claims["roles"] = user.Roles
+	}
+	if len(user.Scope) > 0 {
+		claims["scope"] = user.Scope
+	}
+	if issuer := config.ExpectedIssuerFor(realm); issuer != "" {
+		claims["iss"] = issuer
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.AccessSecret))
+}
+
+// Signing keys a token can be validated with
+const (
+	TokenKeyCurrent  = "current"
+	TokenKeyPrevious = "previous"
+)
+
+// accessSecret is an HS256 secret tokens are validated with, and the key label
+// recording that it validated a token
+type accessSecret struct {
+	key    string
+	secret string
+}
+
+// accessSecrets returns the HS256 secrets in the order they are tried: ACCESS_SECRET,
+// ACCESS_SECRET_PREVIOUS and then ACCESS_SECRETS, labeled with their index in the array
+func accessSecrets() []accessSecret {
+	secrets := []accessSecret{{key: TokenKeyCurrent, secret: Conf.AccessSecret}}
+	if Conf.AccessSecretPrevious != "" {
+		secrets = append(secrets, accessSecret{key: TokenKeyPrevious, secret: Conf.AccessSecretPrevious})
+	}
+	list, _ := Conf.AccessSecretList() // Checked by config.Validate
+	for i, secret := range list {
+		secrets = append(secrets, accessSecret{key: strconv.Itoa(i), secret: secret})
+	}
+	return secrets
+}
+
+// parseWithSecrets parses the token with each access secret in turn, moving on to the
+// next one only when the signature does not match.
+// It returns which key validated the token.
+func parseWithSecrets(tokenString string) (*jwt.Token, string, error) {
+	var firstErr error
+	for _, candidate := range accessSecrets() {
+		token, err := parseWithSecret(tokenString, candidate.secret)
+		if err == nil {
+			if candidate.key != TokenKeyCurrent {
+				log.Debug().Str("key", candidate.key).Msg("Token validated with another access secret than ACCESS_SECRET")
+			}
+			return token, candidate.key, nil
+		}
+		// Report a later secret's error only when the signature matched it,
+		// e.g. an expired token signed with the previous secret
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			return nil, "", err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, "", firstErr
+}
+
+// parseWithSecret parses and validates an HS256 token signed with secret
+func parseWithSecret(tokenString, secret string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}, parserOptions(jwt.SigningMethodHS256.Alg())...)
+}
+
+// parserOptions restricts a token to the algorithm alg and tolerates JWT_LEEWAY of clock skew
+func parserOptions(alg string) []jwt.ParserOption {
+	return []jwt.ParserOption{
+		jwt.WithValidMethods([]string{alg}),
+		jwt.WithLeeway(tokenLeeway()),
+	}
+}
+
+// tokenLeeway returns the clock skew tolerated on the time claims of tokens
+func tokenLeeway() time.Duration {
+	return time.Duration(Conf.JWTLeeway) * time.Second
+}
+
+// HasRole reports whether the token grants role, either as its role or among its roles
+func (c *Claims) HasRole(role string) bool {
+	if c.Role == role {
+		return true
+	}
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerScope parses the scope claim into the networks relays may reach, nil when the
+// token has no scope and relays may reach every peer the server allows
+func (c *Claims) PeerScope() ([]*net.IPNet, error) {
+	return parseCIDRList(strings.Join(c.Scope, ","))
+}
+
+// scopeClaim returns the entries of the "scope" claim, a list of strings or, as for
+// OAuth scopes, a single space-separated string. It reports false for a claim of
+// another type, which must not read as missing since that would lift the restriction.
+func scopeClaim(claims jwt.MapClaims) ([]string, bool) {
+	switch value := claims["scope"].(type) {
+	case nil:
+		return nil, true
+	case string:
+		return strings.Fields(value), true
+	case []interface{}:
+		scope := make([]string, 0, len(value))
+		for _, entry := range value {
+			network, ok := entry.(string)
+			if !ok {
+				return nil, false
+			}
+			scope = append(scope, network)
+		}
+		return scope, true
+	default:
+		return nil, false
+	}
+}
+
+// rolesClaim returns the "roles" claim as a list of roles. Identity providers issue it
+// as a list of strings or as a single role string, both are accepted, and entries of
+// another type, or a claim of another type, read as no further roles.
+func rolesClaim(claims jwt.MapClaims) []string {
+	switch value := claims["roles"].(type) {
+	case string:
+		if role := strings.TrimSpace(value); role != "" {
+			return []string{role}
+		}
+	case []interface{}:
+		var roles []string
+		for _, entry := range value {
+			if role, ok := entry.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+		return roles
+	}
+	return nil
+}
+
+// issuerClaim returns the "iss" claim, or an empty string when the token has none
+func issuerClaim(claims jwt.MapClaims) string {
+	issuer, _ := claims["iss"].(string)
+	return issuer
+}
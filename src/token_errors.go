@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+)
+
+// Errors a token is refused with. ValidateToken returns them wrapped in a *TokenError,
+// so callers tell them apart with errors.Is.
+var (
+	ErrTokenMalformed   = errors.New("malformed token")
+	ErrTokenExpired     = errors.New("token expired")
+	ErrUserIDMissing    = errors.New("token has no user ID")
+	ErrTokenNotVerified = errors.New("token user is not verified")
+	ErrRealmMismatch    = errors.New("token realm does not match")
+	ErrIssuerMismatch   = errors.New("token issuer does not match")
+	ErrTokenType        = errors.New("token is not an access token")
+	ErrRoleMissing      = errors.New("token has no role")
+	ErrExpiryMissing    = errors.New("token has no expiry")
+	ErrTokenTTLTooLong  = errors.New("token lifetime too long")
+	ErrScopeInvalid     = errors.New("token scope is not a list of CIDRs")
+)
+
+// Reasons a token is refused, used as the reason label of saturn_token_validations_total.
+// Each reason is a case of the error in its comment.
+const (
+	TokenReasonParseError         = "parse_error"                // ErrTokenMalformed
+	TokenReasonInvalidClaims      = "invalid_claims"             // ErrTokenMalformed
+	TokenReasonExpired            = "token_expired"              // ErrTokenExpired, refused by the JWT library
+	TokenReasonExpiredDoubleCheck = "token_expired_double_check" // ErrTokenExpired
+	TokenReasonUserIDMissing      = "user_id_missing"            // ErrUserIDMissing
+	TokenReasonIsVerifiedMissing  = "is_verified_missing"        // ErrTokenNotVerified
+	TokenReasonIsVerifiedFalse    = "is_verified_false"          // ErrTokenNotVerified
+	TokenReasonRealmMissing       = "realm_missing"              // ErrRealmMismatch
+	TokenReasonRealmMismatch      = "realm_mismatch"             // ErrRealmMismatch
+	TokenReasonIssuerMismatch     = "issuer_mismatch"            // ErrIssuerMismatch
+	TokenReasonTypeMissing        = "type_missing"               // ErrTokenType
+	TokenReasonTypeNotAccess      = "type_not_access"            // ErrTokenType
+	TokenReasonRoleMissing        = "role_missing"               // ErrRoleMissing
+	TokenReasonExpiryMissing      = "expiry_missing"             // ErrExpiryMissing
+	TokenReasonTTLTooLong         = "ttl_too_long"               // ErrTokenTTLTooLong
+	TokenReasonScopeInvalid       = "scope_invalid"              // ErrScopeInvalid
+)
+
+// TokenError is returned for a refused token with the reason it was refused for
+type TokenError struct {
+	Err      error  // One of the Err values above
+	Reason   string // One of the TokenReason values above
+	Claim    string // Value of the offending claim, empty when it is missing
+	Expected string // Value the claim was expected to have, when there is one
+	Cause    error  // Error of the JWT library, for tokens it refused
+}
+
+// Error describes why the token was refused without the claim values, which come from the client
+func (e *TokenError) Error() string {
+	if e.Cause != nil {
+		return e.Err.Error() + ": " + e.Cause.Error()
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the Err value and the cause, for errors.Is and errors.As
+func (e *TokenError) Unwrap() []error {
+	if e.Cause != nil {
+		return []error{e.Err, e.Cause}
+	}
+	return []error{e.Err}
+}
+
+// tokenFailureReason returns the reason of a TokenError, or fallback for any other error
+func tokenFailureReason(err error, fallback string) string {
+	var tokenErr *TokenError
+	if errors.As(err, &tokenErr) {
+		return tokenErr.Reason
+	}
+	return fallback
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestValidateTokenRefusesWithTokenError(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		overrides  jwt.MapClaims
+		configure  func(config *Config)
+		wantErr    error
+		wantReason string
+	}{
+		{"forged signature", "another-" + testSecret, nil, nil, ErrTokenMalformed, TokenReasonParseError},
+		{"expired", testSecret, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, nil, ErrTokenExpired, TokenReasonExpired},
+		{"user ID missing", testSecret, jwt.MapClaims{"user_id": nil}, nil, ErrUserIDMissing, TokenReasonUserIDMissing},
+		{"is_verified missing", testSecret, jwt.MapClaims{"is_verified": nil}, nil, ErrTokenNotVerified, TokenReasonIsVerifiedMissing},
+		{"is_verified false", testSecret, jwt.MapClaims{"is_verified": "false"}, nil, ErrTokenNotVerified, TokenReasonIsVerifiedFalse},
+		{"realm missing", testSecret, jwt.MapClaims{"realm": nil}, nil, ErrRealmMismatch, TokenReasonRealmMissing},
+		{"realm mismatch", testSecret, jwt.MapClaims{"realm": "other"}, nil, ErrRealmMismatch, TokenReasonRealmMismatch},
+		{
+			"issuer mismatch", testSecret, jwt.MapClaims{"iss": "https://other.example.com"},
+			func(config *Config) { config.ExpectedIssuer = "https://auth.example.com" },
+			ErrIssuerMismatch, TokenReasonIssuerMismatch,
+		},
+		{"type missing", testSecret, jwt.MapClaims{"type": nil}, nil, ErrTokenType, TokenReasonTypeMissing},
+		{"refresh token", testSecret, jwt.MapClaims{"type": "REFRESH_TOKEN"}, nil, ErrTokenType, TokenReasonTypeNotAccess},
+		{"role missing", testSecret, jwt.MapClaims{"role": nil}, nil, ErrRoleMissing, TokenReasonRoleMissing},
+		{"scope of another type", testSecret, jwt.MapClaims{"scope": 42}, nil, ErrScopeInvalid, TokenReasonScopeInvalid},
+		{"scope not a CIDR", testSecret, jwt.MapClaims{"scope": "not-a-network"}, nil, ErrScopeInvalid, TokenReasonScopeInvalid},
+		{"expiry missing", testSecret, jwt.MapClaims{"exp": nil}, nil, ErrExpiryMissing, TokenReasonExpiryMissing},
+		{
+			"lifetime too long", testSecret, jwt.MapClaims{"exp": time.Now().Add(2 * time.Hour).Unix()},
+			func(config *Config) { config.MaxTokenTTL = 60 * 60 },
+			ErrTokenTTLTooLong, TokenReasonTTLTooLong,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := useTestConfig(t)
+			if tt.configure != nil {
+				tt.configure(config)
+			}
+
+			_, err := ValidateToken(signTestToken(t, tt.secret, "alice", tt.overrides))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ValidateToken() error = %v, want %v", err, tt.wantErr)
+			}
+			var tokenErr *TokenError
+			if !errors.As(err, &tokenErr) {
+				t.Fatalf("ValidateToken() error %T is not a *TokenError", err)
+			}
+			if tokenErr.Reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", tokenErr.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestClaimsValidateDoubleChecksExpiry(t *testing.T) {
+	config := useTestConfig(t)
+	config.JWTLeeway = 60
+	claims := claimsFromMap(testClaims("alice", nil))
+
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-30 * time.Second))
+	if err := claims.Validate(config); err != nil {
+		t.Errorf("Validate() refused a token expired within JWT_LEEWAY: %v", err)
+	}
+
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-2 * time.Minute))
+	err := claims.Validate(config)
+	if !errors.Is(err, ErrTokenExpired) || tokenFailureReason(err, "") != TokenReasonExpiredDoubleCheck {
+		t.Errorf("Validate() error = %v, want %v with reason %s", err, ErrTokenExpired, TokenReasonExpiredDoubleCheck)
+	}
+
+	config.JWTExpiryDoubleCheck = false
+	if err := claims.Validate(config); err != nil {
+		t.Errorf("Validate() refused the token with JWT_EXPIRY_DOUBLE_CHECK=false: %v", err)
+	}
+}
+
+func TestTokenFailureReason(t *testing.T) {
+	if got := tokenFailureReason(errors.New("other"), "fallback"); got != "fallback" {
+		t.Errorf("tokenFailureReason(other error) = %q, want fallback", got)
+	}
+	err := &TokenError{Err: ErrTokenExpired, Reason: TokenReasonExpired, Cause: jwt.ErrTokenExpired}
+	if got := tokenFailureReason(err, "fallback"); got != TokenReasonExpired {
+		t.Errorf("tokenFailureReason(TokenError) = %q, want %s", got, TokenReasonExpired)
+	}
+	if !errors.Is(err, jwt.ErrTokenExpired) {
+		t.Error("TokenError does not unwrap to its cause")
+	}
+}
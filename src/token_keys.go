@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Token signing algorithms Saturn can verify
+const (
+	TokenAlgHS256 = "HS256"
+	TokenAlgRS256 = "RS256"
+	TokenAlgEdDSA = "EdDSA"
+)
+
+const (
+	jwksRefreshInterval = 10 * time.Minute
+	jwksFetchTimeout    = 10 * time.Second
+)
+
+// errNoRSAKey is returned when no RSA public key matches the token
+var errNoRSAKey = errors.New("no RSA public key for token")
+
+// RSAKeySet holds the RSA public keys used to verify RS256 tokens.
+// Keys come from a PEM file, a JWKS endpoint, or both.
+type RSAKeySet struct {
+	mu      sync.RWMutex
+	fileKey *rsa.PublicKey            // Key loaded from TOKEN_RSA_PUBLIC_KEY_FILE
+	jwks    map[string]*rsa.PublicKey // kid -> key fetched from TOKEN_JWKS_URL
+	jwksURL string
+	client  *http.Client
+}
+
+var (
+	// Global RSA key set, nil when RS256 is not enabled
+	RSAKeys *RSAKeySet
+	// Global Ed25519 public key, nil when EdDSA is not enabled
+	EdKey ed25519.PublicKey
+)
+
+// InitTokenKeys validates the configured token algorithms and loads the RSA keys
+// when RS256 is enabled and the Ed25519 key when EdDSA is enabled
+func InitTokenKeys(config *Config) {
+	algorithms := config.TokenAlgorithmList()
+	for _, alg := range algorithms {
+		switch alg {
+		case TokenAlgHS256:
+		case TokenAlgRS256:
+			keys, err := NewRSAKeySet(config.TokenRSAPublicKeyFile, config.TokenJWKSURL)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load RS256 verification keys")
+			}
+			RSAKeys = keys
+		case TokenAlgEdDSA:
+			key, err := LoadEd25519PublicKey(config.TokenEdPublicKeyFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to load EdDSA verification key")
+			}
+			EdKey = key
+		default:
+			log.Fatal().Str("alg", alg).Msg("Unsupported token algorithm in TOKEN_ALGORITHMS")
+		}
+	}
+
+	log.Info().Strs("algorithms", algorithms).Msg("Token verification algorithms configured")
+}
+
+// NewRSAKeySet loads the RSA public key file and fetches the JWKS, then keeps
+// refreshing the JWKS in the background so rotated keys are picked up
+func NewRSAKeySet(keyFile, jwksURL string) (*RSAKeySet, error) {
+	if keyFile == "" && jwksURL == "" {
+		return nil, errors.New("RS256 requires TOKEN_RSA_PUBLIC_KEY_FILE or TOKEN_JWKS_URL")
+	}
+
+	keys := &RSAKeySet{
+		jwksURL: jwksURL,
+		client:  &http.Client{Timeout: jwksFetchTimeout},
+	}
+
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RSA public key: %w", err)
+		}
+		keys.fileKey, err = jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RSA public key: %w", err)
+		}
+	}
+
+	if jwksURL != "" {
+		if err := keys.refresh(); err != nil {
+			return nil, err
+		}
+
+		go func() {
+			ticker := time.NewTicker(jwksRefreshInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if err := keys.refresh(); err != nil {
+					log.Error().Err(err).Str("url", jwksURL).Msg("Failed to refresh JWKS, keeping previous keys")
+				}
+			}
+		}()
+	}
+
+	return keys, nil
+}
+
+// LoadEd25519PublicKey reads the PEM encoded Ed25519 public key used to verify EdDSA tokens
+func LoadEd25519PublicKey(keyFile string) (ed25519.PublicKey, error) {
+	if keyFile == "" {
+		return nil, errors.New("EdDSA requires TOKEN_ED25519_PUBLIC_KEY_FILE")
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Ed25519 public key: %w", err)
+	}
+	key, err := jwt.ParseEdPublicKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Ed25519 public key: %w", err)
+	}
+	return key.(ed25519.PublicKey), nil
+}
+
+// jwk is a single JSON Web Key, only the RSA fields are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// refresh fetches the JWKS and replaces the known keys
+func (k *RSAKeySet) refresh() error {
+	resp, err := k.client.Get(k.jwksURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected JWKS response status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		publicKey, err := key.rsaPublicKey()
+		if err != nil {
+			log.Warn().Err(err).Str("kid", key.Kid).Msg("Skipping invalid JWKS key")
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+
+	k.mu.Lock()
+	k.jwks = keys
+	k.mu.Unlock()
+
+	log.Info().Int("keys", len(keys)).Str("url", k.jwksURL).Msg("JWKS loaded")
+	return nil
+}
+
+// rsaPublicKey decodes the modulus and exponent of the key
+func (j jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(j.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(j.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %w", err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// Keyfunc returns the RSA key for the token, matching the JWKS by kid.
+// Tokens without a kid use the key file, or the only JWKS key when there is exactly one.
+func (k *RSAKeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid, ok := token.Header["kid"].(string); ok && kid != "" {
+		if key, found := k.jwks[kid]; found {
+			return key, nil
+		}
+	}
+
+	if k.fileKey != nil {
+		return k.fileKey, nil
+	}
+	if len(k.jwks) == 1 {
+		for _, key := range k.jwks {
+			return key, nil
+		}
+	}
+	return nil, errNoRSAKey
+}
+
+// parseToken tries the configured verification strategies in order and returns the
+// token together with the algorithm and key that validated it.
+// A strategy whose signature does not match falls through to the next one, while a
+// token that verifies but fails other checks (e.g. expiry) is rejected right away.
+// Every strategy tried is timed separately, so the cost of each algorithm can be
+// told apart when several are configured.
+func parseToken(tokenString string) (*jwt.Token, string, string, error) {
+	var firstErr error
+	for _, alg := range Conf.TokenAlgorithmList() {
+		var (
+			token *jwt.Token
+			key   string
+			err   error
+		)
+
+		start := time.Now()
+		switch alg {
+		case TokenAlgHS256:
+			token, key, err = parseWithSecrets(tokenString)
+		case TokenAlgRS256:
+			if RSAKeys == nil {
+				continue
+			}
+			key = "rsa"
+			token, err = jwt.Parse(tokenString, RSAKeys.Keyfunc, parserOptions(TokenAlgRS256)...)
+		case TokenAlgEdDSA:
+			if EdKey == nil {
+				continue
+			}
+			key = "ed25519"
+			token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+				return EdKey, nil
+			}, parserOptions(jwt.SigningMethodEdDSA.Alg())...)
+		default:
+			continue
+		}
+
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		RecordTokenValidationDuration(alg, result, time.Since(start))
+
+		if err == nil {
+			return token, alg, key, nil
+		}
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) && !errors.Is(err, jwt.ErrTokenUnverifiable) {
+			return nil, "", "", err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = errors.New("no token verification algorithm configured")
+	}
+	return nil, "", "", firstErr
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestMintAccessTokenUsesIssuerOfMintedRealm(t *testing.T) {
+	config := useTestConfig(t)
+	config.ExpectedIssuer = "https://auth.example.com,staging=https://auth.staging.example.com"
+
+	tests := []struct {
+		realm      string
+		wantRealm  string
+		wantIssuer string
+	}{
+		{"", testRealm, "https://auth.example.com"},
+		{"staging", "staging", "https://auth.staging.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantRealm, func(t *testing.T) {
+			token, err := MintAccessToken(config, Claims{UserID: "alice", Role: "user", Realm: tt.realm}, time.Hour)
+			if err != nil {
+				t.Fatalf("MintAccessToken() error = %v", err)
+			}
+			claims := jwt.MapClaims{}
+			if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+				t.Fatalf("failed to parse the minted token: %v", err)
+			}
+			if claims["realm"] != tt.wantRealm || claims["iss"] != tt.wantIssuer {
+				t.Errorf("realm, iss = %v, %v, want %s, %s", claims["realm"], claims["iss"], tt.wantRealm, tt.wantIssuer)
+			}
+		})
+	}
+}
+
+// useTestRSAKey generates an RSA key RS256 tokens are verified with, restoring the
+// previous key set after the test
+func useTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	previous := RSAKeys
+	t.Cleanup(func() { RSAKeys = previous })
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	RSAKeys = &RSAKeySet{fileKey: &key.PublicKey}
+	return key
+}
+
+func TestParseTokenSelectsAlgorithmAndKey(t *testing.T) {
+	const (
+		previousSecret = "previous-secret-0123456789abcdefgh"
+		rotatedSecret  = "rotated-secret-0123456789abcdefghi"
+	)
+	rsaKey := useTestRSAKey(t)
+
+	sign := func(method jwt.SigningMethod, key interface{}) string {
+		token, err := jwt.NewWithClaims(method, testClaims("alice", nil)).SignedString(key)
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name       string
+		algorithms string
+		token      string
+		wantAlg    string
+		wantKey    string // Empty when the token must be refused
+	}{
+		{"HS256", TokenAlgHS256, sign(jwt.SigningMethodHS256, []byte(testSecret)), TokenAlgHS256, TokenKeyCurrent},
+		{"RS256", TokenAlgRS256, sign(jwt.SigningMethodRS256, rsaKey), TokenAlgRS256, "rsa"},
+		{"RS256 after HS256", "HS256,RS256", sign(jwt.SigningMethodRS256, rsaKey), TokenAlgRS256, "rsa"},
+		{"HS256 after RS256", "RS256,HS256", sign(jwt.SigningMethodHS256, []byte(testSecret)), TokenAlgHS256, TokenKeyCurrent},
+		{"previous secret", TokenAlgHS256, sign(jwt.SigningMethodHS256, []byte(previousSecret)), TokenAlgHS256, TokenKeyPrevious},
+		{"rotated secret", TokenAlgHS256, sign(jwt.SigningMethodHS256, []byte(rotatedSecret)), TokenAlgHS256, "0"},
+		{"unknown secret", TokenAlgHS256, sign(jwt.SigningMethodHS256, []byte("unknown-secret-0123456789abcdefgh")), "", ""},
+		{"RS256 token with HS256 configured", TokenAlgHS256, sign(jwt.SigningMethodRS256, rsaKey), "", ""},
+		{"HS256 token with RS256 configured", TokenAlgRS256, sign(jwt.SigningMethodHS256, []byte(testSecret)), "", ""},
+		{"HS384 token", TokenAlgHS256, sign(jwt.SigningMethodHS384, []byte(testSecret)), "", ""},
+		{"unsigned token", TokenAlgHS256, sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType), "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := useTestConfig(t)
+			config.TokenAlgorithms = tt.algorithms
+			config.AccessSecretPrevious = previousSecret
+			config.AccessSecrets = `["` + rotatedSecret + `"]`
+
+			_, alg, key, err := parseToken(tt.token)
+			if tt.wantKey == "" {
+				if err == nil {
+					t.Fatalf("parseToken() accepted the token with %s and key %s", alg, key)
+				}
+				if _, err := ValidateToken(tt.token); err == nil {
+					t.Error("ValidateToken() accepted the token")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseToken() error = %v", err)
+			}
+			if alg != tt.wantAlg || key != tt.wantKey {
+				t.Errorf("parseToken() alg, key = %s, %s, want %s, %s", alg, key, tt.wantAlg, tt.wantKey)
+			}
+			if _, err := ValidateToken(tt.token); err != nil {
+				t.Errorf("ValidateToken() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestRolesClaim(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles interface{}
+		want  []string
+	}{
+		{"absent", nil, nil},
+		{"string", "admin", []string{"admin"}},
+		{"padded string", "  admin ", []string{"admin"}},
+		{"empty string", " ", nil},
+		{"list", []interface{}{"admin", "user"}, []string{"admin", "user"}},
+		{"mixed list", []interface{}{"admin", 42, true, "user"}, []string{"admin", "user"}},
+		{"number", 42, nil},
+		{"object", map[string]interface{}{"role": "admin"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{}
+			if tt.roles != nil {
+				claims["roles"] = tt.roles
+			}
+			if got := rolesClaim(claims); !slices.Equal(got, tt.want) {
+				t.Errorf("rolesClaim() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTokenReadsSingleRoleString(t *testing.T) {
+	config := useTestConfig(t)
+	config.RequiredRole = "admin"
+
+	claims, err := ValidateToken(signTestToken(t, testSecret, "alice", jwt.MapClaims{"roles": "admin"}))
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	if !claims.HasRole("admin") {
+		t.Errorf("roles = %q, want the single role admin", claims.Roles)
+	}
+}
+
+func BenchmarkValidateToken(b *testing.B) {
+	useTestConfig(b)
+	tokens := map[string]string{
+		"valid":   signTestToken(b, testSecret, "alice", nil),
+		"expired": signTestToken(b, testSecret, "alice", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"invalid": signTestToken(b, "another-"+testSecret, "alice", nil),
+	}
+	for name, token := range tokens {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				_, _ = ValidateToken(token)
+			}
+		})
+	}
+}
@@ -1,40 +1,312 @@
 package main
 
 import (
+	"errors"
+	"io"
 	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Bytes received from and sent to clients since the server started
+	ingressBytesTotal atomic.Int64
+	egressBytesTotal  atomic.Int64
 )
 
+// TrafficBytes returns the bytes received from and sent to clients since the server started
+func TrafficBytes() (ingress, egress int64) {
+	return ingressBytesTotal.Load(), egressBytesTotal.Load()
+}
+
 // MetricsPacketConn wraps a net.PacketConn to track traffic metrics
 type MetricsPacketConn struct {
 	net.PacketConn
-	realm string
+	realm         string
+	serverID      string                      // Index of the listener, labels traffic to show REUSEPORT imbalance
+	port          string                      // Port the listener is bound on, labels traffic to compare ports
+	transport     string                      // Transport clients reach the listener over, TransportUDP, TransportDTLS or TransportWebSocket
+	packets       prometheus.Counter          // Packets the kernel handed to this listener, nil when metrics are disabled
+	overflows     prometheus.Counter          // Packets the kernel dropped with the receive buffer full, nil when not metered
+	oob           []byte                      // Control messages of the last packet read, carrying the SO_RXQ_OVFL counter
+	dropped       uint32                      // SO_RXQ_OVFL counter of the socket when it was last read
+	maxPacketSize int                         // Packets larger than this are dropped, 0 disables the guard
+	lastSource    atomic.Value                // sourceAddr of the most recently read packet
+	lastRequest   atomic.Pointer[stunRequest] // Most recently read STUN request, its response is measured against it
+	quotaDenied   atomic.Pointer[stunRequest] // ALLOCATE request refused by the allocation quota, answered with a 486
+	handoff       *HandoffRouter              // Routes packets to the listener or process holding their allocation, nil disables
+	routed        chan routedPacket           // Packets routed to this listener by the handoff
+}
+
+// sourceAddr keeps the concrete type stored in MetricsPacketConn.lastSource consistent
+type sourceAddr struct {
+	addr net.Addr
 }
 
-// NewMetricsPacketConn creates a new MetricsPacketConn wrapper
-func NewMetricsPacketConn(conn net.PacketConn, realm string) *MetricsPacketConn {
-	return &MetricsPacketConn{
-		PacketConn: conn,
-		realm:      realm,
+// NewMetricsPacketConn creates a new MetricsPacketConn wrapper for the listener serverID bound on port
+func NewMetricsPacketConn(conn net.PacketConn, realm string, serverID, port int, transport string, maxPacketSize int) *MetricsPacketConn {
+	m := &MetricsPacketConn{
+		PacketConn:    conn,
+		realm:         realm,
+		serverID:      strconv.Itoa(serverID),
+		port:          strconv.Itoa(port),
+		transport:     transport,
+		packets:       ListenerPacketCounter(strconv.Itoa(serverID), strconv.Itoa(port), transport),
+		maxPacketSize: maxPacketSize,
 	}
+	// Overflows are reported by the kernel with the packets read from UDP sockets,
+	// DTLS sessions are read from the socket by the DTLS library
+	if _, ok := conn.(*net.UDPConn); ok && transport == TransportUDP && rxOverflowOOBSize > 0 {
+		m.overflows = RxOverflowCounter(m.serverID, m.port)
+		m.oob = make([]byte, rxOverflowOOBSize)
+	}
+	return m
 }
 
-// ReadFrom reads a packet from the connection and records ingress traffic
+// ReadFrom reads a packet from the connection and records ingress traffic.
+// Packets larger than the maximum packet size, packets from sources exceeding
+// the source packet rate limit and STUN requests suspected of amplification abuse
+// are dropped before they reach pion. In STUN-only mode authenticated TURN requests
+// are answered with a 403, and requests with a stale nonce with a 438.
+// The caller's buffer must be larger than the maximum packet size for oversized
+// packets to be detected, see inboundMTU.
+// With a restart handoff, packets of allocations held elsewhere are passed on and
+// packets routed here by the handoff are returned, skipping the guards they passed.
 func (m *MetricsPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, addr, err = m.PacketConn.ReadFrom(p)
-	if err == nil && n > 0 {
-		// Record ingress traffic (incoming data)
-		RecordIngressTraffic(m.realm, int64(n))
+	for {
+		var routed bool
+		n, addr, routed, err = m.read(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		// Counted before any guard drops it, this is the kernel's REUSEPORT distribution
+		if m.packets != nil && !routed {
+			m.packets.Inc()
+		}
+
+		if m.maxPacketSize > 0 && n > m.maxPacketSize && !routed {
+			RecordOversizedPacketDropped(m.realm)
+			continue
+		}
+
+		if SourceLimiter != nil && !routed {
+			if allowed, exceeded := SourceLimiter.Allow(addr); !allowed {
+				RecordSourceRateDrop(m.realm)
+				if exceeded {
+					log.Warn().
+						Str("realm", m.realm).
+						Str("source_ip", sourceIP(addr)).
+						Str("client_key", clientKey(addr)).
+						Int("source_pps_limit", SourceLimiter.limit).
+						Msg("Source exceeded the packet rate limit, dropping packets")
+					NotifyWebhook(WebhookEvent{
+						Type:     WebhookEventRateLimited,
+						SourceIP: sourceIP(addr),
+						Realm:    m.realm,
+						Reason:   "source_pps_limit",
+					})
+				}
+				continue
+			}
+		}
+
+		if Amplification != nil && !routed {
+			if reason := Amplification.Inspect(p[:n], addr, m.realm); reason != "" {
+				RecordAmplificationSuspected(m.realm, reason)
+				log.Debug().
+					Str("realm", m.realm).
+					Str("source_addr", addr.String()).
+					Str("reason", reason).
+					Msg("STUN request suspected of amplification abuse, dropping it")
+				continue
+			}
+		}
+
+		// In STUN-only mode authenticated TURN requests never reach pion, which would
+		// answer them with a 400
+		if !routed {
+			if response, forbidden := forbiddenResponse(p[:n]); forbidden {
+				denyAuthentication(m.realm, addr, "", "stun_only_mode")
+				log.Debug().
+					Str("realm", m.realm).
+					Str("source_addr", addr.String()).
+					Msg("TURN request in STUN-only mode, answering it with a 403")
+				if _, err := m.WriteTo(response, addr); err != nil {
+					log.Debug().Err(err).Str("source_addr", addr.String()).Msg("Failed to write the 403 response")
+				}
+				continue
+			}
+		}
+
+		// Answered before a handoff, so both processes refuse the nonce alike
+		if !routed {
+			if response, stale := staleNonceResponse(p[:n], m.realm); stale {
+				RecordStaleNonce(m.realm)
+				log.Debug().
+					Str("realm", m.realm).
+					Str("source_addr", addr.String()).
+					Msg("Request carries a nonce older than NONCE_LIFETIME, answering it with a 438")
+				if _, err := m.WriteTo(response, addr); err != nil {
+					log.Debug().Err(err).Str("source_addr", addr.String()).Msg("Failed to write the 438 response")
+				}
+				continue
+			}
+		}
+
+		if m.handoff != nil && !routed && m.handoff.route(m, p[:n], addr) {
+			continue
+		}
+
+		if clamped, ok := clampAllocationLifetime(p[:n], addr); ok && len(clamped) <= len(p) {
+			n = copy(p, clamped)
+		}
+
+		m.lastSource.Store(sourceAddr{addr: addr})
+		m.lastRequest.Store(newSTUNRequest(p[:n]))
+		if n > 0 {
+			// Record ingress traffic (incoming data)
+			RecordIngressTraffic(m.realm, m.serverID, m.port, m.transport, int64(n))
+			RecordPacketSize("ingress", n)
+		}
+		return n, addr, err
+	}
+}
+
+// read returns the next packet routed to this listener by the handoff, or else
+// the next packet from the socket
+func (m *MetricsPacketConn) read(p []byte) (n int, addr net.Addr, routed bool, err error) {
+	if m.handoff == nil {
+		n, addr, err = m.readSocket(p)
+		return n, addr, false, err
+	}
+
+	for {
+		select {
+		case packet := <-m.routed:
+			return copy(p, packet.data), packet.addr, true, nil
+		default:
+		}
+
+		n, addr, err = m.readSocket(p)
+		// route interrupts a blocked read with an expired deadline to hand over a packet
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			_ = m.PacketConn.SetReadDeadline(time.Time{})
+			continue
+		}
+		return n, addr, false, err
+	}
+}
+
+// readSocket reads the next packet from the socket and records the packets the kernel
+// dropped since the last read because the receive buffer was full
+func (m *MetricsPacketConn) readSocket(p []byte) (int, net.Addr, error) {
+	if m.overflows == nil {
+		return m.PacketConn.ReadFrom(p)
+	}
+
+	n, oobn, _, addr, err := m.PacketConn.(*net.UDPConn).ReadMsgUDP(p, m.oob)
+	if err != nil {
+		return n, nil, err
+	}
+	// The counter is cumulative, wrapping around like the kernel's
+	if dropped, ok := rxQueueOverflow(m.oob[:oobn]); ok && dropped != m.dropped {
+		m.overflows.Add(float64(dropped - m.dropped))
+		m.dropped = dropped
+	}
+	return n, addr, nil
+}
+
+// route queues a packet of an allocation held by this listener and wakes up its reader
+func (m *MetricsPacketConn) route(data []byte, addr net.Addr) {
+	select {
+	case m.routed <- routedPacket{data: data, addr: addr}:
+		_ = m.PacketConn.SetReadDeadline(time.Unix(1, 0))
+	default:
+		RecordHandoffPacket(HandoffDropped)
 	}
-	return n, addr, err
 }
 
-// WriteTo writes a packet to the connection and records egress traffic
+// LastSource returns the source address of the most recently read packet.
+// pion handles the packets of a listener one at a time, so while a request is
+// being handled this is the address of the client that sent it.
+func (m *MetricsPacketConn) LastSource() net.Addr {
+	if source, ok := m.lastSource.Load().(sourceAddr); ok {
+		return source.addr
+	}
+	return nil
+}
+
+// markQuotaDenied records that the request being handled, the most recently read one,
+// was refused by the allocation quota, so its error response is replaced with a 486
+func (m *MetricsPacketConn) markQuotaDenied() {
+	m.quotaDenied.Store(m.lastRequest.Load())
+}
+
+// WriteTo writes a packet to the connection and records egress traffic.
+// Only the bytes actually written are recorded, and a short write without an
+// error from the underlying connection is reported as io.ErrShortWrite.
+// STUN responses too large for the request they answer are dropped, while pion is
+// told they were sent, and ALLOCATE requests refused by the allocation quota are
+// answered with a 486 (Allocation Quota Reached) instead of pion's 508. Lifetimes
+// granted above MAX_ALLOCATION_LIFETIME are clamped, see clampGrantedLifetime.
 func (m *MetricsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if Amplification != nil && Amplification.Oversized(p, m.lastRequest.Load()) {
+		RecordAmplificationSuspected(m.realm, AmplificationResponseRatio)
+		log.Debug().
+			Str("realm", m.realm).
+			Str("client_addr", addr.String()).
+			Int("response_bytes", len(p)).
+			Msg("STUN response too large for its request, dropping it")
+		return len(p), nil
+	}
+
+	if denied := m.quotaDenied.Load(); denied != nil {
+		if replacement, ok := quotaErrorResponse(p, denied); ok {
+			m.quotaDenied.CompareAndSwap(denied, nil)
+			if _, err := m.WriteTo(replacement, addr); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		}
+	}
+
+	if clamped, ok := clampGrantedLifetime(p, addr); ok {
+		if _, err := m.WriteTo(clamped, addr); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	noteIssuedNonce(p)
+
+	if lifetime, ok := grantedRefresh(p); ok {
+		refreshType := AllocationRefreshed
+		if lifetime == 0 {
+			refreshType = AllocationDeleted
+		}
+		RecordAllocationRefresh(m.realm, refreshType)
+		log.Debug().
+			Str("realm", m.realm).
+			Str("client_addr", addr.String()).
+			Str("type", refreshType).
+			Dur("lifetime", lifetime).
+			Msg("Allocation refreshed")
+	}
+
 	n, err = m.PacketConn.WriteTo(p, addr)
-	if err == nil && n > 0 {
+	if n > 0 {
 		// Record egress traffic (outgoing data)
-		RecordEgressTraffic(m.realm, int64(n))
+		RecordEgressTraffic(m.realm, m.serverID, m.port, m.transport, int64(n))
+		RecordPacketSize("egress", n)
+	}
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
 	}
 	return n, err
 }
@@ -63,3 +335,13 @@ func (m *MetricsPacketConn) SetReadDeadline(t time.Time) error {
 func (m *MetricsPacketConn) SetWriteDeadline(t time.Time) error {
 	return m.PacketConn.SetWriteDeadline(t)
 }
+
+// inboundMTU returns the read buffer size pion should use for a maximum packet size.
+// The buffer is one byte larger than the maximum so that an oversized packet is
+// always noticed, while every packet up to the maximum is read in full.
+func inboundMTU(maxPacketSize int) int {
+	if maxPacketSize <= 0 {
+		return 0 // pion default
+	}
+	return maxPacketSize + 1
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// TrafficTotals holds the lifetime traffic counters for a single realm
+type TrafficTotals struct {
+	IngressBytes   int64 `json:"ingress_bytes"`
+	EgressBytes    int64 `json:"egress_bytes"`
+	IngressPackets int64 `json:"ingress_packets"`
+	EgressPackets  int64 `json:"egress_packets"`
+}
+
+// TrafficState accumulates lifetime traffic totals and persists them to disk
+// so the traffic counters survive restarts and deploys
+type TrafficState struct {
+	mu     sync.Mutex
+	path   string
+	realms map[string]*TrafficTotals
+}
+
+var (
+	// Global traffic state instance, nil when persistence is disabled
+	Traffic *TrafficState
+)
+
+// LoadTrafficState reads the traffic state from path.
+// A missing file is not an error and yields an empty state.
+func LoadTrafficState(path string) (*TrafficState, error) {
+	state := &TrafficState{
+		path:   path,
+		realms: make(map[string]*TrafficTotals),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, errors.Wrap(err, "failed to read traffic state")
+	}
+
+	if err := json.Unmarshal(data, &state.realms); err != nil {
+		return nil, errors.Wrap(err, "failed to decode traffic state")
+	}
+
+	return state, nil
+}
+
+// AddIngress adds incoming traffic to the realm totals
+func (s *TrafficState) AddIngress(realm string, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totals := s.totals(realm)
+	totals.IngressBytes += bytes
+	totals.IngressPackets++
+}
+
+// AddEgress adds outgoing traffic to the realm totals
+func (s *TrafficState) AddEgress(realm string, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totals := s.totals(realm)
+	totals.EgressBytes += bytes
+	totals.EgressPackets++
+}
+
+// totals returns the totals for the realm, creating them if needed. Callers must hold s.mu.
+func (s *TrafficState) totals(realm string) *TrafficTotals {
+	totals, ok := s.realms[realm]
+	if !ok {
+		totals = &TrafficTotals{}
+		s.realms[realm] = totals
+	}
+	return totals
+}
+
+// Snapshot returns a copy of the current totals per realm
+func (s *TrafficState) Snapshot() map[string]TrafficTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make(map[string]TrafficTotals, len(s.realms))
+	for realm, totals := range s.realms {
+		snapshot[realm] = *totals
+	}
+	return snapshot
+}
+
+// Flush writes the current totals to disk.
+// The state is written to a temporary file first and renamed into place so a crash
+// in the middle of a flush never leaves a truncated state file behind.
+func (s *TrafficState) Flush() error {
+	s.mu.Lock()
+	data, err := json.Marshal(s.realms)
+	s.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to encode traffic state")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary traffic state file")
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "failed to write traffic state")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to close traffic state")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), s.path), "failed to replace traffic state")
+}
+
+// StartTrafficStatePersistence restores the persisted traffic totals, pre-seeds the
+// traffic counters with them and flushes the totals to disk every interval.
+// The returned stop function performs a final flush and must be called after the
+// listeners are closed so no traffic is recorded after the last write.
+func StartTrafficStatePersistence(config *Config) (stop func()) {
+	state, err := LoadTrafficState(config.TrafficStatePath)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", config.TrafficStatePath).Msg("Failed to load traffic state")
+	}
+
+	// Pre-seed the counters so they continue from the lifetime totals
+	for realm, totals := range state.Snapshot() {
+		SeedTrafficMetrics(realm, totals)
+		log.Info().
+			Str("realm", realm).
+			Int64("ingress_bytes", totals.IngressBytes).
+			Int64("egress_bytes", totals.EgressBytes).
+			Msg("Restored lifetime traffic totals")
+	}
+	Traffic = state
+
+	interval := time.Duration(config.TrafficStateFlushInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := state.Flush(); err != nil {
+					log.Error().Err(err).Str("path", config.TrafficStatePath).Msg("Failed to persist traffic state")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	log.Info().
+		Str("path", config.TrafficStatePath).
+		Dur("flush_interval", interval).
+		Msg("Traffic state persistence enabled")
+
+	return func() {
+		// Wait for an in-flight periodic flush before writing the final state
+		close(done)
+		<-finished
+
+		if err := state.Flush(); err != nil {
+			log.Error().Err(err).Str("path", config.TrafficStatePath).Msg("Failed to persist traffic state on shutdown")
+			return
+		}
+		log.Info().Str("path", config.TrafficStatePath).Msg("Traffic state persisted")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+// testPayloadSize is the payload of the benchmarked packets, a typical media packet
+const testPayloadSize = 1200
+
+// fakePacketConn is an in-memory net.PacketConn. Every read returns packet from addr
+// and every write succeeds, so the wrappers are measured rather than the kernel.
+// Writes are cut to writeLimit bytes and fail with writeErr when they are set, and
+// kept in written when record is set.
+type fakePacketConn struct {
+	packet     []byte
+	addr       net.Addr
+	writeLimit int
+	writeErr   error
+	record     bool
+	written    []byte // Last packet written
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	return copy(p, c.packet), c.addr, nil
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	if c.record {
+		c.written = append(c.written[:0], p...)
+	}
+	if c.writeLimit > 0 && c.writeLimit < len(p) {
+		return c.writeLimit, c.writeErr
+	}
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	return len(p), nil
+}
+
+func (c *fakePacketConn) Close() error                     { return nil }
+func (c *fakePacketConn) LocalAddr() net.Addr              { return c.addr }
+func (c *fakePacketConn) SetDeadline(time.Time) error      { return nil }
+func (c *fakePacketConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fakePacketConn) SetWriteDeadline(time.Time) error { return nil }
+
+// channelDataPacket returns a ChannelData packet of the first channel number
+func channelDataPacket(payloadSize int) []byte {
+	packet := make([]byte, 4+payloadSize)
+	binary.BigEndian.PutUint16(packet[0:2], 0x4000)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(payloadSize)) //nolint:gosec
+	return packet
+}
+
+func TestMetricsPacketConnRecordsIngressBytes(t *testing.T) {
+	packet := channelDataPacket(100)
+	conn := NewMetricsPacketConn(&fakePacketConn{packet: packet, addr: testAddr(t, "192.0.2.1:40000")}, testRealm, 0, 3478, TransportUDP, 0)
+
+	ingressBefore, egressBefore := TrafficBytes()
+	n, addr, err := conn.ReadFrom(make([]byte, 1500))
+	if err != nil || n != len(packet) || addr.String() != "192.0.2.1:40000" {
+		t.Fatalf("ReadFrom() = %d, %v, %v, want %d bytes from 192.0.2.1:40000", n, addr, err, len(packet))
+	}
+
+	ingress, egress := TrafficBytes()
+	if got := ingress - ingressBefore; got != int64(len(packet)) {
+		t.Errorf("ingress grew by %d bytes, want %d", got, len(packet))
+	}
+	if got := egress - egressBefore; got != 0 {
+		t.Errorf("egress grew by %d bytes on a read, want 0", got)
+	}
+}
+
+func TestMetricsPacketConnRecordsEgressBytesWritten(t *testing.T) {
+	errWrite := errors.New("write failed")
+	packet := channelDataPacket(100)
+
+	tests := []struct {
+		name     string
+		conn     *fakePacketConn
+		wantN    int
+		wantErr  error
+		wantSent int64
+	}{
+		{"full write", &fakePacketConn{}, len(packet), nil, int64(len(packet))},
+		{"short write", &fakePacketConn{writeLimit: 40}, 40, io.ErrShortWrite, 40},
+		{"partial write with error", &fakePacketConn{writeLimit: 40, writeErr: errWrite}, 40, errWrite, 40},
+		{"failed write", &fakePacketConn{writeErr: errWrite}, 0, errWrite, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewMetricsPacketConn(tt.conn, testRealm, 0, 3478, TransportUDP, 0)
+
+			ingressBefore, egressBefore := TrafficBytes()
+			n, err := conn.WriteTo(packet, testAddr(t, "192.0.2.1:40000"))
+			if n != tt.wantN || !errors.Is(err, tt.wantErr) {
+				t.Errorf("WriteTo() = %d, %v, want %d, %v", n, err, tt.wantN, tt.wantErr)
+			}
+
+			ingress, egress := TrafficBytes()
+			if got := egress - egressBefore; got != tt.wantSent {
+				t.Errorf("egress grew by %d bytes, want %d", got, tt.wantSent)
+			}
+			if got := ingress - ingressBefore; got != 0 {
+				t.Errorf("ingress grew by %d bytes on a write, want 0", got)
+			}
+		})
+	}
+}
+
+// BenchmarkMetricsPacketConnReadFrom reads ChannelData packets from a listener, with
+// and without the MetricsPacketConn wrapper
+func BenchmarkMetricsPacketConnReadFrom(b *testing.B) {
+	packet := channelDataPacket(testPayloadSize)
+	conn := &fakePacketConn{packet: packet, addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}}
+
+	benchmarks := []struct {
+		name     string
+		listener func(b *testing.B) net.PacketConn
+	}{
+		{"unwrapped", func(*testing.B) net.PacketConn { return conn }},
+		{"metrics_disabled", func(*testing.B) net.PacketConn {
+			return NewMetricsPacketConn(conn, testRealm, 0, 3478, TransportUDP, 0)
+		}},
+		{"metrics_enabled", func(b *testing.B) net.PacketConn {
+			useTestMetrics(b)
+			return NewMetricsPacketConn(conn, testRealm, 0, 3478, TransportUDP, 0)
+		}},
+	}
+	for _, bb := range benchmarks {
+		b.Run(bb.name, func(b *testing.B) {
+			listener := bb.listener(b)
+			buf := make([]byte, inboundMTU(0))
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				_, _, _ = listener.ReadFrom(buf)
+			}
+		})
+	}
+}
+
+// errorCode returns the error code of a STUN error response
+func errorCode(t *testing.T, packet []byte) stun.ErrorCode {
+	t.Helper()
+	message := &stun.Message{Raw: append([]byte(nil), packet...)}
+	var code stun.ErrorCodeAttribute
+	if err := message.Decode(); err != nil || code.GetFrom(message) != nil {
+		t.Fatalf("%x is not a STUN error response", packet)
+	}
+	return code.Code
+}
+
+func TestMetricsPacketConnAnswersQuotaDenialWith486(t *testing.T) {
+	request := buildTestMessage(t, stun.NewType(stun.MethodAllocate, stun.ClassRequest))
+	source := testAddr(t, "192.0.2.1:40000")
+	fake := &fakePacketConn{packet: request, addr: source, record: true}
+	conn := NewMetricsPacketConn(fake, testRealm, 0, 3478, TransportUDP, 0)
+	if _, _, err := conn.ReadFrom(make([]byte, 1500)); err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+
+	// pion's answer to an error of the relay generator
+	insufficientCapacity := func(transactionID [stun.TransactionIDSize]byte) []byte {
+		response, err := stun.Build(&stun.Message{TransactionID: transactionID}, allocateErrorResponse, stun.CodeInsufficientCapacity)
+		if err != nil {
+			t.Fatalf("failed to build the 508 response: %v", err)
+		}
+		return response.Raw
+	}
+	var transactionID [stun.TransactionIDSize]byte
+	copy(transactionID[:], request[stunTransactionIDOffset:])
+
+	if _, err := conn.WriteTo(insufficientCapacity(transactionID), source); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if code := errorCode(t, fake.written); code != stun.CodeInsufficientCapacity {
+		t.Errorf("508 of a request the quota did not refuse was answered with %d", code)
+	}
+
+	conn.markQuotaDenied()
+	if _, err := conn.WriteTo(insufficientCapacity(stun.NewTransactionID()), source); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if code := errorCode(t, fake.written); code != stun.CodeInsufficientCapacity {
+		t.Errorf("508 of another request was answered with %d", code)
+	}
+	if _, err := conn.WriteTo(insufficientCapacity(transactionID), source); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if code := errorCode(t, fake.written); code != stun.CodeAllocQuotaReached {
+		t.Errorf("508 of the refused request was answered with %d, want 486", code)
+	}
+	if _, err := conn.WriteTo(insufficientCapacity(transactionID), source); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if code := errorCode(t, fake.written); code != stun.CodeInsufficientCapacity {
+		t.Errorf("508 written after the 486 was answered with %d", code)
+	}
+}
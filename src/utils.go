@@ -1,5 +1,17 @@
 package main
 
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// clientIPv6PrefixBits is the IPv6 prefix a single client is assumed to control.
+// Hosts commonly get a whole /64, so limits keyed by the full address would let
+// one client rotate through billions of addresses.
+const clientIPv6PrefixBits = 64
+
 // safeTokenPreview creates a safe preview of the token for logging purposes
 func safeTokenPreview(token string) string {
 	if len(token) == 0 {
@@ -10,3 +22,195 @@ func safeTokenPreview(token string) string {
 	}
 	return token[:8] + "..." + token[len(token)-8:]
 }
+
+// parseCIDRList parses a comma-separated list of CIDRs.
+// Bare IP addresses are accepted and treated as single-host networks.
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parseIssuerList parses EXPECTED_ISSUER into the issuer for every realm and
+// per-realm issuers. A bare entry applies to realms without their own
+// realm=issuer entry.
+func parseIssuerList(list string) (string, map[string]string, error) {
+	var fallback string
+	perRealm := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		realm, issuer, found := strings.Cut(entry, "=")
+		if !found {
+			if fallback != "" {
+				return "", nil, fmt.Errorf("more than one issuer without a realm in %q", list)
+			}
+			fallback = entry
+			continue
+		}
+
+		realm, issuer = strings.TrimSpace(realm), strings.TrimSpace(issuer)
+		if realm == "" || issuer == "" {
+			return "", nil, fmt.Errorf("invalid realm=issuer entry %q", entry)
+		}
+		if _, exists := perRealm[realm]; exists {
+			return "", nil, fmt.Errorf("duplicate issuer for realm %q", realm)
+		}
+		perRealm[realm] = issuer
+	}
+	return fallback, perRealm, nil
+}
+
+// parseRealmIPs parses comma-separated realm=IP pairs, such as RELAY_PUBLIC_IPS
+func parseRealmIPs(list string) (map[string]net.IP, error) {
+	ips := make(map[string]net.IP)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		realm, address, found := strings.Cut(entry, "=")
+		realm, address = strings.TrimSpace(realm), strings.TrimSpace(address)
+		if !found || realm == "" || address == "" {
+			return nil, fmt.Errorf("invalid realm=IP entry %q", entry)
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not a valid IP address for realm %q", address, realm)
+		}
+		if ip.IsUnspecified() {
+			return nil, fmt.Errorf("%q for realm %q cannot be reached by clients", address, realm)
+		}
+		if _, exists := ips[realm]; exists {
+			return nil, fmt.Errorf("duplicate IP for realm %q", realm)
+		}
+		ips[realm] = ip
+	}
+	return ips, nil
+}
+
+// containsIP reports whether ip belongs to any of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientKey returns the key per-source features such as rate limits count a client
+// under: the IPv4 address, or the /64 prefix of an IPv6 address. IPv4-mapped IPv6
+// addresses are keyed as IPv4. Addresses without an IP are keyed by their string.
+func clientKey(addr net.Addr) string {
+	ip, ok := sourceAddrIP(addr)
+	if !ok {
+		return addr.String()
+	}
+	return clientPrefixKey(ip)
+}
+
+// clientKeyForHost returns the clientKey of a host given as an IP, "host:port" or
+// "[IPv6]:port", e.g. a source IP reported in a webhook event
+func clientKeyForHost(host string) string {
+	ip, ok := parseHostIP(host)
+	if !ok {
+		return host
+	}
+	return clientPrefixKey(ip)
+}
+
+// clientPrefixKey formats the clientPrefix of an IP, IPv4 addresses without a prefix length
+func clientPrefixKey(ip netip.Addr) string {
+	prefix := clientPrefix(ip)
+	if prefix.Addr().Is4() {
+		return prefix.Addr().String()
+	}
+	return prefix.String()
+}
+
+// clientPrefix returns the network a client is counted under: the single address
+// for IPv4 and the /64 for IPv6
+func clientPrefix(ip netip.Addr) netip.Prefix {
+	ip = ip.Unmap().WithZone("")
+	if ip.Is4() {
+		return netip.PrefixFrom(ip, 32)
+	}
+	prefix, _ := ip.Prefix(clientIPv6PrefixBits)
+	return prefix
+}
+
+// sourceAddrIP returns the IP of a network address, with IPv4-mapped IPv6
+// addresses unmapped
+func sourceAddrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		return parseHostIP(addr.String())
+	}
+
+	parsed, ok := netip.AddrFromSlice(ip)
+	return parsed.Unmap(), ok
+}
+
+// parseHostIP parses the IP of an address given as an IP, "host:port" or
+// "[IPv6]:port", with IPv4-mapped IPv6 addresses unmapped
+func parseHostIP(address string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	ip, err := netip.ParseAddr(strings.Trim(address, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+// sourceIP returns the IP part of a network address
+func sourceIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// webSocketTestAddr returns the address of a WebSocket session, resolved from the
+// remote address of its upgrade request like the WebSocket listener does
+func webSocketTestAddr(t *testing.T, remoteAddr string) net.Addr {
+	t.Helper()
+	addr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	if err != nil {
+		t.Fatalf("failed to resolve %s: %v", remoteAddr, err)
+	}
+	return addr
+}
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		want string
+	}{
+		{"UDP IPv4", testAddr(t, "192.0.2.1:40000"), "192.0.2.1"},
+		{"UDP IPv4 other port", testAddr(t, "192.0.2.1:50000"), "192.0.2.1"},
+		{"UDP IPv4 other address", testAddr(t, "192.0.2.2:40000"), "192.0.2.2"},
+		{"UDP IPv6", testAddr(t, "[2001:db8:1:2::1]:40000"), "2001:db8:1:2::/64"},
+		{"UDP IPv6 same /64", testAddr(t, "[2001:db8:1:2:ffff:ffff:ffff:ffff]:50000"), "2001:db8:1:2::/64"},
+		{"UDP IPv6 other /64", testAddr(t, "[2001:db8:1:3::1]:40000"), "2001:db8:1:3::/64"},
+		{"UDP IPv6 with zone", &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 40000, Zone: "eth0"}, "fe80::/64"},
+		{"UDP IPv4-mapped IPv6", &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 40000}, "192.0.2.1"},
+		{"UDP IPv4 in 16 bytes", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To16(), Port: 40000}, "192.0.2.1"},
+		{"TCP IPv4", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}, "192.0.2.1"},
+		{"TCP IPv6", &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2::1"), Port: 443}, "2001:db8:1:2::/64"},
+		{"TCP IPv4-mapped IPv6", &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 443}, "192.0.2.1"},
+		{"WebSocket IPv4", webSocketTestAddr(t, "192.0.2.1:40000"), "192.0.2.1"},
+		{"WebSocket IPv6", webSocketTestAddr(t, "[2001:db8:1:2::1]:40000"), "2001:db8:1:2::/64"},
+		{"WebSocket IPv4-mapped IPv6", webSocketTestAddr(t, "[::ffff:192.0.2.1]:40000"), "192.0.2.1"},
+		{"other IPv6 address type", &net.IPAddr{IP: net.ParseIP("2001:db8:1:2::1")}, "2001:db8:1:2::/64"},
+		{"address without an IP", &net.UnixAddr{Name: "/run/saturn.sock", Net: "unix"}, "/run/saturn.sock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientKey(tt.addr); got != tt.want {
+				t.Errorf("clientKey(%s) = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientKeyForHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:40000", "192.0.2.1"},
+		{"2001:db8:1:2::1", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:2::1]", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:2:ffff::1]:40000", "2001:db8:1:2::/64"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:40000", "192.0.2.1"},
+		{"not-an-ip", "not-an-ip"},
+	}
+	for _, tt := range tests {
+		if got := clientKeyForHost(tt.host); got != tt.want {
+			t.Errorf("clientKeyForHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+		// Webhook events report the same key as the rate limiter counted the client under
+		if addr, err := net.ResolveUDPAddr("udp", tt.host); err == nil {
+			if got, want := clientKeyForHost(tt.host), clientKey(addr); got != want {
+				t.Errorf("clientKeyForHost(%q) = %q, clientKey() = %q", tt.host, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Webhook event types
+const (
+	WebhookEventAuthFailures = "auth_failures" // Repeated auth failures from one source IP
+	WebhookEventRateLimited  = "rate_limited"  // A source was rate limited
+	WebhookEventIPDenied     = "ip_denied"     // A source matched the IP denylist
+)
+
+const (
+	webhookQueueSize     = 256
+	webhookMaxBatchSize  = 50
+	webhookBatchInterval = 5 * time.Second
+	webhookTimeout       = 5 * time.Second
+
+	// Retries of failed deliveries back off exponentially from the base delay up to the max delay
+	webhookRetryBaseDelay = time.Second
+	webhookRetryMaxDelay  = 30 * time.Second
+)
+
+// webhookStatusError is a webhook response with a non-2xx status
+type webhookStatusError struct {
+	status int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("unexpected webhook response status %d", e.status)
+}
+
+// WebhookEvent is a single notable security event delivered to the webhook
+type WebhookEvent struct {
+	Type      string    `json:"type"`
+	SourceIP  string    `json:"source_ip"`
+	Realm     string    `json:"realm"`
+	Count     int       `json:"count,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookPayload is the JSON body POSTed to the webhook URL
+type webhookPayload struct {
+	Service string         `json:"service"`
+	Events  []WebhookEvent `json:"events"`
+}
+
+// authFailureWindow counts auth failures from a single source IP within a window
+type authFailureWindow struct {
+	count       int
+	windowStart time.Time
+}
+
+// WebhookNotifier delivers security events to a webhook asynchronously.
+// Events are queued on a buffered channel and dropped when the queue is full,
+// so notifying never blocks the auth path.
+type WebhookNotifier struct {
+	url      string
+	client   *http.Client
+	queue    chan WebhookEvent
+	debounce time.Duration
+
+	// Delivery attempts per batch, failed attempts are retried with backoff
+	maxAttempts int
+
+	// Auth failure detection
+	threshold int
+	window    time.Duration
+
+	mu           sync.Mutex
+	failures     map[string]*authFailureWindow // clientKey of the source -> failures in the current window
+	lastNotified map[string]time.Time          // event type + clientKey of the source -> last notification
+}
+
+var (
+	// Global webhook notifier instance, nil when webhooks are disabled
+	Webhooks *WebhookNotifier
+)
+
+// InitWebhooks creates the global webhook notifier and starts its sender
+func InitWebhooks(config *Config) {
+	Webhooks = &WebhookNotifier{
+		url:          config.WebhookURL,
+		client:       &http.Client{Timeout: webhookTimeout},
+		queue:        make(chan WebhookEvent, webhookQueueSize),
+		debounce:     time.Duration(config.WebhookDebounce) * time.Second,
+		maxAttempts:  config.WebhookMaxAttempts,
+		threshold:    config.WebhookAuthFailureThreshold,
+		window:       time.Duration(config.WebhookAuthFailureWindow) * time.Second,
+		failures:     make(map[string]*authFailureWindow),
+		lastNotified: make(map[string]time.Time),
+	}
+
+	go Webhooks.run()
+
+	log.Info().
+		Int("auth_failure_threshold", config.WebhookAuthFailureThreshold).
+		Int("auth_failure_window", config.WebhookAuthFailureWindow).
+		Int("max_attempts", config.WebhookMaxAttempts).
+		Msg("Webhook notifications enabled")
+}
+
+// NotifyAuthFailure records an auth failure from the source IP and notifies the
+// webhook once the source reaches the failure threshold within the window.
+// Failures from IPv6 sources are counted per /64, see clientKey.
+func NotifyAuthFailure(sourceIP, realm, reason string) {
+	if Webhooks == nil {
+		return
+	}
+
+	key := clientKeyForHost(sourceIP)
+	Webhooks.mu.Lock()
+	now := time.Now()
+	entry, ok := Webhooks.failures[key]
+	if !ok || now.Sub(entry.windowStart) > Webhooks.window {
+		entry = &authFailureWindow{windowStart: now}
+		Webhooks.failures[key] = entry
+	}
+	entry.count++
+	count := entry.count
+	if count >= Webhooks.threshold {
+		delete(Webhooks.failures, key)
+	}
+	Webhooks.mu.Unlock()
+
+	if count >= Webhooks.threshold {
+		NotifyWebhook(WebhookEvent{
+			Type:     WebhookEventAuthFailures,
+			SourceIP: sourceIP,
+			Realm:    realm,
+			Count:    count,
+			Reason:   reason,
+		})
+	}
+}
+
+// NotifyWebhook queues an event for delivery.
+// Repeated events of the same type from the same source are debounced,
+// and events are dropped when the queue is full.
+func NotifyWebhook(event WebhookEvent) {
+	if Webhooks == nil {
+		return
+	}
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	key := event.Type + "|" + clientKeyForHost(event.SourceIP)
+	Webhooks.mu.Lock()
+	if last, ok := Webhooks.lastNotified[key]; ok && event.Timestamp.Sub(last) < Webhooks.debounce {
+		Webhooks.mu.Unlock()
+		return
+	}
+	Webhooks.lastNotified[key] = event.Timestamp
+	Webhooks.mu.Unlock()
+
+	select {
+	case Webhooks.queue <- event:
+	default:
+		RecordWebhookDropped(event.Type)
+		log.Warn().Str("type", event.Type).Str("source_ip", event.SourceIP).Msg("Webhook queue full, dropping event")
+	}
+}
+
+// run batches queued events and delivers them until the process exits
+func (n *WebhookNotifier) run() {
+	ticker := time.NewTicker(webhookBatchInterval)
+	defer ticker.Stop()
+
+	batch := make([]WebhookEvent, 0, webhookMaxBatchSize)
+	for {
+		select {
+		case event := <-n.queue:
+			batch = append(batch, event)
+			if len(batch) < webhookMaxBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			n.prune()
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		n.deliver(batch)
+		batch = batch[:0]
+	}
+}
+
+// deliver POSTs a batch of events to the webhook URL.
+// Network errors, 5xx and 429 responses are retried with exponential backoff and
+// jitter until maxAttempts is reached, other responses fail the batch right away.
+// Events queued meanwhile wait for the next batch, or are dropped once the queue fills.
+func (n *WebhookNotifier) deliver(events []WebhookEvent) {
+	body, err := json.Marshal(webhookPayload{Service: "saturn-turn-server", Events: events})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode webhook payload")
+		RecordWebhookDelivery("failure")
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := n.post(body)
+		if err == nil {
+			RecordWebhookDelivery("success")
+			log.Debug().Int("events", len(events)).Int("attempt", attempt).Msg("Webhook delivered")
+			return
+		}
+
+		if attempt >= n.maxAttempts || !retryableWebhookError(err) {
+			log.Error().Err(err).Int("events", len(events)).Int("attempts", attempt).Msg("Failed to deliver webhook")
+			RecordWebhookDelivery("failure")
+			return
+		}
+
+		delay := webhookRetryDelay(attempt)
+		log.Warn().Err(err).Int("events", len(events)).Int("attempt", attempt).Dur("retry_in", delay).Msg("Webhook delivery failed, retrying")
+		RecordWebhookDelivery("retry")
+		time.Sleep(delay)
+	}
+}
+
+// post sends the payload and treats any non-2xx response as an error
+func (n *WebhookNotifier) post(body []byte) error {
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &webhookStatusError{status: resp.StatusCode}
+	}
+	return nil
+}
+
+// retryableWebhookError reports whether a failed delivery may succeed when retried,
+// i.e. it failed on the network or the webhook is overloaded or briefly down
+func retryableWebhookError(err error) bool {
+	var statusErr *webhookStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return statusErr.status >= 500 || statusErr.status == http.StatusTooManyRequests
+}
+
+// webhookRetryDelay returns how long to wait before retrying after the given failed
+// attempt, doubling per attempt with jitter so senders do not retry in lockstep
+func webhookRetryDelay(attempt int) time.Duration {
+	delay := webhookRetryMaxDelay
+	if attempt < 16 {
+		delay = min(webhookRetryBaseDelay<<(attempt-1), webhookRetryMaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// prune forgets expired failure windows and debounce entries so the maps stay bounded
+func (n *WebhookNotifier) prune() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	for ip, entry := range n.failures {
+		if now.Sub(entry.windowStart) > n.window {
+			delete(n.failures, ip)
+		}
+	}
+	for key, last := range n.lastNotified {
+		if now.Sub(last) > n.debounce {
+			delete(n.lastNotified, key)
+		}
+	}
+}
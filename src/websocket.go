@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// webSocketHandshakeTimeout bounds how long a client may take to send the upgrade request
+	webSocketHandshakeTimeout = 10 * time.Second
+	// webSocketIdleTimeout closes sessions that sent nothing for longer than the
+	// longest allocation lifetime, like dtlsIdleTimeout
+	webSocketIdleTimeout = maxPionAllocationLifetime
+	// webSocketMaxMessageSize fits the largest UDP payload, larger messages close the session
+	webSocketMaxMessageSize = dtlsBufferSize
+)
+
+// WebSocketPacketConn terminates TURN over WebSocket and presents the messages of
+// every session as a single net.PacketConn, like DTLSPacketConn does for DTLS.
+// Each binary WebSocket message carries one STUN message or ChannelData packet, so
+// browsers behind proxies that only let HTTP(S) through can reach the server.
+type WebSocketPacketConn struct {
+	listener net.Listener
+	server   *http.Server
+	packets  chan routedPacket
+	closed   chan struct{}
+	once     sync.Once
+
+	mu       sync.Mutex
+	sessions map[string]*websocket.Conn // Sessions by client address
+}
+
+// WebSocketTLSConfig loads the certificate of the WebSocket listeners, or returns nil
+// when they serve plain WebSocket behind a proxy terminating TLS
+func WebSocketTLSConfig(config *Config) (*tls.Config, error) {
+	if config.WebSocketCert == "" {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(config.WebSocketCert, config.WebSocketKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load WebSocket certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ListenWebSocket listens for WebSocket sessions upgraded on path at addr, over TLS
+// when tlsConfig is set. Behind a load balancer sending PROXY protocol headers, the
+// client addresses are read from them as proxyProtocol sets.
+func ListenWebSocket(addr *net.TCPAddr, path string, tlsConfig *tls.Config, proxyProtocol ProxyProtocolMode) (*WebSocketPacketConn, error) {
+	tcpListener, err := net.ListenTCP(addr.Network(), addr)
+	if err != nil {
+		return nil, err
+	}
+	var listener net.Listener = tcpListener
+	if proxyProtocol != ProxyProtocolOff {
+		// The header precedes the TLS handshake
+		listener = NewProxyProtocolListener(listener, proxyProtocol)
+	}
+
+	conn := &WebSocketPacketConn{
+		listener: listener,
+		packets:  make(chan routedPacket, dtlsQueueSize),
+		closed:   make(chan struct{}),
+		sessions: make(map[string]*websocket.Conn),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		// Any origin is accepted, clients authenticate with their access token
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   conn.serve,
+	})
+	conn.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: webSocketHandshakeTimeout,
+	}
+
+	var served net.Listener = listener
+	if tlsConfig != nil {
+		served = tls.NewListener(listener, tlsConfig)
+	}
+	go func() {
+		if err := conn.server.Serve(served); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Str("addr", listener.Addr().String()).Msg("WebSocket listener failed")
+		}
+	}()
+	return conn, nil
+}
+
+// serve queues the messages of a session until it is closed or idle
+func (w *WebSocketPacketConn) serve(session *websocket.Conn) {
+	defer session.Close()
+
+	// pion tells clients apart by their address, so it must be a *net.TCPAddr
+	// rather than the address string of the HTTP request
+	addr, err := net.ResolveTCPAddr("tcp", session.Request().RemoteAddr)
+	if err != nil {
+		log.Debug().Err(err).Str("client_addr", session.Request().RemoteAddr).Msg("Invalid WebSocket client address")
+		return
+	}
+	session.PayloadType = websocket.BinaryFrame
+	session.MaxPayloadBytes = webSocketMaxMessageSize
+
+	w.mu.Lock()
+	w.sessions[addr.String()] = session
+	sessionTransports.Store(addr.String(), TransportWebSocket)
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		if w.sessions[addr.String()] == session {
+			delete(w.sessions, addr.String())
+			sessionTransports.Delete(addr.String())
+		}
+		w.mu.Unlock()
+	}()
+
+	for {
+		_ = session.SetReadDeadline(time.Now().Add(webSocketIdleTimeout))
+		var data []byte
+		if err := websocket.Message.Receive(session, &data); err != nil {
+			return
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		select {
+		case w.packets <- routedPacket{data: data, addr: addr}:
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// ReadFrom returns the next message of any session
+func (w *WebSocketPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-w.packets:
+		return copy(p, packet.data), packet.addr, nil
+	case <-w.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteTo sends a packet as one binary message to the session of addr
+func (w *WebSocketPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	w.mu.Lock()
+	session, ok := w.sessions[addr.String()]
+	w.mu.Unlock()
+	if !ok {
+		return 0, errors.New("no WebSocket session with " + addr.String())
+	}
+	if err := websocket.Message.Send(session, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the listener and every session
+func (w *WebSocketPacketConn) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.closed)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = w.server.Shutdown(ctx)
+
+		// Upgraded sessions are hijacked, so the HTTP server does not close them
+		w.mu.Lock()
+		for _, session := range w.sessions {
+			_ = session.Close()
+		}
+		w.mu.Unlock()
+	})
+	return err
+}
+
+// LocalAddr returns the address the listener is bound on
+func (w *WebSocketPacketConn) LocalAddr() net.Addr {
+	return w.listener.Addr()
+}
+
+// SetDeadline is a no-op, sessions are bounded by webSocketIdleTimeout
+func (w *WebSocketPacketConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is a no-op, ReadFrom returns once the connection is closed
+func (w *WebSocketPacketConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes go to the session of their client
+func (w *WebSocketPacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}